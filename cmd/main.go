@@ -1,52 +1,255 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/yuriadams/lear/internal/delivery"
 	"github.com/yuriadams/lear/internal/repository"
 	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/service/engine"
 	"github.com/yuriadams/lear/internal/usecase"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
+const (
+	defaultBookCacheBytes = 64 << 20
+	defaultBookCacheTTL   = time.Hour
+	defaultRatePerMinute  = 6
+	defaultRateBurst      = 3
+)
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
 	}
 
-	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	// Every repository but the books one runs on Postgres, books alone may move to SQLite or memory
+	databaseURL := os.Getenv("DATABASE_URL")
+	if !repository.IsPostgresURL(databaseURL) {
+		log.Fatal("DATABASE_URL must be a PostgreSQL connection string, set BOOKS_DATABASE_URL to store books elsewhere")
+	}
+	booksURL := os.Getenv("BOOKS_DATABASE_URL")
+	if booksURL == "" {
+		booksURL = databaseURL
+	} else if repository.IsPostgresURL(booksURL) && booksURL != databaseURL {
+		log.Fatal("BOOKS_DATABASE_URL must be a sqlite:// or memory:// URL, books in PostgreSQL use DATABASE_URL")
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	analysisService := service.NewAnalysisService()
+	prompts, err := service.NewPromptLibrary(os.Getenv("PROMPTS_DIR"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	analysisService := service.NewAnalysisService(prompts)
+	resilience := engine.DefaultResilientConfig()
+	resilience.ConnectTimeout = envDuration("AI_CONNECT_TIMEOUT", resilience.ConnectTimeout)
+	resilience.FirstTokenTimeout = envDuration("AI_FIRST_TOKEN_TIMEOUT", resilience.FirstTokenTimeout)
+	resilience.IdleTimeout = envDuration("AI_IDLE_TIMEOUT", resilience.IdleTimeout)
+	resilience.MaxRetries = envInt("AI_MAX_RETRIES", resilience.MaxRetries)
+	resilience.BreakerThreshold = envInt("AI_BREAKER_THRESHOLD", resilience.BreakerThreshold)
+	resilience.BreakerOpenDuration = envDuration("AI_BREAKER_OPEN", resilience.BreakerOpenDuration)
+	fallbacks, err := engine.ParseEngineSpecs(os.Getenv("AI_FALLBACK_ENGINES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	members := []engine.Member{{Name: "sambanova", Engine: engine.NewResilientEngine("sambanova", analysisService.AiEngine, resilience)}}
+	for _, spec := range fallbacks {
+		token := os.Getenv("AI_API_TOKEN_" + strings.ToUpper(strings.ReplaceAll(spec.Name, "-", "_")))
+		client := engine.NewChatClient(spec.URL, token, spec.Model)
+		members = append(members, engine.Member{Name: spec.Name, Engine: engine.NewResilientEngine(spec.Name, client, resilience)})
+	}
+	aiEngine := engine.NewFallbackEngine(members...)
+	analysisService.AiEngine = aiEngine
+	prices, err := service.ParsePricing(os.Getenv("MODEL_PRICES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	analysisService.Pricing = service.DefaultPricing.With(prices)
+	analysisService.MaxPromptTokens = envInt("MAX_PROMPT_TOKENS", service.DefaultMaxPromptTokens)
 	scraperMetadata := service.NewScraperMetadata()
 
-	bookRepo := repository.NewBookRepository(db)
-	bookUsecase := usecase.NewBookUsecase(bookRepo, scraperMetadata)
-	bookHandler := delivery.NewBookHandler(
-		bookUsecase,
-		analysisService,
-		template.Must(template.ParseFiles(
-			"web/templates/layout.html",
-			"web/templates/index.html",
-			"web/templates/show.html",
-		)))
+	var embedder engine.Embedder = engine.NewSambaNovaEmbedder()
+	if os.Getenv("EMBEDDER") == "local" {
+		embedder = engine.NewHashEmbedder(512)
+	}
+
+	bookRepo, err := repository.OpenBookRepository(booksURL, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !repository.IsPostgresURL(booksURL) {
+		if err := repository.DetachBookReferences(db); err != nil {
+			log.Fatal(err)
+		}
+	}
 
+	blobs, err := repository.OpenBlobStore(booksURL, os.Getenv("BLOB_DIR"), db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var bookCache *repository.CachedBookRepository
+	if cacheBytes := envInt("BOOK_CACHE_BYTES", defaultBookCacheBytes); cacheBytes > 0 {
+		bookCache = repository.NewCachedBookRepository(bookRepo, int64(cacheBytes), envDuration("BOOK_CACHE_TTL", defaultBookCacheTTL))
+		bookRepo = bookCache
+	}
+
+	chatRepo := repository.NewChatRepository(db)
+	passageRepo := repository.NewPassageRepository(db)
+	analysisRepo := repository.NewAnalysisRepository(db)
+	characterGraphRepo := repository.NewCharacterGraphRepository(db)
+	sentimentRepo := repository.NewSentimentRepository(db)
+	jobRepo := repository.NewJobRepository(db)
+	readingRepo := repository.NewReadingRepository(db)
+	userRepo := repository.NewUserRepository(db)
+	usageRepo := repository.NewUsageRepository(db)
+	bookUsecase := usecase.NewBookUsecase(bookRepo, blobs, scraperMetadata)
+	passageUsecase := usecase.NewPassageUsecase(passageRepo, embedder)
+	chatUsecase := usecase.NewChatUsecase(chatRepo, analysisService, passageUsecase)
+	analysisUsecase := usecase.NewAnalysisUsecase(analysisRepo, analysisService)
+	textStatsUsecase := usecase.NewTextStatsUsecase(service.NewTextStatsService(), bookUsecase)
+	characterGraphUsecase := usecase.NewCharacterGraphUsecase(characterGraphRepo, service.NewCharacterGraphService(), analysisService)
+	sentimentUsecase := usecase.NewSentimentUsecase(sentimentRepo, service.NewSentimentService(), analysisService)
+	compareUsecase := usecase.NewCompareUsecase(textStatsUsecase, analysisRepo, analysisService)
+	diffUsecase := usecase.NewDiffUsecase(service.NewDiffService())
+	readingUsecase := usecase.NewReadingUsecase(readingRepo, bookUsecase)
+	authUsecase := usecase.NewAuthUsecase(userRepo)
+	quotaUsecase := usecase.NewQuotaUsecase(usageRepo,
+		int64(envInt("ANALYSIS_USER_DAILY_TOKENS", usecase.DefaultUserQuotaTokens)),
+		int64(envInt("ANALYSIS_IP_DAILY_TOKENS", usecase.DefaultIPQuotaTokens)),
+		usecase.DefaultQuotaWindow)
+	analysisService.Usage = quotaUsecase
+
+	jobUsecase := usecase.NewJobUsecase(jobRepo, bookUsecase, analysisUsecase, envInt("JOB_WORKERS", usecase.DefaultJobWorkers))
+	go jobUsecase.Start(context.Background())
+
+	templates := template.Must(template.ParseFiles(
+		"web/templates/layout.html",
+		"web/templates/index.html",
+		"web/templates/show.html",
+		"web/templates/compare.html",
+		"web/templates/diff.html",
+		"web/templates/read.html",
+		"web/templates/login.html",
+		"web/templates/usage.html",
+		"web/templates/costs.html",
+	))
+
+	limiter := service.NewRateLimiter(envInt("ANALYSIS_RATE_PER_MINUTE", defaultRatePerMinute), envInt("ANALYSIS_RATE_BURST", defaultRateBurst))
+	quotaHandler := delivery.NewQuotaHandler(quotaUsecase, limiter, envList("ADMIN_USERS"), templates)
+	chatHandler := delivery.NewChatHandler(bookUsecase, chatUsecase, passageUsecase, quotaHandler)
+
+	bookHandler := delivery.NewBookHandler(bookUsecase, analysisUsecase, textStatsUsecase, quotaHandler, templates)
+	graphHandler := delivery.NewGraphHandler(bookUsecase, characterGraphUsecase, quotaHandler)
+	sentimentHandler := delivery.NewSentimentHandler(bookUsecase, sentimentUsecase, quotaHandler)
+	compareHandler := delivery.NewCompareHandler(bookUsecase, compareUsecase, quotaHandler, templates)
+	diffHandler := delivery.NewDiffHandler(bookUsecase, diffUsecase, templates)
+	jobHandler := delivery.NewJobHandler(jobUsecase, analysisUsecase, quotaHandler)
+	readerHandler := delivery.NewReaderHandler(bookUsecase, readingUsecase, templates)
+	authHandler := delivery.NewAuthHandler(authUsecase, templates)
+	healthHandler := delivery.NewHealthHandler(aiEngine.Reporters()...)
+
+	// Routes that call the paid AI engine need a signed in user within the rate limit and quota. The analysis,
+	// comparison, sentiment, character and job routes check it themselves for the requests that do, so that
+	// resuming a stream is free, and analysis sessions for each command.
 	router := mux.NewRouter()
+	router.Use(authHandler.Middleware)
+	router.HandleFunc("/health", healthHandler.Health).Methods("GET")
+	router.HandleFunc("/health/engine", healthHandler.Engine).Methods("GET")
+	router.HandleFunc("/login", authHandler.LoginPage).Methods("GET")
+	router.HandleFunc("/login", authHandler.Login).Methods("POST")
+	router.HandleFunc("/register", authHandler.Register).Methods("POST")
+	router.HandleFunc("/logout", authHandler.Logout).Methods("POST")
+	router.HandleFunc("/me", authHandler.Me).Methods("GET")
+	router.HandleFunc("/tokens", authHandler.Tokens).Methods("GET")
+	router.HandleFunc("/tokens", authHandler.CreateToken).Methods("POST")
+	router.HandleFunc("/tokens/{id:[0-9]+}", authHandler.RevokeToken).Methods("DELETE")
 	router.HandleFunc("/", bookHandler.Index).Methods("GET")
 	router.HandleFunc("/books/{id:[0-9]+}", bookHandler.Show).Methods("GET")
-	router.HandleFunc("/books/{id:[0-9]+}/analyze", bookHandler.StreamAnalysis).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/content", bookHandler.Content).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/read", readerHandler.Read).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/pages", readerHandler.Pages).Methods("GET")
+	router.HandleFunc("/reading", readerHandler.Recent).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/analyze", delivery.RequireUser(bookHandler.StreamAnalysis)).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/analyses", bookHandler.Analyses).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/stats", bookHandler.TextStats).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/characters", graphHandler.Characters).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/sentiment", sentimentHandler.Arc).Methods("GET")
+	router.HandleFunc("/analysis-kinds", bookHandler.AnalysisKinds).Methods("GET")
+	router.HandleFunc("/compare", compareHandler.Show).Methods("GET")
+	router.HandleFunc("/compare/analyze", delivery.RequireUser(compareHandler.StreamAnalysis)).Methods("GET")
+	router.HandleFunc("/diff", diffHandler.Show).Methods("GET")
+	router.HandleFunc("/jobs", jobHandler.Enqueue).Methods("POST")
+	router.HandleFunc("/jobs/{id:[0-9]+}", jobHandler.Show).Methods("GET")
+	router.HandleFunc("/jobs/{id:[0-9]+}", jobHandler.Cancel).Methods("DELETE")
+	if bookCache != nil {
+		router.HandleFunc("/cache/stats", delivery.NewCacheHandler(bookCache).Stats).Methods("GET")
+	}
+	router.HandleFunc("/books/{id:[0-9]+}/ws", delivery.RequireUser(bookHandler.AnalysisSocket)).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/chat", chatHandler.History).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/chat", delivery.RequireUser(quotaHandler.Limit(chatHandler.Ask))).Methods("POST")
+	router.HandleFunc("/books/{id:[0-9]+}/chat", chatHandler.Clear).Methods("DELETE")
+	router.HandleFunc("/books/{id:[0-9]+}/chat/{stream:[0-9a-f]+}", chatHandler.Answer).Methods("GET")
+	router.HandleFunc("/books/{id:[0-9]+}/passages", delivery.RequireUser(chatHandler.SearchPassages)).Methods("GET")
+	router.HandleFunc("/admin/usage", quotaHandler.Usage).Methods("GET")
+	router.HandleFunc("/admin/costs", quotaHandler.Costs).Methods("GET")
 
 	log.Printf("Server running on :%s", port)
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
+
+// envInt reads an integer environment variable, or returns the default when it is unset
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
+// envDuration reads a Go duration environment variable, or returns the default when it is unset
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// envList reads a comma separated environment variable, skipping empty items
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,10 @@
+CREATE TABLE chat_messages (
+  id SERIAL PRIMARY KEY,
+  user_id TEXT NOT NULL,
+  gutenberg_id INT NOT NULL REFERENCES books (gutenberg_id) ON DELETE CASCADE,
+  role TEXT NOT NULL,
+  content TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX chat_messages_user_book_idx ON chat_messages (user_id, gutenberg_id, id);
@@ -0,0 +1,2 @@
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS citations;
+DROP TABLE IF EXISTS passages;
\ No newline at end of file
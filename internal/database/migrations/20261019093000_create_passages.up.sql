@@ -0,0 +1,14 @@
+CREATE TABLE passages (
+  id SERIAL PRIMARY KEY,
+  gutenberg_id INT NOT NULL REFERENCES books (gutenberg_id) ON DELETE CASCADE,
+  model TEXT NOT NULL,
+  start_offset INT NOT NULL,
+  end_offset INT NOT NULL,
+  content TEXT NOT NULL,
+  embedding REAL[] NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX passages_book_model_idx ON passages (gutenberg_id, model, start_offset);
+
+ALTER TABLE chat_messages ADD COLUMN citations jsonb;
@@ -0,0 +1,2 @@
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS prompt_version;
+DROP TABLE IF EXISTS analyses;
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE analyses (
+  id SERIAL PRIMARY KEY,
+  gutenberg_id INT NOT NULL REFERENCES books (gutenberg_id) ON DELETE CASCADE,
+  kind TEXT NOT NULL,
+  prompt_version TEXT NOT NULL,
+  content TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX analyses_book_kind_idx ON analyses (gutenberg_id, kind, created_at);
+
+ALTER TABLE chat_messages ADD COLUMN prompt_version TEXT;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS character_graphs;
\ No newline at end of file
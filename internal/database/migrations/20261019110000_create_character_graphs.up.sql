@@ -0,0 +1,8 @@
+CREATE TABLE character_graphs (
+  gutenberg_id INT PRIMARY KEY REFERENCES books (gutenberg_id) ON DELETE CASCADE,
+  method TEXT NOT NULL,
+  directed BOOLEAN NOT NULL,
+  nodes JSONB NOT NULL,
+  edges JSONB NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS sentiment_arcs;
\ No newline at end of file
@@ -0,0 +1,8 @@
+CREATE TABLE sentiment_arcs (
+  gutenberg_id INT NOT NULL REFERENCES books (gutenberg_id) ON DELETE CASCADE,
+  method TEXT NOT NULL,
+  segments INT NOT NULL,
+  points JSONB NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (gutenberg_id, method, segments)
+);
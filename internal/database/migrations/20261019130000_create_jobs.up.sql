@@ -0,0 +1,20 @@
+CREATE TABLE jobs (
+  id SERIAL PRIMARY KEY,
+  kind TEXT NOT NULL,
+  gutenberg_id INT NOT NULL,
+  analysis_kind TEXT NOT NULL DEFAULT '',
+  prompt_version TEXT NOT NULL DEFAULT '',
+  status TEXT NOT NULL DEFAULT 'queued',
+  progress INT NOT NULL DEFAULT 0,
+  message TEXT NOT NULL DEFAULT '',
+  attempts INT NOT NULL DEFAULT 0,
+  max_attempts INT NOT NULL,
+  last_error TEXT NOT NULL DEFAULT '',
+  run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  finished_at TIMESTAMP
+);
+
+CREATE INDEX jobs_queued_idx ON jobs (run_at, id) WHERE status = 'queued';
+CREATE INDEX jobs_running_idx ON jobs (updated_at) WHERE status = 'running';
@@ -0,0 +1,7 @@
+-- Books whose body lives in a blob cannot be kept without it, they are fetched again on the next visit
+DELETE FROM books WHERE content IS NULL;
+ALTER TABLE books ALTER COLUMN content SET NOT NULL;
+ALTER TABLE books DROP COLUMN IF EXISTS content_hash;
+
+SELECT lo_unlink(oid) FROM blobs;
+DROP TABLE IF EXISTS blobs;
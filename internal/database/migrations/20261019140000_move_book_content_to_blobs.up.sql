@@ -0,0 +1,9 @@
+CREATE TABLE blobs (
+  hash TEXT PRIMARY KEY,
+  oid OID NOT NULL,
+  size BIGINT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE books ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE books ALTER COLUMN content DROP NOT NULL;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS reading_positions;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE reading_positions (
+  user_id TEXT NOT NULL,
+  gutenberg_id INT NOT NULL REFERENCES books (gutenberg_id) ON DELETE CASCADE,
+  mode TEXT NOT NULL,
+  page_size INT NOT NULL,
+  "offset" INT NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, gutenberg_id)
+);
+
+CREATE INDEX reading_positions_recent_idx ON reading_positions (user_id, updated_at DESC);
@@ -0,0 +1,5 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS user_id;
+ALTER TABLE analyses DROP COLUMN IF EXISTS user_id;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,13 @@
+CREATE TABLE usage_records (
+  id SERIAL PRIMARY KEY,
+  user_id INT REFERENCES users (id) ON DELETE SET NULL,
+  ip TEXT NOT NULL DEFAULT '',
+  prompt TEXT NOT NULL,
+  prompt_tokens INT NOT NULL,
+  completion_tokens INT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX usage_records_user_idx ON usage_records (user_id, created_at);
+CREATE INDEX usage_records_ip_idx ON usage_records (ip, created_at);
+CREATE INDEX usage_records_created_idx ON usage_records (created_at);
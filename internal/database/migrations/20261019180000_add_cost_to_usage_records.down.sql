@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS usage_records_book_idx;
+ALTER TABLE usage_records DROP COLUMN IF EXISTS cost;
+ALTER TABLE usage_records DROP COLUMN IF EXISTS latency_ms;
+ALTER TABLE usage_records DROP COLUMN IF EXISTS estimated;
+ALTER TABLE usage_records DROP COLUMN IF EXISTS model;
+ALTER TABLE usage_records DROP COLUMN IF EXISTS gutenberg_id;
@@ -0,0 +1,8 @@
+-- Records made before the engine reported usage were estimated and not priced
+ALTER TABLE usage_records ADD COLUMN gutenberg_id INT;
+ALTER TABLE usage_records ADD COLUMN model TEXT NOT NULL DEFAULT '';
+ALTER TABLE usage_records ADD COLUMN estimated BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE usage_records ADD COLUMN latency_ms INT NOT NULL DEFAULT 0;
+ALTER TABLE usage_records ADD COLUMN cost NUMERIC(12, 6) NOT NULL DEFAULT 0;
+
+CREATE INDEX usage_records_book_idx ON usage_records (gutenberg_id, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE analyses DROP COLUMN IF EXISTS model;
+ALTER TABLE analyses DROP COLUMN IF EXISTS engine;
@@ -0,0 +1,3 @@
+-- Analyses made before the fallback chain were all served by SambaNova, with an unrecorded model
+ALTER TABLE analyses ADD COLUMN engine TEXT NOT NULL DEFAULT '';
+ALTER TABLE analyses ADD COLUMN model TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,329 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+const sessionCookie = "lear_session"
+
+type userContextKey struct{}
+
+type AuthHandler struct {
+	Auth      usecase.IAuthUsecase
+	Templates *template.Template
+	Logger    *service.Logger
+}
+
+type credentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type tokenRequest struct {
+	Name string `json:"name"`
+}
+
+func NewAuthHandler(auth usecase.IAuthUsecase, tmpl *template.Template) *AuthHandler {
+	logger := service.NewLogger("[AuthHandler]")
+	return &AuthHandler{Auth: auth, Templates: tmpl, Logger: logger}
+}
+
+// Middleware identifies the user of each request from an Authorization: Bearer API token or the session cookie,
+// and sets them with the client address as the caller of the analyses it runs. A request with an unknown token
+// is refused, one with an unknown session goes on anonymously.
+func (h *AuthHandler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *domain.User
+		var err error
+
+		if token, ok := bearerToken(r); ok {
+			user, err = h.Auth.TokenUser(token)
+			if err == nil && user == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Invalid API token", http.StatusUnauthorized)
+				return
+			}
+		} else if cookie, cookieErr := r.Cookie(sessionCookie); cookieErr == nil {
+			user, err = h.Auth.SessionUser(cookie.Value)
+		}
+
+		if err != nil {
+			h.Logger.LogError("Failed to authenticate request", err)
+			http.Error(w, "Failed to authenticate request", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := r.Context()
+		if user != nil {
+			ctx = context.WithValue(ctx, userContextKey{}, user)
+		}
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(w, r.WithContext(service.WithCaller(ctx, requestCaller(r))))
+	})
+}
+
+// RequireUser refuses anonymous requests to the handler
+func RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireUser(w, r); ok {
+			next(w, r)
+		}
+	}
+}
+
+// CurrentUser returns the signed in user of the request, or nil
+func CurrentUser(r *http.Request) *domain.User {
+	user, _ := r.Context().Value(userContextKey{}).(*domain.User)
+	return user
+}
+
+// currentUserID returns the ID of the signed in user, or 0 for anonymous requests
+func currentUserID(r *http.Request) int {
+	if user := CurrentUser(r); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+func requireUser(w http.ResponseWriter, r *http.Request) (*domain.User, bool) {
+	user := CurrentUser(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Sign in to use this feature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return user, true
+}
+
+// LoginPage shows the sign in and sign up forms
+func (h *AuthHandler) LoginPage(w http.ResponseWriter, r *http.Request) {
+	renderPage(w, h.Templates, "login.html", map[string]interface{}{"Next": safeRedirect(r.URL.Query().Get("next"))})
+}
+
+// Register creates an account and signs it in
+func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	credentials, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := h.Auth.Register(credentials.Username, credentials.Password)
+	switch {
+	case errors.Is(err, usecase.ErrUsernameTaken):
+		h.authError(w, r, http.StatusConflict, err)
+		return
+	case errors.Is(err, usecase.ErrInvalidUsername), errors.Is(err, usecase.ErrInvalidPassword):
+		h.authError(w, r, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		h.Logger.LogError("Failed to register user", err)
+		http.Error(w, "Failed to register user", http.StatusInternalServerError)
+		return
+	}
+
+	h.login(w, r, credentials, http.StatusCreated)
+}
+
+// Login opens a session in a cookie. Forms are redirected to the next page, JSON requests get the user back.
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	credentials, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	h.login(w, r, credentials, http.StatusOK)
+}
+
+// Logout ends the session of the cookie
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := h.Auth.Logout(cookie.Value); err != nil {
+			h.Logger.LogError("Failed to end session", err)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	if isJSONRequest(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Me returns the signed in user
+func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// CreateToken issues an API token for the signed in user, the response is the only time the secret is shown
+func (h *AuthHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req tokenRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, secret, err := h.Auth.CreateToken(user.ID, req.Name)
+	if err != nil {
+		http.Error(w, "Failed to create API token", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":         token.ID,
+		"name":       token.Name,
+		"created_at": token.CreatedAt,
+		"token":      secret,
+	})
+}
+
+// Tokens lists the API tokens of the signed in user, without their secrets
+func (h *AuthHandler) Tokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := h.Auth.Tokens(user.ID)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch API tokens", err)
+		http.Error(w, "Failed to fetch API tokens", http.StatusInternalServerError)
+		return
+	}
+
+	if tokens == nil {
+		tokens = []domain.APIToken{}
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// RevokeToken deletes one of the signed in user's API tokens
+func (h *AuthHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := h.Auth.RevokeToken(user.ID, id)
+	if err != nil {
+		h.Logger.LogError("Failed to revoke API token", err)
+		http.Error(w, "Failed to revoke API token", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) login(w http.ResponseWriter, r *http.Request, credentials credentialsRequest, status int) {
+	user, session, err := h.Auth.Login(credentials.Username, credentials.Password)
+	if errors.Is(err, usecase.ErrInvalidCredentials) {
+		h.authError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		h.Logger.LogError("Failed to sign in", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	// SameSite keeps other sites from posting to the application with the cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session,
+		Path:     "/",
+		Expires:  time.Now().Add(usecase.SessionTTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if isJSONRequest(r) {
+		writeJSON(w, status, user)
+		return
+	}
+	http.Redirect(w, r, safeRedirect(r.FormValue("next")), http.StatusSeeOther)
+}
+
+// authError answers JSON requests with the error, and forms with the login page showing it
+func (h *AuthHandler) authError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if isJSONRequest(r) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.WriteHeader(status)
+	renderPage(w, h.Templates, "login.html", map[string]interface{}{
+		"Next":     safeRedirect(r.FormValue("next")),
+		"Error":    err.Error(),
+		"Username": r.FormValue("username"),
+	})
+}
+
+func readCredentials(w http.ResponseWriter, r *http.Request) (credentialsRequest, bool) {
+	var credentials credentialsRequest
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return credentials, false
+		}
+		return credentials, true
+	}
+
+	credentials.Username = r.FormValue("username")
+	credentials.Password = r.FormValue("password")
+	return credentials, true
+}
+
+func isJSONRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[len("Bearer "):]), true
+}
+
+// safeRedirect keeps redirects after signing in on this site
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
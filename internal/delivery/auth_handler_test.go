@@ -0,0 +1,252 @@
+package delivery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+const testAPIToken = "lear_test"
+
+var testUser = &domain.User{ID: 42, Username: "goneril"}
+
+type MockAuthUsecase struct {
+	mock.Mock
+}
+
+func (m *MockAuthUsecase) Register(username string, password string) (*domain.User, error) {
+	args := m.Called(username, password)
+	user, _ := args.Get(0).(*domain.User)
+	return user, args.Error(1)
+}
+
+func (m *MockAuthUsecase) Login(username string, password string) (*domain.User, string, error) {
+	args := m.Called(username, password)
+	user, _ := args.Get(0).(*domain.User)
+	return user, args.String(1), args.Error(2)
+}
+
+func (m *MockAuthUsecase) Logout(session string) error {
+	args := m.Called(session)
+	return args.Error(0)
+}
+
+func (m *MockAuthUsecase) SessionUser(session string) (*domain.User, error) {
+	args := m.Called(session)
+	user, _ := args.Get(0).(*domain.User)
+	return user, args.Error(1)
+}
+
+func (m *MockAuthUsecase) TokenUser(token string) (*domain.User, error) {
+	args := m.Called(token)
+	user, _ := args.Get(0).(*domain.User)
+	return user, args.Error(1)
+}
+
+func (m *MockAuthUsecase) CreateToken(userID int, name string) (*domain.APIToken, string, error) {
+	args := m.Called(userID, name)
+	token, _ := args.Get(0).(*domain.APIToken)
+	return token, args.String(1), args.Error(2)
+}
+
+func (m *MockAuthUsecase) Tokens(userID int) ([]domain.APIToken, error) {
+	args := m.Called(userID)
+	tokens, _ := args.Get(0).([]domain.APIToken)
+	return tokens, args.Error(1)
+}
+
+func (m *MockAuthUsecase) RevokeToken(userID int, id int) (bool, error) {
+	args := m.Called(userID, id)
+	return args.Bool(0), args.Error(1)
+}
+
+// signedIn serves every request as testUser, through the auth middleware
+func signedIn(handler http.Handler) http.Handler {
+	auth := new(MockAuthUsecase)
+	auth.On("TokenUser", testAPIToken).Return(testUser, nil)
+	middleware := delivery.NewAuthHandler(auth, createTestTemplates()).Middleware(handler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAPIToken)
+		middleware.ServeHTTP(w, r)
+	})
+}
+
+func TestAuthHandler(t *testing.T) {
+	auth := new(MockAuthUsecase)
+	handler := delivery.NewAuthHandler(auth, createTestTemplates())
+
+	router := mux.NewRouter()
+	router.Use(handler.Middleware)
+	router.HandleFunc("/register", handler.Register).Methods("POST")
+	router.HandleFunc("/login", handler.Login).Methods("POST")
+	router.HandleFunc("/logout", handler.Logout).Methods("POST")
+	router.HandleFunc("/me", handler.Me).Methods("GET")
+	router.HandleFunc("/tokens", handler.CreateToken).Methods("POST")
+	router.HandleFunc("/tokens/{id:[0-9]+}", handler.RevokeToken).Methods("DELETE")
+	router.HandleFunc("/paid", delivery.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(delivery.CurrentUser(r).Username))
+	})).Methods("GET")
+
+	auth.On("TokenUser", testAPIToken).Return(testUser, nil)
+	auth.On("TokenUser", "lear_revoked").Return(nil, nil)
+	auth.On("SessionUser", "session-secret").Return(testUser, nil)
+	auth.On("SessionUser", "expired").Return(nil, nil)
+
+	t.Run("Register and sign in", func(t *testing.T) {
+		auth.On("Register", "goneril", "dragon-wrath").Return(testUser, nil).Once()
+		auth.On("Login", "goneril", "dragon-wrath").Return(testUser, "session-secret", nil).Once()
+
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(`{"username":"goneril","password":"dragon-wrath"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var user domain.User
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &user))
+		assert.Equal(t, "goneril", user.Username)
+		assert.NotContains(t, rec.Body.String(), "password")
+
+		cookies := rec.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, "lear_session", cookies[0].Name)
+		assert.Equal(t, "session-secret", cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+	})
+
+	t.Run("Username taken", func(t *testing.T) {
+		auth.On("Register", "regan", "dragon-wrath").Return(nil, usecase.ErrUsernameTaken).Once()
+
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(`{"username":"regan","password":"dragon-wrath"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	})
+
+	t.Run("Form sign in redirects to the next page", func(t *testing.T) {
+		auth.On("Login", "goneril", "dragon-wrath").Return(testUser, "session-secret", nil).Once()
+
+		form := url.Values{"username": {"goneril"}, "password": {"dragon-wrath"}, "next": {"/books/1532"}}
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "/books/1532", rec.Header().Get("Location"))
+	})
+
+	t.Run("Redirects stay on the site", func(t *testing.T) {
+		auth.On("Login", "goneril", "dragon-wrath").Return(testUser, "session-secret", nil).Once()
+
+		form := url.Values{"username": {"goneril"}, "password": {"dragon-wrath"}, "next": {"//evil.example"}}
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, "/", rec.Header().Get("Location"))
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		auth.On("Login", "goneril", "wrong").Return(nil, "", usecase.ErrInvalidCredentials).Once()
+
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"username":"goneril","password":"wrong"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Empty(t, rec.Result().Cookies())
+	})
+
+	t.Run("Session cookie", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.AddCookie(&http.Cookie{Name: "lear_session", Value: "session-secret"})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"username":"goneril"`)
+	})
+
+	t.Run("Protected routes", func(t *testing.T) {
+		for name, setup := range map[string]func(*http.Request){
+			"anonymous":       func(*http.Request) {},
+			"expired session": func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "lear_session", Value: "expired"}) },
+		} {
+			req, _ := http.NewRequest("GET", "/paid", nil)
+			setup(req)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, name)
+		}
+
+		req, _ := http.NewRequest("GET", "/paid", nil)
+		req.Header.Set("Authorization", "Bearer "+testAPIToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "goneril", rec.Body.String())
+	})
+
+	t.Run("Revoked token", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer lear_revoked")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "an unknown token is refused rather than ignored")
+	})
+
+	t.Run("API tokens", func(t *testing.T) {
+		auth.On("CreateToken", 42, "backup script").Return(&domain.APIToken{ID: 3, UserID: 42, Name: "backup script"}, "lear_secret", nil).Once()
+		auth.On("RevokeToken", 42, 3).Return(true, nil).Once()
+		auth.On("RevokeToken", 42, 4).Return(false, nil).Once()
+
+		req, _ := http.NewRequest("POST", "/tokens", strings.NewReader(`{"name":"backup script"}`))
+		req.Header.Set("Authorization", "Bearer "+testAPIToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"token":"lear_secret"`)
+
+		for id, status := range map[string]int{"3": http.StatusNoContent, "4": http.StatusNotFound} {
+			req, _ := http.NewRequest("DELETE", "/tokens/"+id, nil)
+			req.Header.Set("Authorization", "Bearer "+testAPIToken)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, status, rec.Code, id)
+		}
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		auth.On("Logout", "session-secret").Return(nil).Once()
+
+		req, _ := http.NewRequest("POST", "/logout", nil)
+		req.AddCookie(&http.Cookie{Name: "lear_session", Value: "session-secret"})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, -1, rec.Result().Cookies()[0].MaxAge)
+		auth.AssertCalled(t, "Logout", "session-secret")
+	})
+}
@@ -2,16 +2,28 @@ package delivery
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
 	"github.com/yuriadams/lear/internal/service"
 	"github.com/yuriadams/lear/internal/usecase"
 )
 
+// analysisTimeout bounds a detached analysis run that keeps going while clients reconnect
+const analysisTimeout = 10 * time.Minute
+
+// detachedContext is the context of an analysis run that outlives its request, for the same caller
+func detachedContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(service.WithCaller(context.Background(), requestCaller(r)), analysisTimeout)
+}
+
 type Page struct {
 	Title string
 	Body  []byte
@@ -19,14 +31,18 @@ type Page struct {
 
 type BookHandler struct {
 	Usecase   usecase.IBookUsecase
-	Service   service.IAnalysisService
+	Analysis  usecase.IAnalysisUsecase
+	Stats     usecase.ITextStatsUsecase
+	Quota     *QuotaHandler
 	Templates *template.Template
+	Streams   *StreamHub
 	Logger    *service.Logger
 }
 
-func NewBookHandler(usecase usecase.IBookUsecase, analysis service.IAnalysisService, tmpl *template.Template) *BookHandler {
+// NewBookHandler limits new analyses and the commands of analysis sessions with quota when it is not nil
+func NewBookHandler(usecase usecase.IBookUsecase, analysis usecase.IAnalysisUsecase, stats usecase.ITextStatsUsecase, quota *QuotaHandler, tmpl *template.Template) *BookHandler {
 	logger := service.NewLogger("[BookHandler]")
-	return &BookHandler{Usecase: usecase, Service: analysis, Templates: tmpl, Logger: logger}
+	return &BookHandler{Usecase: usecase, Analysis: analysis, Stats: stats, Quota: quota, Templates: tmpl, Streams: NewStreamHub(), Logger: logger}
 }
 
 func (h *BookHandler) Index(w http.ResponseWriter, r *http.Request) {
@@ -45,7 +61,7 @@ func (h *BookHandler) Index(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	h.renderPage(w, "index.html", "", "", "", bookList)
+	renderPage(w, h.Templates, "index.html", map[string]interface{}{"Books": bookList})
 }
 
 func (h *BookHandler) Show(w http.ResponseWriter, r *http.Request) {
@@ -61,14 +77,57 @@ func (h *BookHandler) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	book, err := h.Usecase.FetchBook(id)
+	book, err := h.Usecase.FetchMetadata(id)
 	if err != nil {
 		h.Logger.LogError("Failed to fetch book", err)
 		http.Error(w, "Failed to fetch book", http.StatusNotFound)
 		return
 	}
 
-	h.renderPage(w, "show.html", book.Content, book.Metadata.Title, book.Metadata.Author, nil)
+	stats, err := h.Stats.Stats(book)
+	if err != nil {
+		h.Logger.LogError("Failed to compute book statistics", err)
+		http.Error(w, "Failed to compute book statistics", http.StatusInternalServerError)
+		return
+	}
+
+	// The text itself is streamed by Content once the page is loaded
+	renderPage(w, h.Templates, "show.html", map[string]interface{}{
+		"GutenbergID": book.GutenbergID,
+		"Title":       book.Metadata.Title,
+		"Author":      book.Metadata.Author,
+		"Kinds":       h.Analysis.Kinds(),
+		"Stats":       stats,
+		"SignedIn":    CurrentUser(r) != nil,
+	})
+}
+
+// Content streams the text of the book from storage as plain text
+func (h *BookHandler) Content(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	gutenbergID := vars["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	content, err := h.Usecase.OpenContent(id)
+	if err != nil {
+		h.Logger.LogError("Failed to open book content", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.Copy(w, content); err != nil {
+		h.Logger.LogError("Book content stream interrupted", err)
+	}
 }
 
 func (h *BookHandler) StreamAnalysis(w http.ResponseWriter, r *http.Request) {
@@ -84,6 +143,33 @@ func (h *BookHandler) StreamAnalysis(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A reconnecting EventSource resumes the run it was following instead of starting a new one
+	if stream, seq, ok := h.Streams.Resume(strconv.Itoa(id), r.Header.Get("Last-Event-ID")); ok {
+		h.Logger.LogInfo(fmt.Sprintf("Resuming analysis stream %s after event %d", stream.ID, seq))
+		h.serveStream(w, r, stream, seq)
+		return
+	}
+
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = service.DefaultAnalysisKind
+	}
+	if !service.IsAnalysisKind(kind) {
+		http.Error(w, "Invalid analysis type", http.StatusBadRequest)
+		return
+	}
+	// Checked before the stream starts, after which failures can only be reported as events
+	version := r.URL.Query().Get("version")
+	if !h.Analysis.HasPromptVersion(kind, version) {
+		http.Error(w, "Unknown prompt version", http.StatusBadRequest)
+		return
+	}
+
+	// Only a new run calls the AI engine, resuming one is free
+	if !h.Quota.Allow(w, r) {
+		return
+	}
+
 	book, err := h.Usecase.FetchBook(id)
 	if err != nil {
 		h.Logger.LogError("Failed to fetch book", err)
@@ -91,23 +177,100 @@ func (h *BookHandler) StreamAnalysis(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.Service.StreamTextAnalysis(w, r, book.Content)
+	userID := currentUserID(r)
+	stream := h.Streams.Open(strconv.Itoa(id))
+	go func() {
+		defer stream.Close()
+
+		ctx, cancel := detachedContext(r)
+		defer cancel()
+		stream.CancelWhenAbandoned(cancel)
+
+		if err := h.Analysis.Analyze(ctx, stream, userID, book, kind, version); err != nil {
+			h.Logger.LogError("Failed to stream analysis", err)
+			// Headers are already sent, so the failure is reported as an event rather than an HTTP status
+			stream.Send(service.ErrorEvent, service.AsAnalysisError(err))
+		}
+	}()
+
+	h.serveStream(w, r, stream, 0)
+}
+
+// Analyses lists the stored analyses of a book, optionally of one type, to compare results across prompt versions
+func (h *BookHandler) Analyses(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	gutenbergID := vars["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	analyses, err := h.Analysis.FetchAnalyses(id, r.URL.Query().Get("type"))
+	if err != nil {
+		h.Logger.LogError("Failed to fetch analyses", err)
+		http.Error(w, "Failed to fetch analyses", http.StatusInternalServerError)
+		return
+	}
+
+	if analyses == nil {
+		analyses = []domain.Analysis{}
+	}
+	writeJSON(w, http.StatusOK, analyses)
+}
+
+// TextStats returns the statistics of a book, computed locally without the AI engine
+func (h *BookHandler) TextStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	gutenbergID := vars["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	book, err := h.Usecase.FetchMetadata(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch book", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return
+	}
+
+	stats, err := h.Stats.Stats(book)
 	if err != nil {
-		http.Error(w, "Failed to stream analysis: "+err.Error(), http.StatusInternalServerError)
+		h.Logger.LogError("Failed to compute book statistics", err)
+		http.Error(w, "Failed to compute book statistics", http.StatusInternalServerError)
+		return
 	}
+	writeJSON(w, http.StatusOK, stats)
 }
 
-func (h *BookHandler) renderPage(w http.ResponseWriter, page, content, title, author string, books []map[string]interface{}) {
+// AnalysisKinds lists the analysis types with their output schema and the events they are streamed as
+func (h *BookHandler) AnalysisKinds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.Analysis.Kinds())
+}
+
+func (h *BookHandler) serveStream(w http.ResponseWriter, r *http.Request, stream *SSEStream, seq int) {
+	if err := h.Streams.Serve(w, r, stream, seq); err != nil {
+		h.Logger.LogError("Analysis stream interrupted", err)
+	}
+}
+
+// renderPage renders a page inside the layout
+func renderPage(w http.ResponseWriter, templates *template.Template, page string, data map[string]interface{}) {
 	var body bytes.Buffer
 
-	h.Templates.ExecuteTemplate(&body, page, map[string]interface{}{
-		"Title":   title,
-		"Author":  author,
-		"Content": content,
-		"Books":   books,
-	})
+	templates.ExecuteTemplate(&body, page, data)
 
-	h.Templates.ExecuteTemplate(w, "layout.html", map[string]interface{}{
+	templates.ExecuteTemplate(w, "layout.html", map[string]interface{}{
 		"Title": "Project King Lear Explorer",
 		"Body":  template.HTML(body.String()),
 	})
@@ -1,9 +1,14 @@
 package delivery_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"html/template"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -11,6 +16,8 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/yuriadams/lear/internal/delivery"
 	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
 )
 
 type MockBookUsecase struct {
@@ -22,20 +29,62 @@ func (m *MockBookUsecase) FetchBook(id int) (*domain.Book, error) {
 	return args.Get(0).(*domain.Book), args.Error(1)
 }
 
+func (m *MockBookUsecase) FetchMetadata(id int) (*domain.Book, error) {
+	args := m.Called(id)
+	book, _ := args.Get(0).(*domain.Book)
+	return book, args.Error(1)
+}
+
 func (m *MockBookUsecase) FetchAllBooks() ([]domain.Book, error) {
 	args := m.Called()
 	return args.Get(0).([]domain.Book), args.Error(1)
 }
 
-type MockAnalysisService struct {
+func (m *MockBookUsecase) OpenContent(id int) (io.ReadCloser, error) {
+	args := m.Called(id)
+	content, _ := args.Get(0).(string)
+	if args.Error(1) != nil {
+		return nil, args.Error(1)
+	}
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+type MockAnalysisUsecase struct {
 	mock.Mock
 }
 
-func (m *MockAnalysisService) StreamTextAnalysis(w http.ResponseWriter, r *http.Request, content string) error {
-	args := m.Called(w, r, content)
+func (m *MockAnalysisUsecase) Analyze(ctx context.Context, events service.EventSender, userID int, book *domain.Book, kind string, version string) error {
+	args := m.Called(ctx, events, userID, book, kind, version)
+	return args.Error(0)
+}
+
+func (m *MockAnalysisUsecase) AnswerQuestion(ctx context.Context, events service.EventSender, book *domain.Book, question string) error {
+	args := m.Called(ctx, events, book, question)
 	return args.Error(0)
 }
 
+func (m *MockAnalysisUsecase) FetchAnalyses(gutenbergID int, kind string) ([]domain.Analysis, error) {
+	args := m.Called(gutenbergID, kind)
+	analyses, _ := args.Get(0).([]domain.Analysis)
+	return analyses, args.Error(1)
+}
+
+// Kinds returns the real catalog so handlers validate types the way they do in production
+func (m *MockAnalysisUsecase) Kinds() []service.AnalysisKind {
+	return service.AnalysisCatalog
+}
+
+// HasPromptVersion checks the embedded prompts, like Kinds
+func (m *MockAnalysisUsecase) HasPromptVersion(kind string, version string) bool {
+	return service.DefaultPrompts().Has(kind, version)
+}
+
+// newTextStats computes real statistics of the content the books open, they need neither a database nor the
+// network
+func newTextStats(books usecase.IBookUsecase) usecase.ITextStatsUsecase {
+	return usecase.NewTextStatsUsecase(service.NewTextStatsService(), books)
+}
+
 func createTestTemplates() *template.Template {
 	tmpl, err := template.New("layout.html").Parse(`
 		<!DOCTYPE html>
@@ -67,7 +116,59 @@ func createTestTemplates() *template.Template {
 	_, err = tmpl.New("show.html").Parse(`
 		<h1>{{.Title}}</h1>
 		<p>By {{.Author}}</p>
-		<div>{{.Content}}</div>
+		<p>{{.Stats.Words}} words</p>
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tmpl.New("compare.html").Parse(`
+		{{range .Comparisons}}
+			<h2>{{.Metadata.Title}}</h2>
+			{{range .Analyses}}<p>{{.Kind}}: {{.Content}}</p>{{end}}
+		{{end}}
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tmpl.New("diff.html").Parse(`
+		{{range .Hunks}}{{range .Rows}}<p>{{with .Old}}{{.Text}}{{end}} | {{with .New}}{{.Text}}{{end}}</p>{{end}}{{end}}
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tmpl.New("login.html").Parse(`
+		{{with .Error}}<p>{{.}}</p>{{end}}
+		<form action="/login" method="post"><input type="hidden" name="next" value="{{.Next}}"></form>
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tmpl.New("read.html").Parse(`
+		<h1>{{.Title}}</h1>
+		<p>Page {{.Page.Number}} of {{.Page.Total}}</p>
+		<pre>{{.Before}}{{if .Marked}}<mark>{{.Marked}}</mark>{{end}}{{.After}}</pre>
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tmpl.New("usage.html").Parse(`
+		<h1>Usage over {{.Days}} days</h1>
+		{{range .Report.Users}}<p>{{.Username}}: {{.Tokens}}</p>{{end}}
+		{{range .Report.Addresses}}<p>{{.IP}}: {{.Tokens}}</p>{{end}}
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tmpl.New("costs.html").Parse(`
+		<h1>Costs over {{.Days}} days: {{printf "%.2f" .Report.Total.Cost}}</h1>
+		{{range .Report.Books}}<p>{{.Title}}: {{printf "%.4f" .Cost}}</p>{{end}}
+		{{range .Report.Days}}<p>{{.Day}}: {{printf "%.4f" .Cost}}</p>{{end}}
 	`)
 	if err != nil {
 		panic(err)
@@ -78,10 +179,10 @@ func createTestTemplates() *template.Template {
 
 func TestBookHandler_Index(t *testing.T) {
 	mockUsecase := new(MockBookUsecase)
-	mockService := new(MockAnalysisService)
+	mockService := new(MockAnalysisUsecase)
 	templates := createTestTemplates()
 
-	handler := delivery.NewBookHandler(mockUsecase, mockService, templates)
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), nil, templates)
 
 	t.Run("Listing books", func(t *testing.T) {
 		mockUsecase.On("FetchAllBooks").Return([]domain.Book{
@@ -115,17 +216,18 @@ func TestBookHandler_Index(t *testing.T) {
 
 func TestBookHandler_Show(t *testing.T) {
 	mockUsecase := new(MockBookUsecase)
-	mockService := new(MockAnalysisService)
+	mockService := new(MockAnalysisUsecase)
 	templates := createTestTemplates()
 
-	handler := delivery.NewBookHandler(mockUsecase, mockService, templates)
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), nil, templates)
 
 	t.Run("Valid book ID", func(t *testing.T) {
 
-		mockUsecase.On("FetchBook", 123).Return(&domain.Book{
-			Content:  "This is the content of the book.",
-			Metadata: domain.Metadata{Title: "Test Title", Author: "Test Author"},
+		mockUsecase.On("FetchMetadata", 123).Return(&domain.Book{
+			GutenbergID: 123,
+			Metadata:    domain.Metadata{Title: "Test Title", Author: "Test Author"},
 		}, nil)
+		mockUsecase.On("OpenContent", 123).Return("This is the content of the book.", nil)
 
 		req, _ := http.NewRequest("GET", "/books/123", nil)
 		rec := httptest.NewRecorder()
@@ -138,24 +240,54 @@ func TestBookHandler_Show(t *testing.T) {
 		assert.Equal(t, http.StatusOK, rec.Code)
 		assert.Contains(t, rec.Body.String(), "Test Title")
 		assert.Contains(t, rec.Body.String(), "Test Author")
-		assert.Contains(t, rec.Body.String(), "This is the content of the book.")
+		assert.NotContains(t, rec.Body.String(), "This is the content of the book.", "the text is streamed separately")
 	})
 }
 
+func TestBookHandler_Content(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	handler := delivery.NewBookHandler(mockUsecase, new(MockAnalysisUsecase), newTextStats(mockUsecase), nil, createTestTemplates())
+
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/content", handler.Content)
+
+	mockUsecase.On("OpenContent", 1532).Return("Nothing will come of nothing.", nil)
+	mockUsecase.On("OpenContent", 99).Return(nil, errors.New("book not found"))
+
+	req, _ := http.NewRequest("GET", "/books/1532/content", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "Nothing will come of nothing.", rec.Body.String())
+
+	req, _ = http.NewRequest("GET", "/books/99/content", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
 func TestBookHandler_StreamAnalysis(t *testing.T) {
 	mockUsecase := new(MockBookUsecase)
-	mockService := new(MockAnalysisService)
+	mockService := new(MockAnalysisUsecase)
 	templates := createTestTemplates()
 
-	handler := delivery.NewBookHandler(mockUsecase, mockService, templates)
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), nil, templates)
+
+	book := &domain.Book{
+		Content:  "This is the content of the book.",
+		Metadata: domain.Metadata{Title: "Test Title", Author: "Test Author"},
+	}
 
 	t.Run("Stream analysis with valid book ID", func(t *testing.T) {
-		mockUsecase.On("FetchBook", 123).Return(&domain.Book{
-			Content:  "This is the content of the book.",
-			Metadata: domain.Metadata{Title: "Test Title", Author: "Test Author"},
-		}, nil)
+		mockUsecase.On("FetchBook", 123).Return(book, nil)
 
-		mockService.On("StreamTextAnalysis", mock.Anything, mock.Anything, "This is the content of the book.").Return(nil)
+		mockService.On("Analyze", mock.Anything, mock.Anything, 0, book, "overview", "").Run(func(args mock.Arguments) {
+			events := args.Get(1).(service.EventSender)
+			events.Send("CustomEvent", service.AnalysisChunk{Analysis: `Lear said "nothing" \ twice`})
+		}).Return(nil)
 
 		req, _ := http.NewRequest("GET", "/books/123/analyze", nil)
 		rec := httptest.NewRecorder()
@@ -166,8 +298,94 @@ func TestBookHandler_StreamAnalysis(t *testing.T) {
 		router.ServeHTTP(rec, req)
 
 		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), "retry: 3000\n\n")
+		assert.Contains(t, rec.Body.String(), `data: {"analysis":"Lear said \"nothing\" \\ twice"}`)
+		assert.Contains(t, rec.Body.String(), "event: Close\n")
 		mockUsecase.AssertCalled(t, "FetchBook", 123)
-		mockService.AssertCalled(t, "StreamTextAnalysis", mock.Anything, mock.Anything, "This is the content of the book.")
+		mockService.AssertCalled(t, "Analyze", mock.Anything, mock.Anything, 0, book, "overview", "")
+	})
+
+	t.Run("Stream analysis of a given type and prompt version", func(t *testing.T) {
+		mockService.On("Analyze", mock.Anything, mock.Anything, 0, book, "themes", "v1").Return(nil)
+
+		req, _ := http.NewRequest("GET", "/books/123/analyze?type=themes&version=v1", nil)
+		rec := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/books/{id}/analyze", handler.StreamAnalysis)
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		mockService.AssertCalled(t, "Analyze", mock.Anything, mock.Anything, 0, book, "themes", "v1")
+	})
+
+	t.Run("Stream analysis with unknown type", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/123/analyze?type=horoscope", nil)
+		rec := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/books/{id}/analyze", handler.StreamAnalysis)
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Stream analysis with unknown prompt version", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/123/analyze?type=themes&version=v99", nil)
+		rec := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/books/{id}/analyze", handler.StreamAnalysis)
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.NotEqual(t, "text/event-stream", rec.Header().Get("Content-Type"), "the stream never starts")
+		mockService.AssertNotCalled(t, "Analyze", mock.Anything, mock.Anything, 0, book, "themes", "v99")
+	})
+
+	t.Run("Stream analysis reports failures as an error event", func(t *testing.T) {
+		rateLimited := &domain.Book{Content: "Rate limited book."}
+		mockUsecase.On("FetchBook", 456).Return(rateLimited, nil)
+		mockService.On("Analyze", mock.Anything, mock.Anything, 0, rateLimited, "overview", "").
+			Return(&service.AnalysisError{Code: "rate_limited", Message: "Try again shortly.", Retryable: true, Err: errors.New("status 429")})
+
+		req, _ := http.NewRequest("GET", "/books/456/analyze", nil)
+		rec := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/books/{id}/analyze", handler.StreamAnalysis)
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "event: error\ndata: {\"code\":\"rate_limited\",\"message\":\"Try again shortly.\",\"retryable\":true}\n\n")
+		assert.Contains(t, rec.Body.String(), "event: Close\n")
+	})
+
+	t.Run("Stream analysis resumes from Last-Event-ID", func(t *testing.T) {
+		stream := handler.Streams.Open("123")
+		stream.Send("CustomEvent", service.AnalysisChunk{Analysis: "first"})
+		stream.Send("CustomEvent", service.AnalysisChunk{Analysis: "second"})
+		stream.Close()
+
+		req, _ := http.NewRequest("GET", "/books/123/analyze", nil)
+		req.Header.Set("Last-Event-ID", stream.ID+"-1")
+		rec := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/books/{id}/analyze", handler.StreamAnalysis)
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "first")
+		assert.Contains(t, rec.Body.String(), "id: "+stream.ID+"-2\nevent: CustomEvent\ndata: {\"analysis\":\"second\"}\n\n")
+		assert.Contains(t, rec.Body.String(), "id: "+stream.ID+"-3\nevent: Close\n")
+		mockService.AssertNumberOfCalls(t, "Analyze", 3)
 	})
 
 	t.Run("Stream analysis with invalid book ID", func(t *testing.T) {
@@ -181,6 +399,102 @@ func TestBookHandler_StreamAnalysis(t *testing.T) {
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 		mockUsecase.AssertNotCalled(t, "FetchBook")
-		mockService.AssertNotCalled(t, "StreamTextAnalysis")
+		mockService.AssertNotCalled(t, "Analyze")
 	})
 }
+
+func TestBookHandler_StreamAnalysisResumeIsFree(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockService := new(MockAnalysisUsecase)
+	quota := new(MockQuotaUsecase)
+	quota.On("Check", mock.Anything).Return(nil)
+	limits := delivery.NewQuotaHandler(quota, service.NewRateLimiter(1, 1), nil, createTestTemplates())
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), limits, createTestTemplates())
+
+	book := &domain.Book{GutenbergID: 123, Content: "Lear divides his kingdom."}
+	mockUsecase.On("FetchBook", 123).Return(book, nil)
+	mockService.On("Kinds").Return([]service.AnalysisKind{{Name: "overview"}})
+	mockService.On("Analyze", mock.Anything, mock.Anything, 0, book, "overview", "").Return(nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/analyze", handler.StreamAnalysis)
+	getQuery := func(query string, lastEventID string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/books/123/analyze"+query, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(lastEventID string) *httptest.ResponseRecorder {
+		return getQuery("", lastEventID)
+	}
+
+	for _, query := range []string{"?type=horoscope", "?version=v99"} {
+		assert.Equal(t, http.StatusBadRequest, getQuery(query, "").Code, "an invalid request takes nothing from the rate limit")
+	}
+
+	rec := get("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	stream := handler.Streams.Open("123")
+	stream.Close()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, get(stream.ID+"-0").Code, "reconnecting takes nothing from the rate limit")
+	}
+
+	rec = get("")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	mockService.AssertNumberOfCalls(t, "Analyze", 1)
+}
+
+func TestBookHandler_Analyses(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockService := new(MockAnalysisUsecase)
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), nil, createTestTemplates())
+
+	mockService.On("FetchAnalyses", 123, "themes").Return([]domain.Analysis{
+		{GutenbergID: 123, Kind: "themes", PromptVersion: "v2", Content: "Madness."},
+		{GutenbergID: 123, Kind: "themes", PromptVersion: "v1", Content: "Blindness."},
+	}, nil)
+
+	req, _ := http.NewRequest("GET", "/books/123/analyses?type=themes", nil)
+	rec := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/analyses", handler.Analyses)
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"prompt_version":"v2"`)
+	assert.Contains(t, rec.Body.String(), `"prompt_version":"v1"`)
+}
+
+func TestBookHandler_TextStats(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockService := new(MockAnalysisUsecase)
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), nil, createTestTemplates())
+
+	mockUsecase.On("FetchMetadata", 123).Return(&domain.Book{GutenbergID: 123}, nil)
+	mockUsecase.On("OpenContent", 123).Return("Nothing will come of nothing. Speak again.", nil)
+
+	req, _ := http.NewRequest("GET", "/books/123/stats", nil)
+	rec := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/stats", handler.TextStats)
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var stats domain.TextStats
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, 123, stats.GutenbergID)
+	assert.Equal(t, 7, stats.Words)
+	assert.Equal(t, 2, stats.Sentences)
+	assert.Equal(t, domain.WordCount{Word: "nothing", Count: 2}, stats.TopWords[0])
+	mockUsecase.AssertNotCalled(t, "FetchBook", 123)
+}
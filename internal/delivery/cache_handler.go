@@ -0,0 +1,24 @@
+package delivery
+
+import (
+	"net/http"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type ICacheStats interface {
+	Stats() domain.CacheStats
+}
+
+type CacheHandler struct {
+	Cache ICacheStats
+}
+
+func NewCacheHandler(cache ICacheStats) *CacheHandler {
+	return &CacheHandler{Cache: cache}
+}
+
+// Stats returns the hit, miss and eviction counts of the book cache
+func (h *CacheHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.Cache.Stats())
+}
@@ -0,0 +1,191 @@
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type ChatHandler struct {
+	Books    usecase.IBookUsecase
+	Chat     usecase.IChatUsecase
+	Passages usecase.IPassageUsecase
+	Quota    *QuotaHandler
+	Streams  *StreamHub
+	Logger   *service.Logger
+}
+
+type askRequest struct {
+	Question string `json:"question"`
+}
+
+// NewChatHandler limits passage searches, which may index the book with the paid embedder, with quota when it
+// is not nil
+func NewChatHandler(books usecase.IBookUsecase, chat usecase.IChatUsecase, passages usecase.IPassageUsecase, quota *QuotaHandler) *ChatHandler {
+	logger := service.NewLogger("[ChatHandler]")
+	return &ChatHandler{Books: books, Chat: chat, Passages: passages, Quota: quota, Streams: NewStreamHub(), Logger: logger}
+}
+
+// History returns the visitor's conversation about the book
+func (h *ChatHandler) History(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.parseGutenbergID(w, r)
+	if !ok {
+		return
+	}
+
+	messages, err := h.Chat.History(visitorID(w, r), id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch chat history", err)
+		http.Error(w, "Failed to fetch chat history", http.StatusInternalServerError)
+		return
+	}
+
+	if messages == nil {
+		messages = []domain.ChatMessage{}
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// Ask starts answering a question and returns the stream to follow with Answer
+func (h *ChatHandler) Ask(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.parseGutenbergID(w, r)
+	if !ok {
+		return
+	}
+
+	var req askRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	book, err := h.Books.FetchBook(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch book", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return
+	}
+
+	userID := visitorID(w, r)
+	// The answer is saved to the history when it ends, so it goes on even when nobody follows the stream
+	stream := h.Streams.Open(strconv.Itoa(id))
+	go func() {
+		defer stream.Close()
+
+		ctx, cancel := detachedContext(r)
+		defer cancel()
+
+		if err := h.Chat.Ask(ctx, stream, userID, book, req.Question); err != nil {
+			h.Logger.LogError("Failed to answer question", err)
+			stream.Send(service.ErrorEvent, service.AsAnalysisError(err))
+		}
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"stream": stream.ID})
+}
+
+// Answer streams the answer started by Ask as SSE
+func (h *ChatHandler) Answer(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["id"]
+	stream, seq, ok := h.Streams.Resume(key, r.Header.Get("Last-Event-ID"))
+	if !ok {
+		stream, ok = h.Streams.Lookup(key, mux.Vars(r)["stream"])
+	}
+	if !ok {
+		http.Error(w, "Unknown stream", http.StatusNotFound)
+		return
+	}
+
+	if err := h.Streams.Serve(w, r, stream, seq); err != nil {
+		h.Logger.LogError("Answer stream interrupted", err)
+	}
+}
+
+// Clear deletes the visitor's conversation about the book
+func (h *ChatHandler) Clear(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.parseGutenbergID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Chat.ClearHistory(visitorID(w, r), id); err != nil {
+		h.Logger.LogError("Failed to clear chat history", err)
+		http.Error(w, "Failed to clear chat history", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SearchPassages returns the passages retrieved for a query, the same ones a question would be answered from
+func (h *ChatHandler) SearchPassages(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.parseGutenbergID(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+
+	k := usecase.DefaultTopPassages
+	if value := r.URL.Query().Get("k"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 50 {
+			http.Error(w, "Invalid k", http.StatusBadRequest)
+			return
+		}
+		k = parsed
+	}
+
+	if !h.Quota.Allow(w, r) {
+		return
+	}
+
+	book, err := h.Books.FetchBook(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch book", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return
+	}
+
+	passages, err := h.Passages.Search(book, query, k)
+	if err != nil {
+		h.Logger.LogError("Failed to search passages", err)
+		http.Error(w, "Failed to search passages", http.StatusInternalServerError)
+		return
+	}
+
+	if passages == nil {
+		passages = []domain.Passage{}
+	}
+	writeJSON(w, http.StatusOK, passages)
+}
+
+func (h *ChatHandler) parseGutenbergID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	gutenbergID := mux.Vars(r)["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
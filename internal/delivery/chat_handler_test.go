@@ -0,0 +1,195 @@
+package delivery_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type MockChatUsecase struct {
+	mock.Mock
+	// Answer receives the events of every Ask. They stay out of Called, which formats its arguments while the
+	// stream is being served.
+	Answer func(events service.EventSender)
+}
+
+func (m *MockChatUsecase) History(userID string, gutenbergID int) ([]domain.ChatMessage, error) {
+	args := m.Called(userID, gutenbergID)
+	messages, _ := args.Get(0).([]domain.ChatMessage)
+	return messages, args.Error(1)
+}
+
+func (m *MockChatUsecase) Ask(ctx context.Context, events service.EventSender, userID string, book *domain.Book, question string) error {
+	args := m.Called(ctx, userID, book, question)
+	if m.Answer != nil {
+		m.Answer(events)
+	}
+	return args.Error(0)
+}
+
+func (m *MockChatUsecase) ClearHistory(userID string, gutenbergID int) error {
+	args := m.Called(userID, gutenbergID)
+	return args.Error(0)
+}
+
+type MockPassageUsecase struct {
+	mock.Mock
+}
+
+func (m *MockPassageUsecase) Search(book *domain.Book, query string, k int) ([]domain.Passage, error) {
+	args := m.Called(book, query, k)
+	passages, _ := args.Get(0).([]domain.Passage)
+	return passages, args.Error(1)
+}
+
+func newChatRouter(handler *delivery.ChatHandler) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/chat", handler.History).Methods("GET")
+	router.HandleFunc("/books/{id}/chat", handler.Ask).Methods("POST")
+	router.HandleFunc("/books/{id}/chat", handler.Clear).Methods("DELETE")
+	router.HandleFunc("/books/{id}/chat/{stream}", handler.Answer).Methods("GET")
+	router.HandleFunc("/books/{id}/passages", handler.SearchPassages).Methods("GET")
+	return router
+}
+
+func TestChatHandler_History(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockChat := new(MockChatUsecase)
+	router := newChatRouter(delivery.NewChatHandler(mockUsecase, mockChat, new(MockPassageUsecase), nil))
+
+	mockChat.On("History", "visitor-1", 123).Return([]domain.ChatMessage{
+		{GutenbergID: 123, Role: "user", Content: "Who is Lear?"},
+		{GutenbergID: 123, Role: "assistant", Content: "The king."},
+	}, nil)
+
+	req, _ := http.NewRequest("GET", "/books/123/chat", nil)
+	req.AddCookie(&http.Cookie{Name: "lear_visitor", Value: "visitor-1"})
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var messages []domain.ChatMessage
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &messages))
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "The king.", messages[1].Content)
+}
+
+func TestChatHandler_HistoryForgedVisitor(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockChat := new(MockChatUsecase)
+	router := newChatRouter(delivery.NewChatHandler(mockUsecase, mockChat, new(MockPassageUsecase), nil))
+
+	mockChat.On("History", mock.MatchedBy(func(userID string) bool { return !strings.HasPrefix(userID, "user-") }), 123).
+		Return([]domain.ChatMessage{}, nil)
+
+	req, _ := http.NewRequest("GET", "/books/123/chat", nil)
+	req.AddCookie(&http.Cookie{Name: "lear_visitor", Value: "user-1"})
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	mockChat.AssertNotCalled(t, "History", "user-1", 123)
+	mockChat.AssertExpectations(t)
+	assert.NotEmpty(t, rec.Result().Cookies(), "the forged cookie is replaced")
+}
+
+func TestChatHandler_AskAndAnswer(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockChat := new(MockChatUsecase)
+	router := newChatRouter(delivery.NewChatHandler(mockUsecase, mockChat, new(MockPassageUsecase), nil))
+
+	book := &domain.Book{GutenbergID: 123, Content: "Lear divides his kingdom."}
+	mockUsecase.On("FetchBook", 123).Return(book, nil)
+	mockChat.On("Ask", mock.Anything, mock.AnythingOfType("string"), book, "Why?").Return(nil)
+	mockChat.Answer = func(events service.EventSender) {
+		events.Send("CustomEvent", service.AnalysisChunk{Analysis: "Pride."})
+	}
+
+	req, _ := http.NewRequest("POST", "/books/123/chat", strings.NewReader(`{"question": "Why?"}`))
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.NotEmpty(t, rec.Result().Cookies())
+
+	var started map[string]string
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &started))
+
+	req, _ = http.NewRequest("GET", "/books/123/chat/"+started["stream"], nil)
+	rec = httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `data: {"analysis":"Pride."}`)
+	assert.Contains(t, rec.Body.String(), "event: Close\n")
+}
+
+func TestChatHandler_UnknownStream(t *testing.T) {
+	router := newChatRouter(delivery.NewChatHandler(new(MockBookUsecase), new(MockChatUsecase), new(MockPassageUsecase), nil))
+
+	req, _ := http.NewRequest("GET", "/books/123/chat/deadbeef", nil)
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestChatHandler_SearchPassages(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockPassages := new(MockPassageUsecase)
+	router := newChatRouter(delivery.NewChatHandler(mockUsecase, new(MockChatUsecase), mockPassages, nil))
+
+	book := &domain.Book{GutenbergID: 123, Content: "Lear divides his kingdom."}
+	mockUsecase.On("FetchBook", 123).Return(book, nil)
+	mockPassages.On("Search", book, "kingdom", 3).Return([]domain.Passage{
+		{GutenbergID: 123, Start: 5, End: 25, Content: "divides his kingdom.", Score: 0.9},
+	}, nil)
+
+	req, _ := http.NewRequest("GET", "/books/123/passages?q=kingdom&k=3", nil)
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"id":0,"gutenberg_id":123,"start":5,"end":25,"content":"divides his kingdom.","score":0.9}]`, rec.Body.String())
+
+	req, _ = http.NewRequest("GET", "/books/123/passages?q=kingdom&k=zero", nil)
+	rec = httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestChatHandler_SearchPassagesQuota(t *testing.T) {
+	mockPassages := new(MockPassageUsecase)
+	quota := new(MockQuotaUsecase)
+	quota.On("Check", mock.Anything).Return(&usecase.QuotaExceededError{Scope: "user", Limit: 1000, RetryAfter: time.Minute})
+	limits := delivery.NewQuotaHandler(quota, service.NewRateLimiter(60, 2), nil, createTestTemplates())
+	router := newChatRouter(delivery.NewChatHandler(new(MockBookUsecase), new(MockChatUsecase), mockPassages, limits))
+
+	req, _ := http.NewRequest("GET", "/books/123/passages?q=kingdom", nil)
+	rec := httptest.NewRecorder()
+
+	signedIn(router).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	mockPassages.AssertNotCalled(t, "Search", mock.Anything, mock.Anything, mock.Anything)
+}
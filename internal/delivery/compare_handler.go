@@ -0,0 +1,163 @@
+package delivery
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type CompareHandler struct {
+	Books     usecase.IBookUsecase
+	Compare   usecase.ICompareUsecase
+	Quota     *QuotaHandler
+	Templates *template.Template
+	Streams   *StreamHub
+	Logger    *service.Logger
+}
+
+// NewCompareHandler limits new comparative analyses with quota when it is not nil
+func NewCompareHandler(books usecase.IBookUsecase, compare usecase.ICompareUsecase, quota *QuotaHandler, tmpl *template.Template) *CompareHandler {
+	logger := service.NewLogger("[CompareHandler]")
+	return &CompareHandler{Books: books, Compare: compare, Quota: quota, Templates: tmpl, Streams: NewStreamHub(), Logger: logger}
+}
+
+// Show puts several books side by side, as a page or, with format=json, as JSON
+func (h *CompareHandler) Show(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "html" && format != "json" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	ids, ok := h.parseBookIDs(w, r)
+	if !ok {
+		return
+	}
+	books, ok := h.fetchBooks(w, ids, h.Books.FetchMetadata)
+	if !ok {
+		return
+	}
+
+	comparisons, err := h.Compare.Compare(books)
+	if err != nil {
+		h.Logger.LogError("Failed to compare books", err)
+		http.Error(w, "Failed to compare books", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		writeJSON(w, http.StatusOK, comparisons)
+		return
+	}
+
+	renderPage(w, h.Templates, "compare.html", map[string]interface{}{
+		"IDs":         r.URL.Query().Get("ids"),
+		"Comparisons": comparisons,
+	})
+}
+
+// StreamAnalysis streams a comparative analysis of the books as SSE, resumable like a single book's analysis
+func (h *CompareHandler) StreamAnalysis(w http.ResponseWriter, r *http.Request) {
+	// Streams are about the ids as requested, which a reconnecting EventSource repeats
+	key := r.URL.Query().Get("ids")
+	if stream, seq, ok := h.Streams.Resume(key, r.Header.Get("Last-Event-ID")); ok {
+		h.Logger.LogInfo(fmt.Sprintf("Resuming comparison stream %s after event %d", stream.ID, seq))
+		h.serveStream(w, r, stream, seq)
+		return
+	}
+
+	ids, ok := h.parseBookIDs(w, r)
+	if !ok {
+		return
+	}
+
+	// Only a new run calls the AI engine, resuming one is free
+	if !h.Quota.Allow(w, r) {
+		return
+	}
+
+	books, ok := h.fetchBooks(w, ids, h.Books.FetchBook)
+	if !ok {
+		return
+	}
+
+	stream := h.Streams.Open(key)
+	go func() {
+		defer stream.Close()
+
+		ctx, cancel := detachedContext(r)
+		defer cancel()
+		stream.CancelWhenAbandoned(cancel)
+
+		if err := h.Compare.Analyze(ctx, stream, books); err != nil {
+			h.Logger.LogError("Failed to stream comparison", err)
+			stream.Send(service.ErrorEvent, service.AsAnalysisError(err))
+		}
+	}()
+
+	h.serveStream(w, r, stream, 0)
+}
+
+// parseBookIDs reads the comma separated ids parameter
+func (h *CompareHandler) parseBookIDs(w http.ResponseWriter, r *http.Request) ([]int, bool) {
+	ids, err := parseIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		http.Error(w, "Invalid ids: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	h.Logger.SetTags(fmt.Sprintf("[books-%s]", r.URL.Query().Get("ids")))
+	return ids, true
+}
+
+// fetchBooks fetches every book of the ids, with or without content
+func (h *CompareHandler) fetchBooks(w http.ResponseWriter, ids []int, fetch func(int) (*domain.Book, error)) ([]*domain.Book, bool) {
+	books := make([]*domain.Book, len(ids))
+	for i, id := range ids {
+		book, err := fetch(id)
+		if err != nil {
+			h.Logger.LogError(fmt.Sprintf("Failed to fetch book %d", id), err)
+			http.Error(w, fmt.Sprintf("Failed to fetch book %d", id), http.StatusNotFound)
+			return nil, false
+		}
+		books[i] = book
+	}
+	return books, true
+}
+
+func (h *CompareHandler) serveStream(w http.ResponseWriter, r *http.Request, stream *SSEStream, seq int) {
+	if err := h.Streams.Serve(w, r, stream, seq); err != nil {
+		h.Logger.LogError("Comparison stream interrupted", err)
+	}
+}
+
+func parseIDs(value string) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a book ID", part)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) < usecase.MinComparedBooks || len(ids) > usecase.MaxComparedBooks {
+		return nil, fmt.Errorf("compare between %d and %d books", usecase.MinComparedBooks, usecase.MaxComparedBooks)
+	}
+	return ids, nil
+}
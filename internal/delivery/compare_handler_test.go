@@ -0,0 +1,136 @@
+package delivery_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+type MockCompareUsecase struct {
+	mock.Mock
+}
+
+func (m *MockCompareUsecase) Compare(books []*domain.Book) ([]domain.BookComparison, error) {
+	args := m.Called(books)
+	comparisons, _ := args.Get(0).([]domain.BookComparison)
+	return comparisons, args.Error(1)
+}
+
+func (m *MockCompareUsecase) Analyze(ctx context.Context, events service.EventSender, books []*domain.Book) error {
+	args := m.Called(ctx, events, books)
+	return args.Error(0)
+}
+
+func newCompareRouter(handler *delivery.CompareHandler) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/compare", handler.Show).Methods("GET")
+	router.HandleFunc("/compare/analyze", handler.StreamAnalysis).Methods("GET")
+	return router
+}
+
+func TestCompareHandler(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockCompare := new(MockCompareUsecase)
+	router := newCompareRouter(delivery.NewCompareHandler(mockUsecase, mockCompare, nil, createTestTemplates()))
+
+	folio := &domain.Book{GutenbergID: 1532, Metadata: domain.Metadata{Title: "King Lear"}}
+	quarto := &domain.Book{GutenbergID: 2264, Metadata: domain.Metadata{Title: "The Tragedy of King Lear"}}
+	books := []*domain.Book{folio, quarto}
+	mockUsecase.On("FetchMetadata", 1532).Return(folio, nil)
+	mockUsecase.On("FetchMetadata", 2264).Return(quarto, nil)
+	mockUsecase.On("FetchBook", 1532).Return(folio, nil)
+	mockUsecase.On("FetchBook", 2264).Return(quarto, nil)
+	mockCompare.On("Compare", books).Return([]domain.BookComparison{
+		{GutenbergID: 1532, Metadata: folio.Metadata, Analyses: []domain.Analysis{{Kind: "themes", Content: "Madness."}}},
+		{GutenbergID: 2264, Metadata: quarto.Metadata},
+	}, nil)
+
+	t.Run("Page", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/compare?ids=1532,2264", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "The Tragedy of King Lear")
+		assert.Contains(t, rec.Body.String(), "themes: Madness.")
+		mockUsecase.AssertNotCalled(t, "FetchBook", 1532)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/compare?ids=1532,2264,1532&format=json", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var comparisons []domain.BookComparison
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &comparisons))
+		assert.Len(t, comparisons, 2, "repeated ids are compared once")
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		mockCompare.On("Analyze", mock.Anything, mock.Anything, books).Run(func(args mock.Arguments) {
+			events := args.Get(1).(service.EventSender)
+			events.Send(service.ComparisonEvent, service.AnalysisChunk{Analysis: "The quarto has the mock trial."})
+		}).Return(nil)
+
+		req, _ := http.NewRequest("GET", "/compare/analyze?ids=1532,2264", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "event: Comparison\n")
+		assert.Contains(t, rec.Body.String(), "The quarto has the mock trial.")
+		assert.Contains(t, rec.Body.String(), "event: Close\n")
+	})
+
+	t.Run("Invalid ids", func(t *testing.T) {
+		for _, ids := range []string{"", "1532", "1532,lear", "1,2,3,4,5,6"} {
+			req, _ := http.NewRequest("GET", "/compare?ids="+ids, nil)
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code, ids)
+		}
+	})
+}
+
+func TestCompareHandler_InvalidStreamIsFree(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockCompare := new(MockCompareUsecase)
+	quota := new(MockQuotaUsecase)
+	quota.On("Check", mock.Anything).Return(nil)
+	limits := delivery.NewQuotaHandler(quota, service.NewRateLimiter(1, 1), nil, createTestTemplates())
+	router := newCompareRouter(delivery.NewCompareHandler(mockUsecase, mockCompare, limits, createTestTemplates()))
+
+	folio := &domain.Book{GutenbergID: 1532}
+	quarto := &domain.Book{GutenbergID: 2264}
+	mockUsecase.On("FetchBook", 1532).Return(folio, nil)
+	mockUsecase.On("FetchBook", 2264).Return(quarto, nil)
+	mockCompare.On("Analyze", mock.Anything, mock.Anything, []*domain.Book{folio, quarto}).Return(nil)
+
+	get := func(ids string) int {
+		req, _ := http.NewRequest("GET", "/compare/analyze?ids="+ids, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, ids := range []string{"1532", "1532,lear"} {
+		assert.Equal(t, http.StatusBadRequest, get(ids), "invalid ids take nothing from the rate limit")
+	}
+	assert.Equal(t, http.StatusOK, get("1532,2264"))
+	assert.Equal(t, http.StatusTooManyRequests, get("1532,2264"))
+}
@@ -0,0 +1,111 @@
+package delivery
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type DiffHandler struct {
+	Books     usecase.IBookUsecase
+	Diffs     usecase.IDiffUsecase
+	Templates *template.Template
+	Logger    *service.Logger
+}
+
+func NewDiffHandler(books usecase.IBookUsecase, diffs usecase.IDiffUsecase, tmpl *template.Template) *DiffHandler {
+	logger := service.NewLogger("[DiffHandler]")
+	return &DiffHandler{Books: books, Diffs: diffs, Templates: tmpl, Logger: logger}
+}
+
+// Show diffs two editions of a work as a side-by-side or inline page, as JSON, or with format=unified as a
+// unified diff
+func (h *DiffHandler) Show(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format != "" && format != "html" && format != "json" && format != "unified" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	view := query.Get("view")
+	if view != "" && view != "side" && view != "inline" {
+		http.Error(w, "Invalid view", http.StatusBadRequest)
+		return
+	}
+	if view == "" {
+		view = "side"
+	}
+
+	context := service.DefaultDiffContext
+	if value := query.Get("context"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid context", http.StatusBadRequest)
+			return
+		}
+		context = n
+	}
+
+	oldBook, ok := h.fetchBook(w, query.Get("old"))
+	if !ok {
+		return
+	}
+	newBook, ok := h.fetchBook(w, query.Get("new"))
+	if !ok {
+		return
+	}
+
+	h.Logger.SetTags(fmt.Sprintf("[books-%d-%d]", oldBook.GutenbergID, newBook.GutenbergID))
+
+	diff := h.Diffs.Diff(oldBook, newBook, context)
+
+	switch format {
+	case "json":
+		writeJSON(w, http.StatusOK, diff)
+	case "unified":
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%d-%d.diff"`, oldBook.GutenbergID, newBook.GutenbergID))
+		oldName := fmt.Sprintf("a/%d", oldBook.GutenbergID)
+		newName := fmt.Sprintf("b/%d", newBook.GutenbergID)
+		if err := service.WriteUnified(w, diff, oldName, newName); err != nil {
+			h.Logger.LogError("Failed to write unified diff", err)
+		}
+	default:
+		hunks := make([]map[string]interface{}, len(diff.Hunks))
+		for i, hunk := range diff.Hunks {
+			hunks[i] = map[string]interface{}{"Hunk": hunk, "Rows": service.SideBySide(hunk)}
+		}
+
+		renderPage(w, h.Templates, "diff.html", map[string]interface{}{
+			"Old":     oldBook,
+			"New":     newBook,
+			"View":    view,
+			"Context": context,
+			"Diff":    diff,
+			"Hunks":   hunks,
+		})
+	}
+}
+
+func (h *DiffHandler) fetchBook(w http.ResponseWriter, value string) (*domain.Book, bool) {
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid ID %q", value), http.StatusBadRequest)
+		return nil, false
+	}
+
+	book, err := h.Books.FetchBook(id)
+	if err != nil {
+		h.Logger.LogError(fmt.Sprintf("Failed to fetch book %d", id), err)
+		http.Error(w, fmt.Sprintf("Failed to fetch book %d", id), http.StatusNotFound)
+		return nil, false
+	}
+	return book, true
+}
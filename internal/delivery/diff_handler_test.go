@@ -0,0 +1,76 @@
+package delivery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+func TestDiffHandler(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	diffs := usecase.NewDiffUsecase(service.NewDiffService())
+	router := mux.NewRouter()
+	router.HandleFunc("/diff", delivery.NewDiffHandler(mockUsecase, diffs, createTestTemplates()).Show).Methods("GET")
+
+	mockUsecase.On("FetchBook", 1532).Return(&domain.Book{
+		GutenbergID: 1532,
+		Content:     "Release 1532\n*** START OF THE PROJECT GUTENBERG EBOOK KING LEAR ***\nLEAR. Nothing will come of nothing.\nEXEUNT.\n*** END OF THE PROJECT GUTENBERG EBOOK KING LEAR ***\n",
+	}, nil)
+	mockUsecase.On("FetchBook", 2264).Return(&domain.Book{
+		GutenbergID: 2264,
+		Content:     "Release 2264\n*** START OF THE PROJECT GUTENBERG EBOOK KING LEAR ***\nLEAR. Nothing can come of nothing.\nEXEUNT.\n*** END OF THE PROJECT GUTENBERG EBOOK KING LEAR ***\n",
+	}, nil)
+
+	t.Run("Page", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/diff?old=1532&new=2264", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "LEAR. Nothing will come of nothing. | LEAR. Nothing can come of nothing.")
+	})
+
+	t.Run("Unified", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/diff?old=1532&new=2264&format=unified&context=0", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "--- a/1532\n+++ b/2264\n@@ -2 +2 @@\n-LEAR. Nothing will come of nothing.\n+LEAR. Nothing can come of nothing.\n", rec.Body.String(),
+			"the Gutenberg header and footer are left out")
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/diff?old=1532&new=2264&format=json", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var diff service.TextDiff
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &diff))
+		assert.Equal(t, 1, diff.Added)
+		assert.Equal(t, 1, diff.Removed)
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"old=1532", "old=1532&new=lear", "old=1532&new=2264&context=-1", "old=1532&new=2264&view=split", "old=1532&new=2264&format=xml"} {
+			req, _ := http.NewRequest("GET", "/diff?"+query, nil)
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package delivery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type GraphHandler struct {
+	Books  usecase.IBookUsecase
+	Graphs usecase.ICharacterGraphUsecase
+	Quota  *QuotaHandler
+	Logger *service.Logger
+}
+
+// NewGraphHandler limits the graphs built with the AI engine with quota when it is not nil
+func NewGraphHandler(books usecase.IBookUsecase, graphs usecase.ICharacterGraphUsecase, quota *QuotaHandler) *GraphHandler {
+	logger := service.NewLogger("[GraphHandler]")
+	return &GraphHandler{Books: books, Graphs: graphs, Quota: quota, Logger: logger}
+}
+
+// Characters returns the character graph of the book as JSON, or as GraphML with format=graphml. Stored graphs
+// are served to everyone, building one for prose calls the paid AI engine and needs a signed in user within
+// the rate limit and quota.
+func (h *GraphHandler) Characters(w http.ResponseWriter, r *http.Request) {
+	gutenbergID := mux.Vars(r)["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "graphml" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	graph, err := h.Graphs.Stored(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch character graph", err)
+		http.Error(w, "Failed to fetch character graph", http.StatusInternalServerError)
+		return
+	}
+
+	if graph == nil {
+		var ok bool
+		if graph, ok = h.build(w, r, id); !ok {
+			return
+		}
+	}
+
+	if format == "graphml" {
+		w.Header().Set("Content-Type", "application/graphml+xml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="book-%d-characters.graphml"`, id))
+		if err := service.WriteGraphML(w, graph); err != nil {
+			h.Logger.LogError("Failed to write GraphML", err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, graph)
+}
+
+// build builds the graph of a book that has none yet, answering the request itself when it fails
+func (h *GraphHandler) build(w http.ResponseWriter, r *http.Request, id int) (*domain.CharacterGraph, bool) {
+	book, err := h.Books.FetchBook(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch book", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return nil, false
+	}
+
+	if h.Graphs.NeedsEngine(book) {
+		if _, ok := requireUser(w, r); !ok || !h.Quota.Allow(w, r) {
+			return nil, false
+		}
+	}
+
+	// Prose is graphed from the characters the AI engine names, which can take a while
+	ctx, cancel := context.WithTimeout(r.Context(), analysisTimeout)
+	defer cancel()
+
+	graph, err := h.Graphs.Graph(ctx, book)
+	if err != nil {
+		h.Logger.LogError("Failed to build character graph", err)
+		http.Error(w, "Failed to build character graph", http.StatusBadGateway)
+		return nil, false
+	}
+	return graph, true
+}
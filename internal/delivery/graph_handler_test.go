@@ -0,0 +1,143 @@
+package delivery_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type MockCharacterGraphUsecase struct {
+	mock.Mock
+}
+
+func (m *MockCharacterGraphUsecase) Stored(gutenbergID int) (*domain.CharacterGraph, error) {
+	args := m.Called(gutenbergID)
+	graph, _ := args.Get(0).(*domain.CharacterGraph)
+	return graph, args.Error(1)
+}
+
+func (m *MockCharacterGraphUsecase) NeedsEngine(book *domain.Book) bool {
+	args := m.Called(book)
+	return args.Bool(0)
+}
+
+func (m *MockCharacterGraphUsecase) Graph(ctx context.Context, book *domain.Book) (*domain.CharacterGraph, error) {
+	args := m.Called(ctx, book)
+	graph, _ := args.Get(0).(*domain.CharacterGraph)
+	return graph, args.Error(1)
+}
+
+func newGraphRouter(handler *delivery.GraphHandler) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/characters", handler.Characters).Methods("GET")
+	return router
+}
+
+func TestGraphHandler_Characters(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockGraphs := new(MockCharacterGraphUsecase)
+	router := newGraphRouter(delivery.NewGraphHandler(mockUsecase, mockGraphs, nil))
+
+	book := &domain.Book{GutenbergID: 1128}
+	mockGraphs.On("Stored", 1128).Return(nil, nil)
+	mockUsecase.On("FetchBook", 1128).Return(book, nil)
+	mockGraphs.On("NeedsEngine", book).Return(false)
+	mockGraphs.On("Graph", mock.Anything, book).Return(&domain.CharacterGraph{
+		GutenbergID: 1128,
+		Method:      domain.GraphSpeakers,
+		Directed:    true,
+		Nodes:       domain.CharacterNodes{{Name: "LEAR", Weight: 2}, {Name: "FOOL", Weight: 1}},
+		Edges:       domain.CharacterEdges{{Source: "FOOL", Target: "LEAR", Weight: 1}},
+	}, nil)
+
+	t.Run("JSON", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/1128/characters", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var graph domain.CharacterGraph
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &graph))
+		assert.Len(t, graph.Nodes, 2)
+		assert.Equal(t, "FOOL", graph.Edges[0].Source)
+	})
+
+	t.Run("GraphML", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/1128/characters?format=graphml", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/graphml+xml", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), `<edge source="FOOL" target="LEAR">`)
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/1128/characters?format=dot", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestGraphHandler_CharactersStored(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockGraphs := new(MockCharacterGraphUsecase)
+	router := newGraphRouter(delivery.NewGraphHandler(mockUsecase, mockGraphs, nil))
+
+	mockGraphs.On("Stored", 1342).Return(&domain.CharacterGraph{GutenbergID: 1342, Method: domain.GraphMentions}, nil)
+
+	req, _ := http.NewRequest("GET", "/books/1342/characters", nil)
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code, "a stored graph is served to anonymous visitors")
+	mockUsecase.AssertNotCalled(t, "FetchBook", mock.Anything)
+	mockGraphs.AssertNotCalled(t, "Graph", mock.Anything, mock.Anything)
+}
+
+func TestGraphHandler_CharactersProse(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockGraphs := new(MockCharacterGraphUsecase)
+	handler := delivery.NewGraphHandler(mockUsecase, mockGraphs, nil)
+
+	book := &domain.Book{GutenbergID: 1342}
+	mockGraphs.On("Stored", 1342).Return(nil, nil)
+	mockUsecase.On("FetchBook", 1342).Return(book, nil)
+	mockGraphs.On("NeedsEngine", book).Return(true)
+	mockGraphs.On("Graph", mock.Anything, book).Return(nil, errors.New("provider unavailable"))
+
+	t.Run("Anonymous", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/1342/characters", nil)
+		rec := httptest.NewRecorder()
+
+		newGraphRouter(handler).ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		mockGraphs.AssertNotCalled(t, "Graph", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Signed in", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/1342/characters", nil)
+		rec := httptest.NewRecorder()
+
+		signedIn(newGraphRouter(handler)).ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadGateway, rec.Code)
+		mockGraphs.AssertCalled(t, "Graph", mock.Anything, book)
+	})
+}
@@ -0,0 +1,62 @@
+package delivery
+
+import (
+	"net/http"
+
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+const (
+	healthOK          = "ok"
+	healthDegraded    = "degraded"
+	healthUnavailable = "unavailable"
+)
+
+type HealthHandler struct {
+	Engines []engine.HealthReporter
+}
+
+func NewHealthHandler(engines ...engine.HealthReporter) *HealthHandler {
+	return &HealthHandler{Engines: engines}
+}
+
+// Health tells the server is up, degraded while the circuit breaker of an AI engine is not closed
+func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
+	status, engines := h.engines()
+	if status == healthUnavailable {
+		status = healthDegraded
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": status, "engines": engines})
+}
+
+// Engine answers 503 while no AI engine can be called, for monitors and load balancers
+func (h *HealthHandler) Engine(w http.ResponseWriter, r *http.Request) {
+	status, engines := h.engines()
+	code := http.StatusOK
+	if status == healthUnavailable {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "engines": engines})
+}
+
+// engines is the health of every engine, unavailable when all of them are open
+func (h *HealthHandler) engines() (string, []engine.Health) {
+	engines := make([]engine.Health, len(h.Engines))
+	open := 0
+	status := healthOK
+	for i, reporter := range h.Engines {
+		engines[i] = reporter.Health()
+		switch engines[i].State {
+		case engine.BreakerOpen:
+			open++
+			status = healthDegraded
+		case engine.BreakerHalfOpen:
+			status = healthDegraded
+		}
+	}
+
+	if len(engines) > 0 && open == len(engines) {
+		status = healthUnavailable
+	}
+	return status, engines
+}
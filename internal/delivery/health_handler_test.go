@@ -0,0 +1,56 @@
+package delivery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+type fixedHealth engine.Health
+
+func (h fixedHealth) Health() engine.Health {
+	return engine.Health(h)
+}
+
+func TestHealthHandler(t *testing.T) {
+	closed := fixedHealth{Name: "sambanova", State: engine.BreakerClosed}
+	open := fixedHealth{Name: "fallback", State: engine.BreakerOpen, ConsecutiveFailures: 5, LastError: "status 503"}
+
+	tests := []struct {
+		name         string
+		engines      []engine.HealthReporter
+		healthStatus string
+		engineCode   int
+	}{
+		{"All closed", []engine.HealthReporter{closed}, "ok", http.StatusOK},
+		{"One open", []engine.HealthReporter{closed, open}, "degraded", http.StatusOK},
+		{"All open", []engine.HealthReporter{open}, "degraded", http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := delivery.NewHealthHandler(tt.engines...)
+
+			w := httptest.NewRecorder()
+			handler.Health(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var body struct {
+				Status  string          `json:"status"`
+				Engines []engine.Health `json:"engines"`
+			}
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			assert.Equal(t, tt.healthStatus, body.Status)
+			assert.Len(t, body.Engines, len(tt.engines))
+
+			w = httptest.NewRecorder()
+			handler.Engine(w, httptest.NewRequest(http.MethodGet, "/health/engine", nil))
+			assert.Equal(t, tt.engineCode, w.Code)
+		})
+	}
+}
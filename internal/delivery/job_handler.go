@@ -0,0 +1,156 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type JobHandler struct {
+	Jobs     usecase.IJobUsecase
+	Analysis usecase.IAnalysisUsecase
+	Quota    *QuotaHandler
+	Logger   *service.Logger
+}
+
+type enqueueRequest struct {
+	Kind         string `json:"kind"`
+	GutenbergID  int    `json:"gutenberg_id"`
+	AnalysisKind string `json:"analysis_kind"`
+	Version      string `json:"version"`
+}
+
+// NewJobHandler limits analysis jobs with quota when it is not nil
+func NewJobHandler(jobs usecase.IJobUsecase, analysis usecase.IAnalysisUsecase, quota *QuotaHandler) *JobHandler {
+	logger := service.NewLogger("[JobHandler]")
+	return &JobHandler{Jobs: jobs, Analysis: analysis, Quota: quota, Logger: logger}
+}
+
+// Enqueue queues a fetch or analysis of a book and returns the job to poll
+func (h *JobHandler) Enqueue(w http.ResponseWriter, r *http.Request) {
+	var req enqueueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.GutenbergID <= 0 {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	job := &domain.Job{Kind: req.Kind, GutenbergID: req.GutenbergID, UserID: currentUserID(r)}
+	switch req.Kind {
+	case domain.JobFetch:
+	case domain.JobAnalysis:
+		// Analyses call the paid AI engine, fetches are open to anonymous visitors
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		job.UserID = user.ID
+		job.AnalysisKind = req.AnalysisKind
+		if job.AnalysisKind == "" {
+			job.AnalysisKind = service.DefaultAnalysisKind
+		}
+		if !service.IsAnalysisKind(job.AnalysisKind) {
+			http.Error(w, "Invalid analysis type", http.StatusBadRequest)
+			return
+		}
+		job.PromptVersion = req.Version
+		if !h.Analysis.HasPromptVersion(job.AnalysisKind, job.PromptVersion) {
+			http.Error(w, "Unknown prompt version", http.StatusBadRequest)
+			return
+		}
+		if !h.Quota.Allow(w, r) {
+			return
+		}
+	default:
+		http.Error(w, "Invalid job kind", http.StatusBadRequest)
+		return
+	}
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%d]", job.GutenbergID))
+
+	if err := h.Jobs.Enqueue(job); err != nil {
+		h.Logger.LogError("Failed to enqueue job", err)
+		http.Error(w, "Failed to enqueue job", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// Show returns the status and progress of a job
+func (h *JobHandler) Show(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.findJob(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// Cancel stops a queued or running job
+func (h *JobHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.findJob(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := h.Jobs.Cancel(job.ID)
+	switch {
+	case errors.Is(err, usecase.ErrJobFinished):
+		writeJSON(w, http.StatusConflict, job)
+	case err != nil:
+		h.Logger.LogError("Failed to cancel job", err)
+		http.Error(w, "Failed to cancel job", http.StatusInternalServerError)
+	case job == nil:
+		http.Error(w, "Job not found", http.StatusNotFound)
+	default:
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+// findJob returns the job of the id parameter. Job ids are sequential, so a job queued by a user is not found by
+// anyone else, only the jobs of anonymous visitors are open to all.
+func (h *JobHandler) findJob(w http.ResponseWriter, r *http.Request) (*domain.Job, bool) {
+	id, ok := h.parseJobID(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	job, err := h.Jobs.Job(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch job", err)
+		http.Error(w, "Failed to fetch job", http.StatusInternalServerError)
+		return nil, false
+	}
+	if job == nil || (job.UserID != 0 && job.UserID != currentUserID(r)) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, false
+	}
+	return job, true
+}
+
+func (h *JobHandler) parseJobID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	jobID := mux.Vars(r)["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[job-%s]", jobID))
+
+	id, err := strconv.Atoi(jobID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse job ID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
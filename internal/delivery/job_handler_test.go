@@ -0,0 +1,157 @@
+package delivery_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type MockJobUsecase struct {
+	mock.Mock
+}
+
+func (m *MockJobUsecase) Enqueue(job *domain.Job) error {
+	args := m.Called(job)
+	return args.Error(0)
+}
+
+func (m *MockJobUsecase) Job(id int) (*domain.Job, error) {
+	args := m.Called(id)
+	job, _ := args.Get(0).(*domain.Job)
+	return job, args.Error(1)
+}
+
+func (m *MockJobUsecase) Cancel(id int) (*domain.Job, error) {
+	args := m.Called(id)
+	job, _ := args.Get(0).(*domain.Job)
+	return job, args.Error(1)
+}
+
+func (m *MockJobUsecase) Start(ctx context.Context) {
+	m.Called(ctx)
+}
+
+func newJobRouter(handler *delivery.JobHandler) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/jobs", handler.Enqueue).Methods("POST")
+	router.HandleFunc("/jobs/{id:[0-9]+}", handler.Show).Methods("GET")
+	router.HandleFunc("/jobs/{id:[0-9]+}", handler.Cancel).Methods("DELETE")
+	return router
+}
+
+func TestJobHandler(t *testing.T) {
+	mockJobs := new(MockJobUsecase)
+	jobRouter := newJobRouter(delivery.NewJobHandler(mockJobs, new(MockAnalysisUsecase), nil))
+	router := signedIn(jobRouter)
+
+	t.Run("Enqueue analysis", func(t *testing.T) {
+		mockJobs.On("Enqueue", mock.MatchedBy(func(job *domain.Job) bool {
+			return job.Kind == domain.JobAnalysis && job.GutenbergID == 1532 && job.AnalysisKind == "overview" && job.UserID == testUser.ID
+		})).Run(func(args mock.Arguments) {
+			args.Get(0).(*domain.Job).ID = 7
+			args.Get(0).(*domain.Job).Status = domain.JobQueued
+		}).Return(nil)
+
+		req, _ := http.NewRequest("POST", "/jobs", strings.NewReader(`{"kind":"analysis","gutenberg_id":1532}`))
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.Equal(t, "/jobs/7", rec.Header().Get("Location"))
+		var job domain.Job
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		assert.Equal(t, domain.JobQueued, job.Status)
+	})
+
+	t.Run("Anonymous analysis", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/jobs", strings.NewReader(`{"kind":"analysis","gutenberg_id":1532}`))
+		rec := httptest.NewRecorder()
+
+		jobRouter.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("Invalid jobs", func(t *testing.T) {
+		for _, body := range []string{
+			`{"kind":"fetch"}`,
+			`{"kind":"translate","gutenberg_id":1532}`,
+			`{"kind":"analysis","gutenberg_id":1532,"analysis_kind":"horoscope"}`,
+			`not json`,
+		} {
+			req, _ := http.NewRequest("POST", "/jobs", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+		}
+	})
+
+	t.Run("Poll", func(t *testing.T) {
+		mockJobs.On("Job", 7).Return(&domain.Job{ID: 7, UserID: testUser.ID, Status: domain.JobRunning, Progress: 50}, nil)
+		mockJobs.On("Job", 8).Return(nil, nil)
+		mockJobs.On("Job", 9).Return(&domain.Job{ID: 9, Kind: domain.JobFetch, Status: domain.JobSucceeded}, nil)
+
+		req, _ := http.NewRequest("GET", "/jobs/7", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"progress":50`)
+
+		req, _ = http.NewRequest("GET", "/jobs/8", nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		mockJobs.On("Cancel", 7).Return(&domain.Job{ID: 7, Status: domain.JobCancelled}, nil)
+		mockJobs.On("Cancel", 9).Return(&domain.Job{ID: 9, Status: domain.JobSucceeded}, usecase.ErrJobFinished)
+
+		req, _ := http.NewRequest("DELETE", "/jobs/7", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"status":"cancelled"`)
+
+		req, _ = http.NewRequest("DELETE", "/jobs/9", nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusConflict, rec.Code, "a finished job cannot be cancelled")
+	})
+
+	t.Run("Other users' jobs", func(t *testing.T) {
+		mockJobs.On("Job", 10).Return(&domain.Job{ID: 10, Kind: domain.JobAnalysis, UserID: testUser.ID + 1, Status: domain.JobRunning}, nil)
+
+		for _, method := range []string{"GET", "DELETE"} {
+			req, _ := http.NewRequest(method, "/jobs/10", nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusNotFound, rec.Code, method)
+
+			req, _ = http.NewRequest(method, "/jobs/7", nil)
+			rec = httptest.NewRecorder()
+			jobRouter.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusNotFound, rec.Code, "anonymous "+method)
+		}
+		mockJobs.AssertNotCalled(t, "Cancel", 10)
+	})
+}
@@ -0,0 +1,211 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+const (
+	maxUsageReportDays    = 90
+	defaultCostReportDays = 30
+)
+
+// QuotaHandler guards the routes that call the AI engine with a rate limit per user, or per address for
+// anonymous requests, and the token budgets of the quota usecase
+type QuotaHandler struct {
+	Quota     usecase.IQuotaUsecase
+	Limiter   *service.RateLimiter
+	Admins    map[string]bool
+	Templates *template.Template
+	Logger    *service.Logger
+}
+
+func NewQuotaHandler(quota usecase.IQuotaUsecase, limiter *service.RateLimiter, admins []string, tmpl *template.Template) *QuotaHandler {
+	logger := service.NewLogger("[QuotaHandler]")
+	adminSet := make(map[string]bool, len(admins))
+	for _, admin := range admins {
+		adminSet[admin] = true
+	}
+	return &QuotaHandler{Quota: quota, Limiter: limiter, Admins: adminSet, Templates: tmpl, Logger: logger}
+}
+
+// Limit refuses requests over the rate limit or the caller's quota
+func (h *QuotaHandler) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.Allow(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// Allow tells whether the request may call the AI engine, answering 429 with Retry-After when it may not.
+// A nil handler allows everything.
+func (h *QuotaHandler) Allow(w http.ResponseWriter, r *http.Request) bool {
+	if h == nil {
+		return true
+	}
+
+	refusal, err := h.check(requestCaller(r))
+	switch {
+	case err != nil:
+		http.Error(w, "Failed to check quota", http.StatusInternalServerError)
+		return false
+	case refusal != nil:
+		w.Header().Set("Retry-After", strconv.Itoa(refusal.RetryAfter))
+		http.Error(w, refusal.Message, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// check takes a call to the AI engine from the caller's rate limit and checks their quota, returning why the
+// call is refused, with the seconds to wait, or nil when it is allowed. A nil handler allows everything.
+func (h *QuotaHandler) check(caller service.Caller) (*service.AnalysisError, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	key := "ip-" + caller.IP
+	if caller.UserID != 0 {
+		key = fmt.Sprintf("user-%d", caller.UserID)
+	}
+
+	if ok, retryAfter := h.Limiter.Allow(key); !ok {
+		h.Logger.SetTags("[" + key + "]")
+		h.Logger.LogInfo("Rate limit reached")
+		return &service.AnalysisError{
+			Code:       service.ErrCodeRateLimited,
+			Message:    "Too many analyses, slow down",
+			Retryable:  true,
+			RetryAfter: retrySeconds(retryAfter),
+		}, nil
+	}
+
+	err := h.Quota.Check(caller)
+	var quotaErr *usecase.QuotaExceededError
+	switch {
+	case errors.As(err, &quotaErr):
+		h.Logger.SetTags("[" + key + "]")
+		h.Logger.LogInfo(quotaErr.Error())
+		return &service.AnalysisError{
+			Code:       service.ErrCodeQuotaExceeded,
+			Message:    fmt.Sprintf("The %s quota of %d tokens is spent", quotaErr.Scope, quotaErr.Limit),
+			Retryable:  true,
+			RetryAfter: retrySeconds(quotaErr.RetryAfter),
+		}, nil
+	case err != nil:
+		h.Logger.LogError("Failed to check quota", err)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Usage shows the token usage of every user and address to admins, over the last days (1 by default), or with
+// format=json as JSON
+func (h *QuotaHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	format, days, ok := h.adminReport(w, r, 1)
+	if !ok {
+		return
+	}
+
+	report, err := h.Quota.Report(time.Duration(days) * 24 * time.Hour)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch usage report", err)
+		http.Error(w, "Failed to fetch usage report", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	renderPage(w, h.Templates, "usage.html", map[string]interface{}{"Days": days, "Report": report})
+}
+
+// Costs shows admins what the calls to the AI engine cost per book, user, day and model over the last days
+// (30 by default), or with format=json as JSON
+func (h *QuotaHandler) Costs(w http.ResponseWriter, r *http.Request) {
+	format, days, ok := h.adminReport(w, r, defaultCostReportDays)
+	if !ok {
+		return
+	}
+
+	report, err := h.Quota.Costs(time.Duration(days) * 24 * time.Hour)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch cost report", err)
+		http.Error(w, "Failed to fetch cost report", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	renderPage(w, h.Templates, "costs.html", map[string]interface{}{"Days": days, "Report": report})
+}
+
+// adminReport checks the request is an admin's and reads the format and days of a report
+func (h *QuotaHandler) adminReport(w http.ResponseWriter, r *http.Request, defaultDays int) (string, int, bool) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return "", 0, false
+	}
+	if !h.Admins[user.Username] {
+		http.Error(w, "Only admins can see the usage", http.StatusForbidden)
+		return "", 0, false
+	}
+
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format != "" && format != "html" && format != "json" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	days := defaultDays
+	if value := query.Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxUsageReportDays {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return "", 0, false
+		}
+		days = n
+	}
+
+	return format, days, true
+}
+
+// requestCaller is who the analyses run for a request are made for
+func requestCaller(r *http.Request) service.Caller {
+	return service.Caller{UserID: currentUserID(r), IP: clientIP(r)}
+}
+
+// clientIP is the address the request came from. Behind a proxy it is the proxy's.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// retrySeconds rounds a wait up to whole seconds, at least one, as Retry-After counts them
+func retrySeconds(retryAfter time.Duration) int {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
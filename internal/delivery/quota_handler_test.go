@@ -0,0 +1,140 @@
+package delivery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type MockQuotaUsecase struct {
+	mock.Mock
+}
+
+func (m *MockQuotaUsecase) Check(caller service.Caller) error {
+	args := m.Called(caller)
+	return args.Error(0)
+}
+
+func (m *MockQuotaUsecase) RecordUsage(usage *domain.Usage) {
+	m.Called(usage)
+}
+
+func (m *MockQuotaUsecase) Report(window time.Duration) (*domain.UsageReport, error) {
+	args := m.Called(window)
+	report, _ := args.Get(0).(*domain.UsageReport)
+	return report, args.Error(1)
+}
+
+func (m *MockQuotaUsecase) Costs(window time.Duration) (*domain.CostReport, error) {
+	args := m.Called(window)
+	report, _ := args.Get(0).(*domain.CostReport)
+	return report, args.Error(1)
+}
+
+func TestQuotaHandler(t *testing.T) {
+	quota := new(MockQuotaUsecase)
+	handler := delivery.NewQuotaHandler(quota, service.NewRateLimiter(60, 2), []string{"goneril"}, createTestTemplates())
+
+	router := mux.NewRouter()
+	router.HandleFunc("/paid", handler.Limit(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("answer"))
+	})).Methods("GET")
+	router.HandleFunc("/admin/usage", handler.Usage).Methods("GET")
+	router.HandleFunc("/admin/costs", handler.Costs).Methods("GET")
+	server := signedIn(router)
+
+	caller := service.Caller{UserID: testUser.ID, IP: "192.0.2.1"}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", target, nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Within the quota", func(t *testing.T) {
+		quota.On("Check", caller).Return(nil).Once()
+
+		rec := get("/paid")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "answer", rec.Body.String())
+	})
+
+	t.Run("Quota spent", func(t *testing.T) {
+		quota.On("Check", caller).Return(&usecase.QuotaExceededError{Scope: "user", Limit: 1000, RetryAfter: 90 * time.Second}).Once()
+
+		rec := get("/paid")
+
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "90", rec.Header().Get("Retry-After"))
+		assert.Contains(t, rec.Body.String(), "user quota of 1000 tokens")
+	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		rec := get("/paid")
+
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+		quota.AssertNumberOfCalls(t, "Check", 2)
+	})
+
+	t.Run("Usage report", func(t *testing.T) {
+		report := &domain.UsageReport{
+			Users: []domain.UsageSummary{{UserID: 42, Username: "goneril", UsageTotal: domain.UsageTotal{Calls: 3, PromptTokens: 900, CompletionTokens: 100}}},
+		}
+		quota.On("Report", 7*24*time.Hour).Return(report, nil).Once()
+
+		rec := get("/admin/usage?days=7&format=json")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var body domain.UsageReport
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, "goneril", body.Users[0].Username)
+		assert.Equal(t, int64(900), body.Users[0].PromptTokens)
+	})
+
+	t.Run("Cost report", func(t *testing.T) {
+		report := &domain.CostReport{
+			Total: domain.CostTotal{UsageTotal: domain.UsageTotal{Calls: 2}, Cost: 0.0036},
+			Books: []domain.CostSummary{{GutenbergID: 1128, Title: "King Lear", CostTotal: domain.CostTotal{Cost: 0.0036}}},
+			Days:  []domain.CostSummary{{Day: "2026-10-19", CostTotal: domain.CostTotal{Cost: 0.0036}}},
+		}
+		quota.On("Costs", 30*24*time.Hour).Return(report, nil).Once()
+
+		rec := get("/admin/costs")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "King Lear: 0.0036")
+		assert.Contains(t, rec.Body.String(), "2026-10-19: 0.0036")
+	})
+
+	t.Run("Invalid days", func(t *testing.T) {
+		rec := get("/admin/usage?days=365")
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Not an admin", func(t *testing.T) {
+		other := delivery.NewQuotaHandler(quota, service.NewRateLimiter(60, 2), []string{"regan"}, createTestTemplates())
+
+		req, _ := http.NewRequest("GET", "/admin/usage", nil)
+		rec := httptest.NewRecorder()
+		signedIn(http.HandlerFunc(other.Usage)).ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	quota.AssertExpectations(t)
+}
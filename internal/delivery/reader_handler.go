@@ -0,0 +1,242 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+// recentReadingLimit is the number of books in the continue reading list
+const recentReadingLimit = 10
+
+type ReaderHandler struct {
+	Books     usecase.IBookUsecase
+	Reading   usecase.IReadingUsecase
+	Templates *template.Template
+	Logger    *service.Logger
+}
+
+func NewReaderHandler(books usecase.IBookUsecase, reading usecase.IReadingUsecase, tmpl *template.Template) *ReaderHandler {
+	logger := service.NewLogger("[ReaderHandler]")
+	return &ReaderHandler{Books: books, Reading: reading, Templates: tmpl, Logger: logger}
+}
+
+// Read serves a page of the book, by number, as the page holding offset, or where the visitor left off, and
+// remembers it. The bytes from offset to end are highlighted. With format=json the page is returned as JSON.
+func (h *ReaderHandler) Read(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format != "" && format != "html" && format != "json" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	mode, pageSize, ok := parseLayout(w, query)
+	if !ok {
+		return
+	}
+
+	number, ok := parseNonNegative(w, query, "page")
+	if !ok {
+		return
+	}
+	offset, ok := parseNonNegative(w, query, "offset")
+	if !ok {
+		return
+	}
+	end, ok := parseNonNegative(w, query, "end")
+	if !ok {
+		return
+	}
+
+	book, ok := h.fetchBook(w, r)
+	if !ok {
+		return
+	}
+
+	userID := visitorID(w, r)
+
+	var page *domain.Page
+	var err error
+	if number == 0 && query.Has("offset") {
+		page, err = h.Reading.ReadAt(userID, book, mode, pageSize, offset)
+	} else {
+		page, err = h.Reading.Read(userID, book, mode, pageSize, number)
+	}
+	if errors.Is(err, usecase.ErrPageNotFound) {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Logger.LogError("Failed to read book", err)
+		http.Error(w, "Failed to read book", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+
+	pages, err := h.Reading.Pages(book, page.Mode, page.PageSize)
+	if err != nil {
+		h.Logger.LogError("Failed to paginate book", err)
+		http.Error(w, "Failed to read book", http.StatusInternalServerError)
+		return
+	}
+
+	before, marked, after := highlight(page, offset, end)
+	renderPage(w, h.Templates, "read.html", map[string]interface{}{
+		"GutenbergID": book.GutenbergID,
+		"Title":       book.Metadata.Title,
+		"Author":      book.Metadata.Author,
+		"Page":        page,
+		"Previous":    page.Number - 1,
+		"Next":        nextPage(page),
+		"Pages":       pages,
+		"Mode":        page.Mode,
+		"Size":        page.PageSize,
+		"Before":      before,
+		"Marked":      marked,
+		"After":       after,
+	})
+}
+
+// Pages returns the page index of the book as JSON
+func (h *ReaderHandler) Pages(w http.ResponseWriter, r *http.Request) {
+	mode, pageSize, ok := parseLayout(w, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	book, ok := h.fetchBook(w, r)
+	if !ok {
+		return
+	}
+
+	pages, err := h.Reading.Pages(book, mode, pageSize)
+	if err != nil {
+		h.Logger.LogError("Failed to paginate book", err)
+		http.Error(w, "Failed to paginate book", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, pages)
+}
+
+// Recent returns the books the visitor read last, for the continue reading list
+func (h *ReaderHandler) Recent(w http.ResponseWriter, r *http.Request) {
+	positions, err := h.Reading.Recent(visitorID(w, r), recentReadingLimit)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch reading positions", err)
+		http.Error(w, "Failed to fetch reading positions", http.StatusInternalServerError)
+		return
+	}
+
+	if positions == nil {
+		positions = []domain.ReadingPosition{}
+	}
+
+	// Books stored apart from the reading positions come without their title
+	for i := range positions {
+		if positions[i].Title != "" {
+			continue
+		}
+		if book, err := h.Books.FetchMetadata(positions[i].GutenbergID); err == nil {
+			positions[i].Title = book.Metadata.Title
+		}
+	}
+	writeJSON(w, http.StatusOK, positions)
+}
+
+func (h *ReaderHandler) fetchBook(w http.ResponseWriter, r *http.Request) (*domain.Book, bool) {
+	gutenbergID := mux.Vars(r)["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// The reading usecase streams the content it needs, pages are served without loading the whole book
+	book, err := h.Books.FetchMetadata(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch book", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return nil, false
+	}
+	return book, true
+}
+
+// parseLayout reads the mode and page size, left empty and zero when not given
+func parseLayout(w http.ResponseWriter, query url.Values) (string, int, bool) {
+	mode := query.Get("mode")
+	if mode != "" && mode != domain.PageBySize && mode != domain.PageBySection {
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	pageSize, ok := parseNonNegative(w, query, "size")
+	if !ok {
+		return "", 0, false
+	}
+	if pageSize != 0 && (pageSize < service.MinPageSize || pageSize > service.MaxPageSize) {
+		http.Error(w, fmt.Sprintf("Page size must be between %d and %d", service.MinPageSize, service.MaxPageSize), http.StatusBadRequest)
+		return "", 0, false
+	}
+
+	return mode, pageSize, true
+}
+
+func parseNonNegative(w http.ResponseWriter, query url.Values, name string) (int, bool) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, true
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		http.Error(w, fmt.Sprintf("Invalid %s", name), http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
+
+// nextPage returns the number of the page after this one, or 0 on the last page
+func nextPage(page *domain.Page) int {
+	if page.Number >= page.Total {
+		return 0
+	}
+	return page.Number + 1
+}
+
+// highlight splits the page text around the part of the byte range from start to end that falls on the page
+func highlight(page *domain.Page, start, end int) (string, string, string) {
+	start = clamp(start, page.Start, page.End) - page.Start
+	end = clamp(end, page.Start, page.End) - page.Start
+	if end <= start {
+		return page.Text, "", ""
+	}
+	return page.Text[:start], page.Text[start:end], page.Text[end:]
+}
+
+func clamp(n, low, high int) int {
+	if n < low {
+		return low
+	}
+	if n > high {
+		return high
+	}
+	return n
+}
@@ -0,0 +1,186 @@
+package delivery_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type MockReadingRepository struct {
+	mock.Mock
+}
+
+func (m *MockReadingRepository) GetPosition(userID string, gutenbergID int) (*domain.ReadingPosition, error) {
+	args := m.Called(userID, gutenbergID)
+	position, _ := args.Get(0).(*domain.ReadingPosition)
+	return position, args.Error(1)
+}
+
+func (m *MockReadingRepository) SavePosition(position *domain.ReadingPosition) error {
+	args := m.Called(position)
+	return args.Error(0)
+}
+
+func (m *MockReadingRepository) RecentPositions(userID string, limit int) ([]domain.ReadingPosition, error) {
+	args := m.Called(userID, limit)
+	positions, _ := args.Get(0).([]domain.ReadingPosition)
+	return positions, args.Error(1)
+}
+
+func TestReaderHandler(t *testing.T) {
+	// Three pages of 1020 bytes, 1020 bytes and 960 bytes at a page size of 1000
+	line := "Nothing will come of nothing.\n"
+	content := strings.Repeat(line, 100)
+
+	mockUsecase := new(MockBookUsecase)
+	mockUsecase.On("FetchMetadata", 1532).Return(&domain.Book{
+		GutenbergID: 1532,
+		Metadata:    domain.Metadata{Title: "King Lear"},
+	}, nil)
+	mockUsecase.On("OpenContent", 1532).Return(content, nil)
+
+	newRouter := func(repo *MockReadingRepository) *mux.Router {
+		handler := delivery.NewReaderHandler(mockUsecase, usecase.NewReadingUsecase(repo, mockUsecase), createTestTemplates())
+		router := mux.NewRouter()
+		router.HandleFunc("/books/{id:[0-9]+}/read", handler.Read).Methods("GET")
+		router.HandleFunc("/books/{id:[0-9]+}/pages", handler.Pages).Methods("GET")
+		router.HandleFunc("/reading", handler.Recent).Methods("GET")
+		return router
+	}
+
+	get := func(router *mux.Router, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.AddCookie(&http.Cookie{Name: "lear_visitor", Value: "reader"})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Page by number", func(t *testing.T) {
+		repo := new(MockReadingRepository)
+		repo.On("SavePosition", &domain.ReadingPosition{UserID: "reader", GutenbergID: 1532, Mode: "size", PageSize: 1000, Offset: 1020}).Return(nil)
+
+		rec := get(newRouter(repo), "/books/1532/read?page=2&size=1000&format=json")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var page domain.Page
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Equal(t, 2, page.Number)
+		assert.Equal(t, 3, page.Total)
+		assert.Equal(t, content[1020:2040], page.Text)
+		repo.AssertExpectations(t)
+	})
+
+	t.Run("Resumes the saved position", func(t *testing.T) {
+		repo := new(MockReadingRepository)
+		repo.On("GetPosition", "reader", 1532).Return(&domain.ReadingPosition{Mode: "size", PageSize: 1000, Offset: 2040}, nil)
+		repo.On("SavePosition", mock.Anything).Return(nil)
+
+		rec := get(newRouter(repo), "/books/1532/read")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Page 3 of 3")
+	})
+
+	t.Run("Paginates once per layout", func(t *testing.T) {
+		repo := new(MockReadingRepository)
+		repo.On("GetPosition", "reader", 1532).Return(&domain.ReadingPosition{Mode: "size", PageSize: 1000, Offset: 1020}, nil)
+		repo.On("SavePosition", mock.Anything).Return(nil)
+
+		reading := usecase.NewReadingUsecase(repo, mockUsecase)
+		paginated := 0
+		reading.Paginate = func(text string, mode string, pageSize int) []domain.PageRef {
+			paginated++
+			return service.Paginate(text, mode, pageSize)
+		}
+		handler := delivery.NewReaderHandler(mockUsecase, reading, createTestTemplates())
+		router := mux.NewRouter()
+		router.HandleFunc("/books/{id:[0-9]+}/read", handler.Read).Methods("GET")
+
+		rec := get(router, "/books/1532/read")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Page 2 of 3")
+		assert.Equal(t, 1, paginated, "the page and the page index share one pagination")
+
+		rec = get(router, "/books/1532/read?page=3&mode=size&size=1000&format=json")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, 1, paginated, "the page index is cached")
+		var page domain.Page
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Equal(t, content[2040:], page.Text, "the page is read from its byte range")
+		mockUsecase.AssertNotCalled(t, "FetchBook", 1532)
+	})
+
+	t.Run("Highlights an offset", func(t *testing.T) {
+		repo := new(MockReadingRepository)
+		repo.On("SavePosition", mock.Anything).Return(nil)
+
+		rec := get(newRouter(repo), "/books/1532/read?size=1000&offset=1050&end=1057")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Page 2 of 3")
+		assert.Contains(t, rec.Body.String(), "<mark>Nothing</mark>")
+	})
+
+	t.Run("Page out of range", func(t *testing.T) {
+		rec := get(newRouter(new(MockReadingRepository)), "/books/1532/read?page=9&size=1000")
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Invalid mode", func(t *testing.T) {
+		rec := get(newRouter(new(MockReadingRepository)), "/books/1532/read?mode=chapter")
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Invalid page size", func(t *testing.T) {
+		rec := get(newRouter(new(MockReadingRepository)), "/books/1532/pages?size=10")
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Page index", func(t *testing.T) {
+		rec := get(newRouter(new(MockReadingRepository)), "/books/1532/pages?size=1000")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var pages []domain.PageRef
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pages))
+		assert.Len(t, pages, 3)
+		assert.Equal(t, 2040, pages[2].Start)
+	})
+
+	t.Run("Continue reading", func(t *testing.T) {
+		repo := new(MockReadingRepository)
+		repo.On("RecentPositions", "reader", 10).Return(nil, nil)
+
+		rec := get(newRouter(repo), "/reading")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `[]`, rec.Body.String())
+	})
+
+	t.Run("Continue reading books stored elsewhere", func(t *testing.T) {
+		repo := new(MockReadingRepository)
+		repo.On("RecentPositions", "reader", 10).Return([]domain.ReadingPosition{{GutenbergID: 1532, Mode: "size", PageSize: 1000}}, nil)
+
+		rec := get(newRouter(repo), "/reading")
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var positions []domain.ReadingPosition
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &positions))
+		if assert.Len(t, positions, 1) {
+			assert.Equal(t, "King Lear", positions[0].Title)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package delivery
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+type SentimentHandler struct {
+	Books     usecase.IBookUsecase
+	Sentiment usecase.ISentimentUsecase
+	Quota     *QuotaHandler
+	Logger    *service.Logger
+}
+
+// NewSentimentHandler limits the llm method with quota when it is not nil
+func NewSentimentHandler(books usecase.IBookUsecase, sentiment usecase.ISentimentUsecase, quota *QuotaHandler) *SentimentHandler {
+	logger := service.NewLogger("[SentimentHandler]")
+	return &SentimentHandler{Books: books, Sentiment: sentiment, Quota: quota, Logger: logger}
+}
+
+// Arc returns the sentiment of the book segment by segment, as JSON or, with format=csv, as CSV
+func (h *SentimentHandler) Arc(w http.ResponseWriter, r *http.Request) {
+	gutenbergID := mux.Vars(r)["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+
+	method := query.Get("method")
+	if method == "" {
+		method = domain.SentimentLexicon
+	}
+	if method != domain.SentimentLexicon && method != domain.SentimentLLM {
+		http.Error(w, "Invalid method", http.StatusBadRequest)
+		return
+	}
+
+	segments := service.DefaultSentimentSegments
+	if value := query.Get("segments"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > service.MaxSentimentSegments {
+			http.Error(w, "Invalid segments", http.StatusBadRequest)
+			return
+		}
+		segments = parsed
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	// The llm method calls the paid AI engine, the lexicon is free for everyone
+	if method == domain.SentimentLLM {
+		if _, ok := requireUser(w, r); !ok || !h.Quota.Allow(w, r) {
+			return
+		}
+	}
+
+	book, err := h.Books.FetchBook(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch book", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return
+	}
+
+	// The llm method scores every segment with the AI engine, which can take a while. Each call after the first,
+	// which was allowed above, takes from the rate limit and quota again.
+	ctx, cancel := context.WithTimeout(r.Context(), analysisTimeout)
+	defer cancel()
+	ctx = service.WithCallCheck(ctx, func() error {
+		refusal, err := h.Quota.check(requestCaller(r))
+		if refusal != nil {
+			return refusal
+		}
+		return err
+	})
+
+	arc, err := h.Sentiment.Arc(ctx, book, method, segments)
+	var refusal *service.AnalysisError
+	if errors.As(err, &refusal) && (refusal.Code == service.ErrCodeRateLimited || refusal.Code == service.ErrCodeQuotaExceeded) {
+		if refusal.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(refusal.RetryAfter))
+		}
+		http.Error(w, refusal.Message, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		h.Logger.LogError("Failed to compute sentiment arc", err)
+		http.Error(w, "Failed to compute sentiment arc", http.StatusBadGateway)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="book-%d-sentiment-%s.csv"`, id, method))
+		if err := writeSentimentCSV(w, arc); err != nil {
+			h.Logger.LogError("Failed to write CSV", err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, arc)
+}
+
+func writeSentimentCSV(w http.ResponseWriter, arc *domain.SentimentArc) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"segment", "start", "end", "score", "label"})
+	for _, point := range arc.Points {
+		writer.Write([]string{
+			strconv.Itoa(point.Segment),
+			strconv.Itoa(point.Start),
+			strconv.Itoa(point.End),
+			strconv.FormatFloat(point.Score, 'f', -1, 64),
+			point.Label,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
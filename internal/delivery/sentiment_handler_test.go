@@ -0,0 +1,121 @@
+package delivery_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+type MockSentimentUsecase struct {
+	mock.Mock
+}
+
+func (m *MockSentimentUsecase) Arc(ctx context.Context, book *domain.Book, method string, segments int) (*domain.SentimentArc, error) {
+	args := m.Called(ctx, book, method, segments)
+	arc, _ := args.Get(0).(*domain.SentimentArc)
+	return arc, args.Error(1)
+}
+
+func newSentimentRouter(handler *delivery.SentimentHandler) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/sentiment", handler.Arc).Methods("GET")
+	return router
+}
+
+func TestSentimentHandler_Arc(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockSentiment := new(MockSentimentUsecase)
+	router := newSentimentRouter(delivery.NewSentimentHandler(mockUsecase, mockSentiment, nil))
+
+	book := &domain.Book{GutenbergID: 1128}
+	mockUsecase.On("FetchBook", 1128).Return(book, nil)
+	arc := &domain.SentimentArc{
+		GutenbergID: 1128,
+		Method:      domain.SentimentLexicon,
+		Points: domain.SentimentPoints{
+			{Segment: 1, Start: 0, End: 120, Score: 0.25, Label: "positive"},
+			{Segment: 2, Start: 121, End: 240, Score: -0.5, Label: "negative"},
+		},
+	}
+	mockSentiment.On("Arc", mock.Anything, book, "lexicon", 20).Return(arc, nil)
+	mockSentiment.On("Arc", mock.Anything, book, "lexicon", 2).Return(arc, nil)
+
+	t.Run("JSON with defaults", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/1128/sentiment", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"score":-0.5`)
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/books/1128/sentiment?segments=2&format=csv", nil)
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "segment,start,end,score,label\n1,0,120,0.25,positive\n2,121,240,-0.5,negative\n", rec.Body.String())
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"method=vibes", "segments=0", "segments=101", "format=xlsx"} {
+			req, _ := http.NewRequest("GET", "/books/1128/sentiment?"+query, nil)
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+		}
+	})
+}
+
+// callingSentiment scores every segment with a call to the AI engine, checking the limits before each call
+// after the first like the usecase does
+type callingSentiment struct {
+	calls int
+}
+
+func (s *callingSentiment) Arc(ctx context.Context, book *domain.Book, method string, segments int) (*domain.SentimentArc, error) {
+	arc := &domain.SentimentArc{GutenbergID: book.GutenbergID, Method: method}
+	for i := 0; i < segments; i++ {
+		if i > 0 {
+			if err := service.CheckCall(ctx); err != nil {
+				return nil, err
+			}
+		}
+		s.calls++
+		arc.Points = append(arc.Points, domain.SentimentPoint{Segment: i + 1})
+	}
+	return arc, nil
+}
+
+func TestSentimentHandler_ArcLimitsEveryCall(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockUsecase.On("FetchBook", 1128).Return(&domain.Book{GutenbergID: 1128}, nil)
+	quota := new(MockQuotaUsecase)
+	quota.On("Check", mock.Anything).Return(nil)
+	limits := delivery.NewQuotaHandler(quota, service.NewRateLimiter(1, 2), nil, createTestTemplates())
+	sentiment := &callingSentiment{}
+	server := signedIn(newSentimentRouter(delivery.NewSentimentHandler(mockUsecase, sentiment, limits)))
+
+	req, _ := http.NewRequest("GET", "/books/1128/sentiment?method=llm&segments=3", nil)
+	rec := httptest.NewRecorder()
+
+	server.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	assert.Equal(t, 2, sentiment.calls, "the third call is refused once the burst of two is spent")
+}
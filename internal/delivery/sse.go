@@ -0,0 +1,335 @@
+package delivery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CloseEvent = "Close"
+
+	defaultRetry     = 3 * time.Second
+	defaultKeepAlive = 15 * time.Second
+	defaultStreamTTL = 10 * time.Minute
+	// defaultGrace is how long a run goes on with nobody following its stream, longer than a reconnect takes
+	defaultGrace = 30 * time.Second
+)
+
+// SSEWriter writes Server-Sent Events frames to a client
+type SSEWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	mu      sync.Mutex
+}
+
+// NewSSEWriter sets the event-stream headers and tells the client how long to wait before reconnecting
+func NewSSEWriter(w http.ResponseWriter, retry time.Duration) (*SSEWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported by response writer")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	s := &SSEWriter{w: w, flusher: flusher}
+	if err := s.write(fmt.Sprintf("retry: %d\n\n", retry.Milliseconds())); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WriteEvent writes a single event frame, splitting multi-line data into several data fields
+func (s *SSEWriter) WriteEvent(event SSEEvent) error {
+	var frame strings.Builder
+	if event.ID != "" {
+		frame.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Name != "" {
+		frame.WriteString("event: " + event.Name + "\n")
+	}
+	for _, line := range strings.Split(string(event.Data), "\n") {
+		frame.WriteString("data: " + line + "\n")
+	}
+	frame.WriteString("\n")
+
+	return s.write(frame.String())
+}
+
+// WriteComment writes a comment line, which clients ignore and proxies see as traffic
+func (s *SSEWriter) WriteComment(comment string) error {
+	return s.write(": " + comment + "\n\n")
+}
+
+func (s *SSEWriter) write(frame string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write([]byte(frame)); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// SSEEvent is an event already marshaled and numbered within its stream
+type SSEEvent struct {
+	ID   string
+	Name string
+	Data json.RawMessage
+}
+
+// SSEStream records the events produced by one run so that reconnecting clients can replay what they missed
+type SSEStream struct {
+	ID string
+	// Key names what the stream is about, a stream is only resumed from a request for the same key
+	Key string
+
+	mu          sync.Mutex
+	events      []SSEEvent
+	done        bool
+	finishedAt  time.Time
+	updated     chan struct{}
+	subscribers int
+	grace       time.Duration
+	abandon     context.CancelFunc
+	idle        *time.Timer
+}
+
+func newSSEStream(id string, key string, grace time.Duration) *SSEStream {
+	return &SSEStream{ID: id, Key: key, grace: grace, updated: make(chan struct{})}
+}
+
+// CancelWhenAbandoned calls cancel once nobody has followed the stream for the grace period of its hub, so a
+// run stops calling the AI engine after its clients left
+func (s *SSEStream) CancelWhenAbandoned(cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.abandon = cancel
+	s.waitIdle()
+}
+
+func (s *SSEStream) subscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscribers++
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+}
+
+func (s *SSEStream) unsubscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscribers--
+	s.waitIdle()
+}
+
+// waitIdle starts the grace period when the last subscriber left a running stream, s.mu must be held
+func (s *SSEStream) waitIdle() {
+	if s.subscribers > 0 || s.done || s.abandon == nil || s.idle != nil {
+		return
+	}
+
+	s.idle = time.AfterFunc(s.grace, func() {
+		s.mu.Lock()
+		abandoned := s.subscribers == 0 && !s.done
+		cancel := s.abandon
+		s.idle = nil
+		s.mu.Unlock()
+
+		if abandoned {
+			cancel()
+		}
+	})
+}
+
+// Send marshals the data as JSON and appends it to the stream, waking up every subscriber
+func (s *SSEStream) Send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event data: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done {
+		return errors.New("stream already closed")
+	}
+
+	s.events = append(s.events, SSEEvent{
+		ID:   fmt.Sprintf("%s-%d", s.ID, len(s.events)+1),
+		Name: event,
+		Data: payload,
+	})
+	s.notify()
+	return nil
+}
+
+// Close appends the final Close event and marks the stream as finished
+func (s *SSEStream) Close() {
+	if err := s.Send(CloseEvent, "Stream Ended"); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.done = true
+	s.finishedAt = time.Now()
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	s.notify()
+}
+
+// since returns the events after the given sequence number and a channel closed on the next update
+func (s *SSEStream) since(seq int) ([]SSEEvent, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq > len(s.events) {
+		seq = len(s.events)
+	}
+	pending := append([]SSEEvent(nil), s.events[seq:]...)
+	return pending, s.done, s.updated
+}
+
+func (s *SSEStream) notify() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *SSEStream) expired(ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done && time.Since(s.finishedAt) > ttl
+}
+
+// StreamHub keeps recent streams around so clients can resume them with Last-Event-ID
+type StreamHub struct {
+	Retry     time.Duration
+	KeepAlive time.Duration
+	TTL       time.Duration
+	// Grace is how long an abandoned stream's run goes on, see SSEStream.CancelWhenAbandoned
+	Grace time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*SSEStream
+}
+
+func NewStreamHub() *StreamHub {
+	return &StreamHub{
+		Retry:     defaultRetry,
+		KeepAlive: defaultKeepAlive,
+		TTL:       defaultStreamTTL,
+		Grace:     defaultGrace,
+		streams:   make(map[string]*SSEStream),
+	}
+}
+
+// Open registers a new stream with a random ID, about the given key
+func (h *StreamHub) Open(key string) *SSEStream {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		buf = []byte(strconv.FormatInt(time.Now().UnixNano(), 16))
+	}
+
+	h.mu.Lock()
+	stream := newSSEStream(hex.EncodeToString(buf), key, h.Grace)
+	defer h.mu.Unlock()
+
+	for id, s := range h.streams {
+		if s.expired(h.TTL) {
+			delete(h.streams, id)
+		}
+	}
+	h.streams[stream.ID] = stream
+	return stream
+}
+
+// Lookup returns a live stream by its ID when it is about the key
+func (h *StreamHub) Lookup(key string, id string) (*SSEStream, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream, ok := h.streams[id]
+	if !ok || stream.Key != key || stream.expired(h.TTL) {
+		return nil, false
+	}
+	return stream, true
+}
+
+// Resume looks up the stream about the key referenced by a Last-Event-ID value ("<stream>-<seq>")
+func (h *StreamHub) Resume(key string, lastEventID string) (*SSEStream, int, bool) {
+	sep := strings.LastIndex(lastEventID, "-")
+	if sep <= 0 {
+		return nil, 0, false
+	}
+
+	seq, err := strconv.Atoi(lastEventID[sep+1:])
+	if err != nil || seq < 0 {
+		return nil, 0, false
+	}
+
+	stream, ok := h.Lookup(key, lastEventID[:sep])
+	if !ok {
+		return nil, 0, false
+	}
+	return stream, seq, true
+}
+
+// Serve writes the stream to the client starting after seq, sending keep-alive comments while it waits
+func (h *StreamHub) Serve(w http.ResponseWriter, r *http.Request, stream *SSEStream, seq int) error {
+	writer, err := NewSSEWriter(w, h.Retry)
+	if err != nil {
+		return err
+	}
+
+	stream.subscribe()
+	defer stream.unsubscribe()
+
+	keepAlive := time.NewTicker(h.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		events, done, updated := stream.since(seq)
+		for _, event := range events {
+			if err := writer.WriteEvent(event); err != nil {
+				return fmt.Errorf("failed to send event: %w", err)
+			}
+			seq++
+		}
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-updated:
+		case <-keepAlive.C:
+			if err := writer.WriteComment("keep-alive"); err != nil {
+				return fmt.Errorf("failed to send keep-alive: %w", err)
+			}
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
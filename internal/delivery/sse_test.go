@@ -0,0 +1,109 @@
+package delivery_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/delivery"
+)
+
+func TestSSEWriter_WriteEvent(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	writer, err := delivery.NewSSEWriter(rec, 2*time.Second)
+	assert.NoError(t, err)
+
+	err = writer.WriteEvent(delivery.SSEEvent{ID: "abc-1", Name: "CustomEvent", Data: []byte("line one\nline two")})
+	assert.NoError(t, err)
+
+	err = writer.WriteComment("keep-alive")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "retry: 2000\n\nid: abc-1\nevent: CustomEvent\ndata: line one\ndata: line two\n\n: keep-alive\n\n", rec.Body.String())
+}
+
+func TestStreamHub_Resume(t *testing.T) {
+	hub := delivery.NewStreamHub()
+	stream := hub.Open("1532")
+
+	resumed, seq, ok := hub.Resume("1532", stream.ID+"-4")
+	assert.True(t, ok)
+	assert.Equal(t, stream, resumed)
+	assert.Equal(t, 4, seq)
+
+	_, _, ok = hub.Resume("2264", stream.ID+"-4")
+	assert.False(t, ok, "a stream is only resumed for its own key")
+
+	_, _, ok = hub.Resume("1532", "unknown-1")
+	assert.False(t, ok)
+
+	_, _, ok = hub.Resume("1532", stream.ID)
+	assert.False(t, ok)
+}
+
+func TestStreamHub_CancelWhenAbandoned(t *testing.T) {
+	hub := delivery.NewStreamHub()
+	hub.Grace = 20 * time.Millisecond
+
+	t.Run("Followed", func(t *testing.T) {
+		stream := hub.Open("1532")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream.CancelWhenAbandoned(cancel)
+
+		go func() {
+			time.Sleep(60 * time.Millisecond)
+			stream.Close()
+		}()
+
+		req := httptest.NewRequest(http.MethodGet, "/books/1532/analyze", nil)
+		assert.NoError(t, hub.Serve(httptest.NewRecorder(), req, stream, 0))
+		assert.NoError(t, ctx.Err(), "a followed run goes on")
+	})
+
+	t.Run("Abandoned", func(t *testing.T) {
+		stream := hub.Open("1532")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream.CancelWhenAbandoned(cancel)
+
+		reqCtx, leave := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/books/1532/analyze", nil).WithContext(reqCtx)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			leave()
+		}()
+		assert.Error(t, hub.Serve(httptest.NewRecorder(), req, stream, 0))
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("the run goes on after its only client left")
+		}
+	})
+}
+
+func TestStreamHub_ServeSendsKeepAlive(t *testing.T) {
+	hub := delivery.NewStreamHub()
+	hub.KeepAlive = 10 * time.Millisecond
+	stream := hub.Open("1")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		stream.Send("CustomEvent", map[string]string{"analysis": "late"})
+		stream.Close()
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/books/1/analyze", nil)
+	rec := httptest.NewRecorder()
+
+	err := hub.Serve(rec, req.WithContext(context.Background()), stream, 0)
+	assert.NoError(t, err)
+	assert.Contains(t, rec.Body.String(), ": keep-alive\n\n")
+	assert.Contains(t, rec.Body.String(), `data: {"analysis":"late"}`)
+}
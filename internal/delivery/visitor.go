@@ -0,0 +1,42 @@
+package delivery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	visitorCookie = "lear_visitor"
+	// userPrefix starts the IDs of signed in users, which a visitor cookie must not claim
+	userPrefix = "user-"
+)
+
+// visitorID identifies the signed in user, or else the browser making the request, issuing a long-lived cookie
+// on the first visit. A cookie posing as a user's ID is replaced by a new one.
+func visitorID(w http.ResponseWriter, r *http.Request) string {
+	if user := CurrentUser(r); user != nil {
+		return fmt.Sprintf("%s%d", userPrefix, user.ID)
+	}
+
+	if cookie, err := r.Cookie(visitorCookie); err == nil && cookie.Value != "" && !strings.HasPrefix(cookie.Value, userPrefix) {
+		return cookie.Value
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
@@ -0,0 +1,213 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	CanceledEvent = "Canceled"
+
+	SocketAnalyze = "analyze"
+	SocketAsk     = "ask"
+	SocketCancel  = "cancel"
+)
+
+// SocketCommand is a control message sent by the client
+type SocketCommand struct {
+	Type     string `json:"type"`
+	Kind     string `json:"kind,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Question string `json:"question,omitempty"`
+}
+
+// SocketMessage is an analysis event sent to the client, tagged with the run that produced it
+type SocketMessage struct {
+	Run   int         `json:"run"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// AnalysisSocket opens an interactive analysis session where the client can start, steer and cancel runs
+func (h *BookHandler) AnalysisSocket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	gutenbergID := vars["id"]
+
+	h.Logger.SetTags(fmt.Sprintf("[book-%s]", gutenbergID))
+
+	id, err := strconv.Atoi(gutenbergID)
+	if err != nil {
+		h.Logger.LogError("Failed to parse gutenbergID", err)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	book, err := h.Usecase.FetchBook(id)
+	if err != nil {
+		h.Logger.LogError("Failed to fetch book", err)
+		http.Error(w, "Failed to fetch book", http.StatusNotFound)
+		return
+	}
+
+	caller := requestCaller(r)
+	server := websocket.Server{
+		Handshake: checkSameOrigin,
+		Handler: func(conn *websocket.Conn) {
+			session := &analysisSession{conn: conn, analysis: h.Analysis, quota: h.Quota, caller: caller, book: book, logger: h.Logger}
+			session.serve()
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// checkSameOrigin rejects browser connections opened from another site, clients without an Origin are allowed
+func checkSameOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin: %w", err)
+	}
+	if originURL.Host != r.Host {
+		return fmt.Errorf("cross-origin websocket from %s", origin)
+	}
+
+	config.Origin = originURL
+	return nil
+}
+
+type analysisSession struct {
+	conn     *websocket.Conn
+	analysis usecase.IAnalysisUsecase
+	quota    *QuotaHandler
+	caller   service.Caller
+	book     *domain.Book
+	logger   *service.Logger
+
+	mu     sync.Mutex
+	run    int
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (s *analysisSession) serve() {
+	ctx, cancel := context.WithCancel(service.WithCaller(context.Background(), s.caller))
+	defer func() {
+		cancel()
+		s.wg.Wait()
+	}()
+
+	for {
+		var cmd SocketCommand
+		if err := websocket.JSON.Receive(s.conn, &cmd); err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.LogError("Failed to read socket command", err)
+			}
+			return
+		}
+
+		if (cmd.Type == SocketAnalyze || cmd.Type == SocketAsk) && !s.allowed() {
+			continue
+		}
+
+		switch cmd.Type {
+		case SocketAnalyze:
+			s.start(ctx, func(ctx context.Context, events service.EventSender) error {
+				return s.analysis.Analyze(ctx, events, s.caller.UserID, s.book, cmd.Kind, cmd.Version)
+			})
+		case SocketAsk:
+			s.start(ctx, func(ctx context.Context, events service.EventSender) error {
+				return s.analysis.AnswerQuestion(ctx, events, s.book, cmd.Question)
+			})
+		case SocketCancel:
+			s.stop()
+		default:
+			events := &socketSender{conn: s.conn}
+			events.Send(service.ErrorEvent, &service.AnalysisError{
+				Code:    service.ErrCodeInvalidRequest,
+				Message: fmt.Sprintf("Unknown command %q.", cmd.Type),
+			})
+		}
+	}
+}
+
+// allowed checks the rate limit and quota of the session's caller before a command that calls the AI engine,
+// telling the client why it is refused and when to try again
+func (s *analysisSession) allowed() bool {
+	refusal, err := s.quota.check(s.caller)
+	if err != nil {
+		refusal = &service.AnalysisError{Code: service.ErrCodeInternal, Message: "Failed to check quota.", Retryable: true}
+	}
+	if refusal == nil {
+		return true
+	}
+
+	events := &socketSender{conn: s.conn}
+	events.Send(service.ErrorEvent, refusal)
+	return false
+}
+
+// start cancels the current run, if any, and runs the analysis with a new run number
+func (s *analysisSession) start(parent context.Context, analysis func(context.Context, service.EventSender) error) {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.run++
+	ctx, cancel := context.WithTimeout(parent, analysisTimeout)
+	s.cancel = cancel
+	events := &socketSender{conn: s.conn, run: s.run}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		err := analysis(ctx, events)
+		switch {
+		case err == nil:
+			events.Send(CloseEvent, "Stream Ended")
+		case errors.Is(err, context.Canceled):
+			events.Send(CanceledEvent, "Analysis canceled")
+		default:
+			s.logger.LogError("Failed to stream analysis", err)
+			events.Send(service.ErrorEvent, service.AsAnalysisError(err))
+		}
+	}()
+}
+
+func (s *analysisSession) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+// socketSender implements service.EventSender over the session's connection
+type socketSender struct {
+	conn *websocket.Conn
+	run  int
+}
+
+func (s *socketSender) Send(event string, data interface{}) error {
+	return websocket.JSON.Send(s.conn, SocketMessage{Run: s.run, Event: event, Data: data})
+}
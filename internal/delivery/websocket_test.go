@@ -0,0 +1,125 @@
+package delivery_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/delivery"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"golang.org/x/net/websocket"
+)
+
+func dialAnalysisSocket(t *testing.T, handler *delivery.BookHandler) *websocket.Conn {
+	router := mux.NewRouter()
+	router.HandleFunc("/books/{id}/ws", handler.AnalysisSocket)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/books/123/ws"
+	conn, err := websocket.Dial(wsURL, "", server.URL)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func receiveUntil(t *testing.T, conn *websocket.Conn, event string) []delivery.SocketMessage {
+	var messages []delivery.SocketMessage
+	for {
+		var msg delivery.SocketMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatalf("failed to receive %s: %v", event, err)
+		}
+		messages = append(messages, msg)
+		if msg.Event == event {
+			return messages
+		}
+	}
+}
+
+func TestBookHandler_AnalysisSocket(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockService := new(MockAnalysisUsecase)
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), nil, createTestTemplates())
+
+	book := &domain.Book{Content: "Lear divides his kingdom."}
+	mockUsecase.On("FetchBook", 123).Return(book, nil)
+
+	t.Run("Analyze and ask a follow-up", func(t *testing.T) {
+		mockService.On("Analyze", mock.Anything, mock.Anything, 0, book, "themes", "").Run(func(args mock.Arguments) {
+			args.Get(1).(service.EventSender).Send("CustomEvent", service.AnalysisChunk{Analysis: "Madness"})
+		}).Return(nil).Once()
+		mockService.On("AnswerQuestion", mock.Anything, mock.Anything, book, "Why?").Run(func(args mock.Arguments) {
+			args.Get(1).(service.EventSender).Send("CustomEvent", service.AnalysisChunk{Analysis: "Pride"})
+		}).Return(nil).Once()
+
+		conn := dialAnalysisSocket(t, handler)
+
+		assert.NoError(t, websocket.JSON.Send(conn, delivery.SocketCommand{Type: "analyze", Kind: "themes"}))
+		messages := receiveUntil(t, conn, "Close")
+		assert.Equal(t, 1, messages[0].Run)
+		assert.Equal(t, map[string]interface{}{"analysis": "Madness"}, messages[0].Data)
+
+		assert.NoError(t, websocket.JSON.Send(conn, delivery.SocketCommand{Type: "ask", Question: "Why?"}))
+		messages = receiveUntil(t, conn, "Close")
+		assert.Equal(t, 2, messages[0].Run)
+		assert.Equal(t, map[string]interface{}{"analysis": "Pride"}, messages[0].Data)
+	})
+
+	t.Run("Cancel a running analysis", func(t *testing.T) {
+		mockService.On("Analyze", mock.Anything, mock.Anything, 0, book, "summary", "").Run(func(args mock.Arguments) {
+			<-args.Get(0).(context.Context).Done()
+		}).Return(context.Canceled).Once()
+
+		conn := dialAnalysisSocket(t, handler)
+
+		assert.NoError(t, websocket.JSON.Send(conn, delivery.SocketCommand{Type: "analyze", Kind: "summary"}))
+		assert.NoError(t, websocket.JSON.Send(conn, delivery.SocketCommand{Type: "cancel"}))
+
+		messages := receiveUntil(t, conn, "Canceled")
+		assert.Equal(t, 1, messages[len(messages)-1].Run)
+	})
+
+	t.Run("Unknown command", func(t *testing.T) {
+		conn := dialAnalysisSocket(t, handler)
+
+		assert.NoError(t, websocket.JSON.Send(conn, delivery.SocketCommand{Type: "dance"}))
+
+		messages := receiveUntil(t, conn, "error")
+		assert.Equal(t, "invalid_request", messages[0].Data.(map[string]interface{})["code"])
+	})
+}
+
+func TestBookHandler_AnalysisSocketLimitsEachCommand(t *testing.T) {
+	mockUsecase := new(MockBookUsecase)
+	mockService := new(MockAnalysisUsecase)
+	quota := new(MockQuotaUsecase)
+	quota.On("Check", mock.Anything).Return(nil)
+	limits := delivery.NewQuotaHandler(quota, service.NewRateLimiter(1, 1), nil, createTestTemplates())
+	handler := delivery.NewBookHandler(mockUsecase, mockService, newTextStats(mockUsecase), limits, createTestTemplates())
+
+	book := &domain.Book{Content: "Lear divides his kingdom."}
+	mockUsecase.On("FetchBook", 123).Return(book, nil)
+	mockService.On("AnswerQuestion", mock.Anything, mock.Anything, book, "Why?").Return(nil).Once()
+
+	conn := dialAnalysisSocket(t, handler)
+
+	assert.NoError(t, websocket.JSON.Send(conn, delivery.SocketCommand{Type: "ask", Question: "Why?"}))
+	receiveUntil(t, conn, "Close")
+
+	assert.NoError(t, websocket.JSON.Send(conn, delivery.SocketCommand{Type: "ask", Question: "Why?"}))
+	messages := receiveUntil(t, conn, "error")
+	refusal := messages[len(messages)-1].Data.(map[string]interface{})
+	assert.Equal(t, "rate_limited", refusal["code"])
+	assert.Greater(t, refusal["retry_after"], float64(0))
+	mockService.AssertNumberOfCalls(t, "AnswerQuestion", 1)
+}
@@ -0,0 +1,17 @@
+package domain
+
+import "time"
+
+// Analysis is the stored result of an analysis run, tied to the prompt version that produced it, the engine and
+// model that answered and the user who ran it, UserID is 0 when unknown
+type Analysis struct {
+	ID            int       `json:"id"`
+	GutenbergID   int       `json:"gutenberg_id"`
+	UserID        int       `json:"user_id,omitempty"`
+	Kind          string    `json:"kind"`
+	PromptVersion string    `json:"prompt_version"`
+	Engine        string    `json:"engine,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	Content       string    `json:"content"`
+	CreatedAt     time.Time `json:"created_at"`
+}
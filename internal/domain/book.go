@@ -7,10 +7,13 @@ import (
 	"time"
 )
 
+// Book is a stored work. Its Content lives in blob storage under ContentHash and is only filled in when the book
+// is fetched to be read or analyzed, listings leave it empty.
 type Book struct {
 	ID          int
 	GutenbergID int
 	Content     string
+	ContentHash string
 	Metadata    Metadata
 	CreatedAt   time.Time
 	DeletedAt   time.Time
@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	// GraphSpeakers graphs are built from the speaker tags of a play, an edge goes from a speaker to the next one
+	GraphSpeakers = "speakers"
+	// GraphMentions graphs link the characters mentioned in the same paragraph
+	GraphMentions = "mentions"
+)
+
+// CharacterGraph is the interaction network of a book's characters
+type CharacterGraph struct {
+	GutenbergID int            `json:"gutenberg_id"`
+	Method      string         `json:"method"`
+	Directed    bool           `json:"directed"`
+	Nodes       CharacterNodes `json:"nodes"`
+	Edges       CharacterEdges `json:"edges"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// CharacterNode is a character weighted by how many speeches or mentions it has
+type CharacterNode struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// CharacterEdge is weighted by how many times the two characters interact
+type CharacterEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
+}
+
+type CharacterNodes []CharacterNode
+
+func (n CharacterNodes) Value() (driver.Value, error) {
+	return json.Marshal(n)
+}
+
+func (n *CharacterNodes) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, n)
+}
+
+type CharacterEdges []CharacterEdge
+
+func (e CharacterEdges) Value() (driver.Value, error) {
+	return json.Marshal(e)
+}
+
+func (e *CharacterEdges) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, e)
+}
@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// ChatMessage is one turn of a user's conversation about a book
+type ChatMessage struct {
+	ID            int       `json:"id"`
+	UserID        string    `json:"-"`
+	GutenbergID   int       `json:"gutenberg_id"`
+	Role          string    `json:"role"`
+	Content       string    `json:"content"`
+	Citations     Citations `json:"citations,omitempty"`
+	PromptVersion string    `json:"prompt_version,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
@@ -0,0 +1,9 @@
+package domain
+
+// BookComparison is one column of a comparison: what is known about a book without running a new analysis
+type BookComparison struct {
+	GutenbergID int        `json:"gutenberg_id"`
+	Metadata    Metadata   `json:"metadata"`
+	Stats       *TextStats `json:"stats"`
+	Analyses    []Analysis `json:"analyses"`
+}
@@ -0,0 +1,40 @@
+package domain
+
+import "time"
+
+const (
+	JobFetch    = "fetch"
+	JobAnalysis = "analysis"
+
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a fetch or analysis of a book run by a background worker, with its progress from 0 to 100. UserID is
+// the user who queued it, 0 for anonymous fetches.
+type Job struct {
+	ID            int        `json:"id"`
+	Kind          string     `json:"kind"`
+	GutenbergID   int        `json:"gutenberg_id"`
+	UserID        int        `json:"user_id,omitempty"`
+	AnalysisKind  string     `json:"analysis_kind,omitempty"`
+	PromptVersion string     `json:"prompt_version,omitempty"`
+	Status        string     `json:"status"`
+	Progress      int        `json:"progress"`
+	Message       string     `json:"message,omitempty"`
+	Attempts      int        `json:"attempts"`
+	MaxAttempts   int        `json:"max_attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	RunAt         time.Time  `json:"run_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+}
+
+// Finished tells whether the job will not run again
+func (j *Job) Finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
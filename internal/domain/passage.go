@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// Passage is a slice of a book's content, located by byte offsets, indexed with an embedding
+type Passage struct {
+	ID          int       `json:"id"`
+	GutenbergID int       `json:"gutenberg_id"`
+	Model       string    `json:"-"`
+	Start       int       `json:"start"`
+	End         int       `json:"end"`
+	Content     string    `json:"content"`
+	Embedding   []float32 `json:"-"`
+	Score       float64   `json:"score,omitempty"`
+}
+
+// Citation points an answer back to the passage supporting it
+type Citation struct {
+	Label string `json:"label"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+type Citations []Citation
+
+func (c Citations) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return json.Marshal(c)
+}
+
+func (c *Citations) Scan(value interface{}) error {
+	if value == nil {
+		*c = nil
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, c)
+}
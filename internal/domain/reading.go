@@ -0,0 +1,37 @@
+package domain
+
+import "time"
+
+const (
+	PageBySize    = "size"
+	PageBySection = "section"
+)
+
+// PageRef locates a page of a book's content by byte offsets, Title is the heading of a section
+type PageRef struct {
+	Number int    `json:"number"`
+	Title  string `json:"title,omitempty"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+// Page is a page of a book with its text, and the mode and page size the book was paged in
+type Page struct {
+	PageRef
+	Total    int    `json:"total"`
+	Mode     string `json:"mode"`
+	PageSize int    `json:"page_size"`
+	Text     string `json:"text"`
+}
+
+// ReadingPosition is where a reader left a book, as the byte offset of the page they were on, so it survives
+// a change of page size or mode
+type ReadingPosition struct {
+	UserID      string    `json:"-"`
+	GutenbergID int       `json:"gutenberg_id"`
+	Title       string    `json:"title,omitempty"`
+	Mode        string    `json:"mode"`
+	PageSize    int       `json:"page_size"`
+	Offset      int       `json:"offset"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	SentimentLexicon = "lexicon"
+	SentimentLLM     = "llm"
+)
+
+// SentimentArc is the sentiment of consecutive segments of a book, from beginning to end
+type SentimentArc struct {
+	GutenbergID int             `json:"gutenberg_id"`
+	Method      string          `json:"method"`
+	Points      SentimentPoints `json:"points"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// SentimentPoint scores one segment, located by byte offsets, from -1 (negative) to 1 (positive)
+type SentimentPoint struct {
+	Segment int     `json:"segment"`
+	Start   int     `json:"start"`
+	End     int     `json:"end"`
+	Score   float64 `json:"score"`
+	Label   string  `json:"label"`
+}
+
+type SentimentPoints []SentimentPoint
+
+func (p SentimentPoints) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+func (p *SentimentPoints) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, p)
+}
@@ -0,0 +1,21 @@
+package domain
+
+// TextStats are the statistics of a book computed locally from its content
+type TextStats struct {
+	GutenbergID       int         `json:"gutenberg_id"`
+	Words             int         `json:"words"`
+	UniqueWords       int         `json:"unique_words"`
+	VocabularyRatio   float64     `json:"vocabulary_ratio"`
+	Sentences         int         `json:"sentences"`
+	AvgSentenceLength float64     `json:"avg_sentence_length"`
+	AvgWordSyllables  float64     `json:"avg_word_syllables"`
+	FleschScore       float64     `json:"flesch_score"`
+	ReadingMinutes    int         `json:"reading_minutes"`
+	TopWords          []WordCount `json:"top_words"`
+}
+
+// WordCount is how many times a word appears in a text
+type WordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
@@ -0,0 +1,79 @@
+package domain
+
+import "time"
+
+// Usage is the token count and cost of one call to the AI engine, with the user, address and book it was made
+// for. UserID and GutenbergID are 0 and IP empty when unknown. Estimated tells the engine did not report the
+// tokens, which were counted from the text instead.
+type Usage struct {
+	ID               int       `json:"id"`
+	UserID           int       `json:"user_id,omitempty"`
+	IP               string    `json:"ip,omitempty"`
+	GutenbergID      int       `json:"gutenberg_id,omitempty"`
+	Prompt           string    `json:"prompt"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Estimated        bool      `json:"estimated"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Cost             float64   `json:"cost"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// UsageTotal sums the calls of a user or address within a window, ResetsIn is when the oldest leaves it
+type UsageTotal struct {
+	Calls            int           `json:"calls"`
+	PromptTokens     int64         `json:"prompt_tokens"`
+	CompletionTokens int64         `json:"completion_tokens"`
+	ResetsIn         time.Duration `json:"-"`
+}
+
+func (t UsageTotal) Tokens() int64 {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+// UsageSummary is a line of the usage report, for a user or for an address
+type UsageSummary struct {
+	UserID   int       `json:"user_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	LastCall time.Time `json:"last_call"`
+	UsageTotal
+}
+
+// UsageReport is the usage of every user and address within a window, heaviest first
+type UsageReport struct {
+	Window    time.Duration  `json:"-"`
+	Users     []UsageSummary `json:"users"`
+	Addresses []UsageSummary `json:"addresses"`
+}
+
+// CostTotal sums the calls of a book, user, day or model, Cost is in US dollars
+type CostTotal struct {
+	UsageTotal
+	Cost             float64 `json:"cost"`
+	AverageLatencyMs int64   `json:"average_latency_ms"`
+	EstimatedCalls   int     `json:"estimated_calls"`
+}
+
+// CostSummary is a line of the cost report, for a book, a user, a day or a model
+type CostSummary struct {
+	GutenbergID int    `json:"gutenberg_id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	UserID      int    `json:"user_id,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Day         string `json:"day,omitempty"`
+	Model       string `json:"model,omitempty"`
+	CostTotal
+}
+
+// CostReport is what the calls within a window cost in total and per book, user and model, most expensive
+// first, and per day, latest first
+type CostReport struct {
+	Window time.Duration `json:"-"`
+	Total  CostTotal     `json:"total"`
+	Books  []CostSummary `json:"books"`
+	Users  []CostSummary `json:"users"`
+	Days   []CostSummary `json:"days"`
+	Models []CostSummary `json:"models"`
+}
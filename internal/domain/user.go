@@ -0,0 +1,20 @@
+package domain
+
+import "time"
+
+// User is a local account, signed in with a session cookie or an API token
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// APIToken lets scripts act as a user with an Authorization: Bearer header, only a hash of the token is stored
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
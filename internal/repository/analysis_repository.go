@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"database/sql"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type IAnalysisRepository interface {
+	GetAnalyses(gutenbergID int, kind string) ([]domain.Analysis, error)
+	SaveAnalysis(analysis *domain.Analysis) error
+}
+
+type AnalysisRepository struct {
+	DB *sql.DB
+}
+
+func NewAnalysisRepository(db *sql.DB) *AnalysisRepository {
+	return &AnalysisRepository{DB: db}
+}
+
+// GetAnalyses returns the book's analyses, newest first, optionally only those of one kind
+func (r *AnalysisRepository) GetAnalyses(gutenbergID int, kind string) ([]domain.Analysis, error) {
+	query := `SELECT id, gutenberg_id, COALESCE(user_id, 0), kind, prompt_version, engine, model, content, created_at FROM analyses
+		WHERE gutenberg_id = $1 AND ($2 = '' OR kind = $2) ORDER BY created_at DESC, id DESC`
+	rows, err := r.DB.Query(query, gutenbergID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var analyses []domain.Analysis
+	for rows.Next() {
+		var analysis domain.Analysis
+		err := rows.Scan(&analysis.ID, &analysis.GutenbergID, &analysis.UserID, &analysis.Kind, &analysis.PromptVersion, &analysis.Engine, &analysis.Model, &analysis.Content, &analysis.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	return analyses, rows.Err()
+}
+
+func (r *AnalysisRepository) SaveAnalysis(analysis *domain.Analysis) error {
+	query := `INSERT INTO analyses (gutenberg_id, user_id, kind, prompt_version, engine, model, content)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7) RETURNING id, created_at`
+	return r.DB.QueryRow(
+		query,
+		analysis.GutenbergID,
+		analysis.UserID,
+		analysis.Kind,
+		analysis.PromptVersion,
+		analysis.Engine,
+		analysis.Model,
+		analysis.Content,
+	).Scan(&analysis.ID, &analysis.CreatedAt)
+}
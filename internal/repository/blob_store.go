@@ -0,0 +1,239 @@
+package repository
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// blobChunkSize is how much of a blob is moved per large object call
+const blobChunkSize = 1 << 20
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps gzip compressed blobs under the SHA-256 of their uncompressed bytes, so the same content is
+// stored once whoever puts it
+type BlobStore interface {
+	// Put stores everything read from r and returns its hash and uncompressed size
+	Put(r io.Reader) (string, int64, error)
+	// Open returns a reader of the uncompressed blob, or ErrBlobNotFound
+	Open(hash string) (io.ReadCloser, error)
+}
+
+// FileBlobStore keeps each blob in a file named after its hash, below a directory named after the hash's first
+// two characters
+type FileBlobStore struct {
+	Dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{Dir: dir}, nil
+}
+
+// Put compresses into a temporary file while hashing, then moves it in place once the hash is known
+func (s *FileBlobStore) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(s.Dir, "put-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash, size, err := compress(tmp, r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	path := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+func (s *FileBlobStore) Open(hash string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decompress(file)
+}
+
+func (s *FileBlobStore) path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(s.Dir, hash+".gz")
+	}
+	return filepath.Join(s.Dir, hash[:2], hash+".gz")
+}
+
+// PostgresBlobStore keeps blobs as Postgres large objects, listed by hash in the blobs table
+type PostgresBlobStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresBlobStore(db *sql.DB) *PostgresBlobStore {
+	return &PostgresBlobStore{DB: db}
+}
+
+// Put writes a new large object in a transaction and drops it again when the blob was already stored
+func (s *PostgresBlobStore) Put(r io.Reader) (string, int64, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var oid uint32
+	if err := tx.QueryRow(`SELECT lo_create(0)`).Scan(&oid); err != nil {
+		return "", 0, err
+	}
+
+	object := &largeObjectWriter{tx: tx, oid: oid}
+	hash, size, err := compress(object, r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := object.Flush(); err != nil {
+		return "", 0, err
+	}
+
+	result, err := tx.Exec(`INSERT INTO blobs (hash, oid, size) VALUES ($1, $2, $3) ON CONFLICT (hash) DO NOTHING`, hash, oid, size)
+	if err != nil {
+		return "", 0, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return "", 0, err
+	} else if inserted == 0 {
+		if _, err := tx.Exec(`SELECT lo_unlink($1)`, oid); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return hash, size, tx.Commit()
+}
+
+func (s *PostgresBlobStore) Open(hash string) (io.ReadCloser, error) {
+	var oid uint32
+	err := s.DB.QueryRow(`SELECT oid FROM blobs WHERE hash = $1`, hash).Scan(&oid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decompress(io.NopCloser(&largeObjectReader{db: s.DB, oid: oid}))
+}
+
+// largeObjectWriter buffers writes into chunks appended to a large object with lo_put
+type largeObjectWriter struct {
+	tx     *sql.Tx
+	oid    uint32
+	offset int64
+	buf    []byte
+}
+
+func (w *largeObjectWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= blobChunkSize {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *largeObjectWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if _, err := w.tx.Exec(`SELECT lo_put($1, $2, $3)`, w.oid, w.offset, w.buf); err != nil {
+		return err
+	}
+	w.offset += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// largeObjectReader reads a large object a chunk at a time with lo_get
+type largeObjectReader struct {
+	db     *sql.DB
+	oid    uint32
+	offset int64
+	buf    []byte
+	eof    bool
+}
+
+func (r *largeObjectReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		var chunk []byte
+		if err := r.db.QueryRow(`SELECT lo_get($1, $2, $3)`, r.oid, r.offset, blobChunkSize).Scan(&chunk); err != nil {
+			return 0, err
+		}
+		r.offset += int64(len(chunk))
+		r.buf = chunk
+		r.eof = len(chunk) < blobChunkSize
+		if len(chunk) == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// compress gzips what it reads from r into w and returns the hash and size of the uncompressed bytes
+func compress(w io.Writer, r io.Reader) (string, int64, error) {
+	hasher := sha256.New()
+	zw := gzip.NewWriter(w)
+
+	size, err := io.Copy(io.MultiWriter(zw, hasher), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+func decompress(compressed io.ReadCloser) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		compressed.Close()
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	return &blobReader{Reader: zr, compressed: compressed}, nil
+}
+
+type blobReader struct {
+	*gzip.Reader
+	compressed io.Closer
+}
+
+func (r *blobReader) Close() error {
+	r.Reader.Close()
+	return r.compressed.Close()
+}
@@ -0,0 +1,79 @@
+package repository_test
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/repository"
+)
+
+func TestBlobStores(t *testing.T) {
+	implementations := map[string]func(t *testing.T) repository.BlobStore{
+		"File": func(t *testing.T) repository.BlobStore {
+			store, err := repository.NewFileBlobStore(t.TempDir())
+			require.NoError(t, err)
+			return store
+		},
+		"Postgres": func(t *testing.T) repository.BlobStore {
+			databaseURL := os.Getenv("TEST_DATABASE_URL")
+			if databaseURL == "" {
+				t.Skip("TEST_DATABASE_URL is not set")
+			}
+
+			db, err := sql.Open("postgres", databaseURL)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			return repository.NewPostgresBlobStore(db)
+		},
+	}
+
+	for name, newStore := range implementations {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+
+			// Several chunks of incompressible text, so large objects are written and read in pieces
+			content := make([]byte, 3<<20)
+			rand.New(rand.NewSource(1)).Read(content)
+
+			hash, size, err := store.Put(bytes.NewReader(content))
+			require.NoError(t, err)
+			assert.Len(t, hash, 64)
+			assert.Equal(t, int64(len(content)), size)
+
+			again, _, err := store.Put(bytes.NewReader(content))
+			require.NoError(t, err)
+			assert.Equal(t, hash, again, "the same content gets the same key")
+
+			blob, err := store.Open(hash)
+			require.NoError(t, err)
+			read, err := io.ReadAll(blob)
+			require.NoError(t, err)
+			assert.NoError(t, blob.Close())
+			assert.Equal(t, content, read)
+
+			_, err = store.Open(strings.Repeat("0", 64))
+			assert.ErrorIs(t, err, repository.ErrBlobNotFound)
+		})
+	}
+}
+
+func TestFileBlobStore_Compresses(t *testing.T) {
+	dir := t.TempDir()
+	store, err := repository.NewFileBlobStore(dir)
+	require.NoError(t, err)
+
+	hash, _, err := store.Put(strings.NewReader(strings.Repeat("Nothing will come of nothing. ", 10000)))
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(dir, hash[:2], hash+".gz"))
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(10000))
+}
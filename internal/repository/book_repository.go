@@ -7,6 +7,7 @@ import (
 	"github.com/yuriadams/lear/internal/domain"
 )
 
+// IBookRepository stores books with their Content and ContentHash as given, GetAllBooks leaves Content out
 type IBookRepository interface {
 	GetAllBooks() ([]domain.Book, error)
 	GetBookByID(gutenbergID int) (*domain.Book, error)
@@ -22,7 +23,7 @@ func NewBookRepository(db *sql.DB) *BookRepository {
 }
 
 func (r *BookRepository) GetAllBooks() ([]domain.Book, error) {
-	rows, err := r.DB.Query(`SELECT id, gutenberg_id, content, metadata, created_at FROM books`)
+	rows, err := r.DB.Query(`SELECT id, gutenberg_id, content_hash, metadata, created_at FROM books`)
 	if err != nil {
 		return nil, err
 	}
@@ -31,7 +32,7 @@ func (r *BookRepository) GetAllBooks() ([]domain.Book, error) {
 	var books []domain.Book
 	for rows.Next() {
 		var book domain.Book
-		err := rows.Scan(&book.ID, &book.GutenbergID, &book.Content, &book.Metadata, &book.CreatedAt)
+		err := rows.Scan(&book.ID, &book.GutenbergID, &book.ContentHash, &book.Metadata, &book.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -43,8 +44,8 @@ func (r *BookRepository) GetAllBooks() ([]domain.Book, error) {
 
 func (r *BookRepository) GetBookByID(gutenbergID int) (*domain.Book, error) {
 	var book domain.Book
-	query := `SELECT id, gutenberg_id, content, metadata FROM books WHERE gutenberg_id = $1`
-	err := r.DB.QueryRow(query, gutenbergID).Scan(&book.ID, &book.GutenbergID, &book.Content, &book.Metadata)
+	query := `SELECT id, gutenberg_id, COALESCE(content, ''), content_hash, metadata FROM books WHERE gutenberg_id = $1`
+	err := r.DB.QueryRow(query, gutenbergID).Scan(&book.ID, &book.GutenbergID, &book.Content, &book.ContentHash, &book.Metadata)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -54,12 +55,16 @@ func (r *BookRepository) GetBookByID(gutenbergID int) (*domain.Book, error) {
 	return &book, nil
 }
 
+// SaveBook stores the book, or leaves the stored one in place when another process saved it first, and sets
+// the ID of the row either way
 func (r *BookRepository) SaveBook(book *domain.Book) error {
-	query := `INSERT INTO books (gutenberg_id, content, metadata) VALUES ($1, $2, $3) RETURNING id`
+	query := `INSERT INTO books (gutenberg_id, content, content_hash, metadata) VALUES ($1, NULLIF($2, ''), $3, $4)
+		ON CONFLICT (gutenberg_id) DO UPDATE SET gutenberg_id = EXCLUDED.gutenberg_id RETURNING id`
 	return r.DB.QueryRow(
 		query,
 		book.GutenbergID,
 		book.Content,
+		book.ContentHash,
 		book.Metadata,
 	).Scan(&book.ID)
 }
@@ -0,0 +1,156 @@
+package repository_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+
+	_ "github.com/lib/pq"
+)
+
+// TestBookRepositoryConformance runs every IBookRepository implementation through the same behaviour. Postgres
+// runs when TEST_DATABASE_URL points at a migrated database, whose books table is emptied.
+func TestBookRepositoryConformance(t *testing.T) {
+	implementations := map[string]func(t *testing.T) repository.IBookRepository{
+		"Memory": func(t *testing.T) repository.IBookRepository {
+			return repository.NewMemoryBookRepository()
+		},
+		"SQLite": func(t *testing.T) repository.IBookRepository {
+			repo, err := repository.OpenBookRepository("sqlite://"+filepath.Join(t.TempDir(), "lear.db"), nil)
+			require.NoError(t, err)
+			return repo
+		},
+		"Cached": func(t *testing.T) repository.IBookRepository {
+			return repository.NewCachedBookRepository(repository.NewMemoryBookRepository(), 1<<20, time.Minute)
+		},
+		"Postgres": func(t *testing.T) repository.IBookRepository {
+			databaseURL := os.Getenv("TEST_DATABASE_URL")
+			if databaseURL == "" {
+				t.Skip("TEST_DATABASE_URL is not set")
+			}
+
+			db, err := sql.Open("postgres", databaseURL)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			_, err = db.Exec(`TRUNCATE books CASCADE`)
+			require.NoError(t, err)
+			return repository.NewBookRepository(db)
+		},
+	}
+
+	for name, newRepo := range implementations {
+		t.Run(name, func(t *testing.T) {
+			t.Run("Missing book", func(t *testing.T) {
+				book, err := newRepo(t).GetBookByID(1532)
+				assert.NoError(t, err)
+				assert.Nil(t, book)
+			})
+
+			t.Run("Save and get", func(t *testing.T) {
+				repo := newRepo(t)
+				lear := &domain.Book{GutenbergID: 1532, Content: "ACT I.", Metadata: domain.Metadata{Title: "King Lear", Author: "William Shakespeare"}}
+				require.NoError(t, repo.SaveBook(lear))
+				assert.NotZero(t, lear.ID)
+				require.NoError(t, repo.SaveBook(&domain.Book{GutenbergID: 2264, ContentHash: "9f86d081"}))
+
+				book, err := repo.GetBookByID(1532)
+				require.NoError(t, err)
+				assert.Equal(t, lear.ID, book.ID)
+				assert.Equal(t, "ACT I.", book.Content)
+				assert.Equal(t, lear.Metadata, book.Metadata)
+
+				book, err = repo.GetBookByID(2264)
+				require.NoError(t, err)
+				assert.Equal(t, "", book.Content)
+				assert.Equal(t, "9f86d081", book.ContentHash)
+			})
+
+			t.Run("Saving twice keeps one row", func(t *testing.T) {
+				repo := newRepo(t)
+				first := &domain.Book{GutenbergID: 1532, ContentHash: "first"}
+				second := &domain.Book{GutenbergID: 1532, ContentHash: "second"}
+				require.NoError(t, repo.SaveBook(first))
+				require.NoError(t, repo.SaveBook(second))
+				assert.Equal(t, first.ID, second.ID)
+
+				books, err := repo.GetAllBooks()
+				require.NoError(t, err)
+				assert.Len(t, books, 1)
+				assert.Equal(t, "first", books[0].ContentHash, "the stored book is kept")
+			})
+
+			t.Run("All books", func(t *testing.T) {
+				repo := newRepo(t)
+				books, err := repo.GetAllBooks()
+				require.NoError(t, err)
+				assert.Empty(t, books)
+
+				for _, id := range []int{2264, 1532, 1128} {
+					require.NoError(t, repo.SaveBook(&domain.Book{GutenbergID: id, Content: "text", ContentHash: "hash"}))
+				}
+
+				books, err = repo.GetAllBooks()
+				require.NoError(t, err)
+				var ids []int
+				for _, book := range books {
+					ids = append(ids, book.GutenbergID)
+					assert.Empty(t, book.Content, "listings leave the content out")
+					assert.Equal(t, "hash", book.ContentHash)
+				}
+				sort.Ints(ids)
+				assert.Equal(t, []int{1128, 1532, 2264}, ids)
+			})
+
+			t.Run("Returned books are copies", func(t *testing.T) {
+				repo := newRepo(t)
+				require.NoError(t, repo.SaveBook(&domain.Book{GutenbergID: 1532, Content: "ACT I."}))
+
+				book, err := repo.GetBookByID(1532)
+				require.NoError(t, err)
+				book.Content = "changed"
+
+				book, err = repo.GetBookByID(1532)
+				require.NoError(t, err)
+				assert.Equal(t, "ACT I.", book.Content)
+			})
+
+			t.Run("Concurrent saves", func(t *testing.T) {
+				repo := newRepo(t)
+				var wg sync.WaitGroup
+				ids := make([]int, 8)
+				for i := range ids {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						book := &domain.Book{GutenbergID: 1532, Content: "ACT I."}
+						assert.NoError(t, repo.SaveBook(book))
+						ids[i] = book.ID
+					}(i)
+				}
+				wg.Wait()
+
+				for _, id := range ids {
+					assert.Equal(t, ids[0], id, "every save gets the one row")
+				}
+			})
+		})
+	}
+}
+
+func TestIsPostgresURL(t *testing.T) {
+	for _, databaseURL := range []string{"postgres://lear@localhost/lear", "postgresql://localhost/lear", "host=localhost dbname=lear", ""} {
+		assert.True(t, repository.IsPostgresURL(databaseURL), databaseURL)
+	}
+	for _, databaseURL := range []string{"sqlite://lear.db", "memory://", "mysql://localhost/lear"} {
+		assert.False(t, repository.IsPostgresURL(databaseURL), databaseURL)
+	}
+}
@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+// allBooksKey is the cache key of the GetAllBooks listing, Gutenberg IDs start at 1
+const allBooksKey = 0
+
+// CachedBookRepository keeps the most recently used books in memory in front of another repository, up to
+// a total size in bytes. Entries expire after the TTL, and saving a book drops its entry and the listing.
+type CachedBookRepository struct {
+	Repo     IBookRepository
+	MaxBytes int64
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	entries map[int]*list.Element
+	recency *list.List
+	stats   domain.CacheStats
+}
+
+type cacheEntry struct {
+	key       int
+	books     []domain.Book
+	size      int64
+	expiresAt time.Time
+}
+
+func NewCachedBookRepository(repo IBookRepository, maxBytes int64, ttl time.Duration) *CachedBookRepository {
+	return &CachedBookRepository{
+		Repo:     repo,
+		MaxBytes: maxBytes,
+		TTL:      ttl,
+		entries:  make(map[int]*list.Element),
+		recency:  list.New(),
+	}
+}
+
+func (r *CachedBookRepository) GetAllBooks() ([]domain.Book, error) {
+	if books, ok := r.get(allBooksKey); ok {
+		return books, nil
+	}
+
+	books, err := r.Repo.GetAllBooks()
+	if err != nil {
+		return nil, err
+	}
+
+	r.put(allBooksKey, books)
+	return copyBooks(books), nil
+}
+
+func (r *CachedBookRepository) GetBookByID(gutenbergID int) (*domain.Book, error) {
+	if books, ok := r.get(gutenbergID); ok {
+		return &books[0], nil
+	}
+
+	book, err := r.Repo.GetBookByID(gutenbergID)
+	if err != nil || book == nil {
+		return book, err
+	}
+
+	r.put(gutenbergID, []domain.Book{*book})
+	return book, nil
+}
+
+func (r *CachedBookRepository) SaveBook(book *domain.Book) error {
+	if err := r.Repo.SaveBook(book); err != nil {
+		return err
+	}
+
+	r.Invalidate(book.GutenbergID)
+	return nil
+}
+
+// Invalidate drops the book and the listing from the cache, for changes made behind the repository's back
+func (r *CachedBookRepository) Invalidate(gutenbergID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remove(gutenbergID)
+	r.remove(allBooksKey)
+}
+
+func (r *CachedBookRepository) Stats() domain.CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.Entries = r.recency.Len()
+	stats.MaxBytes = r.MaxBytes
+	return stats
+}
+
+// get returns a copy of the cached books, so callers cannot change what the next caller gets
+func (r *CachedBookRepository) get(key int) ([]domain.Book, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	element, ok := r.entries[key]
+	if !ok {
+		r.stats.Misses++
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if r.TTL > 0 && time.Now().After(entry.expiresAt) {
+		r.remove(key)
+		r.stats.Misses++
+		return nil, false
+	}
+
+	r.recency.MoveToFront(element)
+	r.stats.Hits++
+	return copyBooks(entry.books), true
+}
+
+// put caches the books unless they alone are bigger than the cache, evicting the least recently used entries
+func (r *CachedBookRepository) put(key int, books []domain.Book) {
+	entry := &cacheEntry{key: key, books: copyBooks(books), size: booksSize(books), expiresAt: time.Now().Add(r.TTL)}
+	if entry.size > r.MaxBytes {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remove(key)
+	for r.stats.Bytes+entry.size > r.MaxBytes {
+		oldest := r.recency.Back()
+		r.remove(oldest.Value.(*cacheEntry).key)
+		r.stats.Evictions++
+	}
+
+	r.entries[key] = r.recency.PushFront(entry)
+	r.stats.Bytes += entry.size
+}
+
+func (r *CachedBookRepository) remove(key int) {
+	element, ok := r.entries[key]
+	if !ok {
+		return
+	}
+
+	r.recency.Remove(element)
+	delete(r.entries, key)
+	r.stats.Bytes -= element.Value.(*cacheEntry).size
+}
+
+// booksSize approximates the memory held by the books with the length of their text fields
+func booksSize(books []domain.Book) int64 {
+	var size int64
+	for _, book := range books {
+		m := book.Metadata
+		size += int64(len(book.Content) + len(m.Author) + len(m.Title) + len(m.Credits) + len(m.Summary) +
+			len(m.Language) + len(m.Subject) + len(m.Category))
+	}
+	return size
+}
+
+func copyBooks(books []domain.Book) []domain.Book {
+	return append([]domain.Book(nil), books...)
+}
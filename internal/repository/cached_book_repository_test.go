@@ -0,0 +1,116 @@
+package repository_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+)
+
+type MockBookRepository struct {
+	mock.Mock
+}
+
+func (m *MockBookRepository) GetAllBooks() ([]domain.Book, error) {
+	args := m.Called()
+	books, _ := args.Get(0).([]domain.Book)
+	return books, args.Error(1)
+}
+
+func (m *MockBookRepository) GetBookByID(gutenbergID int) (*domain.Book, error) {
+	args := m.Called(gutenbergID)
+	book, _ := args.Get(0).(*domain.Book)
+	return book, args.Error(1)
+}
+
+func (m *MockBookRepository) SaveBook(book *domain.Book) error {
+	args := m.Called(book)
+	return args.Error(0)
+}
+
+func newBook(gutenbergID int, size int) *domain.Book {
+	return &domain.Book{GutenbergID: gutenbergID, Content: strings.Repeat("a", size)}
+}
+
+func TestCachedBookRepository_HitsAndMisses(t *testing.T) {
+	repo := new(MockBookRepository)
+	repo.On("GetBookByID", 1532).Return(newBook(1532, 100), nil).Once()
+	repo.On("GetBookByID", 2264).Return(nil, nil).Twice()
+	cache := repository.NewCachedBookRepository(repo, 1000, time.Minute)
+
+	book, err := cache.GetBookByID(1532)
+	assert.NoError(t, err)
+	book.Content = "changed by the caller"
+
+	book, err = cache.GetBookByID(1532)
+	assert.NoError(t, err)
+	assert.Len(t, book.Content, 100, "the cache keeps its own copy")
+
+	for i := 0; i < 2; i++ {
+		book, err = cache.GetBookByID(2264)
+		assert.NoError(t, err)
+		assert.Nil(t, book, "missing books are not cached")
+	}
+
+	repo.AssertExpectations(t)
+	stats := cache.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(100), stats.Bytes)
+}
+
+func TestCachedBookRepository_EvictsLeastRecentlyUsed(t *testing.T) {
+	repo := new(MockBookRepository)
+	for _, id := range []int{1, 2, 3} {
+		repo.On("GetBookByID", id).Return(newBook(id, 400), nil)
+	}
+	repo.On("GetBookByID", 4).Return(newBook(4, 2000), nil)
+	cache := repository.NewCachedBookRepository(repo, 1000, time.Minute)
+
+	cache.GetBookByID(1)
+	cache.GetBookByID(2)
+	cache.GetBookByID(1)
+	cache.GetBookByID(3)
+	cache.GetBookByID(4)
+
+	repo.AssertNumberOfCalls(t, "GetBookByID", 4)
+	cache.GetBookByID(1)
+	repo.AssertNumberOfCalls(t, "GetBookByID", 4)
+	cache.GetBookByID(2)
+	repo.AssertNumberOfCalls(t, "GetBookByID", 5)
+
+	stats := cache.Stats()
+	assert.LessOrEqual(t, stats.Bytes, int64(1000))
+	assert.Equal(t, int64(2), stats.Evictions, "a book bigger than the cache is never stored")
+}
+
+func TestCachedBookRepository_TTLAndInvalidation(t *testing.T) {
+	repo := new(MockBookRepository)
+	repo.On("GetBookByID", 1532).Return(newBook(1532, 10), nil)
+	repo.On("GetAllBooks").Return([]domain.Book{*newBook(1532, 10)}, nil)
+	repo.On("SaveBook", mock.Anything).Return(nil)
+	cache := repository.NewCachedBookRepository(repo, 1000, 50*time.Millisecond)
+
+	cache.GetBookByID(1532)
+	cache.GetBookByID(1532)
+	repo.AssertNumberOfCalls(t, "GetBookByID", 1)
+
+	time.Sleep(60 * time.Millisecond)
+	cache.GetBookByID(1532)
+	repo.AssertNumberOfCalls(t, "GetBookByID", 2)
+
+	cache.GetAllBooks()
+	cache.GetAllBooks()
+	repo.AssertNumberOfCalls(t, "GetAllBooks", 1)
+
+	assert.NoError(t, cache.SaveBook(newBook(1532, 20)))
+	cache.GetBookByID(1532)
+	cache.GetAllBooks()
+	repo.AssertNumberOfCalls(t, "GetBookByID", 3)
+	repo.AssertNumberOfCalls(t, "GetAllBooks", 2)
+}
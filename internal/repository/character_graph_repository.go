@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type ICharacterGraphRepository interface {
+	GetCharacterGraph(gutenbergID int) (*domain.CharacterGraph, error)
+	SaveCharacterGraph(graph *domain.CharacterGraph) error
+}
+
+type CharacterGraphRepository struct {
+	DB *sql.DB
+}
+
+func NewCharacterGraphRepository(db *sql.DB) *CharacterGraphRepository {
+	return &CharacterGraphRepository{DB: db}
+}
+
+// GetCharacterGraph returns the stored graph of the book, or nil when it was not built yet
+func (r *CharacterGraphRepository) GetCharacterGraph(gutenbergID int) (*domain.CharacterGraph, error) {
+	query := `SELECT gutenberg_id, method, directed, nodes, edges, created_at FROM character_graphs WHERE gutenberg_id = $1`
+
+	var graph domain.CharacterGraph
+	err := r.DB.QueryRow(query, gutenbergID).Scan(&graph.GutenbergID, &graph.Method, &graph.Directed, &graph.Nodes, &graph.Edges, &graph.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &graph, nil
+}
+
+// SaveCharacterGraph stores the graph, replacing the one previously built for the book
+func (r *CharacterGraphRepository) SaveCharacterGraph(graph *domain.CharacterGraph) error {
+	query := `INSERT INTO character_graphs (gutenberg_id, method, directed, nodes, edges) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (gutenberg_id) DO UPDATE
+		SET method = EXCLUDED.method, directed = EXCLUDED.directed, nodes = EXCLUDED.nodes, edges = EXCLUDED.edges, created_at = CURRENT_TIMESTAMP
+		RETURNING created_at`
+	return r.DB.QueryRow(query, graph.GutenbergID, graph.Method, graph.Directed, graph.Nodes, graph.Edges).Scan(&graph.CreatedAt)
+}
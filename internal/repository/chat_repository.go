@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"database/sql"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type IChatRepository interface {
+	GetChatHistory(userID string, gutenbergID int) ([]domain.ChatMessage, error)
+	SaveChatMessage(message *domain.ChatMessage) error
+	DeleteChatHistory(userID string, gutenbergID int) error
+}
+
+type ChatRepository struct {
+	DB *sql.DB
+}
+
+func NewChatRepository(db *sql.DB) *ChatRepository {
+	return &ChatRepository{DB: db}
+}
+
+func (r *ChatRepository) GetChatHistory(userID string, gutenbergID int) ([]domain.ChatMessage, error) {
+	query := `SELECT id, user_id, gutenberg_id, role, content, citations, COALESCE(prompt_version, ''), created_at FROM chat_messages
+		WHERE user_id = $1 AND gutenberg_id = $2 ORDER BY id`
+	rows, err := r.DB.Query(query, userID, gutenbergID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []domain.ChatMessage
+	for rows.Next() {
+		var message domain.ChatMessage
+		err := rows.Scan(&message.ID, &message.UserID, &message.GutenbergID, &message.Role, &message.Content, &message.Citations, &message.PromptVersion, &message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func (r *ChatRepository) SaveChatMessage(message *domain.ChatMessage) error {
+	query := `INSERT INTO chat_messages (user_id, gutenberg_id, role, content, citations, prompt_version)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) RETURNING id, created_at`
+	return r.DB.QueryRow(
+		query,
+		message.UserID,
+		message.GutenbergID,
+		message.Role,
+		message.Content,
+		message.Citations,
+		message.PromptVersion,
+	).Scan(&message.ID, &message.CreatedAt)
+}
+
+func (r *ChatRepository) DeleteChatHistory(userID string, gutenbergID int) error {
+	_, err := r.DB.Exec(`DELETE FROM chat_messages WHERE user_id = $1 AND gutenberg_id = $2`, userID, gutenbergID)
+	return err
+}
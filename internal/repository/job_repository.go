@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+const jobColumns = `id, kind, gutenberg_id, COALESCE(user_id, 0), analysis_kind, prompt_version, status, progress, message,
+	attempts, max_attempts, last_error, run_at, created_at, updated_at, finished_at`
+
+type IJobRepository interface {
+	CreateJob(job *domain.Job) error
+	GetJob(id int) (*domain.Job, error)
+	ClaimJob() (*domain.Job, error)
+	UpdateJobProgress(id int, progress int, message string) error
+	FinishJob(id int, status string, lastError string) error
+	RetryJob(id int, lastError string, delay time.Duration) error
+	CancelJob(id int) (bool, error)
+	RequeueStaleJobs(staleAfter time.Duration) (requeued int64, failed int64, err error)
+}
+
+type JobRepository struct {
+	DB *sql.DB
+}
+
+func NewJobRepository(db *sql.DB) *JobRepository {
+	return &JobRepository{DB: db}
+}
+
+func (r *JobRepository) CreateJob(job *domain.Job) error {
+	query := `INSERT INTO jobs (kind, gutenberg_id, user_id, analysis_kind, prompt_version, max_attempts)
+		VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6) RETURNING ` + jobColumns
+	row := r.DB.QueryRow(query, job.Kind, job.GutenbergID, job.UserID, job.AnalysisKind, job.PromptVersion, job.MaxAttempts)
+	return scanJob(row, job)
+}
+
+// GetJob returns the job, or nil when there is none
+func (r *JobRepository) GetJob(id int) (*domain.Job, error) {
+	var job domain.Job
+	err := scanJob(r.DB.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id), &job)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ClaimJob marks the oldest job due to run as running and counts the attempt, or returns nil when none is due.
+// Rows locked by another worker are skipped, so workers in several processes never claim the same job.
+func (r *JobRepository) ClaimJob() (*domain.Job, error) {
+	query := `UPDATE jobs SET status = 'running', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM jobs WHERE status = 'queued' AND run_at <= CURRENT_TIMESTAMP
+			ORDER BY run_at, id LIMIT 1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + jobColumns
+
+	var job domain.Job
+	err := scanJob(r.DB.QueryRow(query), &job)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// UpdateJobProgress records the progress of a running job, which also tells it is still alive
+func (r *JobRepository) UpdateJobProgress(id int, progress int, message string) error {
+	query := `UPDATE jobs SET progress = $2, message = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'running'`
+	_, err := r.DB.Exec(query, id, progress, message)
+	return err
+}
+
+// FinishJob ends a running job, leaving it alone when it was cancelled meanwhile
+func (r *JobRepository) FinishJob(id int, status string, lastError string) error {
+	query := `UPDATE jobs SET status = $2, last_error = $3, updated_at = CURRENT_TIMESTAMP, finished_at = CURRENT_TIMESTAMP,
+		progress = CASE WHEN $2 = 'succeeded' THEN 100 ELSE progress END
+		WHERE id = $1 AND status = 'running'`
+	_, err := r.DB.Exec(query, id, status, lastError)
+	return err
+}
+
+// RetryJob puts a running job that failed back in the queue to run again after the delay
+func (r *JobRepository) RetryJob(id int, lastError string, delay time.Duration) error {
+	query := `UPDATE jobs SET status = 'queued', last_error = $2, run_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond',
+		updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'running'`
+	_, err := r.DB.Exec(query, id, lastError, delay.Milliseconds())
+	return err
+}
+
+// CancelJob cancels a job that has not finished, and tells whether it did
+func (r *JobRepository) CancelJob(id int) (bool, error) {
+	query := `UPDATE jobs SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP, finished_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status IN ('queued', 'running')`
+	result, err := r.DB.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// staleJobError is the last error of a job whose worker stopped during its last attempt
+const staleJobError = "the worker stopped during the last attempt"
+
+// RequeueStaleJobs puts back in the queue the running jobs not updated for staleAfter, left by a stopped worker.
+// The ones that used their last attempt are failed instead, so a job that stops its worker does not run forever.
+func (r *JobRepository) RequeueStaleJobs(staleAfter time.Duration) (int64, int64, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	stale := `status = 'running' AND updated_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 millisecond'`
+	result, err := tx.Exec(`UPDATE jobs SET status = 'failed', last_error = $2, updated_at = CURRENT_TIMESTAMP,
+		finished_at = CURRENT_TIMESTAMP WHERE `+stale+` AND attempts >= max_attempts`, staleAfter.Milliseconds(), staleJobError)
+	if err != nil {
+		return 0, 0, err
+	}
+	failed, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result, err = tx.Exec(`UPDATE jobs SET status = 'queued', run_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE `+stale, staleAfter.Milliseconds())
+	if err != nil {
+		return 0, 0, err
+	}
+	requeued, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return requeued, failed, tx.Commit()
+}
+
+func scanJob(row *sql.Row, job *domain.Job) error {
+	var finishedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.Kind, &job.GutenbergID, &job.UserID, &job.AnalysisKind, &job.PromptVersion, &job.Status,
+		&job.Progress, &job.Message, &job.Attempts, &job.MaxAttempts, &job.LastError, &job.RunAt,
+		&job.CreatedAt, &job.UpdatedAt, &finishedAt)
+	if err != nil {
+		return err
+	}
+
+	job.FinishedAt = nil
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return nil
+}
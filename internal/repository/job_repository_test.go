@@ -0,0 +1,56 @@
+package repository_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+)
+
+// TestJobRepository_RequeueStaleJobs runs when TEST_DATABASE_URL points at a migrated database, whose jobs table
+// is emptied
+func TestJobRepository_RequeueStaleJobs(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`TRUNCATE jobs`)
+	require.NoError(t, err)
+	repo := repository.NewJobRepository(db)
+
+	// A job left running by a stopped worker on its first attempt, and one left on its last
+	retried := &domain.Job{Kind: domain.JobFetch, GutenbergID: 1532, MaxAttempts: 2}
+	exhausted := &domain.Job{Kind: domain.JobFetch, GutenbergID: 1533, MaxAttempts: 1}
+	for _, job := range []*domain.Job{retried, exhausted} {
+		require.NoError(t, repo.CreateJob(job))
+		claimed, err := repo.ClaimJob()
+		require.NoError(t, err)
+		require.Equal(t, job.ID, claimed.ID)
+	}
+	_, err = db.Exec(`UPDATE jobs SET updated_at = CURRENT_TIMESTAMP - INTERVAL '1 hour'`)
+	require.NoError(t, err)
+
+	requeued, failed, err := repo.RequeueStaleJobs(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), requeued)
+	assert.Equal(t, int64(1), failed)
+
+	job, err := repo.GetJob(retried.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.JobQueued, job.Status)
+
+	job, err = repo.GetJob(exhausted.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.JobFailed, job.Status)
+	assert.NotEmpty(t, job.LastError)
+	assert.NotNil(t, job.FinishedAt)
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+// MemoryBookRepository keeps books in a map, they are lost when the process exits
+type MemoryBookRepository struct {
+	mu     sync.RWMutex
+	books  map[int]domain.Book
+	nextID int
+}
+
+func NewMemoryBookRepository() *MemoryBookRepository {
+	return &MemoryBookRepository{books: make(map[int]domain.Book), nextID: 1}
+}
+
+// GetAllBooks returns the books in the order they were saved
+func (r *MemoryBookRepository) GetAllBooks() ([]domain.Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var books []domain.Book
+	for _, book := range r.books {
+		book.Content = ""
+		books = append(books, book)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	return books, nil
+}
+
+func (r *MemoryBookRepository) GetBookByID(gutenbergID int) (*domain.Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	book, ok := r.books[gutenbergID]
+	if !ok {
+		return nil, nil
+	}
+	return &book, nil
+}
+
+// SaveBook keeps the stored book when there is one already, like BookRepository.SaveBook
+func (r *MemoryBookRepository) SaveBook(book *domain.Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored, ok := r.books[book.GutenbergID]; ok {
+		book.ID = stored.ID
+		return nil
+	}
+
+	book.ID = r.nextID
+	r.nextID++
+
+	stored := *book
+	stored.CreatedAt = time.Now()
+	r.books[book.GutenbergID] = stored
+	return nil
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const defaultBlobDir = "data/blobs"
+
+// OpenBookRepository picks where books are stored from the scheme of the database URL: postgres:// uses the
+// Postgres connection, sqlite://path a SQLite file and memory:// the process memory. A URL without a scheme
+// is a Postgres connection string.
+func OpenBookRepository(databaseURL string, postgres *sql.DB) (IBookRepository, error) {
+	if IsPostgresURL(databaseURL) {
+		return NewBookRepository(postgres), nil
+	}
+
+	scheme := databaseScheme(databaseURL)
+	switch scheme {
+	case "sqlite", "sqlite3":
+		db, err := sql.Open("sqlite", strings.TrimPrefix(databaseURL, scheme+"://"))
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLiteBookRepository(db)
+	case "memory":
+		return NewMemoryBookRepository(), nil
+	default:
+		return nil, fmt.Errorf("unsupported database scheme %q", scheme)
+	}
+}
+
+// OpenBlobStore keeps blobs in dir when it is set, otherwise as large objects when books are in Postgres and in
+// defaultBlobDir when they are not
+func OpenBlobStore(databaseURL string, dir string, postgres *sql.DB) (BlobStore, error) {
+	if dir == "" {
+		if IsPostgresURL(databaseURL) {
+			return NewPostgresBlobStore(postgres), nil
+		}
+		dir = defaultBlobDir
+	}
+	return NewFileBlobStore(dir)
+}
+
+// bookReferences are the tables whose gutenberg_id column references the Postgres books table
+var bookReferences = []string{"chat_messages", "passages", "analyses", "character_graphs", "sentiment_arcs", "reading_positions"}
+
+// DetachBookReferences drops the foreign keys to the Postgres books table, which stays empty while books are
+// stored elsewhere and would otherwise refuse every row referring to a book. They are not restored when books
+// move back to Postgres.
+func DetachBookReferences(postgres *sql.DB) error {
+	for _, table := range bookReferences {
+		// Postgres names an unnamed foreign key <table>_<column>_fkey
+		if _, err := postgres.Exec(fmt.Sprintf("ALTER TABLE %[1]s DROP CONSTRAINT IF EXISTS %[1]s_gutenberg_id_fkey", table)); err != nil {
+			return fmt.Errorf("drop the books foreign key of %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// IsPostgresURL tells whether the database URL is a Postgres connection, which every repository but the books
+// one needs
+func IsPostgresURL(databaseURL string) bool {
+	switch databaseScheme(databaseURL) {
+	case "", "postgres", "postgresql":
+		return true
+	}
+	return false
+}
+
+func databaseScheme(databaseURL string) string {
+	if u, err := url.Parse(databaseURL); err == nil {
+		return u.Scheme
+	}
+	return ""
+}
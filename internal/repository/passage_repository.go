@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type IPassageRepository interface {
+	GetPassages(gutenbergID int, model string) ([]domain.Passage, error)
+	SavePassages(passages []domain.Passage) error
+}
+
+type PassageRepository struct {
+	DB *sql.DB
+}
+
+func NewPassageRepository(db *sql.DB) *PassageRepository {
+	return &PassageRepository{DB: db}
+}
+
+func (r *PassageRepository) GetPassages(gutenbergID int, model string) ([]domain.Passage, error) {
+	query := `SELECT id, gutenberg_id, model, start_offset, end_offset, content, embedding FROM passages
+		WHERE gutenberg_id = $1 AND model = $2 ORDER BY start_offset`
+	rows, err := r.DB.Query(query, gutenbergID, model)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passages []domain.Passage
+	for rows.Next() {
+		var passage domain.Passage
+		var embedding pq.Float32Array
+		err := rows.Scan(&passage.ID, &passage.GutenbergID, &passage.Model, &passage.Start, &passage.End, &passage.Content, &embedding)
+		if err != nil {
+			return nil, err
+		}
+		passage.Embedding = embedding
+		passages = append(passages, passage)
+	}
+
+	return passages, rows.Err()
+}
+
+// SavePassages stores a whole index in one transaction so a book is never left half indexed
+func (r *PassageRepository) SavePassages(passages []domain.Passage) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO passages (gutenberg_id, model, start_offset, end_offset, content, embedding)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := range passages {
+		passage := &passages[i]
+		err := stmt.QueryRow(
+			passage.GutenbergID,
+			passage.Model,
+			passage.Start,
+			passage.End,
+			passage.Content,
+			pq.Float32Array(passage.Embedding),
+		).Scan(&passage.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
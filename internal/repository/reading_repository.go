@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type IReadingRepository interface {
+	GetPosition(userID string, gutenbergID int) (*domain.ReadingPosition, error)
+	SavePosition(position *domain.ReadingPosition) error
+	RecentPositions(userID string, limit int) ([]domain.ReadingPosition, error)
+}
+
+type ReadingRepository struct {
+	DB *sql.DB
+}
+
+func NewReadingRepository(db *sql.DB) *ReadingRepository {
+	return &ReadingRepository{DB: db}
+}
+
+// GetPosition returns where the user left the book, or nil when they have not read it
+func (r *ReadingRepository) GetPosition(userID string, gutenbergID int) (*domain.ReadingPosition, error) {
+	position := domain.ReadingPosition{UserID: userID, GutenbergID: gutenbergID}
+	query := `SELECT mode, page_size, "offset", updated_at FROM reading_positions WHERE user_id = $1 AND gutenberg_id = $2`
+	err := r.DB.QueryRow(query, userID, gutenbergID).Scan(&position.Mode, &position.PageSize, &position.Offset, &position.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &position, nil
+}
+
+func (r *ReadingRepository) SavePosition(position *domain.ReadingPosition) error {
+	query := `INSERT INTO reading_positions (user_id, gutenberg_id, mode, page_size, "offset") VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, gutenberg_id) DO UPDATE
+		SET mode = EXCLUDED.mode, page_size = EXCLUDED.page_size, "offset" = EXCLUDED."offset", updated_at = CURRENT_TIMESTAMP
+		RETURNING updated_at`
+	return r.DB.QueryRow(
+		query,
+		position.UserID,
+		position.GutenbergID,
+		position.Mode,
+		position.PageSize,
+		position.Offset,
+	).Scan(&position.UpdatedAt)
+}
+
+// RecentPositions returns the books the user read last with their titles, most recent first. The title is empty
+// when the book is not stored in this database.
+func (r *ReadingRepository) RecentPositions(userID string, limit int) ([]domain.ReadingPosition, error) {
+	query := `SELECT p.gutenberg_id, COALESCE(b.metadata->>'title', ''), p.mode, p.page_size, p."offset", p.updated_at
+		FROM reading_positions p LEFT JOIN books b ON b.gutenberg_id = p.gutenberg_id
+		WHERE p.user_id = $1 ORDER BY p.updated_at DESC LIMIT $2`
+	rows, err := r.DB.Query(query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var positions []domain.ReadingPosition
+	for rows.Next() {
+		position := domain.ReadingPosition{UserID: userID}
+		err := rows.Scan(&position.GutenbergID, &position.Title, &position.Mode, &position.PageSize, &position.Offset, &position.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, position)
+	}
+
+	return positions, rows.Err()
+}
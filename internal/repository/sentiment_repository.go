@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+type ISentimentRepository interface {
+	GetSentimentArc(gutenbergID int, method string, segments int) (*domain.SentimentArc, error)
+	SaveSentimentArc(arc *domain.SentimentArc, segments int) error
+}
+
+type SentimentRepository struct {
+	DB *sql.DB
+}
+
+func NewSentimentRepository(db *sql.DB) *SentimentRepository {
+	return &SentimentRepository{DB: db}
+}
+
+// GetSentimentArc returns the stored arc of the book for a method and number of segments, or nil when there is none
+func (r *SentimentRepository) GetSentimentArc(gutenbergID int, method string, segments int) (*domain.SentimentArc, error) {
+	query := `SELECT gutenberg_id, method, points, created_at FROM sentiment_arcs
+		WHERE gutenberg_id = $1 AND method = $2 AND segments = $3`
+
+	var arc domain.SentimentArc
+	err := r.DB.QueryRow(query, gutenbergID, method, segments).Scan(&arc.GutenbergID, &arc.Method, &arc.Points, &arc.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &arc, nil
+}
+
+// SaveSentimentArc stores the arc under the number of segments requested, short texts may have fewer points
+func (r *SentimentRepository) SaveSentimentArc(arc *domain.SentimentArc, segments int) error {
+	query := `INSERT INTO sentiment_arcs (gutenberg_id, method, segments, points) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (gutenberg_id, method, segments) DO UPDATE SET points = EXCLUDED.points, created_at = CURRENT_TIMESTAMP
+		RETURNING created_at`
+	return r.DB.QueryRow(query, arc.GutenbergID, arc.Method, segments, arc.Points).Scan(&arc.CreatedAt)
+}
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBooksSchema mirrors the books table of the Postgres migrations
+const sqliteBooksSchema = `CREATE TABLE IF NOT EXISTS books (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	gutenberg_id INTEGER UNIQUE NOT NULL,
+	content TEXT NOT NULL DEFAULT '',
+	content_hash TEXT NOT NULL DEFAULT '',
+	metadata BLOB,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+)`
+
+// SQLiteBookRepository stores books in a SQLite file, for running without Postgres
+type SQLiteBookRepository struct {
+	DB *sql.DB
+}
+
+// NewSQLiteBookRepository creates the books table when the database does not have it yet
+func NewSQLiteBookRepository(db *sql.DB) (*SQLiteBookRepository, error) {
+	// SQLite takes one writer at a time, a single connection queues writes instead of failing them as busy
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteBooksSchema); err != nil {
+		return nil, err
+	}
+
+	// Databases created before book bodies moved to blob storage lack the hash column
+	if _, err := db.Exec(`ALTER TABLE books ADD COLUMN content_hash TEXT NOT NULL DEFAULT ''`); err != nil &&
+		!strings.Contains(err.Error(), "duplicate column") {
+		return nil, err
+	}
+	return &SQLiteBookRepository{DB: db}, nil
+}
+
+func (r *SQLiteBookRepository) GetAllBooks() ([]domain.Book, error) {
+	rows, err := r.DB.Query(`SELECT id, gutenberg_id, content_hash, metadata, created_at FROM books`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []domain.Book
+	for rows.Next() {
+		var book domain.Book
+		err := rows.Scan(&book.ID, &book.GutenbergID, &book.ContentHash, &book.Metadata, &book.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+
+	return books, rows.Err()
+}
+
+func (r *SQLiteBookRepository) GetBookByID(gutenbergID int) (*domain.Book, error) {
+	var book domain.Book
+	query := `SELECT id, gutenberg_id, content, content_hash, metadata FROM books WHERE gutenberg_id = ?`
+	err := r.DB.QueryRow(query, gutenbergID).Scan(&book.ID, &book.GutenbergID, &book.Content, &book.ContentHash, &book.Metadata)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &book, nil
+}
+
+// SaveBook keeps the stored book when there is one already, like BookRepository.SaveBook
+func (r *SQLiteBookRepository) SaveBook(book *domain.Book) error {
+	query := `INSERT INTO books (gutenberg_id, content, content_hash, metadata) VALUES (?, ?, ?, ?)
+		ON CONFLICT (gutenberg_id) DO UPDATE SET gutenberg_id = excluded.gutenberg_id RETURNING id`
+	return r.DB.QueryRow(
+		query,
+		book.GutenbergID,
+		book.Content,
+		book.ContentHash,
+		book.Metadata,
+	).Scan(&book.ID)
+}
@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+// usageTotals are the aggregates of usage_records shared by the totals and the report
+const usageTotals = `COUNT(*), COALESCE(SUM(r.prompt_tokens), 0), COALESCE(SUM(r.completion_tokens), 0)`
+
+// costTotals adds the cost, average latency and estimated calls to usageTotals, for the cost report
+const costTotals = usageTotals + `, COALESCE(SUM(r.cost), 0), COALESCE(ROUND(AVG(r.latency_ms)), 0)::BIGINT,
+	COUNT(*) FILTER (WHERE r.estimated)`
+
+// inWindow keeps the records made within the window, whose seconds are $1
+const inWindow = `r.created_at > CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'`
+
+type IUsageRepository interface {
+	SaveUsage(usage *domain.Usage) error
+	UserUsage(userID int, window time.Duration) (domain.UsageTotal, error)
+	IPUsage(ip string, window time.Duration) (domain.UsageTotal, error)
+	UsageReport(window time.Duration) (*domain.UsageReport, error)
+	CostReport(window time.Duration) (*domain.CostReport, error)
+}
+
+type UsageRepository struct {
+	DB *sql.DB
+}
+
+func NewUsageRepository(db *sql.DB) *UsageRepository {
+	return &UsageRepository{DB: db}
+}
+
+func (r *UsageRepository) SaveUsage(usage *domain.Usage) error {
+	query := `INSERT INTO usage_records (user_id, ip, gutenberg_id, prompt, model, prompt_tokens, completion_tokens,
+			estimated, latency_ms, cost)
+		VALUES (NULLIF($1, 0), $2, NULLIF($3, 0), $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at`
+	return r.DB.QueryRow(
+		query,
+		usage.UserID,
+		usage.IP,
+		usage.GutenbergID,
+		usage.Prompt,
+		usage.Model,
+		usage.PromptTokens,
+		usage.CompletionTokens,
+		usage.Estimated,
+		usage.LatencyMs,
+		usage.Cost,
+	).Scan(&usage.ID, &usage.CreatedAt)
+}
+
+// UserUsage sums the calls made for the user within the window up to now
+func (r *UsageRepository) UserUsage(userID int, window time.Duration) (domain.UsageTotal, error) {
+	return r.total(`r.user_id = $1`, userID, window)
+}
+
+// IPUsage sums the calls made from the address within the window up to now, whoever was signed in
+func (r *UsageRepository) IPUsage(ip string, window time.Duration) (domain.UsageTotal, error) {
+	return r.total(`r.ip = $1`, ip, window)
+}
+
+// UsageReport sums the usage within the window per user and per address, heaviest first
+func (r *UsageRepository) UsageReport(window time.Duration) (*domain.UsageReport, error) {
+	report := &domain.UsageReport{Window: window}
+
+	users, err := r.DB.Query(`SELECT u.id, u.username, MAX(r.created_at), `+usageTotals+`
+		FROM usage_records r JOIN users u ON u.id = r.user_id
+		WHERE r.created_at > CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+		GROUP BY u.id, u.username ORDER BY SUM(r.prompt_tokens + r.completion_tokens) DESC`, windowSeconds(window))
+	if err != nil {
+		return nil, err
+	}
+	defer users.Close()
+
+	for users.Next() {
+		var summary domain.UsageSummary
+		err := users.Scan(&summary.UserID, &summary.Username, &summary.LastCall,
+			&summary.Calls, &summary.PromptTokens, &summary.CompletionTokens)
+		if err != nil {
+			return nil, err
+		}
+		report.Users = append(report.Users, summary)
+	}
+	if err := users.Err(); err != nil {
+		return nil, err
+	}
+
+	addresses, err := r.DB.Query(`SELECT r.ip, MAX(r.created_at), `+usageTotals+`
+		FROM usage_records r
+		WHERE r.ip <> '' AND r.created_at > CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+		GROUP BY r.ip ORDER BY SUM(r.prompt_tokens + r.completion_tokens) DESC`, windowSeconds(window))
+	if err != nil {
+		return nil, err
+	}
+	defer addresses.Close()
+
+	for addresses.Next() {
+		var summary domain.UsageSummary
+		err := addresses.Scan(&summary.IP, &summary.LastCall, &summary.Calls, &summary.PromptTokens, &summary.CompletionTokens)
+		if err != nil {
+			return nil, err
+		}
+		report.Addresses = append(report.Addresses, summary)
+	}
+
+	return report, addresses.Err()
+}
+
+// CostReport sums the cost within the window in total and per book, user, day and model
+func (r *UsageRepository) CostReport(window time.Duration) (*domain.CostReport, error) {
+	report := &domain.CostReport{Window: window}
+	seconds := windowSeconds(window)
+
+	total := &report.Total
+	err := r.DB.QueryRow(`SELECT `+costTotals+` FROM usage_records r WHERE `+inWindow, seconds).Scan(
+		&total.Calls, &total.PromptTokens, &total.CompletionTokens, &total.Cost, &total.AverageLatencyMs, &total.EstimatedCalls)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Books, err = r.costSummaries(`SELECT r.gutenberg_id, COALESCE(b.metadata->>'title', ''), `+costTotals+`
+		FROM usage_records r LEFT JOIN books b ON b.gutenberg_id = r.gutenberg_id
+		WHERE r.gutenberg_id IS NOT NULL AND `+inWindow+`
+		GROUP BY r.gutenberg_id, b.metadata->>'title' ORDER BY SUM(r.cost) DESC, COUNT(*) DESC`, seconds,
+		func(s *domain.CostSummary) []interface{} { return []interface{}{&s.GutenbergID, &s.Title} })
+	if err != nil {
+		return nil, err
+	}
+
+	report.Users, err = r.costSummaries(`SELECT u.id, u.username, `+costTotals+`
+		FROM usage_records r JOIN users u ON u.id = r.user_id
+		WHERE `+inWindow+`
+		GROUP BY u.id, u.username ORDER BY SUM(r.cost) DESC, COUNT(*) DESC`, seconds,
+		func(s *domain.CostSummary) []interface{} { return []interface{}{&s.UserID, &s.Username} })
+	if err != nil {
+		return nil, err
+	}
+
+	report.Days, err = r.costSummaries(`SELECT TO_CHAR(r.created_at, 'YYYY-MM-DD') AS day, `+costTotals+`
+		FROM usage_records r
+		WHERE `+inWindow+`
+		GROUP BY day ORDER BY day DESC`, seconds,
+		func(s *domain.CostSummary) []interface{} { return []interface{}{&s.Day} })
+	if err != nil {
+		return nil, err
+	}
+
+	report.Models, err = r.costSummaries(`SELECT r.model, `+costTotals+`
+		FROM usage_records r
+		WHERE `+inWindow+`
+		GROUP BY r.model ORDER BY SUM(r.cost) DESC, COUNT(*) DESC`, seconds,
+		func(s *domain.CostSummary) []interface{} { return []interface{}{&s.Model} })
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// costSummaries runs a cost report query, whose rows are the columns of keys followed by costTotals
+func (r *UsageRepository) costSummaries(query string, seconds int64, keys func(*domain.CostSummary) []interface{}) ([]domain.CostSummary, error) {
+	rows, err := r.DB.Query(query, seconds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []domain.CostSummary
+	for rows.Next() {
+		var s domain.CostSummary
+		dest := append(keys(&s), &s.Calls, &s.PromptTokens, &s.CompletionTokens, &s.Cost, &s.AverageLatencyMs, &s.EstimatedCalls)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
+
+// total sums the usage matching the condition, whose only parameter is $1. Times are computed by the
+// database, so its clock and time zone are the only ones involved.
+func (r *UsageRepository) total(condition string, value interface{}, window time.Duration) (domain.UsageTotal, error) {
+	query := `SELECT ` + usageTotals + `,
+			COALESCE(EXTRACT(EPOCH FROM MIN(r.created_at) + $2 * INTERVAL '1 second' - CURRENT_TIMESTAMP), 0)
+		FROM usage_records r
+		WHERE ` + condition + ` AND r.created_at > CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'`
+
+	var total domain.UsageTotal
+	var resetsIn float64
+	err := r.DB.QueryRow(query, value, windowSeconds(window)).Scan(&total.Calls, &total.PromptTokens, &total.CompletionTokens, &resetsIn)
+	if err != nil {
+		return total, err
+	}
+
+	total.ResetsIn = time.Duration(resetsIn * float64(time.Second))
+	return total, nil
+}
+
+func windowSeconds(window time.Duration) int64 {
+	return int64(window / time.Second)
+}
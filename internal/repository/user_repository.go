@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+var ErrUsernameTaken = errors.New("username already taken")
+
+const userColumns = `u.id, u.username, u.password_hash, u.created_at`
+
+// IUserRepository stores accounts with their sessions and API tokens, which are looked up by the hash of
+// the secret handed to the client
+type IUserRepository interface {
+	CreateUser(user *domain.User) error
+	GetUserByUsername(username string) (*domain.User, error)
+	CreateSession(tokenHash string, userID int, ttl time.Duration) error
+	GetSessionUser(tokenHash string) (*domain.User, error)
+	DeleteSession(tokenHash string) error
+	CreateAPIToken(token *domain.APIToken, tokenHash string) error
+	GetAPITokenUser(tokenHash string) (*domain.User, error)
+	ListAPITokens(userID int) ([]domain.APIToken, error)
+	DeleteAPIToken(userID int, id int) (bool, error)
+}
+
+type UserRepository struct {
+	DB *sql.DB
+}
+
+func NewUserRepository(db *sql.DB) *UserRepository {
+	return &UserRepository{DB: db}
+}
+
+// CreateUser stores the user and sets its ID, or returns ErrUsernameTaken
+func (r *UserRepository) CreateUser(user *domain.User) error {
+	query := `INSERT INTO users (username, password_hash) VALUES ($1, $2) ON CONFLICT (username) DO NOTHING
+		RETURNING id, created_at`
+	err := r.DB.QueryRow(query, user.Username, user.PasswordHash).Scan(&user.ID, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// GetUserByUsername returns the user, or nil when there is none
+func (r *UserRepository) GetUserByUsername(username string) (*domain.User, error) {
+	return scanUser(r.DB.QueryRow(`SELECT `+userColumns+` FROM users u WHERE u.username = $1`, username))
+}
+
+// CreateSession stores a session expiring after the TTL, and drops the sessions that expired
+func (r *UserRepository) CreateSession(tokenHash string, userID int, ttl time.Duration) error {
+	if _, err := r.DB.Exec(`DELETE FROM sessions WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO sessions (token_hash, user_id, expires_at) VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second')`
+	_, err := r.DB.Exec(query, tokenHash, userID, int64(ttl/time.Second))
+	return err
+}
+
+// GetSessionUser returns the user of a session that has not expired, or nil
+func (r *UserRepository) GetSessionUser(tokenHash string) (*domain.User, error) {
+	query := `SELECT ` + userColumns + ` FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > CURRENT_TIMESTAMP`
+	return scanUser(r.DB.QueryRow(query, tokenHash))
+}
+
+func (r *UserRepository) DeleteSession(tokenHash string) error {
+	_, err := r.DB.Exec(`DELETE FROM sessions WHERE token_hash = $1`, tokenHash)
+	return err
+}
+
+func (r *UserRepository) CreateAPIToken(token *domain.APIToken, tokenHash string) error {
+	query := `INSERT INTO api_tokens (user_id, name, token_hash) VALUES ($1, $2, $3) RETURNING id, created_at`
+	return r.DB.QueryRow(query, token.UserID, token.Name, tokenHash).Scan(&token.ID, &token.CreatedAt)
+}
+
+// GetAPITokenUser returns the user of the token and records its use, or returns nil for an unknown token
+func (r *UserRepository) GetAPITokenUser(tokenHash string) (*domain.User, error) {
+	query := `WITH t AS (
+			UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE token_hash = $1 RETURNING user_id
+		)
+		SELECT ` + userColumns + ` FROM t JOIN users u ON u.id = t.user_id`
+	return scanUser(r.DB.QueryRow(query, tokenHash))
+}
+
+func (r *UserRepository) ListAPITokens(userID int) ([]domain.APIToken, error) {
+	rows, err := r.DB.Query(`SELECT id, user_id, name, created_at, last_used_at FROM api_tokens WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []domain.APIToken
+	for rows.Next() {
+		var token domain.APIToken
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&token.ID, &token.UserID, &token.Name, &token.CreatedAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes one of the user's tokens and tells whether there was one
+func (r *UserRepository) DeleteAPIToken(userID int, id int) (bool, error) {
+	result, err := r.DB.Exec(`DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func scanUser(row *sql.Row) (*domain.User, error) {
+	var user domain.User
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// AnalysisKind describes an analysis selectable by clients: the prompt it runs, the JSON its
+// output must follow when it is structured, and the events its output is streamed as
+type AnalysisKind struct {
+	Name        string          `json:"name"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Event       string          `json:"event"`
+	ResultEvent string          `json:"result_event,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+}
+
+// Structured reports whether the kind asks the model for JSON output
+func (k AnalysisKind) Structured() bool {
+	return len(k.Schema) > 0
+}
+
+// AnalysisCatalog lists every analysis kind, the prompt of each one is the template of the same name
+var AnalysisCatalog = []AnalysisKind{
+	{
+		Name:        "overview",
+		Title:       "Overview",
+		Description: "Key characters, language, sentiment and a short plot summary.",
+		Event:       AnalysisEvent,
+	},
+	{
+		Name:        "characters",
+		Title:       "Characters",
+		Description: "The key characters, their roles and relationships.",
+		Event:       "Characters",
+	},
+	{
+		Name:        "themes",
+		Title:       "Themes",
+		Description: "The main themes and motifs with supporting passages.",
+		Event:       "Themes",
+		ResultEvent: "ThemesResult",
+		Schema: json.RawMessage(`{
+  "type": "object",
+  "required": ["themes"],
+  "properties": {
+    "themes": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["name", "description"],
+        "properties": {
+          "name": {"type": "string"},
+          "description": {"type": "string"},
+          "passages": {"type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}`),
+	},
+	{
+		Name:        "sentiment_arc",
+		Title:       "Narrative arc",
+		Description: "How the sentiment evolves from the beginning to the end of the text.",
+		Event:       "SentimentArc",
+		ResultEvent: "SentimentArcResult",
+		Schema: json.RawMessage(`{
+  "type": "object",
+  "required": ["segments"],
+  "properties": {
+    "segments": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["segment", "score", "label"],
+        "properties": {
+          "segment": {"type": "integer"},
+          "score": {"type": "number", "minimum": -1, "maximum": 1},
+          "label": {"type": "string"},
+          "summary": {"type": "string"}
+        }
+      }
+    }
+  }
+}`),
+	},
+	{
+		Name:        "reading_level",
+		Title:       "Reading level",
+		Description: "An estimate of the reading level and intended audience.",
+		Event:       "ReadingLevel",
+		ResultEvent: "ReadingLevelResult",
+		Schema: json.RawMessage(`{
+  "type": "object",
+  "required": ["grade_level", "audience"],
+  "properties": {
+    "grade_level": {"type": "number"},
+    "audience": {"type": "string"},
+    "rationale": {"type": "string"}
+  }
+}`),
+	},
+	{
+		Name:        "entities",
+		Title:       "People and places",
+		Description: "Named people, places and organizations mentioned in the text.",
+		Event:       "Entities",
+		ResultEvent: "EntitiesResult",
+		Schema: json.RawMessage(`{
+  "type": "object",
+  "required": ["people", "places"],
+  "properties": {
+    "people": {"type": "array", "items": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}, "description": {"type": "string"}}}},
+    "places": {"type": "array", "items": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}, "description": {"type": "string"}}}},
+    "organizations": {"type": "array", "items": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}, "description": {"type": "string"}}}}
+  }
+}`),
+	},
+	{
+		Name:        "quotations",
+		Title:       "Quotations",
+		Description: "Memorable quotations with their speaker and significance.",
+		Event:       "Quotations",
+		ResultEvent: "QuotationsResult",
+		Schema: json.RawMessage(`{
+  "type": "object",
+  "required": ["quotes"],
+  "properties": {
+    "quotes": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["text"],
+        "properties": {
+          "text": {"type": "string"},
+          "speaker": {"type": "string"},
+          "significance": {"type": "string"}
+        }
+      }
+    }
+  }
+}`),
+	},
+	{
+		Name:        "style",
+		Title:       "Style",
+		Description: "Diction, sentence structure, imagery, tone and literary devices.",
+		Event:       "Style",
+	},
+	{
+		Name:        "summary",
+		Title:       "Summary",
+		Description: "A plot summary in a few paragraphs.",
+		Event:       "Summary",
+	},
+}
+
+// LookupAnalysisKind finds a kind of the catalog by name
+func LookupAnalysisKind(name string) (AnalysisKind, bool) {
+	for _, kind := range AnalysisCatalog {
+		if kind.Name == name {
+			return kind, true
+		}
+	}
+	return AnalysisKind{}, false
+}
+
+// IsAnalysisKind reports whether kind names a known analysis
+func IsAnalysisKind(name string) bool {
+	_, ok := LookupAnalysisKind(name)
+	return ok
+}
+
+// ParseResult extracts the JSON object from a structured analysis, tolerating a surrounding
+// markdown code fence, and checks the top-level fields required by the kind's schema
+func (k AnalysisKind) ParseResult(content string) (json.RawMessage, bool) {
+	content, ok := extractJSONObject(content)
+	if !ok {
+		return nil, false
+	}
+
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &result); err != nil {
+		return nil, false
+	}
+
+	var schema struct {
+		Required []string `json:"required"`
+	}
+	if err := json.Unmarshal(k.Schema, &schema); err != nil {
+		return nil, false
+	}
+	for _, field := range schema.Required {
+		if _, ok := result[field]; !ok {
+			return nil, false
+		}
+	}
+
+	return json.RawMessage(content), true
+}
+
+// extractJSONObject returns the outermost braces of a model's answer, dropping any prose or code fence around them
+func extractJSONObject(content string) (string, bool) {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return "", false
+	}
+	return content[start : end+1], true
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+const (
+	ErrorEvent = "error"
+
+	ErrCodeUpstreamAuth   = "upstream_auth"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeContextLength  = "context_length"
+	ErrCodeMalformedChunk = "malformed_chunk"
+	ErrCodeUpstream       = "upstream_error"
+	ErrCodeUnavailable    = "upstream_unavailable"
+	ErrCodeTimeout        = "timeout"
+	ErrCodeCanceled       = "canceled"
+	ErrCodeInvalidRequest = "invalid_request"
+	ErrCodeQuotaExceeded  = "quota_exceeded"
+	ErrCodeInternal       = "internal"
+)
+
+// AnalysisError is the payload of the error event sent to the client once a stream has started. RetryAfter is
+// how many seconds to wait before trying again, when known.
+type AnalysisError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	Err        error  `json:"-"`
+}
+
+func (e *AnalysisError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AnalysisError) Unwrap() error {
+	return e.Err
+}
+
+// AsAnalysisError classifies any error coming out of an analysis into a client facing code and message. Only
+// the errors known to be transient are retryable.
+func AsAnalysisError(err error) *AnalysisError {
+	var analysisErr *AnalysisError
+	if errors.As(err, &analysisErr) {
+		return analysisErr
+	}
+
+	var apiErr *engine.APIError
+	var timeoutErr *engine.TimeoutError
+	var openErr *engine.CircuitOpenError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &apiErr):
+		return classifyAPIError(apiErr, err)
+	case errors.As(err, &timeoutErr):
+		return &AnalysisError{Code: ErrCodeTimeout, Message: "The analysis provider took too long to answer.", Retryable: true, Err: err}
+	case errors.As(err, &openErr):
+		return &AnalysisError{Code: ErrCodeUnavailable, Message: "The analysis provider is unavailable, try again shortly.", Retryable: true, Err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &AnalysisError{Code: ErrCodeTimeout, Message: "The analysis took too long and was stopped.", Retryable: true, Err: err}
+	case errors.Is(err, context.Canceled):
+		return &AnalysisError{Code: ErrCodeCanceled, Message: "The analysis was canceled.", Retryable: true, Err: err}
+	case errors.As(err, &netErr):
+		return &AnalysisError{Code: ErrCodeUnavailable, Message: "A service the analysis needs could not be reached, try again shortly.", Retryable: true, Err: err}
+	default:
+		return &AnalysisError{Code: ErrCodeInternal, Message: "The analysis failed unexpectedly.", Err: err}
+	}
+}
+
+func classifyAPIError(apiErr *engine.APIError, err error) *AnalysisError {
+	switch {
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+		return &AnalysisError{Code: ErrCodeUpstreamAuth, Message: "The analysis provider rejected our credentials.", Err: err}
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		return &AnalysisError{Code: ErrCodeRateLimited, Message: "The analysis provider is rate limiting requests, try again shortly.", Retryable: true, Err: err}
+	case isContextLengthMessage(apiErr.Body):
+		return &AnalysisError{Code: ErrCodeContextLength, Message: "The text is too long for the analysis model.", Err: err}
+	default:
+		return &AnalysisError{Code: ErrCodeUpstream, Message: "The analysis provider returned an error.", Retryable: apiErr.StatusCode >= 500, Err: err}
+	}
+}
+
+func isContextLengthMessage(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "context length") ||
+		strings.Contains(message, "context_length") ||
+		strings.Contains(message, "maximum context") ||
+		strings.Contains(message, "too many tokens")
+}
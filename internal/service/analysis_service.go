@@ -2,54 +2,443 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"io"
 	"strings"
+	"time"
 
+	"github.com/yuriadams/lear/internal/domain"
 	"github.com/yuriadams/lear/internal/service/engine"
 )
 
+// EventSender delivers named analysis events to a client transport (SSE, WebSocket, ...)
+type EventSender interface {
+	Send(event string, data interface{}) error
+}
+
+// DiscardEvents drops every event, for analyses whose result is only used once complete
+var DiscardEvents EventSender = discardEvents{}
+
+type discardEvents struct{}
+
+func (discardEvents) Send(event string, data interface{}) error {
+	return nil
+}
+
 type IAnalysisService interface {
-	StreamTextAnalysis(w http.ResponseWriter, r *http.Request, text string) error
+	StreamTextAnalysis(ctx context.Context, events EventSender, text string, kind string, version string) (*Completion, error)
+	AnswerQuestion(ctx context.Context, events EventSender, text string, question string) (*Completion, error)
+	Converse(ctx context.Context, events EventSender, text string, history []engine.ChatMessage) (*Completion, error)
+	ConverseWithPassages(ctx context.Context, events EventSender, passages []domain.Passage, history []engine.ChatMessage) (*Completion, error)
+	StreamPrompt(ctx context.Context, events EventSender, name string, data PromptData) (*Completion, error)
+	StreamComparison(ctx context.Context, events EventSender, books []*domain.Book) (*Completion, error)
+	Catalog() []AnalysisKind
+	HasPrompt(name string, version string) bool
 }
 
 type StreamedChunk struct {
+	Model   string `json:"model"`
 	Choices []struct {
 		Delta struct {
 			Content string `json:"content"`
 		} `json:"delta"`
 	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error,omitempty"`
+	// Usage comes with the last chunk when the engine reports it
+	Usage *engine.Usage `json:"usage,omitempty"`
+}
+
+// AnalysisChunk is the payload of every analysis event sent to the client
+type AnalysisChunk struct {
+	Analysis string `json:"analysis"`
+}
+
+// Completion is the full text streamed by the engine and the prompt that produced it, with the engine and
+// model that answered and their token counts, Estimated when the engine did not report them. Engine is empty
+// unless the AI engine is a FallbackEngine.
+type Completion struct {
+	PromptName       string
+	PromptVersion    string
+	Content          string
+	Engine           string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Estimated        bool
 }
 
+const (
+	AnalysisEvent   = "CustomEvent"
+	ComparisonEvent = "Comparison"
+
+	DefaultAnalysisKind = "overview"
+
+	questionPromptName     = "question"
+	chatPromptName         = "chat"
+	chatPassagesPromptName = "chat_passages"
+	comparisonPromptName   = "comparison"
+
+	// DefaultMaxPromptTokens caps the prompts of NewAnalysisService well below the context window of the
+	// larger models, which bounds what an analysis costs
+	DefaultMaxPromptTokens = 16000
+
+	// answerTokens is the room kept for the answer in the context window
+	answerTokens = 4096
+)
+
 type AnalysisService struct {
 	AiEngine engine.AiEngine
+	Prompts  *PromptLibrary
+	Usage    UsageRecorder
+	// Pricing prices the recorded usage, DefaultPricing when nil
+	Pricing Pricing
+	// MaxPromptTokens caps the prompts below the context window of the model, 0 only keeps them within it
+	MaxPromptTokens int
+}
+
+func NewAnalysisService(prompts *PromptLibrary) *AnalysisService {
+	return &AnalysisService{AiEngine: engine.NewSambaNovaClient(), Prompts: prompts, MaxPromptTokens: DefaultMaxPromptTokens}
+}
+
+// Catalog lists the analysis kinds StreamTextAnalysis accepts
+func (a *AnalysisService) Catalog() []AnalysisKind {
+	return AnalysisCatalog
+}
+
+// HasPrompt reports whether the prompt exists in the given version, or in any version when version is empty
+func (a *AnalysisService) HasPrompt(name string, version string) bool {
+	return a.prompts().Has(name, version)
+}
+
+func (a *AnalysisService) prompts() *PromptLibrary {
+	if a.Prompts == nil {
+		return DefaultPrompts()
+	}
+	return a.Prompts
+}
+
+// StreamTextAnalysis runs the analysis of the given kind and forwards every content delta as the kind's event,
+// using the latest version of its prompt when version is empty. Structured kinds also send their parsed
+// output as the kind's result event when the model followed the schema.
+func (a *AnalysisService) StreamTextAnalysis(ctx context.Context, events EventSender, text string, name string, version string) (*Completion, error) {
+	if name == "" {
+		name = DefaultAnalysisKind
+	}
+
+	kind, ok := LookupAnalysisKind(name)
+	if !ok {
+		return nil, &AnalysisError{Code: ErrCodeInvalidRequest, Message: fmt.Sprintf("Unknown analysis type %q.", name)}
+	}
+
+	prompt, err := a.renderFitted(kind.Name, version, PromptData{Text: text, Schema: string(kind.Schema)}, a.promptBudget())
+	if err != nil {
+		return nil, err
+	}
+
+	completion, err := a.streamPrompt(ctx, events, kind.Event, prompt)
+	if err != nil || !kind.Structured() {
+		return completion, err
+	}
+
+	if result, ok := kind.ParseResult(completion.Content); ok {
+		if err := events.Send(kind.ResultEvent, result); err != nil {
+			return nil, fmt.Errorf("failed to send event: %w", err)
+		}
+	}
+	return completion, nil
+}
+
+// AnswerQuestion streams the answer to a free-form question about the text
+func (a *AnalysisService) AnswerQuestion(ctx context.Context, events EventSender, text string, question string) (*Completion, error) {
+	if strings.TrimSpace(question) == "" {
+		return nil, &AnalysisError{Code: ErrCodeInvalidRequest, Message: "The question is empty."}
+	}
+
+	prompt, err := a.renderFitted(questionPromptName, "", PromptData{Text: text, Question: question}, a.promptBudget())
+	if err != nil {
+		return nil, err
+	}
+
+	return a.streamPrompt(ctx, events, AnalysisEvent, prompt)
+}
+
+// Converse streams the assistant's answer to the last user message of the history, with as much of the text
+// as the history leaves room for. The oldest turns are left out when the history alone does not fit.
+func (a *AnalysisService) Converse(ctx context.Context, events EventSender, text string, history []engine.ChatMessage) (*Completion, error) {
+	bare, err := a.render(chatPromptName, "", PromptData{})
+	if err != nil {
+		return nil, err
+	}
+
+	budget := a.promptBudget()
+	history, historyTokens, err := a.fitHistory(history, budget-a.tokenizer().Count(bare.Text))
+	if err != nil {
+		return nil, err
+	}
+
+	prompt, err := a.renderFitted(chatPromptName, "", PromptData{Text: text}, budget-historyTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.converse(ctx, events, prompt, history)
+}
+
+// ConverseWithPassages answers from the retrieved passages only, asking the model to cite them by label
+func (a *AnalysisService) ConverseWithPassages(ctx context.Context, events EventSender, passages []domain.Passage, history []engine.ChatMessage) (*Completion, error) {
+	prompt, err := a.render(chatPassagesPromptName, "", PromptData{Passages: FormatPassages(passages)})
+	if err != nil {
+		return nil, err
+	}
+
+	history, _, err = a.fitHistory(history, a.promptBudget()-a.tokenizer().Count(prompt.Text))
+	if err != nil {
+		return nil, err
+	}
+
+	return a.converse(ctx, events, prompt, history)
 }
 
-func NewAnalysisService() *AnalysisService {
-	return &AnalysisService{AiEngine: engine.NewSambaNovaClient()}
+// fitHistory leaves out the oldest turns of the history until it holds at most budget tokens, and returns it
+// with its tokens. The last message is always kept, so a question that does not fit alone is an error.
+func (a *AnalysisService) fitHistory(history []engine.ChatMessage, budget int) ([]engine.ChatMessage, int, error) {
+	tokenizer := a.tokenizer()
+	tokens := 0
+	for _, message := range history {
+		tokens += tokenizer.Count(message.Content)
+	}
+
+	trimmed := false
+	for len(history) > 1 && tokens > budget {
+		tokens -= tokenizer.Count(history[0].Content)
+		history = history[1:]
+		trimmed = true
+	}
+	// A history cut in the middle of a turn starts again at the next question
+	for trimmed && len(history) > 1 && history[0].Role != engine.RoleUser {
+		tokens -= tokenizer.Count(history[0].Content)
+		history = history[1:]
+	}
+
+	if tokens > budget {
+		return nil, 0, &AnalysisError{Code: ErrCodeInvalidRequest, Message: "The question is too long."}
+	}
+	return history, tokens, nil
 }
 
-// StreamTextAnalysis handles streaming responses from the SambaNova API and sends them as SSE
-func (a *AnalysisService) StreamTextAnalysis(w http.ResponseWriter, r *http.Request, text string) error {
-	// Configure headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// StreamComparison streams a comparative analysis of several books, each shortened to an equal share of the prompt
+func (a *AnalysisService) StreamComparison(ctx context.Context, events EventSender, books []*domain.Book) (*Completion, error) {
+	if len(books) < 2 {
+		return nil, &AnalysisError{Code: ErrCodeInvalidRequest, Message: "A comparison needs at least two books."}
+	}
 
-	// shorten the text to don't raise a max token limit api error
-	shortenedText := limitTextToTokens(text, 10000)
+	data := PromptData{Books: make([]PromptBook, len(books))}
+	for i, book := range books {
+		data.Books[i] = PromptBook{
+			Title:  book.Metadata.Title,
+			Author: book.Metadata.Author,
+			Text:   book.Content,
+		}
+	}
 
-	prompt := fmt.Sprintf(`
-	Given the following text:
-	%s
-	1. Identify the key characters.
-	2. Detect the language.
-	3. Perform sentiment analysis.
-	4. Summarize the plot briefly.
-	`, shortenedText)
+	prompt, err := a.renderFitted(comparisonPromptName, "", data, a.promptBudget())
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := a.AiEngine.StreamChat(prompt)
+	return a.streamPrompt(ctx, events, ComparisonEvent, prompt)
+}
+
+// StreamPrompt runs the latest version of any prompt, its text shortened to fit the model
+func (a *AnalysisService) StreamPrompt(ctx context.Context, events EventSender, name string, data PromptData) (*Completion, error) {
+	prompt, err := a.renderFitted(name, "", data, a.promptBudget())
+	if err != nil {
+		return nil, err
+	}
+
+	return a.streamPrompt(ctx, events, AnalysisEvent, prompt)
+}
+
+func (a *AnalysisService) render(name, version string, data PromptData) (*Prompt, error) {
+	prompts := a.prompts()
+	if !prompts.Has(name, version) {
+		return nil, &AnalysisError{Code: ErrCodeInvalidRequest, Message: fmt.Sprintf("Unknown version %q of prompt %q.", version, name)}
+	}
+	return prompts.Render(name, version, data)
+}
+
+// renderFitted renders the prompt with its text, or the texts of its books, shortened to equal shares of what
+// the rest of the prompt leaves of the budget, in tokens of the engine's model. Tokens may merge where a text
+// meets the template, so the shares shrink by any overflow until the whole prompt fits.
+func (a *AnalysisService) renderFitted(name, version string, data PromptData, budget int) (*Prompt, error) {
+	texts := []*string{&data.Text}
+	data.Books = append([]PromptBook(nil), data.Books...)
+	for i := range data.Books {
+		texts = append(texts, &data.Books[i].Text)
+	}
+
+	full := make([]string, len(texts))
+	shares := 0
+	for i, text := range texts {
+		full[i] = *text
+		if *text != "" {
+			shares++
+		}
+		*text = ""
+	}
+
+	bare, err := a.render(name, version, data)
+	if err != nil || shares == 0 {
+		return bare, err
+	}
+
+	tokenizer := a.tokenizer()
+	share := (budget - tokenizer.Count(bare.Text)) / shares
+	for {
+		for i, text := range texts {
+			*text = tokenizer.Truncate(full[i], share)
+		}
+
+		prompt, err := a.render(name, version, data)
+		if err != nil {
+			return nil, err
+		}
+		overflow := tokenizer.Count(prompt.Text) - budget
+		if overflow <= 0 || share <= 0 {
+			return prompt, nil
+		}
+		share -= (overflow + shares - 1) / shares
+	}
+}
+
+// model is the model that answers the engine's calls
+func (a *AnalysisService) model() engine.Model {
+	if info, ok := a.AiEngine.(engine.ModelInfo); ok {
+		return info.Model()
+	}
+	return engine.LookupModel("")
+}
+
+func (a *AnalysisService) tokenizer() engine.Tokenizer {
+	return engine.TokenizerFor(a.model())
+}
+
+// promptBudget is how many tokens a prompt may hold, leaving room for the answer in the context window and the
+// model's margin for approximate counts
+func (a *AnalysisService) promptBudget() int {
+	model := a.model()
+	budget := model.ContextWindow - model.ContextWindow*model.CountMargin/100 - answerTokens
+	if a.MaxPromptTokens > 0 && a.MaxPromptTokens < budget {
+		budget = a.MaxPromptTokens
+	}
+	return budget
+}
+
+func (a *AnalysisService) converse(ctx context.Context, events EventSender, systemPrompt *Prompt, history []engine.ChatMessage) (*Completion, error) {
+	if len(history) == 0 || history[len(history)-1].Role != engine.RoleUser {
+		return nil, &AnalysisError{Code: ErrCodeInvalidRequest, Message: "The conversation must end with a question."}
+	}
+
+	messages := make([]engine.ChatMessage, 0, len(history)+1)
+	messages = append(messages, engine.ChatMessage{Role: engine.RoleSystem, Content: systemPrompt.Text})
+	messages = append(messages, history...)
+
+	tokenizer := a.tokenizer()
+	promptTokens := 0
+	for _, message := range messages {
+		promptTokens += tokenizer.Count(message.Content)
+	}
+
+	return a.complete(ctx, events, AnalysisEvent, systemPrompt, promptTokens, func() (io.ReadCloser, error) {
+		return a.AiEngine.StreamConversation(ctx, messages)
+	})
+}
+
+func (a *AnalysisService) streamPrompt(ctx context.Context, events EventSender, event string, prompt *Prompt) (*Completion, error) {
+	return a.complete(ctx, events, event, prompt, a.tokenizer().Count(prompt.Text), func() (io.ReadCloser, error) {
+		return a.AiEngine.StreamChat(ctx, prompt.Text)
+	})
+}
+
+// complete forwards the engine's stream as the given event and collects it into a Completion. The token counts
+// are the ones the engine reported, or promptTokens and the count of the answer when it did not. The usage
+// is recorded for the caller and book of the context, also when the stream broke off after some of the answer.
+func (a *AnalysisService) complete(ctx context.Context, events EventSender, event string, prompt *Prompt, promptTokens int, open func() (io.ReadCloser, error)) (*Completion, error) {
+	start := time.Now()
+	answer := &answerRecorder{EventSender: events}
+	stream := &streamInfo{}
+	err := a.forwardStream(ctx, answer, event, stream, open)
+	latency := time.Since(start)
+
+	completion := &Completion{
+		PromptName:       prompt.Name,
+		PromptVersion:    prompt.Version,
+		Content:          answer.String(),
+		Engine:           stream.Engine,
+		Model:            stream.Model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: a.tokenizer().Count(answer.String()),
+		Estimated:        true,
+	}
+	if completion.Model == "" {
+		completion.Model = a.model().Name
+	}
+	if stream.Usage != nil {
+		completion.PromptTokens = stream.Usage.PromptTokens
+		completion.CompletionTokens = stream.Usage.CompletionTokens
+		completion.Estimated = false
+	}
+	if err == nil || answer.Len() > 0 {
+		a.recordUsage(ctx, completion, latency)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return completion, nil
+}
+
+func (a *AnalysisService) recordUsage(ctx context.Context, completion *Completion, latency time.Duration) {
+	if a.Usage == nil {
+		return
+	}
+
+	pricing := a.Pricing
+	if pricing == nil {
+		pricing = DefaultPricing
+	}
+
+	caller := CallerFrom(ctx)
+	a.Usage.RecordUsage(&domain.Usage{
+		UserID:           caller.UserID,
+		IP:               caller.IP,
+		GutenbergID:      BookFrom(ctx),
+		Prompt:           completion.PromptName,
+		Model:            completion.Model,
+		PromptTokens:     completion.PromptTokens,
+		CompletionTokens: completion.CompletionTokens,
+		Estimated:        completion.Estimated,
+		LatencyMs:        latency.Milliseconds(),
+		Cost:             pricing.Cost(completion.Model, completion.PromptTokens, completion.CompletionTokens),
+	})
+}
+
+// streamInfo is what a stream tells about itself besides the answer
+type streamInfo struct {
+	Engine string
+	Model  string
+	Usage  *engine.Usage
+}
+
+// forwardStream reads the streamed response from the AI engine and forwards every content delta as an event,
+// keeping the engine that served it and the model and usage the chunks carry in info
+func (a *AnalysisService) forwardStream(ctx context.Context, events EventSender, event string, info *streamInfo, open func() (io.ReadCloser, error)) error {
+	resp, err := open()
 
 	if err != nil {
 		return fmt.Errorf("failed to stream chat: %w", err)
@@ -58,9 +447,31 @@ func (a *AnalysisService) StreamTextAnalysis(w http.ResponseWriter, r *http.Requ
 	if resp == nil {
 		return fmt.Errorf("response stream is nil")
 	}
+	defer resp.Close()
+
+	// The chunks may name the model more precisely than the engine that served them
+	if source, ok := engine.SourceOf(resp); ok {
+		info.Engine = source.Engine
+		info.Model = source.Model.Name
+	}
+
+	// Closing the body unblocks the scanner as soon as the caller cancels
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			resp.Close()
+		case <-stop:
+		}
+	}()
 
 	scanner := bufio.NewScanner(resp)
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		line := scanner.Text()
 
 		// Ignore keep-alive messages or empty lines
@@ -73,61 +484,65 @@ func (a *AnalysisService) StreamTextAnalysis(w http.ResponseWriter, r *http.Requ
 
 		var chunk StreamedChunk
 		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
-			return fmt.Errorf("failed to decode streamed chunk: %w", err)
+			return &AnalysisError{
+				Code:      ErrCodeMalformedChunk,
+				Message:   "The analysis provider sent a response we could not read.",
+				Retryable: true,
+				Err:       fmt.Errorf("failed to decode streamed chunk: %w", err),
+			}
+		}
+
+		// Errors raised mid-stream arrive as a chunk instead of an HTTP status
+		if chunk.Error != nil {
+			return streamedChunkError(chunk.Error.Type, chunk.Error.Message)
+		}
+
+		if chunk.Model != "" {
+			info.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			info.Usage = chunk.Usage
 		}
 
-		// // Extract and stream the `delta.content`
+		// Extract and send the `delta.content`
 		for _, choice := range chunk.Choices {
 			content := choice.Delta.Content
 			if content != "" {
-				// Escape special characters to ensure valid JSON
-				escapedContent := escapeJSONString(content)
-
-				// Send the event to the client
-				data := fmt.Sprintf(`event: CustomEvent
-data: {"analysis": "%s"}
-
-`, escapedContent)
-
-				_, err := w.Write([]byte(data))
-				if err != nil {
+				if err := events.Send(event, AnalysisChunk{Analysis: content}); err != nil {
 					return fmt.Errorf("failed to send event: %w", err)
 				}
-				w.(http.Flusher).Flush()
 			}
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading stream: %w", err)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// Send close event after the stream ends
-	closeMessage := `event: Close
-data: Stream Ended
-
-`
-	_, err = w.Write([]byte(closeMessage))
-	if err != nil {
-		return fmt.Errorf("failed to send close event: %w", err)
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading stream: %w", err)
 	}
 
 	return nil
 }
 
-// limitTextToTokens trims the text to a maximum number of words
-func limitTextToTokens(text string, maxWords int) string {
-	words := strings.Fields(text)
-	if len(words) > maxWords {
-		return strings.Join(words[:maxWords], " ")
+// answerRecorder keeps a copy of the analysis chunks it forwards
+type answerRecorder struct {
+	EventSender
+	strings.Builder
+}
+
+func (r *answerRecorder) Send(event string, data interface{}) error {
+	if chunk, ok := data.(AnalysisChunk); ok {
+		r.WriteString(chunk.Analysis)
 	}
-	return text
+	return r.EventSender.Send(event, data)
 }
 
-func escapeJSONString(str string) string {
-	escaped := strings.ReplaceAll(str, `"`, `\"`)
-	escaped = strings.ReplaceAll(escaped, "\n", `\n`)
-	escaped = strings.ReplaceAll(escaped, "\r", `\r`)
-	escaped = strings.ReplaceAll(escaped, "\t", `\t`)
-	return escaped
+func streamedChunkError(kind, message string) *AnalysisError {
+	err := fmt.Errorf("analysis stream error (%s): %s", kind, message)
+	if isContextLengthMessage(message) {
+		return &AnalysisError{Code: ErrCodeContextLength, Message: "The text is too long for the analysis model.", Err: err}
+	}
+	return &AnalysisError{Code: ErrCodeUpstream, Message: "The analysis provider returned an error.", Retryable: true, Err: err}
 }
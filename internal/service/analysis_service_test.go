@@ -2,34 +2,59 @@ package service_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"net/http/httptest"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/yuriadams/lear/internal/domain"
 	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/service/engine"
 )
 
 type MockAiEngine struct {
 	mock.Mock
 }
 
-func (m *MockAiEngine) StreamChat(prompt string) (io.ReadCloser, error) {
+func (m *MockAiEngine) StreamChat(ctx context.Context, prompt string) (io.ReadCloser, error) {
 	args := m.Called(prompt)
 	resp, _ := args.Get(0).(io.ReadCloser)
 	return resp, args.Error(1)
 }
 
+func (m *MockAiEngine) StreamConversation(ctx context.Context, messages []engine.ChatMessage) (io.ReadCloser, error) {
+	args := m.Called(messages)
+	resp, _ := args.Get(0).(io.ReadCloser)
+	return resp, args.Error(1)
+}
+
+type sentEvent struct {
+	Name string
+	Data interface{}
+}
+
+type RecordingSender struct {
+	Events []sentEvent
+}
+
+func (s *RecordingSender) Send(event string, data interface{}) error {
+	s.Events = append(s.Events, sentEvent{Name: event, Data: data})
+	return nil
+}
+
 func TestStreamTextAnalysis_Success(t *testing.T) {
 	mockAiEngine := new(MockAiEngine)
 
 	mockResponse := `
 data: {"choices":[{"delta":{"content":"Character: John"}}]}
-data: {"choices":[{"delta":{"content":"Language: English"}}]}
+data: {"choices":[{"delta":{"content":"Path: C:\\books \"quoted\""}}]}
 data: [DONE]
 `
 	mockAiEngine.On("StreamChat", mock.Anything).Run(func(args mock.Arguments) {
@@ -37,28 +62,108 @@ data: [DONE]
 	}).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
 
 	service := &service.AnalysisService{AiEngine: mockAiEngine}
+	sender := &RecordingSender{}
 
-	req, err := http.NewRequest(http.MethodGet, "/analyze", nil)
+	completion, err := service.StreamTextAnalysis(context.Background(), sender, "This is a test text.", "overview", "")
 	assert.NoError(t, err)
+	assert.Equal(t, "overview", completion.PromptName)
+	assert.Equal(t, "v1", completion.PromptVersion)
+	assert.Equal(t, `Character: JohnPath: C:\books "quoted"`, completion.Content)
+
+	assert.Equal(t, []sentEvent{
+		{Name: "CustomEvent", Data: serviceChunk("Character: John")},
+		{Name: "CustomEvent", Data: serviceChunk(`Path: C:\books "quoted"`)},
+	}, sender.Events)
 
-	rr := httptest.NewRecorder()
+	mockAiEngine.AssertExpectations(t)
+}
+
+type usageLog []*domain.Usage
 
-	err = service.StreamTextAnalysis(rr, req, "This is a test text.")
+func (l *usageLog) RecordUsage(usage *domain.Usage) {
+	*l = append(*l, usage)
+}
+
+func TestStreamTextAnalysis_RecordsUsage(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+	mockResponse := `data: {"choices":[{"delta":{"content":"Goneril and Regan."}}]}
+data: [DONE]
+`
+	mockAiEngine.On("StreamChat", mock.Anything).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil).Once()
+	mockAiEngine.On("StreamChat", mock.Anything).Return(nil, errors.New("stream error")).Once()
+
+	usage := &usageLog{}
+	analysis := &service.AnalysisService{AiEngine: mockAiEngine, Usage: usage}
+	ctx := service.WithCaller(context.Background(), service.Caller{UserID: 42, IP: "192.0.2.1"})
+
+	completion, err := analysis.StreamTextAnalysis(ctx, &RecordingSender{}, "This is a test text.", "overview", "")
 	assert.NoError(t, err)
+	assert.Greater(t, completion.PromptTokens, engine.HeuristicTokenizer{}.Count("This is a test text."), "the prompt template counts too")
+	assert.Equal(t, 5, completion.CompletionTokens)
 
-	expectedResponse := `event: CustomEvent
-data: {"analysis": "Character: John"}
+	assert.True(t, completion.Estimated)
 
-event: CustomEvent
-data: {"analysis": "Language: English"}
+	_, err = analysis.StreamTextAnalysis(ctx, &RecordingSender{}, "This is a test text.", "overview", "")
+	assert.Error(t, err)
 
-event: Close
-data: Stream Ended
+	if assert.Len(t, *usage, 1, "a call that failed before answering is not recorded") {
+		recorded := (*usage)[0]
+		recorded.LatencyMs = 0
+		assert.Equal(t, &domain.Usage{
+			UserID:           42,
+			IP:               "192.0.2.1",
+			Prompt:           "overview",
+			PromptTokens:     completion.PromptTokens,
+			CompletionTokens: 5,
+			Estimated:        true,
+		}, recorded)
+	}
+}
 
+func TestStreamTextAnalysis_RecordsReportedUsageAndCost(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+	mockResponse := `data: {"model":"Meta-Llama-3.1-70B-Instruct","choices":[{"delta":{"content":"Goneril and Regan."}}]}
+data: {"model":"Meta-Llama-3.1-70B-Instruct","choices":[],"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}
+data: [DONE]
 `
-	assert.Equal(t, expectedResponse, rr.Body.String())
+	mockAiEngine.On("StreamChat", mock.Anything).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil).Once()
 
-	mockAiEngine.AssertExpectations(t)
+	usage := &usageLog{}
+	analysis := &service.AnalysisService{AiEngine: mockAiEngine, Usage: usage}
+	ctx := service.WithBook(service.WithCaller(context.Background(), service.Caller{UserID: 42}), 1128)
+
+	completion, err := analysis.StreamTextAnalysis(ctx, &RecordingSender{}, "This is a test text.", "overview", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Meta-Llama-3.1-70B-Instruct", completion.Model)
+	assert.Equal(t, 1000, completion.PromptTokens)
+	assert.Equal(t, 500, completion.CompletionTokens)
+	assert.False(t, completion.Estimated)
+
+	if assert.Len(t, *usage, 1) {
+		recorded := (*usage)[0]
+		assert.Equal(t, 1128, recorded.GutenbergID)
+		assert.Equal(t, "Meta-Llama-3.1-70B-Instruct", recorded.Model)
+		assert.False(t, recorded.Estimated)
+		assert.InDelta(t, 0.0012, recorded.Cost, 1e-9, "1000 prompt tokens at $0.60 and 500 completion tokens at $1.20 per million")
+	}
+}
+
+func TestStreamTextAnalysis_RecordsServingEngine(t *testing.T) {
+	primary := new(MockAiEngine)
+	primary.On("StreamChat", mock.Anything).Return(nil, &engine.APIError{StatusCode: 503})
+	backup := &modelEngine{model: engine.Model{Name: "backup-model", ContextWindow: 8192}}
+
+	analysis := &service.AnalysisService{AiEngine: engine.NewFallbackEngine(
+		engine.Member{Name: "sambanova", Engine: primary},
+		engine.Member{Name: "backup", Engine: backup},
+	)}
+
+	completion, err := analysis.StreamTextAnalysis(context.Background(), &RecordingSender{}, "This is a test text.", "overview", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup", completion.Engine)
+	assert.Equal(t, "backup-model", completion.Model)
+	assert.Equal(t, "Storm.", completion.Content)
+	assert.Len(t, backup.prompts, 1)
 }
 
 func TestStreamTextAnalysis_FailedStreamChat(t *testing.T) {
@@ -68,14 +173,386 @@ func TestStreamTextAnalysis_FailedStreamChat(t *testing.T) {
 
 	service := &service.AnalysisService{AiEngine: mockAiEngine}
 
-	req, err := http.NewRequest(http.MethodGet, "/analyze", nil)
-	assert.NoError(t, err)
+	_, err := service.StreamTextAnalysis(context.Background(), &RecordingSender{}, "This is a test text.", "overview", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to stream chat")
+
+	mockAiEngine.AssertExpectations(t)
+}
+
+func TestStreamTextAnalysis_Canceled(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	mockResponse := `data: {"choices":[{"delta":{"content":"Character: John"}}]}
+`
+	mockAiEngine.On("StreamChat", mock.Anything).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
 
-	rr := httptest.NewRecorder()
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+	sender := &RecordingSender{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := service.StreamTextAnalysis(ctx, sender, "This is a test text.", "overview", "")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, sender.Events)
+}
+
+func TestStreamTextAnalysis_MalformedChunk(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
 
-	err = service.StreamTextAnalysis(rr, req, "This is a test text.")
+	mockResponse := `data: {"choices":[{"delta":
+`
+	mockAiEngine.On("StreamChat", mock.Anything).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+
+	_, err := service.StreamTextAnalysis(context.Background(), &RecordingSender{}, "This is a test text.", "overview", "")
 	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "failed to stream chat")
+	assert.Equal(t, "malformed_chunk", serviceAnalysisError(err).Code)
+}
+
+func TestStreamTextAnalysis_ErrorChunk(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	mockResponse := `data: {"error":{"message":"Requested tokens exceed the maximum context length","type":"invalid_request_error"}}
+`
+	mockAiEngine.On("StreamChat", mock.Anything).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+
+	_, err := service.StreamTextAnalysis(context.Background(), &RecordingSender{}, "This is a test text.", "overview", "")
+	assert.Error(t, err)
+	assert.Equal(t, "context_length", serviceAnalysisError(err).Code)
+}
+
+func TestStreamTextAnalysis_UnknownKind(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+
+	_, err := service.StreamTextAnalysis(context.Background(), &RecordingSender{}, "This is a test text.", "horoscope", "")
+	assert.Error(t, err)
+	assert.Equal(t, "invalid_request", serviceAnalysisError(err).Code)
+	mockAiEngine.AssertNotCalled(t, "StreamChat", mock.Anything)
+}
+
+func TestStreamTextAnalysis_UnknownPromptVersion(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+
+	_, err := service.StreamTextAnalysis(context.Background(), &RecordingSender{}, "This is a test text.", "themes", "v99")
+	assert.Equal(t, "invalid_request", serviceAnalysisError(err).Code)
+	mockAiEngine.AssertNotCalled(t, "StreamChat", mock.Anything)
+}
+
+func TestStreamTextAnalysis_StructuredKind(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	mockResponse := `data: {"choices":[{"delta":{"content":"` + "```json\\n" + `{\"grade_level\": 9,"}}]}
+data: {"choices":[{"delta":{"content":" \"audience\": \"adults\"}\n` + "```" + `"}}]}
+data: [DONE]
+`
+	mockAiEngine.On("StreamChat", mock.MatchedBy(func(prompt string) bool {
+		return strings.Contains(prompt, `"grade_level"`)
+	})).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+	sender := &RecordingSender{}
+
+	completion, err := service.StreamTextAnalysis(context.Background(), sender, "This is a test text.", "reading_level", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "reading_level", completion.PromptName)
+
+	assert.Len(t, sender.Events, 3)
+	assert.Equal(t, "ReadingLevel", sender.Events[0].Name)
+	assert.Equal(t, "ReadingLevel", sender.Events[1].Name)
+	assert.Equal(t, "ReadingLevelResult", sender.Events[2].Name)
+	assert.JSONEq(t, `{"grade_level": 9, "audience": "adults"}`, string(sender.Events[2].Data.(json.RawMessage)))
 
 	mockAiEngine.AssertExpectations(t)
 }
+
+func TestStreamTextAnalysis_StructuredKindWithoutJSON(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	mockResponse := `data: {"choices":[{"delta":{"content":"Suitable for adults."}}]}
+`
+	mockAiEngine.On("StreamChat", mock.Anything).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+	sender := &RecordingSender{}
+
+	completion, err := service.StreamTextAnalysis(context.Background(), sender, "This is a test text.", "reading_level", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Suitable for adults.", completion.Content)
+	assert.Equal(t, []sentEvent{{Name: "ReadingLevel", Data: serviceChunk("Suitable for adults.")}}, sender.Events)
+}
+
+func TestAnalysisKind_ParseResult(t *testing.T) {
+	kind, ok := service.LookupAnalysisKind("entities")
+	assert.True(t, ok)
+
+	result, ok := kind.ParseResult(`Here you go: {"people": [{"name": "Lear"}], "places": []}`)
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"people": [{"name": "Lear"}], "places": []}`, string(result))
+
+	_, ok = kind.ParseResult(`{"people": []}`)
+	assert.False(t, ok, "missing required field")
+
+	_, ok = kind.ParseResult(`{"people": [`)
+	assert.False(t, ok, "truncated output")
+}
+
+func TestAnswerQuestion(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	mockResponse := `data: {"choices":[{"delta":{"content":"Because of pride."}}]}
+data: [DONE]
+`
+	mockAiEngine.On("StreamChat", mock.MatchedBy(func(prompt string) bool {
+		return strings.Contains(prompt, "Why does Lear divide his kingdom?")
+	})).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+	sender := &RecordingSender{}
+
+	_, err := service.AnswerQuestion(context.Background(), sender, "This is a test text.", "Why does Lear divide his kingdom?")
+	assert.NoError(t, err)
+	assert.Equal(t, []sentEvent{{Name: "CustomEvent", Data: serviceChunk("Because of pride.")}}, sender.Events)
+	mockAiEngine.AssertExpectations(t)
+}
+
+func TestConverse(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	mockResponse := `data: {"choices":[{"delta":{"content":"Because "}}]}
+data: {"choices":[{"delta":{"content":"of pride."}}]}
+data: [DONE]
+`
+	history := []engine.ChatMessage{
+		{Role: "user", Content: "Who is Lear?"},
+		{Role: "assistant", Content: "The king of Britain."},
+		{Role: "user", Content: "Why does he divide his kingdom?"},
+	}
+
+	mockAiEngine.On("StreamConversation", mock.MatchedBy(func(messages []engine.ChatMessage) bool {
+		return len(messages) == 4 &&
+			messages[0].Role == "system" && strings.Contains(messages[0].Content, "This is a test text.") &&
+			assert.ObjectsAreEqual(history, messages[1:])
+	})).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+	sender := &RecordingSender{}
+
+	completion, err := service.Converse(context.Background(), sender, "This is a test text.", history)
+	assert.NoError(t, err)
+	assert.Equal(t, "Because of pride.", completion.Content)
+	assert.Equal(t, "chat", completion.PromptName)
+	assert.Len(t, sender.Events, 2)
+	mockAiEngine.AssertExpectations(t)
+}
+
+func TestConverse_WithoutQuestion(t *testing.T) {
+	service := &service.AnalysisService{AiEngine: new(MockAiEngine)}
+
+	_, err := service.Converse(context.Background(), &RecordingSender{}, "This is a test text.", []engine.ChatMessage{
+		{Role: "assistant", Content: "Hello."},
+	})
+	assert.Equal(t, "invalid_request", serviceAnalysisError(err).Code)
+}
+
+func TestAsAnalysisError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		code      string
+		retryable bool
+	}{
+		{"unauthorized", &engine.APIError{StatusCode: 401, Body: "invalid token"}, "upstream_auth", false},
+		{"rate limited", &engine.APIError{StatusCode: 429, Body: "slow down"}, "rate_limited", true},
+		{"context length", &engine.APIError{StatusCode: 400, Body: "maximum context length is 8192 tokens"}, "context_length", false},
+		{"server error", &engine.APIError{StatusCode: 503, Body: "unavailable"}, "upstream_error", true},
+		{"timeout", fmt.Errorf("reading: %w", context.DeadlineExceeded), "timeout", true},
+		{"engine timeout", &engine.TimeoutError{Stage: engine.StageFirstToken, After: time.Minute}, "timeout", true},
+		{"circuit open", &engine.CircuitOpenError{Name: "sambanova", RetryIn: time.Second}, "upstream_unavailable", true},
+		{"network", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, "upstream_unavailable", true},
+		{"unknown", errors.New("boom"), "internal", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysisErr := service.AsAnalysisError(fmt.Errorf("failed to stream chat: %w", tt.err))
+			assert.Equal(t, tt.code, analysisErr.Code)
+			assert.Equal(t, tt.retryable, analysisErr.Retryable)
+			assert.NotEmpty(t, analysisErr.Message)
+		})
+	}
+}
+
+func serviceAnalysisError(err error) *service.AnalysisError {
+	var analysisErr *service.AnalysisError
+	if errors.As(err, &analysisErr) {
+		return analysisErr
+	}
+	return &service.AnalysisError{}
+}
+
+func serviceChunk(content string) service.AnalysisChunk {
+	return service.AnalysisChunk{Analysis: content}
+}
+
+func TestStreamComparison(t *testing.T) {
+	mockAiEngine := new(MockAiEngine)
+
+	mockResponse := `data: {"choices":[{"delta":{"content":"The quarto is longer."}}]}
+`
+	mockAiEngine.On("StreamChat", mock.MatchedBy(func(prompt string) bool {
+		return strings.Contains(prompt, `Text "King Lear" by William Shakespeare`) &&
+			strings.Contains(prompt, `Text "The Tragedy of King Lear" by William Shakespeare`)
+	})).Return(io.NopCloser(bytes.NewBufferString(mockResponse)), nil)
+
+	service := &service.AnalysisService{AiEngine: mockAiEngine}
+	sender := &RecordingSender{}
+
+	books := []*domain.Book{
+		{Content: "Nothing will come of nothing.", Metadata: domain.Metadata{Title: "King Lear", Author: "William Shakespeare"}},
+		{Content: "Nothing can come of nothing.", Metadata: domain.Metadata{Title: "The Tragedy of King Lear", Author: "William Shakespeare"}},
+	}
+	completion, err := service.StreamComparison(context.Background(), sender, books)
+	assert.NoError(t, err)
+	assert.Equal(t, "comparison", completion.PromptName)
+	assert.Equal(t, []sentEvent{{Name: "Comparison", Data: serviceChunk("The quarto is longer.")}}, sender.Events)
+
+	_, err = service.StreamComparison(context.Background(), sender, books[:1])
+	assert.Equal(t, "invalid_request", serviceAnalysisError(err).Code)
+}
+
+// modelEngine answers every prompt with the same chunk as the given model, keeping the prompts and
+// conversations
+type modelEngine struct {
+	model         engine.Model
+	prompts       []string
+	conversations [][]engine.ChatMessage
+}
+
+func (e *modelEngine) Model() engine.Model {
+	return e.model
+}
+
+func (e *modelEngine) StreamChat(ctx context.Context, prompt string) (io.ReadCloser, error) {
+	e.prompts = append(e.prompts, prompt)
+	return io.NopCloser(strings.NewReader(`data: {"choices":[{"delta":{"content":"Storm."}}]}` + "\n")), nil
+}
+
+func (e *modelEngine) StreamConversation(ctx context.Context, messages []engine.ChatMessage) (io.ReadCloser, error) {
+	e.conversations = append(e.conversations, messages)
+	return e.StreamChat(ctx, messages[len(messages)-1].Content)
+}
+
+func TestPromptBudget(t *testing.T) {
+	model := engine.Model{Name: "small", ContextWindow: 4096 + 2000, Encoding: engine.EncodingCL100K}
+	tokenizer := engine.TokenizerFor(model)
+	book := strings.Repeat("Blow, winds, and crack your cheeks! Rage, blow!\n", 2000)
+
+	aiEngine := &modelEngine{model: model}
+	analysis := &service.AnalysisService{AiEngine: aiEngine}
+
+	t.Run("Context window", func(t *testing.T) {
+		_, err := analysis.StreamTextAnalysis(context.Background(), &RecordingSender{}, book, "overview", "")
+		assert.NoError(t, err)
+
+		prompt := aiEngine.prompts[len(aiEngine.prompts)-1]
+		assert.LessOrEqual(t, tokenizer.Count(prompt), 2000, "the answer keeps its room")
+		assert.Greater(t, tokenizer.Count(prompt), 1980)
+		assert.Contains(t, prompt, "Blow, winds, and crack your cheeks! Rage, blow!\nBlow", "line breaks are kept")
+	})
+
+	t.Run("Max prompt tokens", func(t *testing.T) {
+		capped := &service.AnalysisService{AiEngine: aiEngine, MaxPromptTokens: 500}
+		_, err := capped.StreamTextAnalysis(context.Background(), &RecordingSender{}, book, "overview", "")
+		assert.NoError(t, err)
+
+		prompt := aiEngine.prompts[len(aiEngine.prompts)-1]
+		assert.LessOrEqual(t, tokenizer.Count(prompt), 500)
+		assert.Greater(t, tokenizer.Count(prompt), 480)
+	})
+
+	t.Run("Any prompt", func(t *testing.T) {
+		capped := &service.AnalysisService{AiEngine: aiEngine, MaxPromptTokens: 500}
+		_, err := capped.StreamPrompt(context.Background(), &RecordingSender{}, "segment_sentiment", service.PromptData{Text: book})
+		assert.NoError(t, err)
+
+		prompt := aiEngine.prompts[len(aiEngine.prompts)-1]
+		assert.LessOrEqual(t, tokenizer.Count(prompt), 500)
+		assert.Contains(t, prompt, "Blow, winds")
+	})
+
+	t.Run("Comparison shares", func(t *testing.T) {
+		books := []*domain.Book{
+			{Content: book, Metadata: domain.Metadata{Title: "King Lear"}},
+			{Content: strings.ToUpper(book), Metadata: domain.Metadata{Title: "The Tragedy of King Lear"}},
+		}
+		_, err := analysis.StreamComparison(context.Background(), &RecordingSender{}, books)
+		assert.NoError(t, err)
+
+		prompt := aiEngine.prompts[len(aiEngine.prompts)-1]
+		assert.LessOrEqual(t, tokenizer.Count(prompt), 2000)
+		assert.Greater(t, tokenizer.Count(prompt), 1980)
+		assert.Greater(t, strings.Count(prompt, "Blow, winds"), strings.Count(prompt, "BLOW, WINDS"), "the shares are equal in tokens, not in text")
+		assert.Greater(t, strings.Count(prompt, "BLOW, WINDS"), 0)
+		assert.Equal(t, book, books[0].Content, "the books are left alone")
+	})
+}
+
+func TestConverse_FitsHistory(t *testing.T) {
+	model := engine.Model{Name: "small", ContextWindow: 4096 + 2000, Encoding: engine.EncodingCL100K}
+	tokenizer := engine.TokenizerFor(model)
+	aiEngine := &modelEngine{model: model}
+	analysis := &service.AnalysisService{AiEngine: aiEngine}
+
+	// Every turn is about 300 tokens, so ten of them are more than the 2000 tokens of the prompt
+	turn := strings.Repeat("Blow, winds, and crack your cheeks! Rage, blow! ", 20)
+	var history []engine.ChatMessage
+	for i := 0; i < 5; i++ {
+		history = append(history,
+			engine.ChatMessage{Role: engine.RoleUser, Content: fmt.Sprintf("Question %d: %s", i, turn)},
+			engine.ChatMessage{Role: engine.RoleAssistant, Content: fmt.Sprintf("Answer %d: %s", i, turn)})
+	}
+	history = append(history, engine.ChatMessage{Role: engine.RoleUser, Content: "Why does Lear divide his kingdom?"})
+
+	_, err := analysis.Converse(context.Background(), &RecordingSender{}, "The text of the play.", history)
+	assert.NoError(t, err)
+
+	messages := aiEngine.conversations[len(aiEngine.conversations)-1]
+	tokens := 0
+	for _, message := range messages {
+		tokens += tokenizer.Count(message.Content)
+	}
+	assert.LessOrEqual(t, tokens, 2000, "the history is cut to the prompt budget")
+	assert.Less(t, len(messages), len(history)+1, "the oldest turns are left out")
+	assert.Equal(t, engine.RoleUser, messages[1].Role, "the history starts with a question")
+	assert.Equal(t, history[len(history)-1], messages[len(messages)-1], "the question is kept")
+
+	t.Run("Question too long", func(t *testing.T) {
+		question := []engine.ChatMessage{{Role: engine.RoleUser, Content: strings.Repeat(turn, 10)}}
+		_, err := analysis.Converse(context.Background(), &RecordingSender{}, "The text of the play.", question)
+		assert.Equal(t, "invalid_request", serviceAnalysisError(err).Code)
+	})
+}
+
+func TestPromptBudget_CountMargin(t *testing.T) {
+	model := engine.Model{Name: "approximate", ContextWindow: 10000, Encoding: engine.EncodingCL100K, CountMargin: 10}
+	tokenizer := engine.TokenizerFor(model)
+	aiEngine := &modelEngine{model: model}
+	analysis := &service.AnalysisService{AiEngine: aiEngine}
+
+	book := strings.Repeat("Blow, winds, and crack your cheeks! Rage, blow!\n", 2000)
+	_, err := analysis.StreamTextAnalysis(context.Background(), &RecordingSender{}, book, "overview", "")
+	assert.NoError(t, err)
+
+	prompt := aiEngine.prompts[len(aiEngine.prompts)-1]
+	assert.LessOrEqual(t, tokenizer.Count(prompt), 10000-1000-4096, "a tenth of the window is kept spare")
+	assert.Greater(t, tokenizer.Count(prompt), 10000-1000-4096-20)
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+const (
+	// MaxGraphCharacters keeps the graph readable, the least present characters are dropped
+	MaxGraphCharacters = 50
+
+	minDramaSpeakers = 3
+	minDramaSpeeches = 20
+)
+
+var (
+	// Speaker tags open a line: "LEAR. Meantime we shall..." or, in older editions, "  Lear. Meantime..."
+	upperSpeakerTag = regexp.MustCompile(`^\s*([A-Z][A-Z'\-]*(?: [A-Z][A-Z'\-]*){0,2})\.(?:\s|$)`)
+	titleSpeakerTag = regexp.MustCompile(`^ {2,}([A-Z][a-z'\-]+(?: [A-Z][a-z'\-]+)?)\.\s`)
+	sceneHeading    = regexp.MustCompile(`^\s*(?i:act|scene)\b`)
+	paragraphBreak  = regexp.MustCompile(`\n\s*\n`)
+)
+
+// notSpeakers look like speaker tags but are stage directions or headings
+var notSpeakers = map[string]bool{
+	"ACT": true, "SCENE": true, "ENTER": true, "EXIT": true, "EXEUNT": true, "MANET": true,
+	"FINIS": true, "THE END": true, "ALL": true, "BOTH": true, "PROLOGUE": true, "EPILOGUE": true,
+	"DRAMATIS PERSONAE": true,
+}
+
+type ICharacterGraphService interface {
+	FromSpeakers(gutenbergID int, text string) (*domain.CharacterGraph, bool)
+	FromMentions(gutenbergID int, text string, names []string) *domain.CharacterGraph
+}
+
+// CharacterGraphService builds character networks from the text with rules only, the names of prose
+// characters come from the caller
+type CharacterGraphService struct{}
+
+func NewCharacterGraphService() *CharacterGraphService {
+	return &CharacterGraphService{}
+}
+
+// FromSpeakers builds the graph of a play from its speaker tags: each speech is taken as addressed to the
+// next speaker of the scene. It reports false when the text does not read as drama.
+func (s *CharacterGraphService) FromSpeakers(gutenbergID int, text string) (*domain.CharacterGraph, bool) {
+	nodes := make(map[string]int)
+	edges := make(map[[2]string]int)
+	speeches := 0
+
+	previous := ""
+	for _, line := range strings.Split(text, "\n") {
+		if sceneHeading.MatchString(line) {
+			previous = ""
+			continue
+		}
+
+		speaker := speakerTag(line)
+		if speaker == "" {
+			continue
+		}
+
+		speeches++
+		nodes[speaker]++
+		if previous != "" && previous != speaker {
+			edges[[2]string{previous, speaker}]++
+		}
+		previous = speaker
+	}
+
+	if len(nodes) < minDramaSpeakers || speeches < minDramaSpeeches {
+		return nil, false
+	}
+
+	return buildGraph(gutenbergID, domain.GraphSpeakers, true, nodes, edges), true
+}
+
+// FromMentions links the named characters mentioned in the same paragraph
+func (s *CharacterGraphService) FromMentions(gutenbergID int, text string, names []string) *domain.CharacterGraph {
+	patterns := make(map[string]*regexp.Regexp)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			patterns[name] = regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b`)
+		}
+	}
+
+	nodes := make(map[string]int)
+	edges := make(map[[2]string]int)
+	for _, paragraph := range paragraphBreak.Split(text, -1) {
+		var present []string
+		for name, pattern := range patterns {
+			if mentions := len(pattern.FindAllStringIndex(paragraph, -1)); mentions > 0 {
+				nodes[name] += mentions
+				present = append(present, name)
+			}
+		}
+
+		sort.Strings(present)
+		for i := range present {
+			for j := i + 1; j < len(present); j++ {
+				edges[[2]string{present[i], present[j]}]++
+			}
+		}
+	}
+
+	return buildGraph(gutenbergID, domain.GraphMentions, false, nodes, edges)
+}
+
+// EntityNames reads the people of an entities analysis result
+func EntityNames(result json.RawMessage) ([]string, error) {
+	var entities struct {
+		People []struct {
+			Name string `json:"name"`
+		} `json:"people"`
+	}
+	if err := json.Unmarshal(result, &entities); err != nil {
+		return nil, fmt.Errorf("failed to decode entities: %w", err)
+	}
+
+	names := make([]string, 0, len(entities.People))
+	for _, person := range entities.People {
+		names = append(names, person.Name)
+	}
+	return names, nil
+}
+
+func speakerTag(line string) string {
+	if match := upperSpeakerTag.FindStringSubmatch(line); match != nil {
+		if notSpeakers[match[1]] {
+			return ""
+		}
+		return match[1]
+	}
+	if match := titleSpeakerTag.FindStringSubmatch(line); match != nil {
+		if notSpeakers[strings.ToUpper(match[1])] {
+			return ""
+		}
+		return strings.ToUpper(match[1])
+	}
+	return ""
+}
+
+// buildGraph keeps the MaxGraphCharacters heaviest nodes and the edges between them, both sorted for stable output
+func buildGraph(gutenbergID int, method string, directed bool, weights map[string]int, links map[[2]string]int) *domain.CharacterGraph {
+	nodes := make(domain.CharacterNodes, 0, len(weights))
+	for name, weight := range weights {
+		nodes = append(nodes, domain.CharacterNode{Name: name, Weight: weight})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Weight != nodes[j].Weight {
+			return nodes[i].Weight > nodes[j].Weight
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	if len(nodes) > MaxGraphCharacters {
+		nodes = nodes[:MaxGraphCharacters]
+	}
+
+	kept := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		kept[node.Name] = true
+	}
+
+	edges := make(domain.CharacterEdges, 0, len(links))
+	for pair, weight := range links {
+		if kept[pair[0]] && kept[pair[1]] {
+			edges = append(edges, domain.CharacterEdge{Source: pair[0], Target: pair[1], Weight: weight})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Weight != edges[j].Weight {
+			return edges[i].Weight > edges[j].Weight
+		}
+		if edges[i].Source != edges[j].Source {
+			return edges[i].Source < edges[j].Source
+		}
+		return edges[i].Target < edges[j].Target
+	})
+
+	return &domain.CharacterGraph{GutenbergID: gutenbergID, Method: method, Directed: directed, Nodes: nodes, Edges: edges}
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// WriteGraphML writes the graph in the GraphML format read by Gephi, yEd or networkx
+func WriteGraphML(w io.Writer, graph *domain.CharacterGraph) error {
+	edgeDefault := "undirected"
+	if graph.Directed {
+		edgeDefault = "directed"
+	}
+
+	doc := graphML{
+		Xmlns: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "name", For: "node", AttrName: "name", AttrType: "string"},
+			{ID: "node_weight", For: "node", AttrName: "weight", AttrType: "int"},
+			{ID: "edge_weight", For: "edge", AttrName: "weight", AttrType: "int"},
+		},
+		Graph: graphMLGraph{ID: fmt.Sprintf("book-%d", graph.GutenbergID), EdgeDefault: edgeDefault},
+	}
+
+	for _, node := range graph.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			ID: node.Name,
+			Data: []graphMLData{
+				{Key: "name", Value: node.Name},
+				{Key: "node_weight", Value: fmt.Sprint(node.Weight)},
+			},
+		})
+	}
+	for _, edge := range graph.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Source: edge.Source,
+			Target: edge.Target,
+			Data:   []graphMLData{{Key: "edge_weight", Value: fmt.Sprint(edge.Weight)}},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(doc)
+}
@@ -0,0 +1,103 @@
+package service_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+// miniPlay repeats a short exchange so it has enough speeches to read as drama
+func miniPlay() string {
+	var play strings.Builder
+	play.WriteString("ACT I. SCENE I. King Lear's palace.\n\n")
+	for i := 0; i < 5; i++ {
+		play.WriteString("LEAR. What can you say to draw a third more opulent than your sisters?\n")
+		play.WriteString("CORDELIA. Nothing, my lord.\n")
+		play.WriteString("LEAR. Nothing!\n")
+		play.WriteString("  Kent. Good my liege,--\n")
+		play.WriteString("[Exeunt.]\n")
+	}
+	play.WriteString("\nSCENE II. The Earl of Gloucester's castle.\n\n")
+	play.WriteString("EDMUND. Thou, nature, art my goddess.\n")
+	play.WriteString("EXEUNT.\n")
+	return play.String()
+}
+
+func TestCharacterGraph_FromSpeakers(t *testing.T) {
+	graphs := service.NewCharacterGraphService()
+
+	graph, ok := graphs.FromSpeakers(1128, miniPlay())
+	assert.True(t, ok)
+	assert.Equal(t, domain.GraphSpeakers, graph.Method)
+	assert.True(t, graph.Directed)
+
+	assert.Equal(t, domain.CharacterNodes{
+		{Name: "LEAR", Weight: 10},
+		{Name: "CORDELIA", Weight: 5},
+		{Name: "KENT", Weight: 5},
+		{Name: "EDMUND", Weight: 1},
+	}, graph.Nodes)
+
+	// Edmund opens a new scene, so nobody speaks to him
+	assert.Equal(t, domain.CharacterEdges{
+		{Source: "CORDELIA", Target: "LEAR", Weight: 5},
+		{Source: "LEAR", Target: "CORDELIA", Weight: 5},
+		{Source: "LEAR", Target: "KENT", Weight: 5},
+		{Source: "KENT", Target: "LEAR", Weight: 4},
+	}, graph.Edges)
+}
+
+func TestCharacterGraph_FromSpeakersProse(t *testing.T) {
+	graphs := service.NewCharacterGraphService()
+
+	_, ok := graphs.FromSpeakers(1342, "It is a truth universally acknowledged, that a single man in possession of a good fortune, must be in want of a wife.")
+	assert.False(t, ok)
+}
+
+func TestCharacterGraph_FromMentions(t *testing.T) {
+	graphs := service.NewCharacterGraphService()
+
+	text := "Elizabeth laughed at Darcy.\n\nJane wrote to Elizabeth.\n\nDarcy and Elizabeth walked. Elizabeth smiled."
+	graph := graphs.FromMentions(1342, text, []string{"Elizabeth", "Darcy", "Jane", "Wickham", " "})
+
+	assert.Equal(t, domain.GraphMentions, graph.Method)
+	assert.False(t, graph.Directed)
+	assert.Equal(t, domain.CharacterNodes{
+		{Name: "Elizabeth", Weight: 4},
+		{Name: "Darcy", Weight: 2},
+		{Name: "Jane", Weight: 1},
+	}, graph.Nodes)
+	assert.Equal(t, domain.CharacterEdges{
+		{Source: "Darcy", Target: "Elizabeth", Weight: 2},
+		{Source: "Elizabeth", Target: "Jane", Weight: 1},
+	}, graph.Edges)
+}
+
+func TestEntityNames(t *testing.T) {
+	names, err := service.EntityNames(json.RawMessage(`{"people": [{"name": "Lear"}, {"name": "Goneril"}], "places": []}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Lear", "Goneril"}, names)
+}
+
+func TestWriteGraphML(t *testing.T) {
+	graph := &domain.CharacterGraph{
+		GutenbergID: 1128,
+		Directed:    true,
+		Nodes:       domain.CharacterNodes{{Name: "LEAR", Weight: 2}, {Name: "FOOL", Weight: 1}},
+		Edges:       domain.CharacterEdges{{Source: "FOOL", Target: "LEAR", Weight: 1}},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, service.WriteGraphML(&out, graph))
+
+	xml := out.String()
+	assert.Contains(t, xml, `<graph id="book-1128" edgedefault="directed">`)
+	assert.Contains(t, xml, `<node id="LEAR">`)
+	assert.Contains(t, xml, `<data key="node_weight">2</data>`)
+	assert.Contains(t, xml, `<edge source="FOOL" target="LEAR">`)
+}
@@ -0,0 +1,402 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	DiffEqual  = "equal"
+	DiffDelete = "delete"
+	DiffInsert = "insert"
+
+	DefaultDiffContext = 3
+)
+
+// diffToken splits a line into words and the whitespace between them, so joining the tokens gives the line back
+var diffToken = regexp.MustCompile(`\S+|\s+`)
+
+// TextDiff is the difference between two texts, grouped in hunks of changes with their surrounding context
+type TextDiff struct {
+	Added   int        `json:"added"`
+	Removed int        `json:"removed"`
+	Hunks   []DiffHunk `json:"hunks"`
+}
+
+// DiffHunk is a run of changed lines with context lines around them, numbered from 1 as in unified diffs
+type DiffHunk struct {
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// DiffLine is a line of either text, with the words that changed when it was paired with a line of the other text
+type DiffLine struct {
+	Kind    string        `json:"kind"`
+	OldLine int           `json:"old_line,omitempty"`
+	NewLine int           `json:"new_line,omitempty"`
+	Text    string        `json:"text"`
+	Words   []DiffSegment `json:"words,omitempty"`
+}
+
+// DiffSegment is a piece of a changed line that is either kept or changed
+type DiffSegment struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+}
+
+type IDiffService interface {
+	Diff(oldText, newText string, context int) *TextDiff
+}
+
+// DiffService aligns texts line by line with Myers' algorithm, then word by word inside changed lines
+type DiffService struct{}
+
+func NewDiffService() *DiffService {
+	return &DiffService{}
+}
+
+// Diff compares the texts ignoring trailing whitespace and keeps context unchanged lines around each change
+func (s *DiffService) Diff(oldText, newText string, context int) *TextDiff {
+	oldLines := splitLines(oldText)
+	newLines := splitLines(newText)
+
+	ids := make(map[string]int)
+	oldIDs := lineIDs(oldLines, ids)
+	newIDs := lineIDs(newLines, ids)
+
+	oldChanged, newChanged := diffSequences(oldIDs, newIDs)
+
+	var lines []DiffLine
+	diff := &TextDiff{}
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		if i < len(oldLines) && j < len(newLines) && !oldChanged[i] && !newChanged[j] {
+			lines = append(lines, DiffLine{Kind: DiffEqual, OldLine: i + 1, NewLine: j + 1, Text: oldLines[i]})
+			i++
+			j++
+			continue
+		}
+
+		// A change is the deleted lines followed by the inserted lines that replace them
+		var deleted, inserted []DiffLine
+		for ; i < len(oldLines) && oldChanged[i]; i++ {
+			deleted = append(deleted, DiffLine{Kind: DiffDelete, OldLine: i + 1, Text: oldLines[i]})
+		}
+		for ; j < len(newLines) && newChanged[j]; j++ {
+			inserted = append(inserted, DiffLine{Kind: DiffInsert, NewLine: j + 1, Text: newLines[j]})
+		}
+		pairWords(deleted, inserted)
+
+		diff.Removed += len(deleted)
+		diff.Added += len(inserted)
+		lines = append(lines, deleted...)
+		lines = append(lines, inserted...)
+	}
+
+	diff.Hunks = groupHunks(lines, context)
+	return diff
+}
+
+// WriteUnified writes the diff in the unified format read by patch and git apply
+func WriteUnified(w io.Writer, diff *TextDiff, oldName, newName string) error {
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName); err != nil {
+		return err
+	}
+
+	for _, hunk := range diff.Hunks {
+		header := fmt.Sprintf("@@ -%s +%s @@\n", unifiedRange(hunk.OldStart, hunk.OldLines), unifiedRange(hunk.NewStart, hunk.NewLines))
+		if _, err := io.WriteString(w, header); err != nil {
+			return err
+		}
+
+		for _, line := range hunk.Lines {
+			prefix := " "
+			switch line.Kind {
+			case DiffDelete:
+				prefix = "-"
+			case DiffInsert:
+				prefix = "+"
+			}
+			if _, err := io.WriteString(w, prefix+line.Text+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unifiedRange formats a hunk range, an empty range starts at the line before it
+func unifiedRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprint(start)
+	default:
+		return fmt.Sprintf("%d,%d", start, count)
+	}
+}
+
+func splitLines(text string) []string {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+func lineIDs(lines []string, ids map[string]int) []int {
+	sequence := make([]int, len(lines))
+	for i, line := range lines {
+		key := strings.TrimRight(line, " \t")
+		id, ok := ids[key]
+		if !ok {
+			id = len(ids)
+			ids[key] = id
+		}
+		sequence[i] = id
+	}
+	return sequence
+}
+
+// pairWords diffs the words of the i-th deleted line against the i-th inserted line
+func pairWords(deleted, inserted []DiffLine) {
+	for k := 0; k < len(deleted) && k < len(inserted); k++ {
+		oldWords := diffToken.FindAllString(deleted[k].Text, -1)
+		newWords := diffToken.FindAllString(inserted[k].Text, -1)
+
+		ids := make(map[string]int)
+		oldChanged, newChanged := diffSequences(lineIDs(oldWords, ids), lineIDs(newWords, ids))
+
+		deleted[k].Words = wordSegments(oldWords, oldChanged, DiffDelete)
+		inserted[k].Words = wordSegments(newWords, newChanged, DiffInsert)
+	}
+}
+
+// wordSegments merges consecutive words of the same kind
+func wordSegments(words []string, changed []bool, kind string) []DiffSegment {
+	var segments []DiffSegment
+	for i, word := range words {
+		segmentKind := DiffEqual
+		if changed[i] {
+			segmentKind = kind
+		}
+
+		if last := len(segments) - 1; last >= 0 && segments[last].Kind == segmentKind {
+			segments[last].Text += word
+			continue
+		}
+		segments = append(segments, DiffSegment{Kind: segmentKind, Text: word})
+	}
+	return segments
+}
+
+// groupHunks keeps the changed lines with up to context equal lines on each side, merging hunks that touch
+func groupHunks(lines []DiffLine, context int) []DiffHunk {
+	if context < 0 {
+		context = 0
+	}
+
+	var hunks []DiffHunk
+	start, end := -1, -1
+	for i, line := range lines {
+		if line.Kind == DiffEqual {
+			continue
+		}
+
+		from, to := i-context, i+context+1
+		if from < 0 {
+			from = 0
+		}
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		if start >= 0 && from <= end {
+			end = to
+			continue
+		}
+		if start >= 0 {
+			hunks = append(hunks, newHunk(lines, start, end))
+		}
+		start, end = from, to
+	}
+	if start >= 0 {
+		hunks = append(hunks, newHunk(lines, start, end))
+	}
+	return hunks
+}
+
+// newHunk builds the hunk of lines[start:end], looking before start for where a one-sided hunk begins
+func newHunk(lines []DiffLine, start, end int) DiffHunk {
+	hunk := DiffHunk{Lines: lines[start:end]}
+	for _, line := range hunk.Lines {
+		if line.Kind != DiffInsert {
+			if hunk.OldStart == 0 {
+				hunk.OldStart = line.OldLine
+			}
+			hunk.OldLines++
+		}
+		if line.Kind != DiffDelete {
+			if hunk.NewStart == 0 {
+				hunk.NewStart = line.NewLine
+			}
+			hunk.NewLines++
+		}
+	}
+
+	// A hunk without lines on one side starts after the last line it follows
+	if hunk.OldStart == 0 {
+		hunk.OldStart = precedingLine(lines[:start], func(l DiffLine) int { return l.OldLine }) + 1
+	}
+	if hunk.NewStart == 0 {
+		hunk.NewStart = precedingLine(lines[:start], func(l DiffLine) int { return l.NewLine }) + 1
+	}
+	return hunk
+}
+
+func precedingLine(lines []DiffLine, number func(DiffLine) int) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if n := number(lines[i]); n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// diffSequences marks the elements of a and b that are not part of a longest common subsequence
+func diffSequences(a, b []int) ([]bool, []bool) {
+	d := &differ{a: a, b: b, aChanged: make([]bool, len(a)), bChanged: make([]bool, len(b))}
+	d.compare(0, len(a), 0, len(b))
+	return d.aChanged, d.bChanged
+}
+
+type differ struct {
+	a, b               []int
+	aChanged, bChanged []bool
+}
+
+// compare is Myers' linear space refinement: split at the middle snake of an optimal path and recurse on both sides
+func (d *differ) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	switch {
+	case aLo == aHi:
+		for j := bLo; j < bHi; j++ {
+			d.bChanged[j] = true
+		}
+	case bLo == bHi:
+		for i := aLo; i < aHi; i++ {
+			d.aChanged[i] = true
+		}
+	default:
+		xStart, yStart, xEnd, yEnd := d.middleSnake(aLo, aHi, bLo, bHi)
+		d.compare(aLo, xStart, bLo, yStart)
+		d.compare(xEnd, aHi, yEnd, bHi)
+	}
+}
+
+// middleSnake searches forward from the start and backward from the end until the paths overlap, and returns
+// the snake where they meet in absolute coordinates
+func (d *differ) middleSnake(aLo, aHi, bLo, bHi int) (int, int, int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	offset := n + m + 1
+
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	for D := 0; D <= (n+m+1)/2; D++ {
+		for k := -D; k <= D; k += 2 {
+			x := forward[offset+k-1] + 1
+			if k == -D || (k != D && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			}
+			y := x - k
+			xStart, yStart := x, y
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+
+			if kr := delta - k; odd && kr >= -(D-1) && kr <= D-1 && x+backward[offset+kr] >= n {
+				return aLo + xStart, bLo + yStart, aLo + x, bLo + y
+			}
+		}
+
+		for kr := -D; kr <= D; kr += 2 {
+			x := backward[offset+kr-1] + 1
+			if kr == -D || (kr != D && backward[offset+kr-1] < backward[offset+kr+1]) {
+				x = backward[offset+kr+1]
+			}
+			y := x - kr
+			xStart, yStart := x, y
+			for x < n && y < m && d.a[aHi-1-x] == d.b[bHi-1-y] {
+				x++
+				y++
+			}
+			backward[offset+kr] = x
+
+			if k := delta - kr; !odd && k >= -D && k <= D && x+forward[offset+k] >= n {
+				return aHi - x, bHi - y, aHi - xStart, bHi - yStart
+			}
+		}
+	}
+
+	// Unreachable: the searches always meet by the time D reaches half the edit distance
+	return aLo, bLo, aHi, bHi
+}
+
+// DiffRow is a row of a side-by-side view, a side is nil where the other text has lines with nothing against them
+type DiffRow struct {
+	Old *DiffLine
+	New *DiffLine
+}
+
+// SideBySide lays a hunk out in rows, each deleted line next to the inserted line that replaces it
+func SideBySide(hunk DiffHunk) []DiffRow {
+	var rows []DiffRow
+	lines := hunk.Lines
+	for i := 0; i < len(lines); {
+		if lines[i].Kind == DiffEqual {
+			rows = append(rows, DiffRow{Old: &lines[i], New: &lines[i]})
+			i++
+			continue
+		}
+
+		var deleted, inserted []*DiffLine
+		for ; i < len(lines) && lines[i].Kind == DiffDelete; i++ {
+			deleted = append(deleted, &lines[i])
+		}
+		for ; i < len(lines) && lines[i].Kind == DiffInsert; i++ {
+			inserted = append(inserted, &lines[i])
+		}
+		for k := 0; k < len(deleted) || k < len(inserted); k++ {
+			var row DiffRow
+			if k < len(deleted) {
+				row.Old = deleted[k]
+			}
+			if k < len(inserted) {
+				row.New = inserted[k]
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
@@ -0,0 +1,150 @@
+package service_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+func TestDiff_Lines(t *testing.T) {
+	diffs := service.NewDiffService()
+
+	oldText := "ACT I.\nLEAR. Nothing will come of nothing: speak again.\nCORDELIA. Unhappy that I am.\nKENT. Good my liege.\n"
+	newText := "ACT I.\nLEAR. Nothing can come of nothing: speak again.\nCORDELIA. Unhappy that I am.\nKENT. Good my liege.\nEXEUNT.\n"
+	diff := diffs.Diff(oldText, newText, 0)
+
+	assert.Equal(t, 2, diff.Added)
+	assert.Equal(t, 1, diff.Removed)
+	assert.Len(t, diff.Hunks, 2)
+	assert.Len(t, diffs.Diff(oldText, newText, 1).Hunks, 1, "hunks whose context touches are merged")
+
+	hunk := diff.Hunks[0]
+	assert.Equal(t, 2, hunk.OldStart)
+	assert.Equal(t, 1, hunk.OldLines)
+	assert.Equal(t, []service.DiffSegment{
+		{Kind: service.DiffEqual, Text: "LEAR. Nothing "},
+		{Kind: service.DiffDelete, Text: "will"},
+		{Kind: service.DiffEqual, Text: " come of nothing: speak again."},
+	}, hunk.Lines[0].Words)
+	assert.Equal(t, []service.DiffSegment{
+		{Kind: service.DiffEqual, Text: "LEAR. Nothing "},
+		{Kind: service.DiffInsert, Text: "can"},
+		{Kind: service.DiffEqual, Text: " come of nothing: speak again."},
+	}, hunk.Lines[1].Words)
+}
+
+func TestDiff_Unified(t *testing.T) {
+	diffs := service.NewDiffService()
+
+	diff := diffs.Diff("a\nb\nc\nd\ne\nf\ng\n", "a\nB\nc\nd\ne\nf\ng\nh\n", 1)
+
+	var out bytes.Buffer
+	assert.NoError(t, service.WriteUnified(&out, diff, "a/1532", "b/2264"))
+	assert.Equal(t, "--- a/1532\n+++ b/2264\n"+
+		"@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"+
+		"@@ -7 +7,2 @@\n g\n+h\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, service.WriteUnified(&out, diffs.Diff("a\n", "a\nb\n", 0), "a/1", "b/2"))
+	assert.Equal(t, "--- a/1\n+++ b/2\n@@ -1,0 +2 @@\n+b\n", out.String(), "an empty range names the line before it")
+}
+
+func TestDiff_IdenticalAndEmpty(t *testing.T) {
+	diffs := service.NewDiffService()
+
+	assert.Empty(t, diffs.Diff("same\ntext", "same\ntext  ", 3).Hunks, "trailing whitespace is ignored")
+
+	diff := diffs.Diff("", "new\nlines", 3)
+	assert.Equal(t, 2, diff.Added)
+	assert.Equal(t, 1, diff.Hunks[0].OldStart)
+	assert.Equal(t, 0, diff.Hunks[0].OldLines)
+	assert.Equal(t, 1, diff.Hunks[0].NewStart)
+}
+
+// TestDiff_Minimal checks on random texts that the diff keeps a longest common subsequence of lines
+func TestDiff_Minimal(t *testing.T) {
+	diffs := service.NewDiffService()
+	rng := rand.New(rand.NewSource(1))
+
+	for round := 0; round < 2000; round++ {
+		a := randomLines(rng, rng.Intn(15), 1+rng.Intn(4))
+		b := randomLines(rng, rng.Intn(15), 1+rng.Intn(4))
+
+		diff := diffs.Diff(strings.Join(a, "\n"), strings.Join(b, "\n"), 0)
+		lcs := lcsLength(a, b)
+		assert.Equal(t, len(a)-lcs, diff.Removed, "a=%v b=%v", a, b)
+		assert.Equal(t, len(b)-lcs, diff.Added, "a=%v b=%v", a, b)
+	}
+}
+
+func TestDiff_LargeEditions(t *testing.T) {
+	diffs := service.NewDiffService()
+	rng := rand.New(rand.NewSource(2))
+
+	old := make([]string, 10000)
+	for i := range old {
+		old[i] = fmt.Sprintf("line %d", i)
+	}
+	edited := append([]string(nil), old...)
+	for i := 0; i < 500; i++ {
+		edited[rng.Intn(len(edited))] = fmt.Sprintf("edited %d", i)
+	}
+
+	start := time.Now()
+	diff := diffs.Diff(strings.Join(old, "\n"), strings.Join(edited, "\n"), 3)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, diff.Added, diff.Removed)
+	assert.LessOrEqual(t, diff.Added, 500)
+}
+
+func randomLines(rng *rand.Rand, n, alphabet int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = string(rune('a' + rng.Intn(alphabet)))
+	}
+	return lines
+}
+
+func lcsLength(a, b []string) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] > lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	return lengths[0][0]
+}
+
+func TestDiff_SideBySide(t *testing.T) {
+	diffs := service.NewDiffService()
+
+	diff := diffs.Diff("a\nb\nc\nd\n", "a\nB\nC\nD\nd\n", 1)
+	rows := service.SideBySide(diff.Hunks[0])
+
+	assert.Len(t, rows, 5)
+	assert.Equal(t, "a", rows[0].Old.Text)
+	assert.Equal(t, rows[0].Old, rows[0].New)
+	assert.Equal(t, "b", rows[1].Old.Text)
+	assert.Equal(t, "B", rows[1].New.Text)
+	assert.Equal(t, "c", rows[2].Old.Text)
+	assert.Equal(t, "C", rows[2].New.Text)
+	assert.Nil(t, rows[3].Old, "an inserted line with no deleted line to replace")
+	assert.Equal(t, "D", rows[3].New.Text)
+	assert.Equal(t, "d", rows[4].New.Text)
+}
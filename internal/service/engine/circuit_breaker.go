@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// CircuitOpenError is returned without calling the engine while its breaker is open
+type CircuitOpenError struct {
+	Name    string
+	RetryIn time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s is unavailable, retry in %s", e.Name, e.RetryIn.Round(time.Second))
+}
+
+// Health is the state of an engine's circuit breaker
+type Health struct {
+	Name                string       `json:"name"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	LastError           string       `json:"last_error,omitempty"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	RetryInSeconds      int          `json:"retry_in_seconds,omitempty"`
+}
+
+// HealthReporter is implemented by engines that report the state of their circuit breaker
+type HealthReporter interface {
+	Health() Health
+}
+
+// CircuitBreaker stops calls to an engine after Threshold failures in a row, for OpenDuration. Then a single
+// call is let through: its success closes the breaker, its failure opens it again. A Threshold of 0 or less
+// never opens it.
+type CircuitBreaker struct {
+	Name         string
+	Threshold    int
+	OpenDuration time.Duration
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	lastError string
+	openedAt  time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(name string, threshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Name: name, Threshold: threshold, OpenDuration: openDuration, state: BreakerClosed}
+}
+
+// Allow returns a CircuitOpenError when the call may not be made, and otherwise expects its outcome through
+// Success, Failure or Cancel
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.OpenDuration - time.Since(b.openedAt); wait > 0 {
+			return &CircuitOpenError{Name: b.Name, RetryIn: wait}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{Name: b.Name, RetryIn: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastError = err.Error()
+	b.probing = false
+	if b.Threshold > 0 && (b.state == BreakerHalfOpen || b.failures >= b.Threshold) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Cancel ends a call that tells nothing about the engine, such as one its caller gave up on, so that a half
+// open breaker lets the next call probe
+func (b *CircuitBreaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := Health{Name: b.Name, State: b.state, ConsecutiveFailures: b.failures, LastError: b.lastError}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		health.OpenedAt = &openedAt
+	}
+	if wait := b.OpenDuration - time.Since(b.openedAt); b.state == BreakerOpen && wait > 0 {
+		health.RetryInSeconds = int(wait.Round(time.Second) / time.Second)
+	}
+	return health
+}
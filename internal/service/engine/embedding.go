@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	SambaNovaEmbeddingsAPIURL = "https://api.sambanova.ai/v1/embeddings"
+
+	embeddingBatchSize = 32
+	// embeddingTimeout bounds a call for one batch, from connecting to reading the embeddings
+	embeddingTimeout = time.Minute
+)
+
+// Embedder turns texts into vectors whose cosine similarity reflects how related they are
+type Embedder interface {
+	Model() string
+	Embed(texts []string) ([][]float32, error)
+}
+
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type EmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+type SambaNovaEmbedder struct {
+	apiURL     string
+	authToken  string
+	model      string
+	httpClient *http.Client
+}
+
+func NewSambaNovaEmbedder() *SambaNovaEmbedder {
+	return &SambaNovaEmbedder{
+		apiURL:     SambaNovaEmbeddingsAPIURL,
+		authToken:  os.Getenv("AI_API_TOKEN"),
+		model:      "E5-Mistral-7B-Instruct",
+		httpClient: &http.Client{Timeout: embeddingTimeout},
+	}
+}
+
+func (e *SambaNovaEmbedder) Model() string {
+	return e.model
+}
+
+func (e *SambaNovaEmbedder) Embed(texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		batch, err := e.embedBatch(texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
+
+func (e *SambaNovaEmbedder) embedBatch(texts []string) ([][]float32, error) {
+	reqBody, err := json.Marshal(EmbeddingRequest{Model: e.model, Input: texts})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request body: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", e.apiURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+e.authToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var embeddingResp EmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embeddingResp); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings: %w", err)
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, data := range embeddingResp.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+// HashEmbedder is a deterministic bag-of-words embedder that needs no network, for local runs and tests
+type HashEmbedder struct {
+	Dimensions int
+}
+
+func NewHashEmbedder(dimensions int) *HashEmbedder {
+	return &HashEmbedder{Dimensions: dimensions}
+}
+
+func (e *HashEmbedder) Model() string {
+	return fmt.Sprintf("hash-%d", e.Dimensions)
+}
+
+func (e *HashEmbedder) Embed(texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embeddings[i] = e.embed(text)
+	}
+	return embeddings, nil
+}
+
+// embed hashes every word into one of the dimensions and normalizes the counts to unit length
+func (e *HashEmbedder) embed(text string) []float32 {
+	vector := make([]float32, e.Dimensions)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		sum := h.Sum32()
+
+		sign := float32(1)
+		if sum&0x80000000 != 0 {
+			sign = -1
+		}
+		vector[int(sum%uint32(e.Dimensions))] += sign
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return vector
+	}
+
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
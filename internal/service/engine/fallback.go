@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Member is an engine of a FallbackEngine with the name its answers are recorded under
+type Member struct {
+	Name   string
+	Engine AiEngine
+}
+
+// Source tells which engine of a FallbackEngine served a stream, and its model
+type Source struct {
+	Engine string
+	Model  Model
+}
+
+// SourceOf returns the source of a stream opened by a FallbackEngine
+func SourceOf(stream io.ReadCloser) (Source, bool) {
+	if sourced, ok := stream.(*sourcedStream); ok {
+		return sourced.source, true
+	}
+	return Source{}, false
+}
+
+type sourcedStream struct {
+	io.ReadCloser
+	source Source
+}
+
+// FallbackEngine calls its members in order of priority until one of them starts answering. A member fails
+// over once its call returned an error, so members should be ResilientEngines, which retry, time out before
+// the first chunk and fail fast while their circuit breaker is open.
+type FallbackEngine struct {
+	Members []Member
+}
+
+func NewFallbackEngine(members ...Member) *FallbackEngine {
+	return &FallbackEngine{Members: members}
+}
+
+func (e *FallbackEngine) StreamChat(ctx context.Context, prompt string) (io.ReadCloser, error) {
+	return e.call(ctx, func(engine AiEngine) (io.ReadCloser, error) {
+		return engine.StreamChat(ctx, prompt)
+	})
+}
+
+func (e *FallbackEngine) StreamConversation(ctx context.Context, messages []ChatMessage) (io.ReadCloser, error) {
+	return e.call(ctx, func(engine AiEngine) (io.ReadCloser, error) {
+		return engine.StreamConversation(ctx, messages)
+	})
+}
+
+// Model is the model of the first member with the smallest context window of all members, so that prompts
+// fit whichever member answers
+func (e *FallbackEngine) Model() Model {
+	if len(e.Members) == 0 {
+		return LookupModel("")
+	}
+
+	model := modelOf(e.Members[0].Engine)
+	for _, member := range e.Members[1:] {
+		if window := modelOf(member.Engine).ContextWindow; window < model.ContextWindow {
+			model.ContextWindow = window
+		}
+	}
+	return model
+}
+
+// Reporters are the members that report their health, in order of priority
+func (e *FallbackEngine) Reporters() []HealthReporter {
+	var reporters []HealthReporter
+	for _, member := range e.Members {
+		if reporter, ok := member.Engine.(HealthReporter); ok {
+			reporters = append(reporters, reporter)
+		}
+	}
+	return reporters
+}
+
+func (e *FallbackEngine) call(ctx context.Context, open func(AiEngine) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if len(e.Members) == 0 {
+		return nil, errors.New("no AI engine configured")
+	}
+
+	// The error of a member that was called tells more than one whose breaker is open
+	var failure error
+	for i, member := range e.Members {
+		body, err := open(member.Engine)
+		if err == nil {
+			if i > 0 {
+				log.Printf("[FallbackEngine] Served by %s", member.Name)
+			}
+			return &sourcedStream{ReadCloser: body, source: Source{Engine: member.Name, Model: modelOf(member.Engine)}}, nil
+		}
+		// A cancelled caller wants no answer from the next member either
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		if i < len(e.Members)-1 {
+			log.Printf("[FallbackEngine] %s failed, falling over to %s: %v", member.Name, e.Members[i+1].Name, err)
+		}
+		var openErr *CircuitOpenError
+		if failure == nil || !errors.As(err, &openErr) {
+			failure = fmt.Errorf("%s: %w", member.Name, err)
+		}
+	}
+	return nil, failure
+}
+
+func modelOf(engine AiEngine) Model {
+	if info, ok := engine.(ModelInfo); ok {
+		return info.Model()
+	}
+	return LookupModel("")
+}
+
+// EngineSpec configures an OpenAI compatible chat API to fall over to
+type EngineSpec struct {
+	Name  string
+	URL   string
+	Model string
+}
+
+// ParseEngineSpecs reads engines as name=url|model separated by commas
+func ParseEngineSpecs(spec string) ([]EngineSpec, error) {
+	var specs []EngineSpec
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, target, ok := strings.Cut(item, "=")
+		url, model, ok2 := strings.Cut(target, "|")
+		name, url, model = strings.TrimSpace(name), strings.TrimSpace(url), strings.TrimSpace(model)
+		if !ok || !ok2 || name == "" || model == "" || !strings.HasPrefix(url, "http") {
+			return nil, fmt.Errorf("invalid engine %q, expected name=url|model", item)
+		}
+		specs = append(specs, EngineSpec{Name: name, URL: url, Model: model})
+	}
+	return specs, nil
+}
@@ -0,0 +1,107 @@
+package engine_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+// namedEngine is a scriptedEngine answering with a model
+type namedEngine struct {
+	*scriptedEngine
+	model engine.Model
+}
+
+func (e namedEngine) Model() engine.Model {
+	return e.model
+}
+
+func TestFallbackEngine(t *testing.T) {
+	t.Run("Primary answers", func(t *testing.T) {
+		primary := &scriptedEngine{answers: []func() (io.ReadCloser, error){answer("data: primary\n")}}
+		secondary := &scriptedEngine{answers: []func() (io.ReadCloser, error){answer("data: secondary\n")}}
+		fallback := engine.NewFallbackEngine(engine.Member{Name: "sambanova", Engine: primary}, engine.Member{Name: "backup", Engine: secondary})
+
+		body, err := fallback.StreamChat(context.Background(), "prompt")
+		assert.NoError(t, err)
+		source, ok := engine.SourceOf(body)
+		assert.True(t, ok)
+		assert.Equal(t, "sambanova", source.Engine)
+		assert.Equal(t, "data: primary\n", readAll(t, body))
+		assert.Zero(t, secondary.Calls())
+	})
+
+	t.Run("Falls over", func(t *testing.T) {
+		primary := &scriptedEngine{answers: []func() (io.ReadCloser, error){fail(&engine.TimeoutError{Stage: engine.StageFirstToken})}}
+		secondary := namedEngine{
+			scriptedEngine: &scriptedEngine{answers: []func() (io.ReadCloser, error){answer("data: secondary\n")}},
+			model:          engine.Model{Name: "backup-model", ContextWindow: 4096},
+		}
+		fallback := engine.NewFallbackEngine(engine.Member{Name: "sambanova", Engine: primary}, engine.Member{Name: "backup", Engine: secondary})
+
+		body, err := fallback.StreamConversation(context.Background(), []engine.ChatMessage{{Role: engine.RoleUser, Content: "question"}})
+		assert.NoError(t, err)
+		source, _ := engine.SourceOf(body)
+		assert.Equal(t, engine.Source{Engine: "backup", Model: secondary.model}, source)
+		assert.Equal(t, "data: secondary\n", readAll(t, body))
+		assert.Equal(t, 1, primary.Calls())
+	})
+
+	t.Run("All fail", func(t *testing.T) {
+		primary := &scriptedEngine{answers: []func() (io.ReadCloser, error){fail(&engine.APIError{StatusCode: 401})}}
+		secondary := &scriptedEngine{answers: []func() (io.ReadCloser, error){fail(&engine.CircuitOpenError{Name: "backup"})}}
+		fallback := engine.NewFallbackEngine(engine.Member{Name: "sambanova", Engine: primary}, engine.Member{Name: "backup", Engine: secondary})
+
+		_, err := fallback.StreamChat(context.Background(), "prompt")
+		var apiErr *engine.APIError
+		assert.ErrorAs(t, err, &apiErr, "the error of an engine that was called is kept over an open breaker")
+		assert.Contains(t, err.Error(), "sambanova")
+	})
+
+	t.Run("No members", func(t *testing.T) {
+		_, err := engine.NewFallbackEngine().StreamChat(context.Background(), "prompt")
+		assert.Error(t, err)
+	})
+}
+
+func TestFallbackEngine_Model(t *testing.T) {
+	primary := namedEngine{model: engine.LookupModel("Meta-Llama-3.1-70B-Instruct")}
+	secondary := namedEngine{model: engine.Model{Name: "small", ContextWindow: 8192}}
+	fallback := engine.NewFallbackEngine(engine.Member{Name: "sambanova", Engine: primary}, engine.Member{Name: "backup", Engine: secondary})
+
+	model := fallback.Model()
+	assert.Equal(t, "Meta-Llama-3.1-70B-Instruct", model.Name)
+	assert.Equal(t, engine.EncodingCL100K, model.Encoding)
+	assert.Equal(t, 8192, model.ContextWindow, "prompts fit the smallest context window")
+}
+
+func TestFallbackEngine_Reporters(t *testing.T) {
+	resilient := engine.NewResilientEngine("sambanova", &scriptedEngine{}, testConfig())
+	fallback := engine.NewFallbackEngine(engine.Member{Name: "sambanova", Engine: resilient}, engine.Member{Name: "plain", Engine: &scriptedEngine{}})
+
+	reporters := fallback.Reporters()
+	if assert.Len(t, reporters, 1) {
+		assert.Equal(t, "sambanova", reporters[0].Health().Name)
+	}
+}
+
+func TestParseEngineSpecs(t *testing.T) {
+	specs, err := engine.ParseEngineSpecs(" together=https://api.together.xyz/v1/chat/completions|meta-llama/Llama-3.3-70B-Instruct-Turbo, ,local=http://localhost:8000/v1/chat/completions|llama3 ")
+	assert.NoError(t, err)
+	assert.Equal(t, []engine.EngineSpec{
+		{Name: "together", URL: "https://api.together.xyz/v1/chat/completions", Model: "meta-llama/Llama-3.3-70B-Instruct-Turbo"},
+		{Name: "local", URL: "http://localhost:8000/v1/chat/completions", Model: "llama3"},
+	}, specs)
+
+	specs, err = engine.ParseEngineSpecs("")
+	assert.NoError(t, err)
+	assert.Empty(t, specs)
+
+	for _, invalid := range []string{"together", "together=https://api.together.xyz", "=https://api.together.xyz|llama", "together=api.together.xyz|llama"} {
+		_, err := engine.ParseEngineSpecs(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,44 @@
+package engine
+
+// DefaultContextWindow is the context window assumed for models missing from Models
+const DefaultContextWindow = 8192
+
+// Model is what the service needs to know about a chat model to fit prompts in it: how many tokens a call
+// may hold, prompt and answer together, and the BPE table its text is counted with. An empty Encoding counts
+// with the heuristic tokenizer.
+type Model struct {
+	Name          string
+	ContextWindow int
+	Encoding      string
+	// CountMargin is the percentage of the context window kept spare when Encoding only approximates the
+	// model's own table
+	CountMargin int
+}
+
+// llama3CountMargin covers the difference between cl100k_base and the Llama 3 table, and the tokens of the
+// chat template around each message
+const llama3CountMargin = 5
+
+// Models are the SambaNova Cloud models with their context windows. Their token counts are approximate: Llama 3
+// extends the cl100k_base table with 28k tokens, mostly of other languages, and splits text with its own
+// pattern, so cl100k_base counts English within a few percent and prompts keep llama3CountMargin spare.
+var Models = map[string]Model{
+	"Meta-Llama-3.1-8B-Instruct":   {Name: "Meta-Llama-3.1-8B-Instruct", ContextWindow: 16384, Encoding: EncodingCL100K, CountMargin: llama3CountMargin},
+	"Meta-Llama-3.1-70B-Instruct":  {Name: "Meta-Llama-3.1-70B-Instruct", ContextWindow: 131072, Encoding: EncodingCL100K, CountMargin: llama3CountMargin},
+	"Meta-Llama-3.1-405B-Instruct": {Name: "Meta-Llama-3.1-405B-Instruct", ContextWindow: 16384, Encoding: EncodingCL100K, CountMargin: llama3CountMargin},
+	"Meta-Llama-3.3-70B-Instruct":  {Name: "Meta-Llama-3.3-70B-Instruct", ContextWindow: 131072, Encoding: EncodingCL100K, CountMargin: llama3CountMargin},
+}
+
+// ModelInfo is implemented by engines that tell which model answers their calls
+type ModelInfo interface {
+	Model() Model
+}
+
+// LookupModel describes the named model, an unknown one gets the default context window and the heuristic
+// tokenizer
+func LookupModel(name string) Model {
+	if model, ok := Models[name]; ok {
+		return model
+	}
+	return Model{Name: name, ContextWindow: DefaultContextWindow}
+}
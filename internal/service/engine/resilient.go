@@ -0,0 +1,352 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeout stages of a call to the engine
+const (
+	StageConnect    = "connect"
+	StageFirstToken = "first_token"
+	StageIdle       = "idle"
+)
+
+// TimeoutError is returned when the engine did not answer, send its first chunk or its next one in time
+type TimeoutError struct {
+	Stage string
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("engine %s timeout after %s", e.Stage, e.After)
+}
+
+// ResilientConfig tunes a ResilientEngine, a zero timeout waits forever
+type ResilientConfig struct {
+	// ConnectTimeout is how long the engine may take to answer a call, until the headers of the response
+	ConnectTimeout time.Duration
+	// FirstTokenTimeout is how long the first chunk of the answer may take once the engine answered
+	FirstTokenTimeout time.Duration
+	// IdleTimeout is how long the stream may stay silent between chunks
+	IdleTimeout time.Duration
+
+	// MaxRetries is how many times a call is made again after a failure that may pass, before the answer
+	// starts streaming
+	MaxRetries int
+	// RetryBaseDelay doubles after each retry up to RetryMaxDelay, and each wait is jittered. A Retry-After
+	// longer than RetryMaxDelay is not waited for.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// BreakerThreshold failures in a row stop the calls for BreakerOpenDuration, 0 disables the breaker
+	BreakerThreshold    int
+	BreakerOpenDuration time.Duration
+}
+
+func DefaultResilientConfig() ResilientConfig {
+	return ResilientConfig{
+		ConnectTimeout:      30 * time.Second,
+		FirstTokenTimeout:   60 * time.Second,
+		IdleTimeout:         30 * time.Second,
+		MaxRetries:          3,
+		RetryBaseDelay:      500 * time.Millisecond,
+		RetryMaxDelay:       20 * time.Second,
+		BreakerThreshold:    5,
+		BreakerOpenDuration: 30 * time.Second,
+	}
+}
+
+// ResilientEngine wraps an engine with timeouts, retries and a circuit breaker. Calls are retried until the
+// first chunk of the answer arrives, after which a failure ends the stream.
+type ResilientEngine struct {
+	Engine  AiEngine
+	Config  ResilientConfig
+	Breaker *CircuitBreaker
+}
+
+func NewResilientEngine(name string, engine AiEngine, config ResilientConfig) *ResilientEngine {
+	return &ResilientEngine{
+		Engine:  engine,
+		Config:  config,
+		Breaker: NewCircuitBreaker(name, config.BreakerThreshold, config.BreakerOpenDuration),
+	}
+}
+
+func (e *ResilientEngine) StreamChat(ctx context.Context, prompt string) (io.ReadCloser, error) {
+	return e.call(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+		return e.Engine.StreamChat(ctx, prompt)
+	})
+}
+
+func (e *ResilientEngine) StreamConversation(ctx context.Context, messages []ChatMessage) (io.ReadCloser, error) {
+	return e.call(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+		return e.Engine.StreamConversation(ctx, messages)
+	})
+}
+
+// Model describes the model of the wrapped engine
+func (e *ResilientEngine) Model() Model {
+	return modelOf(e.Engine)
+}
+
+func (e *ResilientEngine) Health() Health {
+	return e.Breaker.Health()
+}
+
+// call makes attempts until one starts answering, waiting between them unless the caller cancels
+func (e *ResilientEngine) call(ctx context.Context, open func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if err := e.Breaker.Allow(); err != nil {
+			// The failures of this call opened the breaker, the last one tells why
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+
+		body, err := e.attempt(ctx, open)
+		if err == nil {
+			e.Breaker.Success()
+			return body, nil
+		}
+
+		if ctx.Err() != nil {
+			// The caller gave up, which tells nothing about the engine
+			e.Breaker.Cancel()
+			return nil, err
+		}
+		if !Transient(err) {
+			// The engine is up, it refused this call
+			e.Breaker.Success()
+			return nil, err
+		}
+		e.Breaker.Failure(err)
+		lastErr = err
+
+		delay, ok := e.retryDelay(err, attempt)
+		if !ok {
+			return nil, err
+		}
+		log.Printf("[ResilientEngine] [%s] Attempt %d failed, retrying in %s: %v", e.Breaker.Name, attempt+1, delay.Round(time.Millisecond), err)
+		if !wait(ctx, delay) {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps for the delay, or returns false as soon as the context is cancelled
+func wait(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// attempt opens the stream and waits for its first chunk, so that an engine that answers but stays silent
+// is retried too
+func (e *ResilientEngine) attempt(ctx context.Context, open func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	body, err := e.open(ctx, open)
+	if err != nil || body == nil {
+		return body, err
+	}
+
+	watched := newWatchdogReader(body, e.Config.FirstTokenTimeout, e.Config.IdleTimeout, func(err error) {
+		e.Breaker.Failure(err)
+	})
+
+	first := make([]byte, 4096)
+	n, err := watched.Read(first)
+	if n == 0 && err != nil && err != io.EOF {
+		watched.Close()
+		return nil, err
+	}
+	return &prefixedReader{prefix: first[:n], ReadCloser: watched}, nil
+}
+
+// open calls the engine within the connect timeout, which cancels the call's context so that the request
+// stops. The context of a call that answered in time lives on until its stream is closed.
+func (e *ResilientEngine) open(ctx context.Context, open func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	if e.Config.ConnectTimeout <= 0 {
+		body, err := open(ctx)
+		return cancelOnClose(body, err, cancel)
+	}
+
+	type result struct {
+		body io.ReadCloser
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		body, err := open(ctx)
+		done <- result{body, err}
+	}()
+
+	timer := time.NewTimer(e.Config.ConnectTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return cancelOnClose(r.body, r.err, cancel)
+	case <-timer.C:
+		cancel()
+		// An engine that ignores its context may still answer, its stream is closed then
+		go func() {
+			if r := <-done; r.body != nil {
+				r.body.Close()
+			}
+		}()
+		return nil, &TimeoutError{Stage: StageConnect, After: e.Config.ConnectTimeout}
+	}
+}
+
+// cancelOnClose cancels the context of a call once its stream is closed, or right away when it failed
+func cancelOnClose(body io.ReadCloser, err error, cancel context.CancelFunc) (io.ReadCloser, error) {
+	if err != nil || body == nil {
+		cancel()
+		return body, err
+	}
+	return &cancelingReader{ReadCloser: body, cancel: cancel}, nil
+}
+
+type cancelingReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// retryDelay is the jittered backoff of the attempt, or the engine's Retry-After when it asked for longer
+func (e *ResilientEngine) retryDelay(err error, attempt int) (time.Duration, bool) {
+	if attempt >= e.Config.MaxRetries {
+		return 0, false
+	}
+
+	backoff := e.Config.RetryBaseDelay << attempt
+	if backoff > e.Config.RetryMaxDelay || backoff <= 0 {
+		backoff = e.Config.RetryMaxDelay
+	}
+	// Half the backoff is fixed and half random, so that retries of many calls spread out
+	delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+		if apiErr.RetryAfter > e.Config.RetryMaxDelay {
+			return 0, false
+		}
+		delay = apiErr.RetryAfter
+	}
+	return delay, true
+}
+
+// Transient tells whether a call that failed with the error may succeed later: network failures, timeouts,
+// rate limits and server errors
+func Transient(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests ||
+			apiErr.StatusCode == http.StatusRequestTimeout ||
+			apiErr.StatusCode >= 500
+	}
+
+	var openErr *CircuitOpenError
+	return !errors.As(err, &openErr)
+}
+
+// watchdogReader closes the stream when its first chunk takes longer than first, or a next one longer than
+// idle, and reads then fail with a TimeoutError. onExpire is told of idle timeouts only, the first chunk is
+// awaited by ResilientEngine.attempt which handles its failure.
+type watchdogReader struct {
+	body     io.ReadCloser
+	idle     time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+	onExpire func(error)
+
+	mu    sync.Mutex
+	stage string
+	after time.Duration
+}
+
+func newWatchdogReader(body io.ReadCloser, first, idle time.Duration, onExpire func(error)) *watchdogReader {
+	w := &watchdogReader{body: body, idle: idle, onExpire: onExpire, stage: StageFirstToken, after: first}
+	w.timer = time.AfterFunc(time.Hour, w.expire)
+	w.arm(first)
+	return w
+}
+
+// arm restarts the timer, or stops it for a zero timeout
+func (w *watchdogReader) arm(timeout time.Duration) {
+	if timeout > 0 {
+		w.timer.Reset(timeout)
+	} else {
+		w.timer.Stop()
+	}
+}
+
+func (w *watchdogReader) expire() {
+	w.timedOut.Store(true)
+	w.body.Close()
+	if err := w.timeoutError(); err.Stage == StageIdle {
+		w.onExpire(err)
+	}
+}
+
+func (w *watchdogReader) timeoutError() *TimeoutError {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return &TimeoutError{Stage: w.stage, After: w.after}
+}
+
+func (w *watchdogReader) Read(p []byte) (int, error) {
+	n, err := w.body.Read(p)
+	if w.timedOut.Load() {
+		return n, w.timeoutError()
+	}
+
+	if n > 0 {
+		w.mu.Lock()
+		w.stage, w.after = StageIdle, w.idle
+		w.mu.Unlock()
+		w.arm(w.idle)
+	}
+	return n, err
+}
+
+func (w *watchdogReader) Close() error {
+	w.timer.Stop()
+	return w.body.Close()
+}
+
+// prefixedReader gives back the bytes read ahead before the rest of the stream
+type prefixedReader struct {
+	prefix []byte
+	io.ReadCloser
+}
+
+func (r *prefixedReader) Read(p []byte) (int, error) {
+	if len(r.prefix) > 0 {
+		n := copy(p, r.prefix)
+		r.prefix = r.prefix[n:]
+		return n, nil
+	}
+	return r.ReadCloser.Read(p)
+}
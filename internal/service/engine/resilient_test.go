@@ -0,0 +1,338 @@
+package engine_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+// scriptedEngine answers each call with the next of its answers, repeating the last one
+type scriptedEngine struct {
+	mu      sync.Mutex
+	calls   int
+	answers []func() (io.ReadCloser, error)
+}
+
+func (e *scriptedEngine) StreamChat(ctx context.Context, prompt string) (io.ReadCloser, error) {
+	e.mu.Lock()
+	answer := e.answers[min(e.calls, len(e.answers)-1)]
+	e.calls++
+	e.mu.Unlock()
+	return answer()
+}
+
+func (e *scriptedEngine) StreamConversation(ctx context.Context, messages []engine.ChatMessage) (io.ReadCloser, error) {
+	return e.StreamChat(ctx, messages[len(messages)-1].Content)
+}
+
+func (e *scriptedEngine) Calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func answer(text string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(text)), nil
+	}
+}
+
+func fail(err error) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return nil, err
+	}
+}
+
+func testConfig() engine.ResilientConfig {
+	return engine.ResilientConfig{
+		ConnectTimeout:      time.Second,
+		FirstTokenTimeout:   time.Second,
+		IdleTimeout:         time.Second,
+		MaxRetries:          3,
+		RetryBaseDelay:      time.Millisecond,
+		RetryMaxDelay:       100 * time.Millisecond,
+		BreakerThreshold:    10,
+		BreakerOpenDuration: time.Minute,
+	}
+}
+
+func readAll(t *testing.T, body io.ReadCloser) string {
+	defer body.Close()
+	content, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestResilientEngine_Retries(t *testing.T) {
+	t.Run("Server errors", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+			fail(&engine.APIError{StatusCode: 503}),
+			fail(errors.New("connection reset")),
+			answer("data: {}\n"),
+		}}
+		resilient := engine.NewResilientEngine("test", scripted, testConfig())
+
+		body, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.NoError(t, err)
+		assert.Equal(t, "data: {}\n", readAll(t, body))
+		assert.Equal(t, 3, scripted.Calls())
+		assert.Equal(t, engine.BreakerClosed, resilient.Health().State)
+		assert.Zero(t, resilient.Health().ConsecutiveFailures, "a success resets the failures")
+	})
+
+	t.Run("Gives up", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){fail(&engine.APIError{StatusCode: 502})}}
+		resilient := engine.NewResilientEngine("test", scripted, testConfig())
+
+		_, err := resilient.StreamChat(context.Background(), "prompt")
+		var apiErr *engine.APIError
+		assert.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, 4, scripted.Calls(), "the call and 3 retries")
+	})
+
+	t.Run("Client errors", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){fail(&engine.APIError{StatusCode: 400, Body: "context length exceeded"})}}
+		resilient := engine.NewResilientEngine("test", scripted, testConfig())
+
+		_, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.Error(t, err)
+		assert.Equal(t, 1, scripted.Calls())
+		assert.Zero(t, resilient.Health().ConsecutiveFailures)
+	})
+
+	t.Run("Retry-After", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+			fail(&engine.APIError{StatusCode: 429, RetryAfter: 50 * time.Millisecond}),
+			answer("data: {}\n"),
+		}}
+		resilient := engine.NewResilientEngine("test", scripted, testConfig())
+
+		start := time.Now()
+		body, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.NoError(t, err)
+		body.Close()
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("Retry-After too long", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+			fail(&engine.APIError{StatusCode: 429, RetryAfter: time.Hour}),
+		}}
+		resilient := engine.NewResilientEngine("test", scripted, testConfig())
+
+		_, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.Error(t, err)
+		assert.Equal(t, 1, scripted.Calls(), "a wait longer than the max delay fails right away")
+	})
+}
+
+func TestResilientEngine_Timeouts(t *testing.T) {
+	config := testConfig()
+	config.ConnectTimeout = 20 * time.Millisecond
+	config.FirstTokenTimeout = 20 * time.Millisecond
+	config.IdleTimeout = 20 * time.Millisecond
+	config.MaxRetries = 1
+
+	t.Run("Connect", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+			func() (io.ReadCloser, error) {
+				time.Sleep(200 * time.Millisecond)
+				return io.NopCloser(strings.NewReader("late")), nil
+			},
+			answer("data: {}\n"),
+		}}
+		resilient := engine.NewResilientEngine("test", scripted, config)
+
+		body, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.NoError(t, err)
+		assert.Equal(t, "data: {}\n", readAll(t, body))
+		assert.Equal(t, 2, scripted.Calls())
+	})
+
+	t.Run("First token", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+			func() (io.ReadCloser, error) {
+				silent, _ := io.Pipe()
+				return silent, nil
+			},
+		}}
+		resilient := engine.NewResilientEngine("test", scripted, config)
+
+		_, err := resilient.StreamChat(context.Background(), "prompt")
+		var timeoutErr *engine.TimeoutError
+		if assert.ErrorAs(t, err, &timeoutErr) {
+			assert.Equal(t, engine.StageFirstToken, timeoutErr.Stage)
+		}
+		assert.Equal(t, 2, scripted.Calls())
+		assert.Equal(t, 2, resilient.Health().ConsecutiveFailures)
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		go writer.Write([]byte("data: first\n"))
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+			func() (io.ReadCloser, error) { return reader, nil },
+		}}
+		resilient := engine.NewResilientEngine("test", scripted, config)
+
+		body, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.NoError(t, err)
+		defer body.Close()
+
+		content, err := io.ReadAll(body)
+		assert.Equal(t, "data: first\n", string(content))
+		var timeoutErr *engine.TimeoutError
+		if assert.ErrorAs(t, err, &timeoutErr) {
+			assert.Equal(t, engine.StageIdle, timeoutErr.Stage)
+		}
+		assert.Equal(t, 1, scripted.Calls(), "a stream that started is not retried")
+		assert.Equal(t, 1, resilient.Health().ConsecutiveFailures)
+	})
+}
+
+func TestResilientEngine_CircuitBreaker(t *testing.T) {
+	config := testConfig()
+	config.MaxRetries = 0
+	config.BreakerThreshold = 2
+	config.BreakerOpenDuration = 50 * time.Millisecond
+
+	scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+		fail(&engine.APIError{StatusCode: 500}),
+		fail(&engine.APIError{StatusCode: 500}),
+		fail(&engine.APIError{StatusCode: 500}),
+		answer("data: {}\n"),
+	}}
+	resilient := engine.NewResilientEngine("sambanova", scripted, config)
+
+	for i := 0; i < 2; i++ {
+		_, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.Error(t, err)
+	}
+	health := resilient.Health()
+	assert.Equal(t, engine.BreakerOpen, health.State)
+	assert.Equal(t, 2, health.ConsecutiveFailures)
+	assert.NotNil(t, health.OpenedAt)
+	assert.Contains(t, health.LastError, "status 500")
+
+	_, err := resilient.StreamChat(context.Background(), "prompt")
+	var openErr *engine.CircuitOpenError
+	assert.ErrorAs(t, err, &openErr, "an open breaker fails fast")
+	assert.Equal(t, 2, scripted.Calls())
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = resilient.StreamChat(context.Background(), "prompt")
+	assert.Error(t, err)
+	assert.Equal(t, 3, scripted.Calls(), "a single call is let through after the open duration")
+	assert.Equal(t, engine.BreakerOpen, resilient.Health().State, "and its failure opens the breaker again")
+
+	time.Sleep(60 * time.Millisecond)
+	body, err := resilient.StreamChat(context.Background(), "prompt")
+	assert.NoError(t, err)
+	body.Close()
+	assert.Equal(t, engine.BreakerClosed, resilient.Health().State)
+}
+
+func TestResilientEngine_Cancellation(t *testing.T) {
+	t.Run("Connect timeout stops the request", func(t *testing.T) {
+		stopped := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The server notices a closed connection once the body is read
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			close(stopped)
+		}))
+		defer server.Close()
+
+		config := testConfig()
+		config.ConnectTimeout = 20 * time.Millisecond
+		config.MaxRetries = 0
+		resilient := engine.NewResilientEngine("test", engine.NewChatClient(server.URL, "token", "model"), config)
+
+		_, err := resilient.StreamChat(context.Background(), "prompt")
+		var timeoutErr *engine.TimeoutError
+		if assert.ErrorAs(t, err, &timeoutErr) {
+			assert.Equal(t, engine.StageConnect, timeoutErr.Stage)
+		}
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("the request goes on after the connect timeout")
+		}
+	})
+
+	t.Run("Backoff stops when the caller cancels", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){fail(&engine.APIError{StatusCode: 503})}}
+		config := testConfig()
+		config.RetryBaseDelay = time.Minute
+		config.RetryMaxDelay = time.Minute
+		resilient := engine.NewResilientEngine("test", scripted, config)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := resilient.StreamChat(ctx, "prompt")
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Equal(t, 1, scripted.Calls())
+	})
+
+	t.Run("Cancelled call", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){fail(context.Canceled)}}
+		resilient := engine.NewResilientEngine("test", scripted, testConfig())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := resilient.StreamChat(ctx, "prompt")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, scripted.Calls(), "a cancelled call is not retried")
+		assert.Zero(t, resilient.Health().ConsecutiveFailures, "nor counted against the engine")
+	})
+
+	t.Run("Cancelled probe", func(t *testing.T) {
+		scripted := &scriptedEngine{answers: []func() (io.ReadCloser, error){
+			fail(&engine.APIError{StatusCode: 500}),
+			fail(context.Canceled),
+			answer("data: {}\n"),
+		}}
+		config := testConfig()
+		config.MaxRetries = 0
+		config.BreakerThreshold = 1
+		config.BreakerOpenDuration = 20 * time.Millisecond
+		resilient := engine.NewResilientEngine("test", scripted, config)
+
+		_, err := resilient.StreamChat(context.Background(), "prompt")
+		assert.Error(t, err)
+		assert.Equal(t, engine.BreakerOpen, resilient.Health().State)
+
+		time.Sleep(30 * time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = resilient.StreamChat(ctx, "prompt")
+		assert.ErrorIs(t, err, context.Canceled)
+
+		body, err := resilient.StreamChat(context.Background(), "prompt")
+		if assert.NoError(t, err, "the cancelled probe lets the next call probe") {
+			body.Close()
+		}
+		assert.Equal(t, 3, scripted.Calls())
+		assert.Equal(t, engine.BreakerClosed, resilient.Health().State)
+	})
+}
@@ -2,14 +2,30 @@ package engine
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
-const SambaNovaChatAPIURL = "https://api.sambanova.ai/v1/chat/completions"
+const (
+	SambaNovaChatAPIURL   = "https://api.sambanova.ai/v1/chat/completions"
+	DefaultSambaNovaModel = "Meta-Llama-3.1-70B-Instruct"
+
+	// responseHeaderTimeout bounds the wait for a response when no ResilientEngine times the call sooner
+	responseHeaderTimeout = 2 * time.Minute
+)
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
 
 type ChatMessage struct {
 	Role    string `json:"role"`
@@ -17,37 +33,97 @@ type ChatMessage struct {
 }
 
 type ChatRequest struct {
-	Model    string        `json:"model"`
-	Messages []ChatMessage `json:"messages"`
-	Stream   bool          `json:"stream"`
+	Model         string         `json:"model"`
+	Messages      []ChatMessage  `json:"messages"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// StreamOptions asks for the token usage of the call in the last streamed chunk
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Usage is the token count the API reports for a call
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// APIError is returned when the chat API answers with a non-200 status. RetryAfter is the wait the API asked
+// for with a Retry-After header, 0 without one.
+type APIError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
 }
 
+func (e *APIError) Error() string {
+	return fmt.Sprintf("failed to analyze text, status %d: %s", e.StatusCode, e.Body)
+}
+
+// AiEngine streams chat completions. A call stops, and its stream closes, when the context is cancelled.
 type AiEngine interface {
-	StreamChat(prompt string) (io.ReadCloser, error)
+	StreamChat(ctx context.Context, prompt string) (io.ReadCloser, error)
+	StreamConversation(ctx context.Context, messages []ChatMessage) (io.ReadCloser, error)
 }
 
 type DefaultSambaNovaClient struct {
-	apiURL    string
-	authToken string
+	apiURL     string
+	authToken  string
+	model      string
+	httpClient *http.Client
 }
 
 func NewSambaNovaClient() *DefaultSambaNovaClient {
+	model := os.Getenv("AI_MODEL")
+	if model == "" {
+		model = DefaultSambaNovaModel
+	}
+
+	return NewChatClient(SambaNovaChatAPIURL, os.Getenv("AI_API_TOKEN"), model)
+}
+
+// NewChatClient calls any chat API compatible with SambaNova's, which follows OpenAI's
+func NewChatClient(apiURL, authToken, model string) *DefaultSambaNovaClient {
 	return &DefaultSambaNovaClient{
-		apiURL:    SambaNovaChatAPIURL,
-		authToken: os.Getenv("AI_API_TOKEN"),
+		apiURL:    apiURL,
+		authToken: authToken,
+		model:     model,
+		// No overall timeout, as answers stream for minutes. ResilientEngine times the response and its chunks.
+		httpClient: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: responseHeaderTimeout,
+			MaxIdleConnsPerHost:   10,
+			IdleConnTimeout:       90 * time.Second,
+		}},
 	}
 }
 
-func (c *DefaultSambaNovaClient) StreamChat(prompt string) (io.ReadCloser, error) {
-	chatRequest := ChatRequest{
-		Model: "Meta-Llama-3.1-70B-Instruct",
-		Messages: []ChatMessage{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
+// Model describes the model the client asks for, with its context window
+func (c *DefaultSambaNovaClient) Model() Model {
+	return LookupModel(c.model)
+}
+
+func (c *DefaultSambaNovaClient) StreamChat(ctx context.Context, prompt string) (io.ReadCloser, error) {
+	return c.StreamConversation(ctx, []ChatMessage{
+		{
+			Role:    RoleUser,
+			Content: prompt,
 		},
-		Stream: true,
+	})
+}
+
+// StreamConversation sends a multi-turn conversation and streams the next assistant message
+func (c *DefaultSambaNovaClient) StreamConversation(ctx context.Context, messages []ChatMessage) (io.ReadCloser, error) {
+	chatRequest := ChatRequest{
+		Model:         c.model,
+		Messages:      messages,
+		Stream:        true,
+		StreamOptions: &StreamOptions{IncludeUsage: true},
 	}
 
 	reqBody, err := json.Marshal(chatRequest)
@@ -55,23 +131,39 @@ func (c *DefaultSambaNovaClient) StreamChat(prompt string) (io.ReadCloser, error
 		return nil, fmt.Errorf("failed to create request body: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", c.apiURL, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.apiURL, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Authorization", "Bearer "+c.authToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform request: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to analyze text, status %d: %s", resp.StatusCode, string(body))
+		resp.Body.Close()
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
 	return resp.Body, nil
 }
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date, 0 when missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
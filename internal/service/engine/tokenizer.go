@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// EncodingCL100K is the BPE table of GPT-4, the base of the Llama 3 one
+const EncodingCL100K = "cl100k_base"
+
+// HeuristicBytesPerToken is the average token length of English text with the common BPE tables
+const HeuristicBytesPerToken = 4
+
+// encodings are the BPE tables in the tiktoken format, embedded so that counting tokens needs no download
+//
+//go:embed encodings/*.tiktoken
+var encodings embed.FS
+
+// Tokenizer counts the tokens of a text for a model and cuts texts to a number of tokens
+type Tokenizer interface {
+	Count(text string) int
+	// Truncate returns the longest prefix of the text with at most maxTokens tokens
+	Truncate(text string, maxTokens int) string
+}
+
+var (
+	tokenizersMu sync.Mutex
+	tokenizers   = map[string]Tokenizer{}
+)
+
+// TokenizerFor returns the tokenizer of the model's BPE table, or the heuristic one when it has none or the
+// table fails to load. Tables are loaded once, on first use.
+func TokenizerFor(model Model) Tokenizer {
+	if model.Encoding == "" {
+		return HeuristicTokenizer{}
+	}
+
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+
+	if tokenizer, ok := tokenizers[model.Encoding]; ok {
+		return tokenizer
+	}
+
+	var tokenizer Tokenizer = HeuristicTokenizer{}
+	tiktoken.SetBpeLoader(embeddedLoader{})
+	if encoding, err := tiktoken.GetEncoding(model.Encoding); err != nil {
+		log.Printf("[Tokenizer] Failed to load %s, counting tokens with the heuristic: %v", model.Encoding, err)
+	} else {
+		tokenizer = &bpeTokenizer{encoding: encoding}
+	}
+
+	tokenizers[model.Encoding] = tokenizer
+	return tokenizer
+}
+
+// HeuristicTokenizer counts HeuristicBytesPerToken bytes a token, for models whose table is unknown
+type HeuristicTokenizer struct{}
+
+func (HeuristicTokenizer) Count(text string) int {
+	return (len(text) + HeuristicBytesPerToken - 1) / HeuristicBytesPerToken
+}
+
+func (HeuristicTokenizer) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	if max := maxTokens * HeuristicBytesPerToken; len(text) > max {
+		return validPrefix(text[:max])
+	}
+	return text
+}
+
+type bpeTokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+func (t *bpeTokenizer) Count(text string) int {
+	return len(t.encoding.EncodeOrdinary(text))
+}
+
+// Truncate encodes growing prefixes of the text rather than all of it, since only the first tokens matter and
+// books are much longer than any context window
+func (t *bpeTokenizer) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	// Every token holds at least one byte
+	if len(text) <= maxTokens {
+		return text
+	}
+
+	for size := maxTokens * 2 * HeuristicBytesPerToken; ; size *= 2 {
+		prefix := text
+		if size < len(text) {
+			prefix = validPrefix(text[:size])
+		}
+
+		tokens := t.encoding.EncodeOrdinary(prefix)
+		if len(tokens) <= maxTokens {
+			if len(prefix) == len(text) {
+				return text
+			}
+			continue
+		}
+
+		length := 0
+		for _, token := range tokens[:maxTokens] {
+			length += len(t.encoding.Decode([]int{token}))
+		}
+		return validPrefix(text[:length])
+	}
+}
+
+// validPrefix drops the bytes of a character cut at the end of the text
+func validPrefix(text string) string {
+	for i := 1; i < utf8.UTFMax && len(text) > 0; i++ {
+		if r, size := utf8.DecodeLastRuneInString(text); r != utf8.RuneError || size > 1 {
+			break
+		}
+		text = text[:len(text)-1]
+	}
+	return text
+}
+
+// embeddedLoader reads the BPE tables tiktoken asks for from encodings instead of downloading them
+type embeddedLoader struct{}
+
+func (embeddedLoader) LoadTiktokenBpe(url string) (map[string]int, error) {
+	contents, err := encodings.ReadFile("encodings/" + path.Base(url))
+	if err != nil {
+		return nil, fmt.Errorf("no embedded BPE table for %s: %w", url, err)
+	}
+	return parseTiktokenBpe(contents)
+}
+
+// parseTiktokenBpe reads a table of base64 tokens and their ranks, one per line
+func parseTiktokenBpe(contents []byte) (map[string]int, error) {
+	ranks := make(map[string]int, 100000)
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		encoded, rank, ok := bytes.Cut(line, []byte(" "))
+		if !ok {
+			return nil, fmt.Errorf("invalid BPE table line %q", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BPE token %q: %w", encoded, err)
+		}
+		ranks[string(token)], err = strconv.Atoi(string(rank))
+		if err != nil {
+			return nil, fmt.Errorf("invalid BPE rank %q: %w", rank, err)
+		}
+	}
+	return ranks, nil
+}
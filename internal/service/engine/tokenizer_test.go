@@ -0,0 +1,52 @@
+package engine_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+func TestTokenizerFor(t *testing.T) {
+	bpe := engine.TokenizerFor(engine.LookupModel(engine.DefaultSambaNovaModel))
+
+	t.Run("Count", func(t *testing.T) {
+		assert.Equal(t, 2, bpe.Count("hello world"))
+		assert.Equal(t, 6, bpe.Count("tiktoken is great!"))
+		assert.Equal(t, 0, bpe.Count(""))
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		assert.Equal(t, "tiktoken is", bpe.Truncate("tiktoken is great!", 4))
+		assert.Equal(t, "tiktoken is great!", bpe.Truncate("tiktoken is great!", 6))
+		assert.Equal(t, "", bpe.Truncate("tiktoken is great!", 0))
+	})
+
+	t.Run("Truncate a book", func(t *testing.T) {
+		book := strings.Repeat("Blow, winds, and crack your cheeks! Rage, blow!\n", 5000)
+
+		truncated := bpe.Truncate(book, 1000)
+		assert.True(t, strings.HasPrefix(book, truncated))
+		assert.LessOrEqual(t, bpe.Count(truncated), 1000)
+		assert.Greater(t, bpe.Count(truncated), 990)
+	})
+
+	t.Run("Unknown model", func(t *testing.T) {
+		model := engine.LookupModel("mystery")
+		assert.Equal(t, engine.DefaultContextWindow, model.ContextWindow)
+		assert.Equal(t, engine.HeuristicTokenizer{}, engine.TokenizerFor(model))
+	})
+}
+
+func TestHeuristicTokenizer(t *testing.T) {
+	tokenizer := engine.HeuristicTokenizer{}
+
+	assert.Equal(t, 5, tokenizer.Count("Goneril and Regan."))
+	assert.Equal(t, "Goneril ", tokenizer.Truncate("Goneril and Regan.", 2))
+
+	truncated := tokenizer.Truncate("Foolséé", 2)
+	assert.Equal(t, "Foolsé", truncated, "a character is never cut")
+	assert.True(t, utf8.ValidString(truncated))
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+const (
+	PassageWords   = 200
+	PassageOverlap = 40
+
+	CitationsEvent = "Citations"
+)
+
+var (
+	wordPattern     = regexp.MustCompile(`\S+`)
+	passageCitation = regexp.MustCompile(`\[P(\d+)\]`)
+)
+
+// SplitPassages cuts the text into overlapping windows of words, keeping the byte offsets of each window
+func SplitPassages(gutenbergID int, text string) []domain.Passage {
+	words := wordPattern.FindAllStringIndex(text, -1)
+
+	var passages []domain.Passage
+	for start := 0; start < len(words); start += PassageWords - PassageOverlap {
+		end := start + PassageWords
+		if end > len(words) {
+			end = len(words)
+		}
+
+		from, to := words[start][0], words[end-1][1]
+		passages = append(passages, domain.Passage{
+			GutenbergID: gutenbergID,
+			Start:       from,
+			End:         to,
+			Content:     text[from:to],
+		})
+
+		if end == len(words) {
+			break
+		}
+	}
+	return passages
+}
+
+// TopPassages returns the k passages most similar to the query embedding, best first
+func TopPassages(query []float32, passages []domain.Passage, k int) []domain.Passage {
+	scored := make([]domain.Passage, len(passages))
+	copy(scored, passages)
+	for i := range scored {
+		scored[i].Score = CosineSimilarity(query, scored[i].Embedding)
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Score > scored[j].Score
+	})
+
+	if len(scored) > k {
+		scored = scored[:k]
+	}
+	return scored
+}
+
+func CosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// FormatPassages labels each passage [P1], [P2], ... for the model to cite
+func FormatPassages(passages []domain.Passage) string {
+	var text strings.Builder
+	for i, passage := range passages {
+		fmt.Fprintf(&text, "[P%d] %s\n\n", i+1, passage.Content)
+	}
+	return text.String()
+}
+
+// CitedPassages maps the [Pn] labels found in an answer back to the passages' offsets, an answer citing
+// none gets an empty list
+func CitedPassages(answer string, passages []domain.Passage) domain.Citations {
+	seen := make(map[int]bool)
+	citations := domain.Citations{}
+
+	for _, match := range passageCitation.FindAllStringSubmatch(answer, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n < 1 || n > len(passages) || seen[n] {
+			continue
+		}
+		seen[n] = true
+		citations = append(citations, domain.Citation{Label: match[0], Start: passages[n-1].Start, End: passages[n-1].End})
+	}
+	return citations
+}
@@ -0,0 +1,71 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+func TestSplitPassages(t *testing.T) {
+	words := make([]string, 450)
+	for i := range words {
+		words[i] = "word"
+	}
+	text := "  " + strings.Join(words, " ") + "\n"
+
+	passages := service.SplitPassages(1532, text)
+
+	assert.Len(t, passages, 3)
+	for _, passage := range passages {
+		assert.Equal(t, 1532, passage.GutenbergID)
+		assert.Equal(t, text[passage.Start:passage.End], passage.Content)
+	}
+	assert.Equal(t, 2, passages[0].Start)
+	assert.Equal(t, len(text)-1, passages[2].End)
+	assert.Len(t, strings.Fields(passages[0].Content), service.PassageWords)
+}
+
+func TestTopPassages_WithHashEmbedder(t *testing.T) {
+	embedder := engine.NewHashEmbedder(256)
+
+	passages := []domain.Passage{
+		{Start: 0, Content: "The storm rages on the heath while the king wanders"},
+		{Start: 100, Content: "Cordelia refuses to flatter her father and loses her dowry"},
+		{Start: 200, Content: "Gloucester is blinded by Cornwall in his own castle"},
+	}
+	texts := []string{passages[0].Content, passages[1].Content, passages[2].Content}
+
+	embeddings, err := embedder.Embed(texts)
+	assert.NoError(t, err)
+	for i := range passages {
+		passages[i].Embedding = embeddings[i]
+	}
+
+	again, _ := embedder.Embed(texts[:1])
+	assert.Equal(t, embeddings[0], again[0])
+
+	query, _ := embedder.Embed([]string{"Why does Cordelia refuse to flatter her father?"})
+	top := service.TopPassages(query[0], passages, 2)
+
+	assert.Len(t, top, 2)
+	assert.Equal(t, 100, top[0].Start)
+	assert.Greater(t, top[0].Score, top[1].Score)
+}
+
+func TestCitedPassages(t *testing.T) {
+	passages := []domain.Passage{
+		{Start: 0, End: 10},
+		{Start: 10, End: 20},
+	}
+
+	citations := service.CitedPassages("Pride [P2], and again pride [P2]. Not [P9].", passages)
+	assert.Equal(t, domain.Citations{{Label: "[P2]", Start: 10, End: 20}}, citations)
+
+	citations = service.CitedPassages("No citations here.", passages)
+	assert.NotNil(t, citations, "an answer citing nothing is sent as an empty list")
+	assert.Empty(t, citations)
+}
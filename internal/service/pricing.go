@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ModelPrice is what a model charges in US dollars per million tokens
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// Pricing maps model names to their price, calls to models missing from it cost nothing
+type Pricing map[string]ModelPrice
+
+// DefaultPricing is the SambaNova Cloud price list of the models the engines use
+var DefaultPricing = Pricing{
+	"Meta-Llama-3.1-8B-Instruct":   {Prompt: 0.10, Completion: 0.20},
+	"Meta-Llama-3.1-70B-Instruct":  {Prompt: 0.60, Completion: 1.20},
+	"Meta-Llama-3.1-405B-Instruct": {Prompt: 5.00, Completion: 10.00},
+	"Meta-Llama-3.3-70B-Instruct":  {Prompt: 0.60, Completion: 1.20},
+}
+
+// Cost is the price in US dollars of a call to the model
+func (p Pricing) Cost(model string, promptTokens int, completionTokens int) float64 {
+	price, ok := p[model]
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1e6
+}
+
+// With returns a copy of the pricing with the prices of other added or replacing its own
+func (p Pricing) With(other Pricing) Pricing {
+	merged := make(Pricing, len(p)+len(other))
+	for model, price := range p {
+		merged[model] = price
+	}
+	for model, price := range other {
+		merged[model] = price
+	}
+	return merged
+}
+
+// ParsePricing reads prices written as model=prompt/completion, separated by commas, in dollars per million
+// tokens, e.g. "Meta-Llama-3.1-70B-Instruct=0.60/1.20"
+func ParsePricing(spec string) (Pricing, error) {
+	pricing := Pricing{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		model, prices, ok := strings.Cut(item, "=")
+		prompt, completion, ok2 := strings.Cut(prices, "/")
+		if !ok || !ok2 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("invalid price %q, expected model=prompt/completion", item)
+		}
+
+		var price ModelPrice
+		var err error
+		if price.Prompt, err = strconv.ParseFloat(strings.TrimSpace(prompt), 64); err != nil || price.Prompt < 0 {
+			return nil, fmt.Errorf("invalid prompt price %q of %s", prompt, model)
+		}
+		if price.Completion, err = strconv.ParseFloat(strings.TrimSpace(completion), 64); err != nil || price.Completion < 0 {
+			return nil, fmt.Errorf("invalid completion price %q of %s", completion, model)
+		}
+		pricing[strings.TrimSpace(model)] = price
+	}
+	return pricing, nil
+}
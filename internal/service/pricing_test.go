@@ -0,0 +1,43 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+func TestPricing_Cost(t *testing.T) {
+	pricing := service.Pricing{"llama": {Prompt: 2, Completion: 4}}
+
+	assert.InDelta(t, 0.004, pricing.Cost("llama", 1000, 500), 1e-9)
+	assert.Zero(t, pricing.Cost("unknown", 1000, 500), "unknown models are not priced")
+}
+
+func TestParsePricing(t *testing.T) {
+	t.Run("Prices", func(t *testing.T) {
+		pricing, err := service.ParsePricing("llama = 0.60/1.20, tiny=0.1/0.2,")
+		assert.NoError(t, err)
+		assert.Equal(t, service.Pricing{
+			"llama": {Prompt: 0.60, Completion: 1.20},
+			"tiny":  {Prompt: 0.1, Completion: 0.2},
+		}, pricing)
+	})
+
+	t.Run("Override the defaults", func(t *testing.T) {
+		pricing, err := service.ParsePricing("Meta-Llama-3.1-70B-Instruct=1/2")
+		assert.NoError(t, err)
+
+		merged := service.DefaultPricing.With(pricing)
+		assert.Equal(t, service.ModelPrice{Prompt: 1, Completion: 2}, merged["Meta-Llama-3.1-70B-Instruct"])
+		assert.Equal(t, service.DefaultPricing["Meta-Llama-3.1-8B-Instruct"], merged["Meta-Llama-3.1-8B-Instruct"])
+		assert.Equal(t, 0.60, service.DefaultPricing["Meta-Llama-3.1-70B-Instruct"].Prompt, "the defaults are left alone")
+	})
+
+	for _, spec := range []string{"llama", "llama=1", "=1/2", "llama=a/2", "llama=1/-2"} {
+		t.Run("Invalid "+spec, func(t *testing.T) {
+			_, err := service.ParsePricing(spec)
+			assert.Error(t, err)
+		})
+	}
+}
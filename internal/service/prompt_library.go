@@ -0,0 +1,183 @@
+package service
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+)
+
+//go:embed prompts/*.tmpl
+var embeddedPrompts embed.FS
+
+// promptFile matches template files named <name>.v<version>.tmpl
+var promptFile = regexp.MustCompile(`^([a-z_]+)\.v(\d+)\.tmpl$`)
+
+// Prompt is a rendered template along with the name and version it was rendered from
+type Prompt struct {
+	Name    string
+	Version string
+	Text    string
+}
+
+// PromptData is what prompt templates can refer to
+type PromptData struct {
+	Text     string
+	Question string
+	Passages string
+	Schema   string
+	Books    []PromptBook
+}
+
+// PromptBook is one of the books a prompt compares
+type PromptBook struct {
+	Title  string
+	Author string
+	Text   string
+}
+
+// PromptLibrary holds every version of every prompt template
+type PromptLibrary struct {
+	templates map[string]map[int]*template.Template
+}
+
+// NewPromptLibrary loads the embedded prompts, then the ones in dir, which add versions or replace embedded ones
+func NewPromptLibrary(dir string) (*PromptLibrary, error) {
+	library := &PromptLibrary{templates: make(map[string]map[int]*template.Template)}
+
+	embedded, err := fs.Sub(embeddedPrompts, "prompts")
+	if err != nil {
+		return nil, err
+	}
+	if err := library.load(embedded); err != nil {
+		return nil, fmt.Errorf("failed to load embedded prompts: %w", err)
+	}
+
+	if dir != "" {
+		if err := library.load(os.DirFS(dir)); err != nil {
+			return nil, fmt.Errorf("failed to load prompts from %s: %w", dir, err)
+		}
+	}
+
+	return library, nil
+}
+
+var (
+	defaultPrompts     *PromptLibrary
+	defaultPromptsOnce sync.Once
+)
+
+// DefaultPrompts returns the embedded prompts, which are known to parse
+func DefaultPrompts() *PromptLibrary {
+	defaultPromptsOnce.Do(func() {
+		library, err := NewPromptLibrary("")
+		if err != nil {
+			panic(err)
+		}
+		defaultPrompts = library
+	})
+	return defaultPrompts
+}
+
+func (l *PromptLibrary) load(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		match := promptFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return err
+		}
+
+		tmpl, err := template.New(entry.Name()).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return err
+		}
+
+		name := match[1]
+		version, _ := strconv.Atoi(match[2])
+		if l.templates[name] == nil {
+			l.templates[name] = make(map[int]*template.Template)
+		}
+		l.templates[name][version] = tmpl
+	}
+
+	return nil
+}
+
+// Versions lists the versions of a prompt, oldest first
+func (l *PromptLibrary) Versions(name string) []string {
+	numbers := make([]int, 0, len(l.templates[name]))
+	for version := range l.templates[name] {
+		numbers = append(numbers, version)
+	}
+	sort.Ints(numbers)
+
+	versions := make([]string, len(numbers))
+	for i, version := range numbers {
+		versions[i] = fmt.Sprintf("v%d", version)
+	}
+	return versions
+}
+
+// Has reports whether a prompt exists with the given version, or in any version when version is empty
+func (l *PromptLibrary) Has(name, version string) bool {
+	_, _, err := l.lookup(name, version)
+	return err == nil
+}
+
+// Render executes a prompt, using its latest version when version is empty
+func (l *PromptLibrary) Render(name, version string, data PromptData) (*Prompt, error) {
+	tmpl, number, err := l.lookup(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	var text bytes.Buffer
+	if err := tmpl.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("failed to render prompt %s: %w", name, err)
+	}
+
+	return &Prompt{Name: name, Version: fmt.Sprintf("v%d", number), Text: text.String()}, nil
+}
+
+func (l *PromptLibrary) lookup(name, version string) (*template.Template, int, error) {
+	versions, ok := l.templates[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown prompt %q", name)
+	}
+
+	if version == "" {
+		latest := -1
+		for number := range versions {
+			if number > latest {
+				latest = number
+			}
+		}
+		return versions[latest], latest, nil
+	}
+
+	number, err := strconv.Atoi(version[1:])
+	if version[0] != 'v' || err != nil {
+		return nil, 0, fmt.Errorf("invalid prompt version %q", version)
+	}
+
+	tmpl, ok := versions[number]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown version %s of prompt %q", version, name)
+	}
+	return tmpl, number, nil
+}
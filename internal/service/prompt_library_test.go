@@ -0,0 +1,65 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+func TestPromptLibrary_Embedded(t *testing.T) {
+	library, err := service.NewPromptLibrary("")
+	assert.NoError(t, err)
+
+	for _, kind := range service.AnalysisCatalog {
+		assert.NotEmpty(t, library.Versions(kind.Name), kind.Name)
+	}
+
+	prompt, err := library.Render("themes", "", service.PromptData{Text: "Blow, winds, and crack your cheeks!", Schema: `{"required": ["themes"]}`})
+	assert.NoError(t, err)
+	assert.Equal(t, "themes", prompt.Name)
+	assert.Equal(t, "v2", prompt.Version)
+	assert.Contains(t, prompt.Text, "Blow, winds, and crack your cheeks!")
+	assert.Contains(t, prompt.Text, `{"required": ["themes"]}`)
+}
+
+func TestPromptLibrary_DirectoryOverride(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "themes.v2.tmpl"), []byte("Themes of: {{.Text}}"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "summary.v1.tmpl"), []byte("Summary of: {{.Text}}"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("ignored"), 0o644))
+
+	library, err := service.NewPromptLibrary(dir)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"v1", "v2"}, library.Versions("themes"))
+
+	latest, err := library.Render("themes", "", service.PromptData{Text: "Lear"})
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", latest.Version)
+	assert.Equal(t, "Themes of: Lear", latest.Text)
+
+	pinned, err := library.Render("themes", "v1", service.PromptData{Text: "Lear"})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", pinned.Version)
+	assert.NotEqual(t, latest.Text, pinned.Text)
+
+	replaced, err := library.Render("summary", "v1", service.PromptData{Text: "Lear"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Summary of: Lear", replaced.Text)
+
+	_, err = library.Render("themes", "v3", service.PromptData{})
+	assert.Error(t, err)
+	_, err = library.Render("unknown", "", service.PromptData{})
+	assert.Error(t, err)
+}
+
+func TestPromptLibrary_InvalidTemplate(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "themes.v2.tmpl"), []byte("{{.Text"), 0o644))
+
+	_, err := service.NewPromptLibrary(dir)
+	assert.Error(t, err)
+}
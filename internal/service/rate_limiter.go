@@ -0,0 +1,79 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimiterKeys is how many buckets are kept before the full ones are dropped, a full bucket is the same
+// as a missing one
+const maxRateLimiterKeys = 10000
+
+// RateLimiter is a token bucket per key, such as a user or an address. Each bucket holds up to Burst calls
+// and refills at PerMinute calls a minute.
+type RateLimiter struct {
+	PerMinute int
+	Burst     int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(perMinute int, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{PerMinute: perMinute, Burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a call from the key's bucket, or returns how long until the next one is available
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.PerMinute <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(l.PerMinute) / float64(time.Minute)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimiterKeys {
+			l.prune(now, rate)
+		}
+		bucket = &tokenBucket{tokens: float64(l.Burst), updated: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.refill(now, rate, float64(l.Burst))
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate)
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst float64) {
+	b.tokens += float64(now.Sub(b.updated)) * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+}
+
+func (l *RateLimiter) prune(now time.Time, rate float64) {
+	for key, bucket := range l.buckets {
+		bucket.refill(now, rate, float64(l.Burst))
+		if bucket.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
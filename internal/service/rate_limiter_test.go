@@ -0,0 +1,28 @@
+package service_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := service.NewRateLimiter(60, 2)
+
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.Allow("user-1")
+		assert.True(t, ok, "the burst is allowed at once")
+	}
+
+	ok, retryAfter := limiter.Allow("user-1")
+	assert.False(t, ok)
+	assert.InDelta(t, float64(time.Second), float64(retryAfter), float64(100*time.Millisecond), "one call a second")
+
+	ok, _ = limiter.Allow("user-2")
+	assert.True(t, ok, "every key has its own bucket")
+
+	ok, _ = service.NewRateLimiter(0, 0).Allow("user-1")
+	assert.True(t, ok, "a rate of 0 disables the limit")
+}
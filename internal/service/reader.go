@@ -0,0 +1,110 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+const (
+	DefaultPageSize = 8000
+	MinPageSize     = 1000
+	MaxPageSize     = 100000
+
+	// minSectionBytes keeps headings that follow each other, like an act and its first scene or a table of
+	// contents, on one page
+	minSectionBytes = 300
+)
+
+// sectionHeading matches the lines that open a section: acts, scenes, chapters, books, parts, cantos and staves
+// numbered in roman or arabic numerals, and prologues and epilogues
+var sectionHeading = regexp.MustCompile(`(?m)^[ \t]*(?:(?:ACT|SCENE|CHAPTER|BOOK|PART|CANTO|STAVE|Chapter|Book|Part)[ \t]+[IVXLCDM\d]+\b[^\n]{0,60}|PROLOGUE|EPILOGUE)[ \t]*\r?$`)
+
+// Paginate cuts the text into pages of about pageSize bytes ending at line ends, or by section, falling back to
+// pages of pageSize bytes when the text has no section headings
+func Paginate(text string, mode string, pageSize int) []domain.PageRef {
+	if mode == domain.PageBySection {
+		if pages := paginateBySection(text); len(pages) > 1 {
+			return pages
+		}
+	}
+	return paginateBySize(text, pageSize)
+}
+
+// PageAt returns the number of the page holding the byte offset, the last page for offsets past the end
+func PageAt(pages []domain.PageRef, offset int) int {
+	for _, page := range pages {
+		if offset < page.End {
+			return page.Number
+		}
+	}
+	return len(pages)
+}
+
+func paginateBySize(text string, pageSize int) []domain.PageRef {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	pages := appendPages(nil, text, 0, len(text), pageSize, "")
+	if pages == nil {
+		pages = []domain.PageRef{{Number: 1}}
+	}
+	return pages
+}
+
+// appendPages cuts the text from start to end into pages of about pageSize bytes ending at line ends, numbered
+// after the pages they are appended to
+func appendPages(pages []domain.PageRef, text string, start, end, pageSize int, title string) []domain.PageRef {
+	for start < end {
+		cut := start + pageSize
+		if cut >= end {
+			cut = end
+		} else if newline := strings.IndexByte(text[cut:end], '\n'); newline >= 0 {
+			cut += newline + 1
+		} else {
+			cut = end
+		}
+
+		pages = append(pages, domain.PageRef{Number: len(pages) + 1, Title: title, Start: start, End: cut})
+		start = cut
+	}
+	return pages
+}
+
+// paginateBySection starts a page at every section heading, cutting a section longer than MaxPageSize into
+// pages of that size that keep its title
+func paginateBySection(text string) []domain.PageRef {
+	headings := sectionHeading.FindAllStringIndex(text, -1)
+	if len(headings) == 0 {
+		return nil
+	}
+
+	var sections []domain.PageRef
+	if headings[0][0] > 0 {
+		sections = append(sections, domain.PageRef{Start: 0, End: headings[0][0]})
+	}
+
+	for i, heading := range headings {
+		end := len(text)
+		if i+1 < len(headings) {
+			end = headings[i+1][0]
+		}
+
+		// A short section joins the one it belongs to instead of making a page of its own
+		if last := len(sections) - 1; last >= 0 && sections[last].Title != "" && sections[last].End-sections[last].Start < minSectionBytes {
+			sections[last].End = end
+			continue
+		}
+
+		title := strings.TrimSpace(text[heading[0]:heading[1]])
+		sections = append(sections, domain.PageRef{Title: title, Start: heading[0], End: end})
+	}
+
+	var pages []domain.PageRef
+	for _, section := range sections {
+		pages = appendPages(pages, text, section.Start, section.End, MaxPageSize, section.Title)
+	}
+	return pages
+}
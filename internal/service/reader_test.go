@@ -0,0 +1,75 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+func TestPaginate_BySize(t *testing.T) {
+	text := strings.Repeat("Nothing will come of nothing.\n", 100)
+
+	pages := service.Paginate(text, domain.PageBySize, 1000)
+
+	assert.Len(t, pages, 3)
+	assert.Equal(t, 0, pages[0].Start)
+	assert.Equal(t, 1020, pages[0].End, "pages end at the end of a line")
+	assert.Equal(t, pages[0].End, pages[1].Start)
+	assert.Equal(t, len(text), pages[2].End)
+	assert.Equal(t, 3, pages[2].Number)
+
+	assert.Equal(t, []domain.PageRef{{Number: 1}}, service.Paginate("", domain.PageBySize, 1000), "an empty text has one empty page")
+}
+
+func TestPaginate_BySection(t *testing.T) {
+	scene := strings.Repeat("LEAR. Speak.\n", 30)
+	text := "The Tragedy of King Lear\n\n" +
+		"ACT I.\n\n" +
+		"SCENE I. A Room of State in King Lear's Palace.\n\n" + scene +
+		"SCENE II. A Hall in the Earl of Gloucester's Castle.\n\n" + scene +
+		"ACT II.\n\nSCENE I. A court within the Castle of the Earl of Gloucester.\n\n" + scene
+
+	pages := service.Paginate(text, domain.PageBySection, 1000)
+
+	assert.Len(t, pages, 4)
+	assert.Equal(t, "", pages[0].Title, "the text before the first heading")
+	assert.Equal(t, "ACT I.", pages[1].Title, "an act heading is kept with its first scene")
+	assert.Contains(t, text[pages[1].Start:pages[1].End], "SCENE I. A Room of State")
+	assert.Equal(t, "SCENE II. A Hall in the Earl of Gloucester's Castle.", pages[2].Title)
+	assert.Equal(t, "ACT II.", pages[3].Title)
+	assert.Equal(t, len(text), pages[3].End)
+
+	noSections := strings.Repeat("Nothing will come of nothing.\n", 100)
+	assert.Len(t, service.Paginate(noSections, domain.PageBySection, 1000), 3, "falls back to pages by size")
+}
+
+func TestPaginate_LongSection(t *testing.T) {
+	line := "Blow, winds, and crack your cheeks! Rage, blow!\n"
+	chapter := strings.Repeat(line, 2*service.MaxPageSize/len(line)+10)
+	text := "CHAPTER I.\n\n" + chapter + "CHAPTER II.\n\n" + strings.Repeat(line, 10)
+
+	pages := service.Paginate(text, domain.PageBySection, 1000)
+
+	assert.Len(t, pages, 4, "the first chapter is cut in three")
+	for i, page := range pages[:3] {
+		assert.Equal(t, "CHAPTER I.", page.Title)
+		assert.Equal(t, i+1, page.Number)
+		assert.LessOrEqual(t, page.End-page.Start, service.MaxPageSize+len(line))
+		assert.True(t, strings.HasSuffix(text[page.Start:page.End], "\n"), "pages end at line ends")
+	}
+	assert.Equal(t, pages[0].End, pages[1].Start)
+	assert.Equal(t, "CHAPTER II.", pages[3].Title)
+	assert.Equal(t, 4, pages[3].Number)
+	assert.Equal(t, len(text), pages[3].End)
+}
+
+func TestPageAt(t *testing.T) {
+	pages := []domain.PageRef{{Number: 1, Start: 0, End: 10}, {Number: 2, Start: 10, End: 20}}
+
+	assert.Equal(t, 1, service.PageAt(pages, 0))
+	assert.Equal(t, 2, service.PageAt(pages, 10))
+	assert.Equal(t, 2, service.PageAt(pages, 500))
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+const (
+	DefaultSentimentSegments = 20
+	MaxSentimentSegments     = 100
+
+	// neutralBand is the score range labeled neutral
+	neutralBand = 0.1
+	// maxLexiconScore is the magnitude of the strongest lexicon words
+	maxLexiconScore = 3
+)
+
+//go:embed lexicon/sentiment.txt
+var sentimentLexicon string
+
+// negations flip the score of the word that follows them
+var negations = map[string]bool{"not": true, "no": true, "never": true, "nor": true, "nothing": true, "cannot": true}
+
+type ISentimentService interface {
+	Segments(text string, segments int) []domain.SentimentPoint
+	LexiconArc(gutenbergID int, text string, segments int) *domain.SentimentArc
+}
+
+// SentimentService scores the sentiment of a text locally with a word lexicon
+type SentimentService struct {
+	Lexicon map[string]float64
+}
+
+func NewSentimentService() *SentimentService {
+	return &SentimentService{Lexicon: ParseLexicon(sentimentLexicon)}
+}
+
+// ParseLexicon reads "word score" lines, skipping blank lines and # comments
+func ParseLexicon(content string) map[string]float64 {
+	lexicon := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		score, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		lexicon[strings.ToLower(fields[0])] = score
+	}
+	return lexicon
+}
+
+// Segments cuts the text into the given number of segments with about as many words each, unscored
+func (s *SentimentService) Segments(text string, segments int) []domain.SentimentPoint {
+	words := wordPattern.FindAllStringIndex(text, -1)
+	if len(words) == 0 || segments <= 0 {
+		return []domain.SentimentPoint{}
+	}
+	if segments > len(words) {
+		segments = len(words)
+	}
+
+	points := make([]domain.SentimentPoint, segments)
+	for i := range points {
+		first := i * len(words) / segments
+		last := (i+1)*len(words)/segments - 1
+		points[i] = domain.SentimentPoint{Segment: i + 1, Start: words[first][0], End: words[last][1]}
+	}
+	return points
+}
+
+// LexiconArc scores each segment by the mean lexicon score of its sentiment words, scaled to [-1, 1]
+func (s *SentimentService) LexiconArc(gutenbergID int, text string, segments int) *domain.SentimentArc {
+	points := s.Segments(text, segments)
+	for i := range points {
+		points[i].Score = round(s.score(text[points[i].Start:points[i].End]), 4)
+		points[i].Label = SentimentLabel(points[i].Score)
+	}
+	return &domain.SentimentArc{GutenbergID: gutenbergID, Method: domain.SentimentLexicon, Points: points}
+}
+
+func (s *SentimentService) score(text string) float64 {
+	total, matched := 0.0, 0
+	negated := false
+	for _, word := range statsWordPattern.FindAllString(text, -1) {
+		word = strings.ToLower(word)
+		if negations[word] || strings.HasSuffix(word, "n't") {
+			negated = true
+			continue
+		}
+
+		if score, ok := s.Lexicon[word]; ok {
+			if negated {
+				score = -score
+			}
+			total += score
+			matched++
+		}
+		negated = false
+	}
+
+	if matched == 0 {
+		return 0
+	}
+	return total / float64(matched) / maxLexiconScore
+}
+
+// SentimentLabel names the polarity of a score
+func SentimentLabel(score float64) string {
+	switch {
+	case score > neutralBand:
+		return "positive"
+	case score < -neutralBand:
+		return "negative"
+	default:
+		return "neutral"
+	}
+}
+
+// ParseSegmentSentiment reads the score and label the model gave a segment, clamping the score to [-1, 1]
+func ParseSegmentSentiment(content string) (float64, string, bool) {
+	object, ok := extractJSONObject(content)
+	if !ok {
+		return 0, "", false
+	}
+
+	var result struct {
+		Score *float64 `json:"score"`
+		Label string   `json:"label"`
+	}
+	if err := json.Unmarshal([]byte(object), &result); err != nil || result.Score == nil {
+		return 0, "", false
+	}
+
+	score := math.Max(-1, math.Min(1, *result.Score))
+	label := strings.ToLower(strings.TrimSpace(result.Label))
+	if label == "" {
+		label = SentimentLabel(score)
+	}
+	return score, label, true
+}
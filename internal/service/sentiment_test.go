@@ -0,0 +1,67 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+func TestSentiment_Segments(t *testing.T) {
+	sentiment := service.NewSentimentService()
+
+	text := "one two three four five six seven"
+	points := sentiment.Segments(text, 3)
+
+	assert.Len(t, points, 3)
+	assert.Equal(t, "one two", text[points[0].Start:points[0].End])
+	assert.Equal(t, "three four", text[points[1].Start:points[1].End])
+	assert.Equal(t, "five six seven", text[points[2].Start:points[2].End])
+
+	assert.Len(t, sentiment.Segments("too short", 5), 2, "a segment has at least one word")
+	assert.Empty(t, sentiment.Segments("", 5))
+}
+
+func TestSentiment_LexiconArc(t *testing.T) {
+	sentiment := service.NewSentimentService()
+
+	text := "Joy and love, a happy wedding. " +
+		"The weather was mild that day. " +
+		"Grief, murder and despair, a wretched end."
+	arc := sentiment.LexiconArc(1128, text, 3)
+
+	assert.Equal(t, domain.SentimentLexicon, arc.Method)
+	assert.Len(t, arc.Points, 3)
+	assert.Equal(t, "positive", arc.Points[0].Label)
+	assert.Equal(t, 1.0, arc.Points[0].Score)
+	assert.Equal(t, "neutral", arc.Points[1].Label)
+	assert.Equal(t, 0.0, arc.Points[1].Score)
+	assert.Equal(t, "negative", arc.Points[2].Label)
+	assert.Equal(t, -1.0, arc.Points[2].Score)
+}
+
+func TestSentiment_Negation(t *testing.T) {
+	sentiment := &service.SentimentService{Lexicon: service.ParseLexicon("# test\ngood 3\nbad -3\n")}
+
+	arc := sentiment.LexiconArc(1, "not good", 1)
+	assert.Equal(t, -1.0, arc.Points[0].Score)
+
+	arc = sentiment.LexiconArc(1, "It isn't bad, no doubt good", 1)
+	assert.Equal(t, 1.0, arc.Points[0].Score, "a negation only flips the next word")
+}
+
+func TestParseSegmentSentiment(t *testing.T) {
+	score, label, ok := service.ParseSegmentSentiment("```json\n{\"score\": -0.6, \"label\": \"Grief\"}\n```")
+	assert.True(t, ok)
+	assert.Equal(t, -0.6, score)
+	assert.Equal(t, "grief", label)
+
+	score, label, ok = service.ParseSegmentSentiment(`{"score": 4}`)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, score)
+	assert.Equal(t, "positive", label)
+
+	_, _, ok = service.ParseSegmentSentiment(`{"label": "calm"}`)
+	assert.False(t, ok)
+}
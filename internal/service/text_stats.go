@@ -0,0 +1,165 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+const (
+	DefaultWordsPerMinute = 238
+	DefaultTopWords       = 20
+)
+
+var (
+	statsWordPattern   = regexp.MustCompile(`[A-Za-z]+(?:'[A-Za-z]+)*`)
+	sentenceEndPattern = regexp.MustCompile(`[.!?]+`)
+	vowelGroupPattern  = regexp.MustCompile(`[aeiouy]+`)
+)
+
+// stopWords are left out of the most frequent words, they would otherwise fill the list in every book
+var stopWords = map[string]bool{
+	"a": true, "about": true, "after": true, "all": true, "am": true, "an": true, "and": true, "any": true,
+	"are": true, "as": true, "at": true, "be": true, "been": true, "but": true, "by": true, "can": true,
+	"did": true, "do": true, "for": true, "from": true, "had": true, "has": true, "have": true, "he": true,
+	"her": true, "him": true, "his": true, "i": true, "if": true, "in": true, "into": true, "is": true,
+	"it": true, "its": true, "me": true, "more": true, "my": true, "no": true, "not": true, "now": true,
+	"o": true, "of": true, "on": true, "one": true, "or": true, "our": true, "out": true, "shall": true,
+	"she": true, "so": true, "than": true, "that": true, "the": true, "thee": true, "their": true, "them": true,
+	"then": true, "there": true, "they": true, "this": true, "thou": true, "thy": true, "to": true, "up": true,
+	"upon": true, "us": true, "was": true, "we": true, "were": true, "what": true, "when": true, "which": true,
+	"who": true, "will": true, "with": true, "would": true, "ye": true, "you": true, "your": true,
+}
+
+type ITextStatsService interface {
+	Compute(gutenbergID int, text string) *domain.TextStats
+	ComputeReader(gutenbergID int, r io.Reader) (*domain.TextStats, error)
+}
+
+// TextStatsService computes text statistics without calling any AI engine
+type TextStatsService struct {
+	WordsPerMinute int
+	TopWords       int
+}
+
+func NewTextStatsService() *TextStatsService {
+	return &TextStatsService{WordsPerMinute: DefaultWordsPerMinute, TopWords: DefaultTopWords}
+}
+
+// Compute counts words, sentences and syllables of the text and derives its readability from them
+func (s *TextStatsService) Compute(gutenbergID int, text string) *domain.TextStats {
+	stats, _ := s.ComputeReader(gutenbergID, strings.NewReader(text))
+	return stats
+}
+
+// ComputeReader computes the statistics of a text read line by line, so a book is never held in memory whole.
+// Neither a word nor a sentence terminator spans a line break, the counts are those of the whole text.
+func (s *TextStatsService) ComputeReader(gutenbergID int, r io.Reader) (*domain.TextStats, error) {
+	stats := &domain.TextStats{GutenbergID: gutenbergID, TopWords: []domain.WordCount{}}
+
+	counts := make(map[string]int)
+	syllables := 0
+	// terminated tells whether a terminator follows the last word read so far
+	terminated := false
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		words := statsWordPattern.FindAllStringIndex(line, -1)
+		for _, word := range words {
+			lower := strings.ToLower(line[word[0]:word[1]])
+			counts[lower]++
+			syllables += countSyllables(lower)
+		}
+		stats.Words += len(words)
+		stats.Sentences += len(sentenceEndPattern.FindAllStringIndex(line, -1))
+
+		if len(words) > 0 {
+			terminated = sentenceEndPattern.MatchString(line[words[len(words)-1][1]:])
+		} else if sentenceEndPattern.MatchString(line) {
+			terminated = true
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if stats.Words == 0 {
+		stats.Sentences = 0
+		return stats, nil
+	}
+
+	stats.UniqueWords = len(counts)
+	stats.VocabularyRatio = round(float64(stats.UniqueWords)/float64(stats.Words), 4)
+
+	// Text after the last terminator still counts as a sentence
+	if !terminated {
+		stats.Sentences++
+	}
+
+	wordsPerSentence := float64(stats.Words) / float64(stats.Sentences)
+	syllablesPerWord := float64(syllables) / float64(stats.Words)
+	stats.AvgSentenceLength = round(wordsPerSentence, 2)
+	stats.AvgWordSyllables = round(syllablesPerWord, 2)
+	stats.FleschScore = round(206.835-1.015*wordsPerSentence-84.6*syllablesPerWord, 2)
+
+	wordsPerMinute := s.WordsPerMinute
+	if wordsPerMinute <= 0 {
+		wordsPerMinute = DefaultWordsPerMinute
+	}
+	stats.ReadingMinutes = int(math.Ceil(float64(stats.Words) / float64(wordsPerMinute)))
+
+	stats.TopWords = topWords(counts, s.TopWords)
+	return stats, nil
+}
+
+// topWords returns the n most frequent words that are not stop words, ties in alphabetical order
+func topWords(counts map[string]int, n int) []domain.WordCount {
+	frequent := make([]domain.WordCount, 0, len(counts))
+	for word, count := range counts {
+		if !stopWords[word] {
+			frequent = append(frequent, domain.WordCount{Word: word, Count: count})
+		}
+	}
+
+	sort.Slice(frequent, func(i, j int) bool {
+		if frequent[i].Count != frequent[j].Count {
+			return frequent[i].Count > frequent[j].Count
+		}
+		return frequent[i].Word < frequent[j].Word
+	})
+
+	if n > 0 && len(frequent) > n {
+		frequent = frequent[:n]
+	}
+	return frequent
+}
+
+// countSyllables estimates the syllables of a lowercase word by its vowel groups, ignoring a silent final e
+func countSyllables(word string) int {
+	word = strings.ReplaceAll(word, "'", "")
+	syllables := len(vowelGroupPattern.FindAllString(word, -1))
+	if strings.HasSuffix(word, "e") && !strings.HasSuffix(word, "le") && syllables > 1 {
+		syllables--
+	}
+	if syllables == 0 {
+		return 1
+	}
+	return syllables
+}
+
+func round(value float64, places int) float64 {
+	factor := math.Pow(10, float64(places))
+	return math.Round(value*factor) / factor
+}
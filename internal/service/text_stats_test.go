@@ -0,0 +1,63 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+func TestTextStats_Compute(t *testing.T) {
+	stats := service.NewTextStatsService()
+
+	text := "Blow, winds, and crack your cheeks! Rage! Blow! You cataracts and hurricanoes, spout"
+	result := stats.Compute(2266, text)
+
+	assert.Equal(t, 2266, result.GutenbergID)
+	assert.Equal(t, 13, result.Words)
+	assert.Equal(t, 11, result.UniqueWords)
+	assert.Equal(t, 0.8462, result.VocabularyRatio)
+	assert.Equal(t, 4, result.Sentences, "the unterminated last sentence counts")
+	assert.Equal(t, 3.25, result.AvgSentenceLength)
+	assert.Equal(t, 1, result.ReadingMinutes)
+	assert.Equal(t, domain.WordCount{Word: "blow", Count: 2}, result.TopWords[0])
+	for _, word := range result.TopWords {
+		assert.NotContains(t, []string{"and", "you", "your"}, word.Word, "stop words are left out")
+	}
+}
+
+func TestTextStats_Flesch(t *testing.T) {
+	stats := service.NewTextStatsService()
+
+	simple := stats.Compute(1, "The cat sat on the mat. The dog ran to the cat.")
+	complex := stats.Compute(2, "Unquestionably, philosophical considerations notwithstanding, extraordinary circumstances necessitate reconsideration.")
+
+	assert.Greater(t, simple.FleschScore, 90.0)
+	assert.Less(t, complex.FleschScore, 0.0)
+	assert.Equal(t, 1.0, simple.AvgWordSyllables)
+}
+
+func TestTextStats_Empty(t *testing.T) {
+	stats := service.NewTextStatsService()
+
+	result := stats.Compute(1, "  \n ")
+	assert.Equal(t, 0, result.Words)
+	assert.Equal(t, 0, result.Sentences)
+	assert.Empty(t, result.TopWords)
+}
+
+func TestTextStats_ComputeReader(t *testing.T) {
+	stats := service.NewTextStatsService()
+
+	text := "Blow, winds, and crack\nyour cheeks! Rage! Blow!\n\n" + strings.Repeat("You cataracts ", 1000) + "\nand hurricanoes, spout"
+	result, err := stats.ComputeReader(2266, strings.NewReader(text))
+	assert.NoError(t, err)
+	assert.Equal(t, 2011, result.Words)
+	assert.Equal(t, 4, result.Sentences, "the unterminated last sentence counts")
+
+	terminated, err := stats.ComputeReader(2266, strings.NewReader("Rage! Blow\n!\n\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, terminated.Sentences, "a terminator on a later line ends the last sentence")
+}
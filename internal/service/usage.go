@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+
+	"github.com/yuriadams/lear/internal/domain"
+)
+
+// Caller is who a call to the AI engine is made for, UserID is 0 for anonymous calls
+type Caller struct {
+	UserID int
+	IP     string
+}
+
+type callerKey struct{}
+
+type bookKey struct{}
+
+type callCheckKey struct{}
+
+// WithCaller tells the analyses run with the context who they are for, which their usage is recorded under
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func CallerFrom(ctx context.Context) Caller {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	return caller
+}
+
+// WithBook tells the analyses run with the context which book they are about, for their usage records
+func WithBook(ctx context.Context, gutenbergID int) context.Context {
+	return context.WithValue(ctx, bookKey{}, gutenbergID)
+}
+
+// BookFrom is the book of WithBook, or 0
+func BookFrom(ctx context.Context) int {
+	gutenbergID, _ := ctx.Value(bookKey{}).(int)
+	return gutenbergID
+}
+
+// WithCallCheck has the usecases that call the AI engine several times for one request run check before every
+// call after the first, which the request was allowed, so that a caller over their limits is stopped midway
+func WithCallCheck(ctx context.Context, check func() error) context.Context {
+	return context.WithValue(ctx, callCheckKey{}, check)
+}
+
+// CheckCall runs the check of WithCallCheck, allowing the call when there is none
+func CheckCall(ctx context.Context) error {
+	if check, ok := ctx.Value(callCheckKey{}).(func() error); ok {
+		return check()
+	}
+	return nil
+}
+
+// UsageRecorder receives the usage of every call to the AI engine
+type UsageRecorder interface {
+	RecordUsage(usage *domain.Usage)
+}
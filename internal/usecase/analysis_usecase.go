@@ -0,0 +1,77 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+type IAnalysisUsecase interface {
+	Analyze(ctx context.Context, events service.EventSender, userID int, book *domain.Book, kind string, version string) error
+	AnswerQuestion(ctx context.Context, events service.EventSender, book *domain.Book, question string) error
+	FetchAnalyses(gutenbergID int, kind string) ([]domain.Analysis, error)
+	Kinds() []service.AnalysisKind
+	HasPromptVersion(kind string, version string) bool
+}
+
+type AnalysisUsecase struct {
+	Repo    repository.IAnalysisRepository
+	Service service.IAnalysisService
+	Logger  *service.Logger
+}
+
+func NewAnalysisUsecase(repo repository.IAnalysisRepository, analysis service.IAnalysisService) *AnalysisUsecase {
+	return &AnalysisUsecase{Repo: repo, Service: analysis, Logger: service.NewLogger("[AnalysisUsecase]")}
+}
+
+// Analyze streams an analysis of the book and stores the result along with the prompt version used, the engine
+// that served it and the user who asked for it
+func (u *AnalysisUsecase) Analyze(ctx context.Context, events service.EventSender, userID int, book *domain.Book, kind string, version string) error {
+	u.Logger.SetTags(fmt.Sprintf("[book-%d]", book.GutenbergID))
+
+	completion, err := u.Service.StreamTextAnalysis(service.WithBook(ctx, book.GutenbergID), events, book.Content, kind, version)
+	if err != nil {
+		return err
+	}
+
+	analysis := &domain.Analysis{
+		GutenbergID:   book.GutenbergID,
+		UserID:        userID,
+		Kind:          completion.PromptName,
+		PromptVersion: completion.PromptVersion,
+		Engine:        completion.Engine,
+		Model:         completion.Model,
+		Content:       completion.Content,
+	}
+
+	if err := u.Repo.SaveAnalysis(analysis); err != nil {
+		u.Logger.LogError("Failed to save analysis", err)
+		return err
+	}
+
+	u.Logger.LogInfo(fmt.Sprintf("Analysis %s saved with prompt %s, served by %s %s", analysis.Kind, analysis.PromptVersion, analysis.Engine, analysis.Model))
+	return nil
+}
+
+// AnswerQuestion streams a one-off answer that is not stored
+func (u *AnalysisUsecase) AnswerQuestion(ctx context.Context, events service.EventSender, book *domain.Book, question string) error {
+	_, err := u.Service.AnswerQuestion(service.WithBook(ctx, book.GutenbergID), events, book.Content, question)
+	return err
+}
+
+func (u *AnalysisUsecase) FetchAnalyses(gutenbergID int, kind string) ([]domain.Analysis, error) {
+	return u.Repo.GetAnalyses(gutenbergID, kind)
+}
+
+// Kinds lists the analyses a book can be run through
+func (u *AnalysisUsecase) Kinds() []service.AnalysisKind {
+	return u.Service.Catalog()
+}
+
+// HasPromptVersion reports whether the analysis has a prompt of the version, an empty version is the latest
+func (u *AnalysisUsecase) HasPromptVersion(kind string, version string) bool {
+	return u.Service.HasPrompt(kind, version)
+}
@@ -0,0 +1,169 @@
+package usecase
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SessionTTL        = 30 * 24 * time.Hour
+	MinPasswordLength = 8
+	// MaxPasswordLength is the most bcrypt hashes, longer passwords would be cut silently
+	MaxPasswordLength = 72
+
+	// APITokenPrefix marks API tokens, so a leaked one is easy to recognize
+	APITokenPrefix = "lear_"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidUsername    = errors.New("username must be 3 to 64 letters, digits, dots, dashes or underscores")
+	ErrInvalidPassword    = fmt.Errorf("password must be %d to %d bytes long", MinPasswordLength, MaxPasswordLength)
+	ErrUsernameTaken      = repository.ErrUsernameTaken
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,64}$`)
+
+// dummyPasswordHash is compared against when a username is unknown, so a login takes as long either way
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("lear-dummy-password"), bcrypt.DefaultCost)
+
+type IAuthUsecase interface {
+	Register(username string, password string) (*domain.User, error)
+	Login(username string, password string) (*domain.User, string, error)
+	Logout(session string) error
+	SessionUser(session string) (*domain.User, error)
+	TokenUser(token string) (*domain.User, error)
+	CreateToken(userID int, name string) (*domain.APIToken, string, error)
+	Tokens(userID int) ([]domain.APIToken, error)
+	RevokeToken(userID int, id int) (bool, error)
+}
+
+// AuthUsecase manages local accounts with bcrypt hashed passwords. Sessions and API tokens are random secrets
+// given to the client once, only their SHA-256 is stored.
+type AuthUsecase struct {
+	Repo   repository.IUserRepository
+	Logger *service.Logger
+}
+
+func NewAuthUsecase(repo repository.IUserRepository) *AuthUsecase {
+	return &AuthUsecase{Repo: repo, Logger: service.NewLogger("[AuthUsecase]")}
+}
+
+func (u *AuthUsecase) Register(username string, password string) (*domain.User, error) {
+	username = strings.TrimSpace(username)
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return nil, ErrInvalidPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &domain.User{Username: username, PasswordHash: string(hash)}
+	if err := u.Repo.CreateUser(user); err != nil {
+		if !errors.Is(err, ErrUsernameTaken) {
+			u.Logger.LogError("Failed to create user", err)
+		}
+		return nil, err
+	}
+
+	u.Logger.LogInfo(fmt.Sprintf("User %d registered", user.ID))
+	return user, nil
+}
+
+// Login checks the password and opens a session, returning the secret to keep in the session cookie
+func (u *AuthUsecase) Login(username string, password string) (*domain.User, string, error) {
+	user, err := u.Repo.GetUserByUsername(strings.TrimSpace(username))
+	if err != nil {
+		u.Logger.LogError("Failed to fetch user", err)
+		return nil, "", err
+	}
+
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, "", ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, "", ErrInvalidCredentials
+	}
+
+	session := newSecret("")
+	if err := u.Repo.CreateSession(hashSecret(session), user.ID, SessionTTL); err != nil {
+		u.Logger.LogError("Failed to create session", err)
+		return nil, "", err
+	}
+
+	return user, session, nil
+}
+
+func (u *AuthUsecase) Logout(session string) error {
+	return u.Repo.DeleteSession(hashSecret(session))
+}
+
+// SessionUser returns the user signed in with the session, or nil when it is unknown or expired
+func (u *AuthUsecase) SessionUser(session string) (*domain.User, error) {
+	if session == "" {
+		return nil, nil
+	}
+	return u.Repo.GetSessionUser(hashSecret(session))
+}
+
+// TokenUser returns the user of the API token, or nil when it is unknown or revoked
+func (u *AuthUsecase) TokenUser(token string) (*domain.User, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, nil
+	}
+	return u.Repo.GetAPITokenUser(hashSecret(token))
+}
+
+// CreateToken issues an API token for the user, returning the secret which cannot be retrieved again
+func (u *AuthUsecase) CreateToken(userID int, name string) (*domain.APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "API token"
+	}
+
+	secret := newSecret(APITokenPrefix)
+	token := &domain.APIToken{UserID: userID, Name: name}
+	if err := u.Repo.CreateAPIToken(token, hashSecret(secret)); err != nil {
+		u.Logger.LogError("Failed to create API token", err)
+		return nil, "", err
+	}
+
+	return token, secret, nil
+}
+
+func (u *AuthUsecase) Tokens(userID int) ([]domain.APIToken, error) {
+	return u.Repo.ListAPITokens(userID)
+}
+
+// RevokeToken deletes one of the user's API tokens and tells whether there was one
+func (u *AuthUsecase) RevokeToken(userID int, id int) (bool, error) {
+	return u.Repo.DeleteAPIToken(userID, id)
+}
+
+func newSecret(prefix string) string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return prefix + hex.EncodeToString(buf)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/yuriadams/lear/internal/domain"
@@ -13,26 +14,111 @@ import (
 	"github.com/yuriadams/lear/internal/service"
 )
 
+// MaxBookBytes caps the size of a downloaded book, the longest Gutenberg texts are a fraction of it
+const MaxBookBytes = 64 << 20
+
+// DefaultContentURL is where the plain text of a book is downloaded from, formatted with its Gutenberg ID
+const DefaultContentURL = "https://www.gutenberg.org/cache/epub/%[1]d/pg%[1]d.txt"
+
+var (
+	ErrBookTooLarge = errors.New("book is larger than the download limit")
+	ErrBookNotFound = errors.New("book not found on Project Gutenberg")
+	// ErrGutenbergUnavailable is a download refused for a reason that may pass, such as a 5xx or 429 answer
+	ErrGutenbergUnavailable = errors.New("Project Gutenberg is unavailable")
+)
+
 type IBookUsecase interface {
 	FetchBook(gutenbergID int) (*domain.Book, error)
+	FetchMetadata(gutenbergID int) (*domain.Book, error)
 	FetchAllBooks() ([]domain.Book, error)
+	OpenContent(gutenbergID int) (io.ReadCloser, error)
 }
 
 type BookUsecase struct {
 	Repo    repository.IBookRepository
+	Blobs   repository.BlobStore
 	Scraper service.IScraperMetadata
 	Logger  *service.Logger
+
+	// ContentURL is formatted with the Gutenberg ID of the book to download
+	ContentURL string
+	// MaxBytes caps the size of a downloaded book
+	MaxBytes int64
+
+	mu       sync.Mutex
+	inflight map[int]*fetchCall
 }
 
-func NewBookUsecase(repo repository.IBookRepository, scraper service.IScraperMetadata) *BookUsecase {
-	return &BookUsecase{Repo: repo, Scraper: scraper, Logger: service.NewLogger("[BookUsecase]")}
+// fetchCall is a fetch of a book in progress, which concurrent requests for the same book wait for
+type fetchCall struct {
+	done chan struct{}
+	book *domain.Book
+	err  error
 }
 
+func NewBookUsecase(repo repository.IBookRepository, blobs repository.BlobStore, scraper service.IScraperMetadata) *BookUsecase {
+	return &BookUsecase{
+		Repo:       repo,
+		Blobs:      blobs,
+		Scraper:    scraper,
+		Logger:     service.NewLogger("[BookUsecase]"),
+		ContentURL: DefaultContentURL,
+		MaxBytes:   MaxBookBytes,
+		inflight:   make(map[int]*fetchCall),
+	}
+}
+
+// FetchAllBooks lists the stored books without their content
 func (u *BookUsecase) FetchAllBooks() ([]domain.Book, error) {
 	return u.Repo.GetAllBooks()
 }
 
+// FetchBook returns the book with its content, for the analyses that need the whole text
 func (u *BookUsecase) FetchBook(gutenbergID int) (*domain.Book, error) {
+	book, err := u.FetchMetadata(gutenbergID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stored book is shared with concurrent callers and the cache, the content goes in a copy
+	withContent := *book
+	if err := u.loadContent(&withContent); err != nil {
+		return nil, err
+	}
+	return &withContent, nil
+}
+
+// FetchMetadata returns the stored book without loading its content from blob storage, or downloads and stores
+// it. Concurrent calls for a book share a single download.
+func (u *BookUsecase) FetchMetadata(gutenbergID int) (*domain.Book, error) {
+	u.mu.Lock()
+	if call, ok := u.inflight[gutenbergID]; ok {
+		u.mu.Unlock()
+		<-call.done
+		return call.book, call.err
+	}
+
+	call := &fetchCall{done: make(chan struct{})}
+	u.inflight[gutenbergID] = call
+	u.mu.Unlock()
+
+	// Deferred so that waiters are released and the book can be fetched again even if the fetch panics
+	defer func() {
+		if call.book == nil && call.err == nil {
+			call.err = fmt.Errorf("fetch of book %d did not finish", gutenbergID)
+		}
+
+		u.mu.Lock()
+		delete(u.inflight, gutenbergID)
+		u.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.book, call.err = u.fetchBook(gutenbergID)
+	return call.book, call.err
+}
+
+func (u *BookUsecase) fetchBook(gutenbergID int) (*domain.Book, error) {
 	u.Logger.SetTags(fmt.Sprintf("[book-%d]", gutenbergID))
 
 	existingBook, err := u.Repo.GetBookByID(gutenbergID)
@@ -47,34 +133,38 @@ func (u *BookUsecase) FetchBook(gutenbergID int) (*domain.Book, error) {
 	}
 
 	var wg sync.WaitGroup
-	contentCh := make(chan []byte, 1)
+	contentCh := make(chan string, 1)
 	metadataCh := make(chan []byte, 1)
-	errCh := make(chan error, 2)
+	contentErrCh := make(chan error, 1)
+	metadataErrCh := make(chan error, 1)
 
 	wg.Add(2)
 
-	go u.fetchBookContent(contentCh, errCh, gutenbergID, &wg)
-	go u.fetchBookMetadata(metadataCh, errCh, gutenbergID, &wg)
+	go u.fetchBookContent(contentCh, contentErrCh, gutenbergID, &wg)
+	go u.fetchBookMetadata(metadataCh, metadataErrCh, gutenbergID, &wg)
 
 	wg.Wait()
 
 	close(contentCh)
 	close(metadataCh)
-	close(errCh)
+	close(contentErrCh)
+	close(metadataErrCh)
 
-	var errorMsg string
-	for err := range errCh {
-		if err != nil {
-			errorMsg += err.Error() + "; "
-		}
+	// The content's error stays wrapped, so callers can tell a missing book from a download that may succeed later
+	fetchErr, metadataErr := <-contentErrCh, <-metadataErrCh
+	switch {
+	case fetchErr == nil:
+		fetchErr = metadataErr
+	case metadataErr != nil:
+		fetchErr = fmt.Errorf("%w; %s", fetchErr, metadataErr)
 	}
 
-	if errorMsg != "" {
-		u.Logger.LogError("Failed to fetch book data", errors.New(errorMsg))
-		return nil, errors.New(errorMsg)
+	if fetchErr != nil {
+		u.Logger.LogError("Failed to fetch book data", fetchErr)
+		return nil, fetchErr
 	}
 
-	content := <-contentCh
+	hash := <-contentCh
 	metadataJSON := <-metadataCh
 
 	var metadata domain.Metadata
@@ -86,7 +176,7 @@ func (u *BookUsecase) FetchBook(gutenbergID int) (*domain.Book, error) {
 
 	book := &domain.Book{
 		GutenbergID: gutenbergID,
-		Content:     string(content),
+		ContentHash: hash,
 		Metadata:    metadata,
 	}
 
@@ -99,25 +189,79 @@ func (u *BookUsecase) FetchBook(gutenbergID int) (*domain.Book, error) {
 	return book, nil
 }
 
-func (u *BookUsecase) fetchBookContent(ch chan []byte, errCh chan error, gutenbergID int, wg *sync.WaitGroup) {
+// OpenContent streams the book's content from storage, fetching the book first when it is not stored yet
+func (u *BookUsecase) OpenContent(gutenbergID int) (io.ReadCloser, error) {
+	book, err := u.Repo.GetBookByID(gutenbergID)
+	if err != nil {
+		return nil, err
+	}
+
+	if book == nil {
+		if book, err = u.FetchMetadata(gutenbergID); err != nil {
+			return nil, err
+		}
+	}
+
+	if book.Content != "" || book.ContentHash == "" {
+		return io.NopCloser(strings.NewReader(book.Content)), nil
+	}
+	return u.Blobs.Open(book.ContentHash)
+}
+
+// loadContent reads the book's content from blob storage, books stored before it keep theirs in the row
+func (u *BookUsecase) loadContent(book *domain.Book) error {
+	if book.Content != "" || book.ContentHash == "" {
+		return nil
+	}
+
+	blob, err := u.Blobs.Open(book.ContentHash)
+	if err != nil {
+		u.Logger.LogError("Failed to open book content", err)
+		return err
+	}
+	defer blob.Close()
+
+	content, err := io.ReadAll(blob)
+	if err != nil {
+		u.Logger.LogError("Failed to read book content", err)
+		return err
+	}
+
+	book.Content = string(content)
+	return nil
+}
+
+// fetchBookContent streams the download into blob storage, up to MaxBytes, and sends the blob's hash
+func (u *BookUsecase) fetchBookContent(ch chan string, errCh chan error, gutenbergID int, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	contentURL := fmt.Sprintf("https://www.gutenberg.org/cache/epub/%d/pg%d.txt", gutenbergID, gutenbergID)
-	resp, err := http.Get(contentURL)
+	resp, err := http.Get(fmt.Sprintf(u.ContentURL, gutenbergID))
 	if err != nil {
 		errCh <- fmt.Errorf("failed to fetch content: %w", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	content, err := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		errCh <- fmt.Errorf("failed to fetch content: %w", ErrBookNotFound)
+		return
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		errCh <- fmt.Errorf("failed to fetch content: %w: %s", ErrGutenbergUnavailable, resp.Status)
+		return
+	case resp.StatusCode != http.StatusOK:
+		errCh <- fmt.Errorf("failed to fetch content: %s", resp.Status)
+		return
+	}
+
+	hash, size, err := u.Blobs.Put(&cappedReader{r: resp.Body, remaining: u.MaxBytes})
 	if err != nil {
-		errCh <- fmt.Errorf("failed to read content: %w", err)
+		errCh <- fmt.Errorf("failed to store content: %w", err)
 		return
 	}
 
-	ch <- content
-	u.Logger.LogInfo("Content fetched successfully")
+	ch <- hash
+	u.Logger.LogInfo(fmt.Sprintf("Content fetched successfully, %d bytes", size))
 }
 
 func (u *BookUsecase) fetchBookMetadata(ch chan []byte, errCh chan error, gutenbergID int, wg *sync.WaitGroup) {
@@ -134,3 +278,22 @@ func (u *BookUsecase) fetchBookMetadata(ch chan []byte, errCh chan error, gutenb
 	ch <- metadata
 	u.Logger.LogInfo("Metadata fetched successfully")
 }
+
+// cappedReader fails with ErrBookTooLarge once more than remaining bytes are read
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return 0, ErrBookTooLarge
+	}
+	return n, err
+}
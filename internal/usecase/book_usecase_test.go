@@ -0,0 +1,236 @@
+package usecase_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+// countingBlobStore counts how often blobs are opened
+type countingBlobStore struct {
+	repository.BlobStore
+
+	mu    sync.Mutex
+	opens int
+}
+
+func (s *countingBlobStore) Open(hash string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.opens++
+	s.mu.Unlock()
+	return s.BlobStore.Open(hash)
+}
+
+func (s *countingBlobStore) Opens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opens
+}
+
+func newBlobStore(t *testing.T) *countingBlobStore {
+	store, err := repository.NewFileBlobStore(t.TempDir())
+	require.NoError(t, err)
+	return &countingBlobStore{BlobStore: store}
+}
+
+// fakeScraper answers every book with the same metadata
+type fakeScraper struct{}
+
+func (fakeScraper) ScrapeMetadata(url string) ([]byte, error) {
+	return []byte(`{"title": "King Lear", "author": "William Shakespeare"}`), nil
+}
+
+// newGutenberg serves the text of every book, as the Gutenberg mirror would
+func newGutenberg(t *testing.T, text string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, text)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newBookUsecase(t *testing.T, repo repository.IBookRepository, server *httptest.Server) *usecase.BookUsecase {
+	books := usecase.NewBookUsecase(repo, newBlobStore(t), fakeScraper{})
+	books.ContentURL = server.URL + "/%d.txt"
+	return books
+}
+
+// countingBookRepository counts the books saved
+type countingBookRepository struct {
+	*repository.MemoryBookRepository
+	saves int32
+}
+
+func (r *countingBookRepository) SaveBook(book *domain.Book) error {
+	atomic.AddInt32(&r.saves, 1)
+	return r.MemoryBookRepository.SaveBook(book)
+}
+
+// panickingBookRepository panics on its first lookup, like a bug in a repository would
+type panickingBookRepository struct {
+	*repository.MemoryBookRepository
+	panicked int32
+}
+
+func (r *panickingBookRepository) GetBookByID(gutenbergID int) (*domain.Book, error) {
+	if atomic.CompareAndSwapInt32(&r.panicked, 0, 1) {
+		panic("repository bug")
+	}
+	return r.MemoryBookRepository.GetBookByID(gutenbergID)
+}
+
+func TestBookUsecase_FetchBookCoalesces(t *testing.T) {
+	var downloads int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		<-release
+		fmt.Fprint(w, "Nothing will come of nothing.")
+	}))
+	t.Cleanup(server.Close)
+
+	repo := &countingBookRepository{MemoryBookRepository: repository.NewMemoryBookRepository()}
+	books := newBookUsecase(t, repo, server)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	results := make([]*domain.Book, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = books.FetchBook(1532)
+		}(i)
+	}
+
+	// Every caller has asked for the book by the time the download answers
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		require.NoError(t, errs[i])
+		assert.Equal(t, "Nothing will come of nothing.", results[i].Content)
+		assert.Equal(t, "King Lear", results[i].Metadata.Title)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads), "concurrent callers share one download")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&repo.saves), "concurrent callers share one SaveBook")
+
+	stored, err := repo.GetBookByID(1532)
+	require.NoError(t, err)
+	assert.Equal(t, results[0].ContentHash, stored.ContentHash, "the book is upserted with its content hash")
+}
+
+func TestBookUsecase_FetchBookPanics(t *testing.T) {
+	repo := &panickingBookRepository{MemoryBookRepository: repository.NewMemoryBookRepository()}
+	books := newBookUsecase(t, repo, newGutenberg(t, "Nothing will come of nothing."))
+
+	assert.Panics(t, func() { books.FetchMetadata(1532) })
+
+	// The panicked fetch is no longer in flight, so the next caller fetches again instead of waiting forever
+	done := make(chan error, 1)
+	go func() {
+		_, err := books.FetchMetadata(1532)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("FetchMetadata is blocked by the panicked fetch")
+	}
+}
+
+func TestBookUsecase_FetchMetadata(t *testing.T) {
+	blobs := newBlobStore(t)
+	hash, _, err := blobs.Put(strings.NewReader("It was a dark and stormy night."))
+	require.NoError(t, err)
+
+	repo := repository.NewMemoryBookRepository()
+	require.NoError(t, repo.SaveBook(&domain.Book{GutenbergID: 84, ContentHash: hash, Metadata: domain.Metadata{Title: "Frankenstein"}}))
+	books := usecase.NewBookUsecase(repo, blobs, nil)
+
+	book, err := books.FetchMetadata(84)
+	require.NoError(t, err)
+	assert.Equal(t, "Frankenstein", book.Metadata.Title)
+	assert.Empty(t, book.Content)
+	assert.Zero(t, blobs.Opens(), "metadata is read without the content")
+
+	book, err = books.FetchBook(84)
+	require.NoError(t, err)
+	assert.Equal(t, "It was a dark and stormy night.", book.Content)
+	assert.Equal(t, 1, blobs.Opens())
+
+	stored, err := repo.GetBookByID(84)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Content, "the content is not kept with the stored book")
+}
+
+func TestBookUsecase_MaxBytes(t *testing.T) {
+	text := "Nothing will come of nothing."
+
+	t.Run("Exactly the limit", func(t *testing.T) {
+		books := newBookUsecase(t, repository.NewMemoryBookRepository(), newGutenberg(t, text))
+		books.MaxBytes = int64(len(text))
+
+		content, err := books.OpenContent(1532)
+		require.NoError(t, err)
+		read, err := io.ReadAll(content)
+		require.NoError(t, err)
+		assert.NoError(t, content.Close())
+		assert.Equal(t, text, string(read))
+	})
+
+	t.Run("One byte over", func(t *testing.T) {
+		repo := repository.NewMemoryBookRepository()
+		books := newBookUsecase(t, repo, newGutenberg(t, text))
+		books.MaxBytes = int64(len(text)) - 1
+
+		_, err := books.OpenContent(1532)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, usecase.ErrBookTooLarge)
+
+		stored, err := repo.GetBookByID(1532)
+		require.NoError(t, err)
+		assert.Nil(t, stored, "a book over the limit is not stored")
+	})
+}
+
+func TestBookUsecase_FetchErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+	}{
+		{"Missing from Gutenberg", http.StatusNotFound, usecase.ErrBookNotFound},
+		{"Gutenberg unavailable", http.StatusServiceUnavailable, usecase.ErrGutenbergUnavailable},
+		{"Gutenberg rate limiting", http.StatusTooManyRequests, usecase.ErrGutenbergUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			t.Cleanup(server.Close)
+			books := newBookUsecase(t, repository.NewMemoryBookRepository(), server)
+
+			_, err := books.FetchMetadata(1532)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package usecase
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+const (
+	// entitiesKind is the analysis naming the characters of prose, which has no speaker tags
+	entitiesKind = "entities"
+	// speakerGraphCacheSize is the number of books whose speaker graph, or lack of one, is kept
+	speakerGraphCacheSize = 32
+)
+
+type ICharacterGraphUsecase interface {
+	Stored(gutenbergID int) (*domain.CharacterGraph, error)
+	NeedsEngine(book *domain.Book) bool
+	Graph(ctx context.Context, book *domain.Book) (*domain.CharacterGraph, error)
+}
+
+// CharacterGraphUsecase builds and stores the character graphs of books. The speaker graphs of the books most
+// recently looked at are kept in memory, so NeedsEngine and Graph scan a book's text once.
+type CharacterGraphUsecase struct {
+	Repo     repository.ICharacterGraphRepository
+	Graphs   service.ICharacterGraphService
+	Analysis service.IAnalysisService
+	Logger   *service.Logger
+
+	mu       sync.Mutex
+	speakers map[int]*list.Element
+	recency  *list.List
+}
+
+// speakerGraph is the graph of a book built from its speaker tags, ok is false when the book has none
+type speakerGraph struct {
+	gutenbergID int
+	graph       *domain.CharacterGraph
+	ok          bool
+}
+
+func NewCharacterGraphUsecase(repo repository.ICharacterGraphRepository, graphs service.ICharacterGraphService, analysis service.IAnalysisService) *CharacterGraphUsecase {
+	return &CharacterGraphUsecase{
+		Repo:     repo,
+		Graphs:   graphs,
+		Analysis: analysis,
+		Logger:   service.NewLogger("[CharacterGraphUsecase]"),
+		speakers: make(map[int]*list.Element),
+		recency:  list.New(),
+	}
+}
+
+// Stored returns the character graph already built for the book, or nil
+func (u *CharacterGraphUsecase) Stored(gutenbergID int) (*domain.CharacterGraph, error) {
+	return u.Repo.GetCharacterGraph(gutenbergID)
+}
+
+// NeedsEngine tells whether building the book's graph calls the AI engine, as it does for prose
+func (u *CharacterGraphUsecase) NeedsEngine(book *domain.Book) bool {
+	_, ok := u.speakerGraph(book)
+	return !ok
+}
+
+// Graph returns the stored character graph of the book, building it on first use: from speaker tags for
+// plays, otherwise from the mentions of the characters the AI engine names
+func (u *CharacterGraphUsecase) Graph(ctx context.Context, book *domain.Book) (*domain.CharacterGraph, error) {
+	u.Logger.SetTags(fmt.Sprintf("[book-%d]", book.GutenbergID))
+
+	graph, err := u.Repo.GetCharacterGraph(book.GutenbergID)
+	if err != nil {
+		u.Logger.LogError("Failed to fetch character graph", err)
+		return nil, err
+	}
+	if graph != nil {
+		return graph, nil
+	}
+
+	graph, ok := u.speakerGraph(book)
+	if !ok {
+		names, err := u.characterNames(ctx, book)
+		if err != nil {
+			return nil, err
+		}
+		graph = u.Graphs.FromMentions(book.GutenbergID, book.Content, names)
+	}
+
+	if err := u.Repo.SaveCharacterGraph(graph); err != nil {
+		u.Logger.LogError("Failed to save character graph", err)
+		return nil, err
+	}
+
+	u.Logger.LogInfo(fmt.Sprintf("Character graph built from %s with %d characters", graph.Method, len(graph.Nodes)))
+	return graph, nil
+}
+
+// speakerGraph returns the cached speaker graph of the book, or builds it from the text and caches it, evicting
+// the least recently used
+func (u *CharacterGraphUsecase) speakerGraph(book *domain.Book) (*domain.CharacterGraph, bool) {
+	u.mu.Lock()
+	if element, ok := u.speakers[book.GutenbergID]; ok {
+		u.recency.MoveToFront(element)
+		u.mu.Unlock()
+		cached := element.Value.(*speakerGraph)
+		return cached.graph, cached.ok
+	}
+	u.mu.Unlock()
+
+	graph, ok := u.Graphs.FromSpeakers(book.GutenbergID, book.Content)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, cached := u.speakers[book.GutenbergID]; !cached {
+		u.speakers[book.GutenbergID] = u.recency.PushFront(&speakerGraph{gutenbergID: book.GutenbergID, graph: graph, ok: ok})
+		for u.recency.Len() > speakerGraphCacheSize {
+			oldest := u.recency.Back()
+			u.recency.Remove(oldest)
+			delete(u.speakers, oldest.Value.(*speakerGraph).gutenbergID)
+		}
+	}
+	return graph, ok
+}
+
+func (u *CharacterGraphUsecase) characterNames(ctx context.Context, book *domain.Book) ([]string, error) {
+	completion, err := u.Analysis.StreamTextAnalysis(service.WithBook(ctx, book.GutenbergID), service.DiscardEvents, book.Content, entitiesKind, "")
+	if err != nil {
+		u.Logger.LogError("Failed to name characters", err)
+		return nil, err
+	}
+
+	kind, _ := service.LookupAnalysisKind(entitiesKind)
+	result, ok := kind.ParseResult(completion.Content)
+	if !ok {
+		return nil, &service.AnalysisError{
+			Code:      service.ErrCodeUpstream,
+			Message:   "The analysis provider did not list the characters in the expected format.",
+			Retryable: true,
+		}
+	}
+
+	return service.EntityNames(result)
+}
@@ -0,0 +1,78 @@
+package usecase_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+// countingGraphs counts the scans of a book's text for speaker tags
+type countingGraphs struct {
+	service.ICharacterGraphService
+
+	mu    sync.Mutex
+	scans int
+}
+
+func (g *countingGraphs) FromSpeakers(gutenbergID int, text string) (*domain.CharacterGraph, bool) {
+	g.mu.Lock()
+	g.scans++
+	g.mu.Unlock()
+	return g.ICharacterGraphService.FromSpeakers(gutenbergID, text)
+}
+
+func (g *countingGraphs) Scans() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.scans
+}
+
+// memoryGraphRepository keeps character graphs in a map
+type memoryGraphRepository struct {
+	graphs map[int]*domain.CharacterGraph
+}
+
+func (r *memoryGraphRepository) GetCharacterGraph(gutenbergID int) (*domain.CharacterGraph, error) {
+	return r.graphs[gutenbergID], nil
+}
+
+func (r *memoryGraphRepository) SaveCharacterGraph(graph *domain.CharacterGraph) error {
+	r.graphs[graph.GutenbergID] = graph
+	return nil
+}
+
+func TestCharacterGraphUsecase_ScansOnce(t *testing.T) {
+	play := "ACT I. SCENE I.\n\n" + strings.Repeat("LEAR. What can you say to draw a third more opulent than your sisters?\n"+
+		"CORDELIA. Nothing, my lord.\n"+
+		"LEAR. Nothing will come of nothing. Speak again.\n"+
+		"KENT. Good my liege,--\n", 5)
+
+	t.Run("Play", func(t *testing.T) {
+		graphs := &countingGraphs{ICharacterGraphService: service.NewCharacterGraphService()}
+		characters := usecase.NewCharacterGraphUsecase(&memoryGraphRepository{graphs: make(map[int]*domain.CharacterGraph)}, graphs, nil)
+		book := &domain.Book{GutenbergID: 1532, Content: play}
+
+		assert.False(t, characters.NeedsEngine(book))
+		graph, err := characters.Graph(context.Background(), book)
+		require.NoError(t, err)
+		assert.NotEmpty(t, graph.Nodes)
+		assert.Equal(t, 1, graphs.Scans())
+	})
+
+	t.Run("Prose", func(t *testing.T) {
+		graphs := &countingGraphs{ICharacterGraphService: service.NewCharacterGraphService()}
+		characters := usecase.NewCharacterGraphUsecase(&memoryGraphRepository{graphs: make(map[int]*domain.CharacterGraph)}, graphs, nil)
+		book := &domain.Book{GutenbergID: 1342, Content: "It is a truth universally acknowledged, that a single man in possession of a good fortune, must be in want of a wife."}
+
+		assert.True(t, characters.NeedsEngine(book))
+		assert.True(t, characters.NeedsEngine(book))
+		assert.Equal(t, 1, graphs.Scans())
+	})
+}
@@ -0,0 +1,116 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+// maxChatHistory is the number of previous messages sent back to the engine with a new question
+const maxChatHistory = 20
+
+type IChatUsecase interface {
+	History(userID string, gutenbergID int) ([]domain.ChatMessage, error)
+	Ask(ctx context.Context, events service.EventSender, userID string, book *domain.Book, question string) error
+	ClearHistory(userID string, gutenbergID int) error
+}
+
+type ChatUsecase struct {
+	Repo     repository.IChatRepository
+	Service  service.IAnalysisService
+	Passages IPassageUsecase
+	Logger   *service.Logger
+}
+
+// NewChatUsecase answers from retrieved passages when passages is set, otherwise from the beginning of the book
+func NewChatUsecase(repo repository.IChatRepository, analysis service.IAnalysisService, passages IPassageUsecase) *ChatUsecase {
+	return &ChatUsecase{Repo: repo, Service: analysis, Passages: passages, Logger: service.NewLogger("[ChatUsecase]")}
+}
+
+func (u *ChatUsecase) History(userID string, gutenbergID int) ([]domain.ChatMessage, error) {
+	return u.Repo.GetChatHistory(userID, gutenbergID)
+}
+
+// Ask streams the answer to a question, sending the previous turns as context, and stores both messages once answered
+func (u *ChatUsecase) Ask(ctx context.Context, events service.EventSender, userID string, book *domain.Book, question string) error {
+	u.Logger.SetTags(fmt.Sprintf("[book-%d]", book.GutenbergID))
+
+	question = strings.TrimSpace(question)
+	if question == "" {
+		return &service.AnalysisError{Code: service.ErrCodeInvalidRequest, Message: "The question is empty."}
+	}
+
+	history, err := u.Repo.GetChatHistory(userID, book.GutenbergID)
+	if err != nil {
+		u.Logger.LogError("Failed to fetch chat history", err)
+		return err
+	}
+
+	if len(history) > maxChatHistory {
+		history = history[len(history)-maxChatHistory:]
+	}
+
+	messages := make([]engine.ChatMessage, 0, len(history)+1)
+	for _, message := range history {
+		messages = append(messages, engine.ChatMessage{Role: message.Role, Content: message.Content})
+	}
+	messages = append(messages, engine.ChatMessage{Role: engine.RoleUser, Content: question})
+
+	completion, citations, err := u.answer(ctx, events, book, question, messages)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range []*domain.ChatMessage{
+		{UserID: userID, GutenbergID: book.GutenbergID, Role: engine.RoleUser, Content: question},
+		{
+			UserID:        userID,
+			GutenbergID:   book.GutenbergID,
+			Role:          engine.RoleAssistant,
+			Content:       completion.Content,
+			Citations:     citations,
+			PromptVersion: completion.PromptVersion,
+		},
+	} {
+		if err := u.Repo.SaveChatMessage(message); err != nil {
+			u.Logger.LogError("Failed to save chat message", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *ChatUsecase) answer(ctx context.Context, events service.EventSender, book *domain.Book, question string, messages []engine.ChatMessage) (*service.Completion, domain.Citations, error) {
+	ctx = service.WithBook(ctx, book.GutenbergID)
+	if u.Passages == nil {
+		completion, err := u.Service.Converse(ctx, events, book.Content, messages)
+		return completion, nil, err
+	}
+
+	passages, err := u.Passages.Search(book, question, DefaultTopPassages)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	completion, err := u.Service.ConverseWithPassages(ctx, events, passages, messages)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	citations := service.CitedPassages(completion.Content, passages)
+	if err := events.Send(service.CitationsEvent, citations); err != nil {
+		return nil, nil, err
+	}
+
+	return completion, citations, nil
+}
+
+func (u *ChatUsecase) ClearHistory(userID string, gutenbergID int) error {
+	return u.Repo.DeleteChatHistory(userID, gutenbergID)
+}
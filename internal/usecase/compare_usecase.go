@@ -0,0 +1,76 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+const (
+	MinComparedBooks = 2
+	MaxComparedBooks = 5
+)
+
+type ICompareUsecase interface {
+	Compare(books []*domain.Book) ([]domain.BookComparison, error)
+	Analyze(ctx context.Context, events service.EventSender, books []*domain.Book) error
+}
+
+type CompareUsecase struct {
+	Stats    ITextStatsUsecase
+	Analyses repository.IAnalysisRepository
+	Service  service.IAnalysisService
+	Logger   *service.Logger
+}
+
+func NewCompareUsecase(stats ITextStatsUsecase, analyses repository.IAnalysisRepository, analysis service.IAnalysisService) *CompareUsecase {
+	return &CompareUsecase{Stats: stats, Analyses: analyses, Service: analysis, Logger: service.NewLogger("[CompareUsecase]")}
+}
+
+// Compare puts the metadata, statistics and latest stored analysis of each type of the books side by side
+func (u *CompareUsecase) Compare(books []*domain.Book) ([]domain.BookComparison, error) {
+	comparisons := make([]domain.BookComparison, len(books))
+	for i, book := range books {
+		analyses, err := u.Analyses.GetAnalyses(book.GutenbergID, "")
+		if err != nil {
+			u.Logger.LogError(fmt.Sprintf("Failed to fetch analyses of book %d", book.GutenbergID), err)
+			return nil, err
+		}
+
+		stats, err := u.Stats.Stats(book)
+		if err != nil {
+			u.Logger.LogError(fmt.Sprintf("Failed to compute the statistics of book %d", book.GutenbergID), err)
+			return nil, err
+		}
+
+		comparisons[i] = domain.BookComparison{
+			GutenbergID: book.GutenbergID,
+			Metadata:    book.Metadata,
+			Stats:       stats,
+			Analyses:    latestAnalyses(analyses),
+		}
+	}
+	return comparisons, nil
+}
+
+// Analyze streams a comparative analysis of the books, which is not stored
+func (u *CompareUsecase) Analyze(ctx context.Context, events service.EventSender, books []*domain.Book) error {
+	_, err := u.Service.StreamComparison(ctx, events, books)
+	return err
+}
+
+// latestAnalyses keeps the first analysis of each kind from a list sorted newest first
+func latestAnalyses(analyses []domain.Analysis) []domain.Analysis {
+	seen := make(map[string]bool)
+	latest := make([]domain.Analysis, 0, len(analyses))
+	for _, analysis := range analyses {
+		if !seen[analysis.Kind] {
+			seen[analysis.Kind] = true
+			latest = append(latest, analysis)
+		}
+	}
+	return latest
+}
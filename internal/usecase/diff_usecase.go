@@ -0,0 +1,43 @@
+package usecase
+
+import (
+	"regexp"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+// gutenbergStart and gutenbergEnd are the markers around the text of a work, outside them is the licence and
+// the ebook's own details, which differ between any two editions
+var (
+	gutenbergStart = regexp.MustCompile(`(?mi)^\*\*\* ?START OF (THE|THIS) PROJECT GUTENBERG.*$`)
+	gutenbergEnd   = regexp.MustCompile(`(?mi)^\*\*\* ?END OF (THE|THIS) PROJECT GUTENBERG.*$`)
+)
+
+type IDiffUsecase interface {
+	Diff(oldBook, newBook *domain.Book, context int) *service.TextDiff
+}
+
+type DiffUsecase struct {
+	Service service.IDiffService
+}
+
+func NewDiffUsecase(diffs service.IDiffService) *DiffUsecase {
+	return &DiffUsecase{Service: diffs}
+}
+
+// Diff compares the texts of two editions of a work, leaving out the Project Gutenberg header and footer
+func (u *DiffUsecase) Diff(oldBook, newBook *domain.Book, context int) *service.TextDiff {
+	return u.Service.Diff(workText(oldBook.Content), workText(newBook.Content), context)
+}
+
+// workText cuts the content down to the lines between the Gutenberg markers, or keeps it whole without them
+func workText(content string) string {
+	if loc := gutenbergStart.FindStringIndex(content); loc != nil {
+		content = content[loc[1]:]
+	}
+	if loc := gutenbergEnd.FindStringIndex(content); loc != nil {
+		content = content[:loc[0]]
+	}
+	return content
+}
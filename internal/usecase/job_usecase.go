@@ -0,0 +1,273 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+const (
+	DefaultJobWorkers  = 2
+	DefaultJobAttempts = 3
+
+	jobPollInterval     = time.Second
+	jobTimeout          = 10 * time.Minute
+	jobStaleAfter       = 15 * time.Minute
+	jobProgressInterval = time.Second
+	jobBaseBackoff      = 5 * time.Second
+	jobMaxBackoff       = 5 * time.Minute
+)
+
+var ErrJobFinished = errors.New("job already finished")
+
+type IJobUsecase interface {
+	Enqueue(job *domain.Job) error
+	Job(id int) (*domain.Job, error)
+	Cancel(id int) (*domain.Job, error)
+	Start(ctx context.Context)
+}
+
+// JobUsecase runs fetches and analyses queued in the database on a pool of worker goroutines, so they go on
+// without an open request and survive a restart
+type JobUsecase struct {
+	Repo     repository.IJobRepository
+	Books    IBookUsecase
+	Analysis IAnalysisUsecase
+	Workers  int
+	Logger   *service.Logger
+}
+
+func NewJobUsecase(repo repository.IJobRepository, books IBookUsecase, analysis IAnalysisUsecase, workers int) *JobUsecase {
+	return &JobUsecase{Repo: repo, Books: books, Analysis: analysis, Workers: workers, Logger: service.NewLogger("[JobUsecase]")}
+}
+
+func (u *JobUsecase) Enqueue(job *domain.Job) error {
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = DefaultJobAttempts
+	}
+
+	if err := u.Repo.CreateJob(job); err != nil {
+		u.Logger.LogError("Failed to enqueue job", err)
+		return err
+	}
+
+	u.Logger.LogInfo(fmt.Sprintf("Job %d queued: %s of book %d", job.ID, job.Kind, job.GutenbergID))
+	return nil
+}
+
+// Job returns the job, or nil when there is none
+func (u *JobUsecase) Job(id int) (*domain.Job, error) {
+	return u.Repo.GetJob(id)
+}
+
+// Cancel stops a queued or running job and returns it, or nil when there is none. A running job notices
+// within a poll interval.
+func (u *JobUsecase) Cancel(id int) (*domain.Job, error) {
+	cancelled, err := u.Repo.CancelJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := u.Repo.GetJob(id)
+	if err != nil || job == nil {
+		return job, err
+	}
+	if !cancelled {
+		return job, ErrJobFinished
+	}
+	return job, nil
+}
+
+// Start runs the workers until the context is done, then waits for the jobs they are running to stop
+func (u *JobUsecase) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		u.requeueStale(ctx)
+	}()
+
+	for i := 0; i < u.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (u *JobUsecase) work(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := u.Repo.ClaimJob()
+		if err != nil {
+			u.Logger.LogError("Failed to claim job", err)
+		}
+
+		if job != nil {
+			u.run(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// requeueStale gives the jobs of a worker that stopped in the middle of them to the other workers, or fails them
+// when that was their last attempt
+func (u *JobUsecase) requeueStale(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		requeued, failed, err := u.Repo.RequeueStaleJobs(jobStaleAfter)
+		if err != nil {
+			u.Logger.LogError("Failed to requeue stale jobs", err)
+		} else if requeued > 0 || failed > 0 {
+			u.Logger.LogInfo(fmt.Sprintf("Requeued %d stale jobs, failed %d out of attempts", requeued, failed))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *JobUsecase) run(ctx context.Context, job *domain.Job) {
+	logger := service.NewLogger("[JobUsecase]")
+	logger.SetTags(fmt.Sprintf("[job-%d]", job.ID), fmt.Sprintf("[book-%d]", job.GutenbergID))
+	logger.LogInfo(fmt.Sprintf("Running %s, attempt %d of %d", job.Kind, job.Attempts, job.MaxAttempts))
+
+	// The usage of queued analyses counts towards the quota of the user who enqueued them
+	jobCtx, cancel := context.WithTimeout(service.WithCaller(ctx, service.Caller{UserID: job.UserID}), jobTimeout)
+	defer cancel()
+	go u.watchCancellation(jobCtx, cancel, job.ID)
+
+	err := u.execute(jobCtx, job)
+	if stored, _ := u.Repo.GetJob(job.ID); stored != nil && stored.Status == domain.JobCancelled {
+		logger.LogInfo("Job cancelled")
+		return
+	}
+
+	switch {
+	case err == nil:
+		err = u.Repo.FinishJob(job.ID, domain.JobSucceeded, "")
+		logger.LogInfo("Job succeeded")
+	case ctx.Err() != nil:
+		// The workers are stopping, the job runs again as soon as they start
+		logger.LogInfo("Job interrupted, requeued")
+		err = u.Repo.RetryJob(job.ID, err.Error(), 0)
+	case jobRetryable(err) && job.Attempts < job.MaxAttempts:
+		delay := jobBackoff(job.Attempts)
+		logger.LogError(fmt.Sprintf("Job failed, retrying in %s", delay), err)
+		err = u.Repo.RetryJob(job.ID, err.Error(), delay)
+	default:
+		logger.LogError("Job failed", err)
+		err = u.Repo.FinishJob(job.ID, domain.JobFailed, err.Error())
+	}
+
+	if err != nil {
+		logger.LogError("Failed to update job", err)
+	}
+}
+
+func (u *JobUsecase) execute(ctx context.Context, job *domain.Job) error {
+	progress := &jobProgress{repo: u.Repo, jobID: job.ID}
+	progress.update(0, "Fetching the book")
+
+	book, err := u.Books.FetchBook(job.GutenbergID)
+	if err != nil {
+		return err
+	}
+	if job.Kind == domain.JobFetch {
+		return nil
+	}
+
+	progress.update(10, "Analyzing the book")
+	return u.Analysis.Analyze(ctx, progress, job.UserID, book, job.AnalysisKind, job.PromptVersion)
+}
+
+// watchCancellation cancels the context of a running job once the job is cancelled in the database
+func (u *JobUsecase) watchCancellation(ctx context.Context, cancel context.CancelFunc, id int) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if job, err := u.Repo.GetJob(id); err == nil && job != nil && job.Status == domain.JobCancelled {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// jobRetryable tells whether a failed attempt may succeed if run again. A book missing from Project Gutenberg or
+// over the download limit never will.
+func jobRetryable(err error) bool {
+	switch {
+	case errors.Is(err, ErrBookNotFound) || errors.Is(err, ErrBookTooLarge):
+		return false
+	case errors.Is(err, ErrGutenbergUnavailable):
+		return true
+	default:
+		return service.AsAnalysisError(err).Retryable
+	}
+}
+
+// jobBackoff doubles the delay before each retry, up to jobMaxBackoff
+func jobBackoff(attempt int) time.Duration {
+	delay := jobBaseBackoff
+	for i := 1; i < attempt && delay < jobMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > jobMaxBackoff {
+		delay = jobMaxBackoff
+	}
+	return delay
+}
+
+// jobProgress receives the events of a job's analysis and records how far it got, at most once per interval
+type jobProgress struct {
+	repo    repository.IJobRepository
+	jobID   int
+	chunks  int
+	updated time.Time
+}
+
+func (p *jobProgress) Send(event string, data interface{}) error {
+	if _, ok := data.(service.AnalysisChunk); !ok {
+		return nil
+	}
+
+	p.chunks++
+	if time.Since(p.updated) >= jobProgressInterval {
+		p.update(50, fmt.Sprintf("Received %d chunks of the analysis", p.chunks))
+	}
+	return nil
+}
+
+func (p *jobProgress) update(progress int, message string) {
+	p.updated = time.Now()
+	p.repo.UpdateJobProgress(p.jobID, progress, message)
+}
@@ -0,0 +1,115 @@
+package usecase_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+// singleJobRepository hands out one job to claim and sends how its attempt ended
+type singleJobRepository struct {
+	repository.IJobRepository
+
+	mu      sync.Mutex
+	job     *domain.Job
+	claimed bool
+	ended   chan string
+}
+
+func (r *singleJobRepository) ClaimJob() (*domain.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.claimed {
+		return nil, nil
+	}
+	r.claimed = true
+	r.job.Status = domain.JobRunning
+	r.job.Attempts++
+	job := *r.job
+	return &job, nil
+}
+
+func (r *singleJobRepository) GetJob(id int) (*domain.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job := *r.job
+	return &job, nil
+}
+
+func (r *singleJobRepository) UpdateJobProgress(id int, progress int, message string) error {
+	return nil
+}
+
+func (r *singleJobRepository) FinishJob(id int, status string, lastError string) error {
+	r.ended <- status
+	return nil
+}
+
+func (r *singleJobRepository) RetryJob(id int, lastError string, delay time.Duration) error {
+	r.ended <- domain.JobQueued
+	return nil
+}
+
+func (r *singleJobRepository) RequeueStaleJobs(staleAfter time.Duration) (int64, int64, error) {
+	return 0, 0, nil
+}
+
+// failingBooks fails every fetch with err
+type failingBooks struct {
+	usecase.IBookUsecase
+	err error
+}
+
+func (b failingBooks) FetchBook(gutenbergID int) (*domain.Book, error) {
+	return nil, b.err
+}
+
+func TestJobUsecase_Retries(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		status   string
+	}{
+		{"Missing from Gutenberg", fmt.Errorf("failed to fetch content: %w", usecase.ErrBookNotFound), 0, domain.JobFailed},
+		{"Too large", fmt.Errorf("failed to store content: %w", usecase.ErrBookTooLarge), 0, domain.JobFailed},
+		{"Unexpected error", errors.New("boom"), 0, domain.JobFailed},
+		{"Gutenberg unavailable", fmt.Errorf("failed to fetch content: %w", usecase.ErrGutenbergUnavailable), 0, domain.JobQueued},
+		{"Last attempt", fmt.Errorf("failed to fetch content: %w", usecase.ErrGutenbergUnavailable), 2, domain.JobFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &singleJobRepository{
+				job:   &domain.Job{ID: 1, Kind: domain.JobFetch, GutenbergID: 1532, Status: domain.JobQueued, Attempts: tt.attempts, MaxAttempts: 3},
+				ended: make(chan string, 1),
+			}
+			jobs := usecase.NewJobUsecase(repo, failingBooks{err: tt.err}, nil, 1)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				jobs.Start(ctx)
+				close(stopped)
+			}()
+
+			select {
+			case status := <-repo.ended:
+				assert.Equal(t, tt.status, status)
+			case <-time.After(5 * time.Second):
+				require.Fail(t, "the job did not end")
+			}
+			cancel()
+			<-stopped
+		})
+	}
+}
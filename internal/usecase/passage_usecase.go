@@ -0,0 +1,107 @@
+package usecase
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/service/engine"
+)
+
+const DefaultTopPassages = 5
+
+type IPassageUsecase interface {
+	Search(book *domain.Book, query string, k int) ([]domain.Passage, error)
+}
+
+type PassageUsecase struct {
+	Repo     repository.IPassageRepository
+	Embedder engine.Embedder
+	Logger   *service.Logger
+
+	mu       sync.Mutex
+	indexing map[int]*sync.Mutex
+}
+
+func NewPassageUsecase(repo repository.IPassageRepository, embedder engine.Embedder) *PassageUsecase {
+	return &PassageUsecase{
+		Repo:     repo,
+		Embedder: embedder,
+		Logger:   service.NewLogger("[PassageUsecase]"),
+		indexing: make(map[int]*sync.Mutex),
+	}
+}
+
+// Search returns the k passages of the book closest to the query, indexing the book on first use
+func (u *PassageUsecase) Search(book *domain.Book, query string, k int) ([]domain.Passage, error) {
+	passages, err := u.index(book)
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings, err := u.Embedder.Embed([]string{query})
+	if err != nil {
+		u.Logger.LogError("Failed to embed query", err)
+		return nil, err
+	}
+
+	return service.TopPassages(embeddings[0], passages, k), nil
+}
+
+func (u *PassageUsecase) index(book *domain.Book) ([]domain.Passage, error) {
+	// Only one request indexes a given book, the others wait and read its result
+	lock := u.bookLock(book.GutenbergID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	u.Logger.SetTags(fmt.Sprintf("[book-%d]", book.GutenbergID))
+
+	passages, err := u.Repo.GetPassages(book.GutenbergID, u.Embedder.Model())
+	if err != nil {
+		u.Logger.LogError("Failed to fetch passages", err)
+		return nil, err
+	}
+
+	if len(passages) > 0 {
+		return passages, nil
+	}
+
+	passages = service.SplitPassages(book.GutenbergID, book.Content)
+	texts := make([]string, len(passages))
+	for i, passage := range passages {
+		texts[i] = passage.Content
+	}
+
+	embeddings, err := u.Embedder.Embed(texts)
+	if err != nil {
+		u.Logger.LogError("Failed to embed passages", err)
+		return nil, err
+	}
+
+	for i := range passages {
+		passages[i].Model = u.Embedder.Model()
+		passages[i].Embedding = embeddings[i]
+	}
+
+	if err := u.Repo.SavePassages(passages); err != nil {
+		u.Logger.LogError("Failed to save passages", err)
+		return nil, err
+	}
+
+	u.Logger.LogInfo(fmt.Sprintf("Indexed %d passages", len(passages)))
+	return passages, nil
+}
+
+func (u *PassageUsecase) bookLock(gutenbergID int) *sync.Mutex {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	lock, ok := u.indexing[gutenbergID]
+	if !ok {
+		lock = &sync.Mutex{}
+		u.indexing[gutenbergID] = lock
+	}
+	return lock
+}
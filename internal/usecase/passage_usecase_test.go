@@ -0,0 +1,153 @@
+package usecase_test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+// memoryPassageRepository keeps passages in memory and counts the times they are saved
+type memoryPassageRepository struct {
+	mu       sync.Mutex
+	passages map[int][]domain.Passage
+	saves    int
+}
+
+func (r *memoryPassageRepository) GetPassages(gutenbergID int, model string) ([]domain.Passage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var passages []domain.Passage
+	for _, passage := range r.passages[gutenbergID] {
+		if passage.Model == model {
+			passages = append(passages, passage)
+		}
+	}
+	return passages, nil
+}
+
+func (r *memoryPassageRepository) SavePassages(passages []domain.Passage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.saves++
+	for _, passage := range passages {
+		r.passages[passage.GutenbergID] = append(r.passages[passage.GutenbergID], passage)
+	}
+	return nil
+}
+
+func (r *memoryPassageRepository) Saves() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.saves
+}
+
+// stormEmbedder embeds the texts mentioning a storm apart from the others. Indexing, embedding more than one
+// text, waits for release and fails while err is set.
+type stormEmbedder struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	err     error
+	indexed int
+}
+
+func (e *stormEmbedder) Model() string {
+	return "storm-embedding"
+}
+
+func (e *stormEmbedder) Embed(texts []string) ([][]float32, error) {
+	if len(texts) > 1 {
+		<-e.release
+
+		e.mu.Lock()
+		e.indexed++
+		err := e.err
+		e.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embeddings[i] = []float32{0, 1}
+		if strings.Contains(text, "storm") {
+			embeddings[i] = []float32{1, 0}
+		}
+	}
+	return embeddings, nil
+}
+
+func (e *stormEmbedder) Indexed() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.indexed
+}
+
+func TestPassageUsecase_Search(t *testing.T) {
+	book := &domain.Book{GutenbergID: 1532, Content: strings.Repeat("nothing ", 400) + strings.Repeat("storm ", 400)}
+
+	t.Run("Indexes a book once", func(t *testing.T) {
+		repo := &memoryPassageRepository{passages: make(map[int][]domain.Passage)}
+		embedder := &stormEmbedder{release: make(chan struct{})}
+		passages := usecase.NewPassageUsecase(repo, embedder)
+
+		const callers = 10
+		var wg sync.WaitGroup
+		results := make([][]domain.Passage, callers)
+		errs := make([]error, callers)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = passages.Search(book, "storm", 2)
+			}(i)
+		}
+
+		// Every caller is waiting on the book's indexing by the time it finishes
+		time.Sleep(50 * time.Millisecond)
+		close(embedder.release)
+		wg.Wait()
+
+		for i := 0; i < callers; i++ {
+			require.NoError(t, errs[i])
+			require.Len(t, results[i], 2)
+			assert.Contains(t, results[i][0].Content, "storm", "the closest passage comes first")
+		}
+		assert.Equal(t, 1, embedder.Indexed(), "concurrent callers share one indexing")
+		assert.Equal(t, 1, repo.Saves())
+
+		_, err := passages.Search(book, "storm", 2)
+		require.NoError(t, err)
+		assert.Equal(t, 1, embedder.Indexed(), "stored passages are not embedded again")
+	})
+
+	t.Run("Failed indexing", func(t *testing.T) {
+		repo := &memoryPassageRepository{passages: make(map[int][]domain.Passage)}
+		embedder := &stormEmbedder{release: make(chan struct{}), err: errors.New("status 503")}
+		close(embedder.release)
+		passages := usecase.NewPassageUsecase(repo, embedder)
+
+		_, err := passages.Search(book, "storm", 2)
+		assert.Error(t, err)
+		assert.Zero(t, repo.Saves(), "nothing is stored after a failure")
+
+		embedder.mu.Lock()
+		embedder.err = nil
+		embedder.mu.Unlock()
+
+		found, err := passages.Search(book, "storm", 2)
+		require.NoError(t, err)
+		assert.Len(t, found, 2)
+		assert.Equal(t, 2, embedder.Indexed(), "the next search indexes the book again")
+	})
+}
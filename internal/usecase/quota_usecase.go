@@ -0,0 +1,97 @@
+package usecase
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+const (
+	DefaultQuotaWindow     = 24 * time.Hour
+	DefaultUserQuotaTokens = 500000
+	DefaultIPQuotaTokens   = 1000000
+)
+
+// QuotaExceededError tells which budget a caller spent and when enough of it comes back to try again
+type QuotaExceededError struct {
+	Scope      string
+	Limit      int64
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s token quota of %d exceeded, retry in %s", e.Scope, e.Limit, e.RetryAfter.Round(time.Second))
+}
+
+type IQuotaUsecase interface {
+	Check(caller service.Caller) error
+	RecordUsage(usage *domain.Usage)
+	Report(window time.Duration) (*domain.UsageReport, error)
+	Costs(window time.Duration) (*domain.CostReport, error)
+}
+
+// QuotaUsecase keeps the estimated tokens spent by each user and each address within a rolling window under
+// a budget, a budget of 0 is unlimited. Calls are refused once a budget is spent, so the call that spends it
+// may go over.
+type QuotaUsecase struct {
+	Repo       repository.IUsageRepository
+	UserTokens int64
+	IPTokens   int64
+	Window     time.Duration
+	Logger     *service.Logger
+}
+
+func NewQuotaUsecase(repo repository.IUsageRepository, userTokens int64, ipTokens int64, window time.Duration) *QuotaUsecase {
+	return &QuotaUsecase{
+		Repo:       repo,
+		UserTokens: userTokens,
+		IPTokens:   ipTokens,
+		Window:     window,
+		Logger:     service.NewLogger("[QuotaUsecase]"),
+	}
+}
+
+// Check returns a QuotaExceededError when the caller's user or address spent its budget
+func (u *QuotaUsecase) Check(caller service.Caller) error {
+	if u.UserTokens > 0 && caller.UserID != 0 {
+		total, err := u.Repo.UserUsage(caller.UserID, u.Window)
+		if err != nil {
+			u.Logger.LogError("Failed to fetch user usage", err)
+			return err
+		}
+		if total.Tokens() >= u.UserTokens {
+			return &QuotaExceededError{Scope: "user", Limit: u.UserTokens, RetryAfter: total.ResetsIn}
+		}
+	}
+
+	if u.IPTokens > 0 && caller.IP != "" {
+		total, err := u.Repo.IPUsage(caller.IP, u.Window)
+		if err != nil {
+			u.Logger.LogError("Failed to fetch address usage", err)
+			return err
+		}
+		if total.Tokens() >= u.IPTokens {
+			return &QuotaExceededError{Scope: "address", Limit: u.IPTokens, RetryAfter: total.ResetsIn}
+		}
+	}
+
+	return nil
+}
+
+// RecordUsage stores the usage of a call to the AI engine, a failure is logged as the call is already made
+func (u *QuotaUsecase) RecordUsage(usage *domain.Usage) {
+	if err := u.Repo.SaveUsage(usage); err != nil {
+		u.Logger.LogError("Failed to record usage", err)
+	}
+}
+
+func (u *QuotaUsecase) Report(window time.Duration) (*domain.UsageReport, error) {
+	return u.Repo.UsageReport(window)
+}
+
+func (u *QuotaUsecase) Costs(window time.Duration) (*domain.CostReport, error) {
+	return u.Repo.CostReport(window)
+}
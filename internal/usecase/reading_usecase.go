@@ -0,0 +1,228 @@
+package usecase
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+var ErrPageNotFound = errors.New("page not found")
+
+// pageIndexCacheSize is the number of page indexes kept, one per book, mode and page size
+const pageIndexCacheSize = 32
+
+type IReadingUsecase interface {
+	Pages(book *domain.Book, mode string, pageSize int) ([]domain.PageRef, error)
+	Read(userID string, book *domain.Book, mode string, pageSize int, number int) (*domain.Page, error)
+	ReadAt(userID string, book *domain.Book, mode string, pageSize int, offset int) (*domain.Page, error)
+	Recent(userID string, limit int) ([]domain.ReadingPosition, error)
+}
+
+// ReadingUsecase serves books a page at a time and remembers the page each user is on. The books need no
+// content: it is streamed from Books to paginate a book and to read a page. The page indexes most recently
+// used are kept in memory, a book's content never changes.
+type ReadingUsecase struct {
+	Repo   repository.IReadingRepository
+	Books  IBookUsecase
+	Logger *service.Logger
+	// Paginate splits a book's content into pages
+	Paginate func(text string, mode string, pageSize int) []domain.PageRef
+
+	mu      sync.Mutex
+	indexes map[pageLayout]*list.Element
+	recency *list.List
+}
+
+// pageLayout is the key of a cached page index
+type pageLayout struct {
+	gutenbergID int
+	mode        string
+	pageSize    int
+}
+
+type pageIndex struct {
+	layout pageLayout
+	pages  []domain.PageRef
+}
+
+func NewReadingUsecase(repo repository.IReadingRepository, books IBookUsecase) *ReadingUsecase {
+	return &ReadingUsecase{
+		Repo:     repo,
+		Books:    books,
+		Logger:   service.NewLogger("[ReadingUsecase]"),
+		Paginate: service.Paginate,
+		indexes:  make(map[pageLayout]*list.Element),
+		recency:  list.New(),
+	}
+}
+
+// Pages returns the page index of the book, an empty mode pages by size and a zero size is the default one
+func (u *ReadingUsecase) Pages(book *domain.Book, mode string, pageSize int) ([]domain.PageRef, error) {
+	mode, pageSize = readingLayout(mode, pageSize)
+	pages, _, err := u.pages(book, mode, pageSize)
+	return pages, err
+}
+
+// Read returns a page of the book and saves it as the user's position. Page 0 resumes where the user left
+// off, in the mode and page size they read in unless others are given.
+func (u *ReadingUsecase) Read(userID string, book *domain.Book, mode string, pageSize int, number int) (*domain.Page, error) {
+	u.Logger.SetTags(fmt.Sprintf("[book-%d]", book.GutenbergID))
+
+	offset := 0
+	if number == 0 {
+		position, err := u.Repo.GetPosition(userID, book.GutenbergID)
+		if err != nil {
+			u.Logger.LogError("Failed to fetch reading position", err)
+			return nil, err
+		}
+		if position != nil {
+			if mode == "" {
+				mode = position.Mode
+			}
+			if pageSize == 0 {
+				pageSize = position.PageSize
+			}
+			offset = position.Offset
+		}
+	}
+
+	mode, pageSize = readingLayout(mode, pageSize)
+	pages, content, err := u.pages(book, mode, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if number == 0 {
+		number = service.PageAt(pages, offset)
+	}
+	if number < 1 || number > len(pages) {
+		return nil, ErrPageNotFound
+	}
+
+	return u.open(userID, book, mode, pageSize, pages, content, number)
+}
+
+// ReadAt returns the page holding the byte offset, for links to a passage, and saves it as the user's position
+func (u *ReadingUsecase) ReadAt(userID string, book *domain.Book, mode string, pageSize int, offset int) (*domain.Page, error) {
+	u.Logger.SetTags(fmt.Sprintf("[book-%d]", book.GutenbergID))
+
+	mode, pageSize = readingLayout(mode, pageSize)
+	pages, content, err := u.pages(book, mode, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return u.open(userID, book, mode, pageSize, pages, content, service.PageAt(pages, offset))
+}
+
+// Recent returns the books the user read last, most recent first
+func (u *ReadingUsecase) Recent(userID string, limit int) ([]domain.ReadingPosition, error) {
+	return u.Repo.RecentPositions(userID, limit)
+}
+
+// open reads the page from content when the book was just paginated, and otherwise reads the page's bytes only
+func (u *ReadingUsecase) open(userID string, book *domain.Book, mode string, pageSize int, pages []domain.PageRef, content *string, number int) (*domain.Page, error) {
+	ref := pages[number-1]
+
+	var text string
+	if content != nil {
+		text = (*content)[ref.Start:ref.End]
+	} else {
+		var err error
+		if text, err = u.readRange(book.GutenbergID, ref.Start, ref.End); err != nil {
+			u.Logger.LogError("Failed to read page", err)
+			return nil, err
+		}
+	}
+
+	position := &domain.ReadingPosition{
+		UserID:      userID,
+		GutenbergID: book.GutenbergID,
+		Mode:        mode,
+		PageSize:    pageSize,
+		Offset:      ref.Start,
+	}
+	if err := u.Repo.SavePosition(position); err != nil {
+		u.Logger.LogError("Failed to save reading position", err)
+		return nil, err
+	}
+
+	return &domain.Page{PageRef: ref, Total: len(pages), Mode: mode, PageSize: pageSize, Text: text}, nil
+}
+
+// readRange streams the book's content up to end, keeping the bytes from start only
+func (u *ReadingUsecase) readRange(gutenbergID int, start, end int) (string, error) {
+	content, err := u.Books.OpenContent(gutenbergID)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	if _, err := io.CopyN(io.Discard, content, int64(start)); err != nil {
+		return "", err
+	}
+	text := make([]byte, end-start)
+	if _, err := io.ReadFull(content, text); err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// pages returns the cached page index of the book in the layout, or loads and paginates the book, caching the
+// index and evicting the least recently used one. The content is returned when it was loaded.
+func (u *ReadingUsecase) pages(book *domain.Book, mode string, pageSize int) ([]domain.PageRef, *string, error) {
+	layout := pageLayout{gutenbergID: book.GutenbergID, mode: mode, pageSize: pageSize}
+
+	u.mu.Lock()
+	if element, ok := u.indexes[layout]; ok {
+		u.recency.MoveToFront(element)
+		u.mu.Unlock()
+		return element.Value.(*pageIndex).pages, nil, nil
+	}
+	u.mu.Unlock()
+
+	content, err := u.readContent(book.GutenbergID)
+	if err != nil {
+		u.Logger.LogError("Failed to read book content", err)
+		return nil, nil, err
+	}
+	pages := u.Paginate(content, mode, pageSize)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.indexes[layout]; !ok {
+		u.indexes[layout] = u.recency.PushFront(&pageIndex{layout: layout, pages: pages})
+		for u.recency.Len() > pageIndexCacheSize {
+			oldest := u.recency.Back()
+			u.recency.Remove(oldest)
+			delete(u.indexes, oldest.Value.(*pageIndex).layout)
+		}
+	}
+	return pages, &content, nil
+}
+
+func (u *ReadingUsecase) readContent(gutenbergID int) (string, error) {
+	content, err := u.Books.OpenContent(gutenbergID)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	text, err := io.ReadAll(content)
+	return string(text), err
+}
+
+// readingLayout fills in the default mode and page size
+func readingLayout(mode string, pageSize int) (string, int) {
+	if mode == "" {
+		mode = domain.PageBySize
+	}
+	if pageSize == 0 {
+		pageSize = service.DefaultPageSize
+	}
+	return mode, pageSize
+}
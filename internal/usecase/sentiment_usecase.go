@@ -0,0 +1,95 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/repository"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+const segmentSentimentPrompt = "segment_sentiment"
+
+type ISentimentUsecase interface {
+	Arc(ctx context.Context, book *domain.Book, method string, segments int) (*domain.SentimentArc, error)
+}
+
+type SentimentUsecase struct {
+	Repo      repository.ISentimentRepository
+	Sentiment service.ISentimentService
+	Analysis  service.IAnalysisService
+	Logger    *service.Logger
+}
+
+func NewSentimentUsecase(repo repository.ISentimentRepository, sentiment service.ISentimentService, analysis service.IAnalysisService) *SentimentUsecase {
+	return &SentimentUsecase{Repo: repo, Sentiment: sentiment, Analysis: analysis, Logger: service.NewLogger("[SentimentUsecase]")}
+}
+
+// Arc returns the stored sentiment arc of the book, computing it on first use with the lexicon or, one call
+// per segment, with the AI engine
+func (u *SentimentUsecase) Arc(ctx context.Context, book *domain.Book, method string, segments int) (*domain.SentimentArc, error) {
+	u.Logger.SetTags(fmt.Sprintf("[book-%d]", book.GutenbergID))
+
+	arc, err := u.Repo.GetSentimentArc(book.GutenbergID, method, segments)
+	if err != nil {
+		u.Logger.LogError("Failed to fetch sentiment arc", err)
+		return nil, err
+	}
+	if arc != nil {
+		return arc, nil
+	}
+
+	switch method {
+	case domain.SentimentLexicon:
+		arc = u.Sentiment.LexiconArc(book.GutenbergID, book.Content, segments)
+	case domain.SentimentLLM:
+		arc, err = u.llmArc(ctx, book, segments)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &service.AnalysisError{Code: service.ErrCodeInvalidRequest, Message: fmt.Sprintf("Unknown sentiment method %q.", method)}
+	}
+
+	if err := u.Repo.SaveSentimentArc(arc, segments); err != nil {
+		u.Logger.LogError("Failed to save sentiment arc", err)
+		return nil, err
+	}
+
+	u.Logger.LogInfo(fmt.Sprintf("Sentiment arc of %d segments computed with %s", len(arc.Points), arc.Method))
+	return arc, nil
+}
+
+func (u *SentimentUsecase) llmArc(ctx context.Context, book *domain.Book, segments int) (*domain.SentimentArc, error) {
+	ctx = service.WithBook(ctx, book.GutenbergID)
+	points := u.Sentiment.Segments(book.Content, segments)
+	for i, point := range points {
+		if i > 0 {
+			if err := service.CheckCall(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		// StreamPrompt keeps the beginning of a segment too long for the model
+		data := service.PromptData{Text: book.Content[point.Start:point.End]}
+		completion, err := u.Analysis.StreamPrompt(ctx, service.DiscardEvents, segmentSentimentPrompt, data)
+		if err != nil {
+			u.Logger.LogError(fmt.Sprintf("Failed to score segment %d", point.Segment), err)
+			return nil, err
+		}
+
+		score, label, ok := service.ParseSegmentSentiment(completion.Content)
+		if !ok {
+			return nil, &service.AnalysisError{
+				Code:      service.ErrCodeUpstream,
+				Message:   "The analysis provider did not score a segment in the expected format.",
+				Retryable: true,
+			}
+		}
+		points[i].Score = score
+		points[i].Label = label
+	}
+
+	return &domain.SentimentArc{GutenbergID: book.GutenbergID, Method: domain.SentimentLLM, Points: points}, nil
+}
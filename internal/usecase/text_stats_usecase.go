@@ -0,0 +1,89 @@
+package usecase
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+)
+
+type ITextStatsUsecase interface {
+	Stats(book *domain.Book) (*domain.TextStats, error)
+}
+
+// TextStatsUsecase computes the statistics of a book once, streaming its content from storage, and keeps them in
+// memory, a book's content never changes
+type TextStatsUsecase struct {
+	Service service.ITextStatsService
+	Books   IBookUsecase
+
+	mu       sync.Mutex
+	cache    map[int]*domain.TextStats
+	inflight map[int]*statsCall
+}
+
+// statsCall is a computation of a book's statistics in progress, which concurrent requests for the book wait for
+type statsCall struct {
+	done  chan struct{}
+	stats *domain.TextStats
+	err   error
+}
+
+func NewTextStatsUsecase(stats service.ITextStatsService, books IBookUsecase) *TextStatsUsecase {
+	return &TextStatsUsecase{
+		Service:  stats,
+		Books:    books,
+		cache:    make(map[int]*domain.TextStats),
+		inflight: make(map[int]*statsCall),
+	}
+}
+
+// Stats returns the cached statistics of the book or computes them, outside the lock so that other books are
+// not held up. Concurrent calls for a book share a single computation.
+func (u *TextStatsUsecase) Stats(book *domain.Book) (*domain.TextStats, error) {
+	id := book.GutenbergID
+
+	u.mu.Lock()
+	if stats, ok := u.cache[id]; ok {
+		u.mu.Unlock()
+		return stats, nil
+	}
+	if call, ok := u.inflight[id]; ok {
+		u.mu.Unlock()
+		<-call.done
+		return call.stats, call.err
+	}
+
+	call := &statsCall{done: make(chan struct{})}
+	u.inflight[id] = call
+	u.mu.Unlock()
+
+	// Deferred so that waiters are released even if the computation panics
+	defer func() {
+		if call.stats == nil && call.err == nil {
+			call.err = fmt.Errorf("statistics of book %d did not finish", id)
+		}
+
+		u.mu.Lock()
+		if call.err == nil {
+			u.cache[id] = call.stats
+		}
+		delete(u.inflight, id)
+		u.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.stats, call.err = u.compute(id)
+	return call.stats, call.err
+}
+
+func (u *TextStatsUsecase) compute(gutenbergID int) (*domain.TextStats, error) {
+	content, err := u.Books.OpenContent(gutenbergID)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	return u.Service.ComputeReader(gutenbergID, content)
+}
@@ -0,0 +1,89 @@
+package usecase_test
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yuriadams/lear/internal/domain"
+	"github.com/yuriadams/lear/internal/service"
+	"github.com/yuriadams/lear/internal/usecase"
+)
+
+// gatedBooks serves the same text for every book, holding back the books in gated until release is closed
+type gatedBooks struct {
+	usecase.IBookUsecase
+
+	gated   map[int]bool
+	release chan struct{}
+
+	mu    sync.Mutex
+	opens map[int]int
+}
+
+func (b *gatedBooks) OpenContent(gutenbergID int) (io.ReadCloser, error) {
+	b.mu.Lock()
+	b.opens[gutenbergID]++
+	b.mu.Unlock()
+
+	if b.gated[gutenbergID] {
+		<-b.release
+	}
+	return io.NopCloser(strings.NewReader("Nothing will come of nothing. Speak again.")), nil
+}
+
+func (b *gatedBooks) Opens(gutenbergID int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.opens[gutenbergID]
+}
+
+func TestTextStatsUsecase_Stats(t *testing.T) {
+	books := &gatedBooks{gated: map[int]bool{1532: true}, release: make(chan struct{}), opens: make(map[int]int)}
+	stats := usecase.NewTextStatsUsecase(service.NewTextStatsService(), books)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	results := make([]*domain.TextStats, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = stats.Stats(&domain.Book{GutenbergID: 1532})
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Another book is computed while the first one is still being read
+	done := make(chan error, 1)
+	go func() {
+		_, err := stats.Stats(&domain.Book{GutenbergID: 84})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stats of one book waits for another")
+	}
+
+	close(books.release)
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		require.NoError(t, errs[i])
+		assert.Same(t, results[0], results[i])
+	}
+	assert.Equal(t, 7, results[0].Words)
+	assert.Equal(t, 1, books.Opens(1532), "concurrent callers share one computation")
+
+	cached, err := stats.Stats(&domain.Book{GutenbergID: 1532})
+	require.NoError(t, err)
+	assert.Same(t, results[0], cached)
+	assert.Equal(t, 1, books.Opens(1532), "the statistics are cached")
+}